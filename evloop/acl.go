@@ -0,0 +1,101 @@
+package evloop
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// ErrDenied is the reason of the Rejected event for the clients denied by
+// an ACL.
+var ErrDenied = errors.New("denied by access control list")
+
+// ACL is an access control list of CIDR blocks, checked right after a
+// connection is accepted or a datagram is read. The rules can be replaced
+// with Set while the server is running. A nil ACL allows every client.
+type ACL struct {
+	rules atomic.Value // *aclRules
+}
+
+type aclRules struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// NewACL returns an ACL with the allow and deny lists, see Set.
+func NewACL(allow, deny []string) (*ACL, error) {
+	acl := &ACL{}
+	if err := acl.Set(allow, deny); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// Set replaces the rules of the ACL. The lists hold CIDR blocks, like
+// "10.0.0.0/8", or single IP addresses. A client is denied when it matches
+// the deny list, or when the allow list isn't empty and the client doesn't
+// match it. On error the rules are left unchanged.
+func (acl *ACL) Set(allow, deny []string) error {
+	var rules aclRules
+	var err error
+	if rules.allow, err = parseCIDRs(allow); err != nil {
+		return err
+	}
+	if rules.deny, err = parseCIDRs(deny); err != nil {
+		return err
+	}
+	acl.rules.Store(&rules)
+	return nil
+}
+
+// Allowed reports whether the client IP is allowed. Clients without an IP
+// address, like unix socket peers, are always allowed.
+func (acl *ACL) Allowed(ip net.IP) bool {
+	if acl == nil || ip == nil {
+		return true
+	}
+	rules, _ := acl.rules.Load().(*aclRules)
+	if rules == nil {
+		return true
+	}
+	for _, n := range rules.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(rules.allow) == 0 {
+		return true
+	}
+	for _, n := range rules.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid acl address %q", s)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid acl address %q", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
@@ -0,0 +1,113 @@
+package evloop
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd.
+const listenFdsStart = 3
+
+// activatedFd is a file descriptor passed with systemd socket activation.
+type activatedFd struct {
+	fd   int
+	name string
+}
+
+var activation struct {
+	once sync.Once
+	fds  []activatedFd
+}
+
+// activatedFds returns the file descriptors passed by systemd in the
+// LISTEN_FDS and LISTEN_FDNAMES environment variables.
+func activatedFds() []activatedFd {
+	activation.once.Do(func() {
+		if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+			return
+		}
+		n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil || n <= 0 {
+			return
+		}
+		var names []string
+		if v := os.Getenv("LISTEN_FDNAMES"); v != "" {
+			names = strings.Split(v, ":")
+		}
+		for i := 0; i < n; i++ {
+			fd := activatedFd{fd: listenFdsStart + i, name: "unknown"}
+			if i < len(names) && names[i] != "" {
+				fd.name = names[i]
+			}
+			activation.fds = append(activation.fds, fd)
+		}
+	})
+	return activation.fds
+}
+
+// inherit creates the listener from an inherited file descriptor. The fd
+// scheme takes the descriptor number, the systemd scheme takes the name of
+// a socket passed with socket activation.
+func (ln *listener) inherit() error {
+	fd := -1
+	switch ln.network {
+	case "fd":
+		n, err := strconv.Atoi(ln.addr)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid file descriptor %q", ln.addr)
+		}
+		fd = n
+	case "systemd":
+		for _, afd := range activatedFds() {
+			if afd.name == ln.addr {
+				fd = afd.fd
+				break
+			}
+		}
+		if fd == -1 {
+			return fmt.Errorf("systemd socket %q not found", ln.addr)
+		}
+	}
+	return ln.inheritFd(fd)
+}
+
+// inheritFd creates the listener from the file descriptor and detects its
+// network.
+func (ln *listener) inheritFd(fd int) error {
+	f := os.NewFile(uintptr(fd), ln.network+"://"+ln.addr)
+	if f == nil {
+		return fmt.Errorf("invalid file descriptor %d", fd)
+	}
+	// the net package works on duplicates, the original descriptor is
+	// closed in any case.
+	defer f.Close()
+	ln.inherited = true
+	var err error
+	if ln.ln, err = net.FileListener(f); err == nil {
+		switch ln.ln.(type) {
+		case *net.TCPListener:
+			ln.network = "tcp"
+		case *net.UnixListener:
+			ln.network = "unix"
+		}
+		ln.addr = ln.ln.Addr().String()
+		return nil
+	}
+	ln.ln = nil
+	if ln.pConn, err = net.FilePacketConn(f); err == nil {
+		if _, ok := ln.pConn.(*net.UDPConn); !ok {
+			ln.pConn.Close()
+			ln.pConn = nil
+			return fmt.Errorf("file descriptor %d is not a tcp, udp or unix listener", fd)
+		}
+		ln.network = "udp"
+		ln.addr = ln.pConn.LocalAddr().String()
+		return nil
+	}
+	ln.pConn = nil
+	return err
+}
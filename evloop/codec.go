@@ -0,0 +1,228 @@
+package evloop
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrFrameTooLarge is returned by codecs when a frame exceeds its
+// configured maximum length.
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// Codec splits a connection byte stream into frames and frames outgoing
+// messages. It is used by the React event.
+type Codec interface {
+	// Decode splits in into whole frames. The unprocessed remainder of in
+	// is returned as rest and is prepended to the next input. The frames
+	// are only valid until the React event returns.
+	Decode(in []byte) (frames [][]byte, rest []byte, err error)
+	// Encode frames an outgoing message.
+	Encode(frame []byte) ([]byte, error)
+}
+
+// LengthFieldCodec prefixes every frame with its length.
+type LengthFieldCodec struct {
+	// FieldLength is the size of the length prefix in bytes, one of
+	// 1, 2, 4 or 8.
+	FieldLength int
+	// ByteOrder of the length prefix. Default is binary.BigEndian.
+	ByteOrder binary.ByteOrder
+	// MaxFrameLength limits the size of a frame, not counting the prefix.
+	// Zero means no limit.
+	MaxFrameLength int
+}
+
+func (lc *LengthFieldCodec) order() binary.ByteOrder {
+	if lc.ByteOrder == nil {
+		return binary.BigEndian
+	}
+	return lc.ByteOrder
+}
+
+func (lc *LengthFieldCodec) Decode(in []byte) (frames [][]byte, rest []byte, err error) {
+	order := lc.order()
+	for len(in) >= lc.FieldLength {
+		var n uint64
+		switch lc.FieldLength {
+		case 1:
+			n = uint64(in[0])
+		case 2:
+			n = uint64(order.Uint16(in))
+		case 4:
+			n = uint64(order.Uint32(in))
+		case 8:
+			n = order.Uint64(in)
+		default:
+			return nil, in, fmt.Errorf("invalid length field size %d", lc.FieldLength)
+		}
+		if lc.MaxFrameLength > 0 && n > uint64(lc.MaxFrameLength) {
+			return nil, in, ErrFrameTooLarge
+		}
+		if uint64(len(in)-lc.FieldLength) < n {
+			break
+		}
+		end := lc.FieldLength + int(n)
+		frames = append(frames, in[lc.FieldLength:end])
+		in = in[end:]
+	}
+	return frames, in, nil
+}
+
+func (lc *LengthFieldCodec) Encode(frame []byte) ([]byte, error) {
+	if lc.MaxFrameLength > 0 && len(frame) > lc.MaxFrameLength {
+		return nil, ErrFrameTooLarge
+	}
+	order := lc.order()
+	out := make([]byte, lc.FieldLength, lc.FieldLength+len(frame))
+	n := uint64(len(frame))
+	switch lc.FieldLength {
+	case 1:
+		if n > 0xFF {
+			return nil, ErrFrameTooLarge
+		}
+		out[0] = byte(n)
+	case 2:
+		if n > 0xFFFF {
+			return nil, ErrFrameTooLarge
+		}
+		order.PutUint16(out, uint16(n))
+	case 4:
+		if n > 0xFFFFFFFF {
+			return nil, ErrFrameTooLarge
+		}
+		order.PutUint32(out, uint32(n))
+	case 8:
+		order.PutUint64(out, n)
+	default:
+		return nil, fmt.Errorf("invalid length field size %d", lc.FieldLength)
+	}
+	return append(out, frame...), nil
+}
+
+// DelimiterCodec splits frames on a delimiter. The delimiter is stripped
+// from decoded frames and appended to encoded ones.
+type DelimiterCodec struct {
+	// Delimiter that terminates every frame.
+	Delimiter []byte
+	// MaxFrameLength limits the size of a frame, not counting the
+	// delimiter. Zero means no limit.
+	MaxFrameLength int
+}
+
+// NewLineCodec returns a codec for "\n" terminated lines.
+func NewLineCodec() *DelimiterCodec {
+	return &DelimiterCodec{Delimiter: []byte{'\n'}}
+}
+
+// NewCRLFCodec returns a codec for "\r\n" terminated lines.
+func NewCRLFCodec() *DelimiterCodec {
+	return &DelimiterCodec{Delimiter: []byte{'\r', '\n'}}
+}
+
+func (dc *DelimiterCodec) Decode(in []byte) (frames [][]byte, rest []byte, err error) {
+	if len(dc.Delimiter) == 0 {
+		return nil, in, errors.New("empty delimiter")
+	}
+	for {
+		i := bytes.Index(in, dc.Delimiter)
+		if i == -1 {
+			break
+		}
+		if dc.MaxFrameLength > 0 && i > dc.MaxFrameLength {
+			return nil, in, ErrFrameTooLarge
+		}
+		frames = append(frames, in[:i])
+		in = in[i+len(dc.Delimiter):]
+	}
+	if dc.MaxFrameLength > 0 && len(in) > dc.MaxFrameLength+len(dc.Delimiter) {
+		return nil, in, ErrFrameTooLarge
+	}
+	return frames, in, nil
+}
+
+func (dc *DelimiterCodec) Encode(frame []byte) ([]byte, error) {
+	if dc.MaxFrameLength > 0 && len(frame) > dc.MaxFrameLength {
+		return nil, ErrFrameTooLarge
+	}
+	out := make([]byte, 0, len(frame)+len(dc.Delimiter))
+	out = append(out, frame...)
+	return append(out, dc.Delimiter...), nil
+}
+
+// FixedLengthCodec splits the stream into frames of the same length.
+type FixedLengthCodec struct {
+	// Length of every frame.
+	Length int
+}
+
+func (fc *FixedLengthCodec) Decode(in []byte) (frames [][]byte, rest []byte, err error) {
+	if fc.Length <= 0 {
+		return nil, in, fmt.Errorf("invalid frame length %d", fc.Length)
+	}
+	for len(in) >= fc.Length {
+		frames = append(frames, in[:fc.Length])
+		in = in[fc.Length:]
+	}
+	return frames, in, nil
+}
+
+func (fc *FixedLengthCodec) Encode(frame []byte) ([]byte, error) {
+	if len(frame) != fc.Length {
+		return nil, fmt.Errorf("frame length %d, expected %d", len(frame), fc.Length)
+	}
+	return frame, nil
+}
+
+// streamer is implemented by connections that keep an input stream for
+// the React event.
+type streamer interface {
+	inputStream() *InputStream
+}
+
+// reactData returns a Data event that decodes the incoming data with the
+// events codec and fires the React event for every whole frame. Wakes are
+// passed to the original Data event.
+func reactData(events Events) func(c Conn, in []byte) (out []byte, action Action) {
+	codec, data, react := events.Codec, events.Data, events.React
+	return func(c Conn, in []byte) (out []byte, action Action) {
+		if in == nil {
+			if data != nil {
+				return data(c, in)
+			}
+			return
+		}
+		if codec == nil {
+			return react(c, in)
+		}
+		var is *InputStream
+		if st, ok := c.(streamer); ok {
+			is = st.inputStream()
+		} else {
+			is = &InputStream{}
+		}
+		frames, rest, err := codec.Decode(is.Begin(in))
+		if err != nil {
+			is.End(nil)
+			return nil, Close
+		}
+		for _, frame := range frames {
+			fout, faction := react(c, frame)
+			if len(fout) > 0 {
+				enc, err := codec.Encode(fout)
+				if err != nil {
+					action = Close
+					break
+				}
+				out = append(out, enc...)
+			}
+			if faction != None {
+				action = faction
+				break
+			}
+		}
+		is.End(rest)
+		return
+	}
+}
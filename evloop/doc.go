@@ -0,0 +1,17 @@
+// Package evloop is an event-loop networking framework. It serves tcp, udp
+// and unix sockets with a fixed number of loops, each running on its own
+// goroutine, and reports the connection state through the Events callbacks.
+//
+// On Linux and BSD the loops are backed by epoll and kqueue. Addresses with
+// a "-net" scheme suffix, like `tcp-net://:8080`, and other platforms use
+// the net package instead.
+//
+// # Stability
+//
+// The exported API of this package is stable. Within a major version of the
+// module exported identifiers are not removed or renamed, function
+// signatures do not change and existing events keep their semantics. New
+// events, options, fields and Conn methods may be added in minor versions.
+// The Conn interface is implemented by the package only and should not be
+// implemented by users.
+package evloop
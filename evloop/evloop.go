@@ -0,0 +1,586 @@
+package evloop
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Action is an action that occurs after the completion of an event.
+type Action int32
+
+const (
+	// None indicates that no action should occur following an event.
+	None Action = iota
+	// Detach detaches a connection. Not available for UDP connections.
+	Detach
+	// Close closes the connection.
+	Close
+	// Shutdown shutdowns the server.
+	Shutdown
+)
+
+// Options are set when the client opens.
+type Options struct {
+	// TCPKeepAlive (SO_KEEPALIVE) socket option.
+	TCPKeepAlive time.Duration
+	// ReuseInputBuffer will force the connection to share and reuse the
+	// same input packet buffer with all other connections that also use
+	// this option.
+	// Default value is false, which means that all input data which is
+	// passed to the Data event will be a uniquely copied []byte slice.
+	ReuseInputBuffer bool
+	// TCPNoDelay (TCP_NODELAY) disables the Nagle's algorithm. The net
+	// package enables it for all the connections of the stdlib backend.
+	TCPNoDelay bool
+	// Linger (SO_LINGER) sets how long closing waits for the unsent data
+	// to be sent. Negative values reset the connection on close, zero keeps
+	// the system default.
+	Linger time.Duration
+	// ReadBuffer (SO_RCVBUF) and WriteBuffer (SO_SNDBUF) set the socket
+	// buffer sizes.
+	ReadBuffer  int
+	WriteBuffer int
+	// TCPUserTimeout (TCP_USER_TIMEOUT) limits how long the sent data may
+	// remain unacknowledged before the connection is closed. Linux only.
+	TCPUserTimeout time.Duration
+	// TCPQuickAck (TCP_QUICKACK) sends the acknowledgments immediately
+	// instead of delaying them. Linux only.
+	TCPQuickAck bool
+	// TCPNotSentLowat (TCP_NOTSENT_LOWAT) limits the amount of unsent data
+	// in the socket write buffer. Linux and macOS only.
+	TCPNotSentLowat int
+	// Mark (SO_MARK) sets the firewall mark of the connection packets.
+	// Linux only, requires the CAP_NET_ADMIN capability.
+	Mark int
+}
+
+// Server represents a server context which provides information about the
+// running server and has control functions for managing state.
+type Server struct {
+	// The address parameter is an array of listening addresses that align
+	// with the addr strings passed to the Serve function.
+	Addresses []net.Addr
+	// NumLoops is the number of loops that the server is using.
+	NumLoops int
+
+	ctl controller
+}
+
+// controller is implemented by the poll and stdlib servers.
+type controller interface {
+	dial(network, addr string, ctx interface{}) error
+	shutdown()
+	drain()
+	draining() bool
+	upgrade() error
+	rejections() Rejections
+	stats() Stats
+}
+
+// ErrServerClosed is returned by Dial once the server is closed.
+var ErrServerClosed = errors.New("server closed")
+
+// Dial opens an outbound connection that is managed by one of the server
+// loops. The network must be one of "tcp", "tcp4", "tcp6" or "unix". The
+// connect is non-blocking; once it completes the Opened event fires for the
+// new connection, followed by the regular Data and Closed events. When the
+// connect fails only the Closed event fires, with the connect error. Host
+// names are resolved in the background, so their resolve errors are
+// reported by the Closed event too.
+// The ctx parameter is set as the connection context before Opened fires.
+// Dial is safe to call from any goroutine.
+func (s Server) Dial(network, addr string, ctx interface{}) error {
+	if s.ctl == nil {
+		return errors.New("dial is not available")
+	}
+	return s.ctl.dial(network, addr, ctx)
+}
+
+// Shutdown shutdowns the server, as if an event returned the Shutdown
+// action. Shutdown is safe to call from any goroutine.
+func (s Server) Shutdown() {
+	if s.ctl != nil {
+		s.ctl.shutdown()
+	}
+}
+
+// Drain gracefully shutdowns the server. The server stops accepting new
+// connections and shutdowns once all the open connections are closed, or
+// once the WithDrainTimeout duration has elapsed. Drain is safe to call
+// from any goroutine.
+func (s Server) Drain() {
+	if s.ctl != nil {
+		s.ctl.drain()
+	}
+}
+
+// Draining reports whether the server has started to drain, with Drain,
+// Upgrade or the upgrade signal.
+func (s Server) Draining() bool {
+	return s.ctl != nil && s.ctl.draining()
+}
+
+// Upgrade starts a new process of the running binary, with the same
+// arguments, that inherits all the listeners, and drains the server. The
+// new process picks the listeners up when it calls Serve or Run with the
+// same addresses, so that no connection is refused during the restart.
+// Upgrade is safe to call from any goroutine.
+func (s Server) Upgrade() error {
+	if s.ctl == nil {
+		return errors.New("upgrade is not available")
+	}
+	return s.ctl.upgrade()
+}
+
+// Rejections returns the counters of the connections that the server
+// rejected for the connection limits, the accept rate, or for running out
+// of file descriptors.
+func (s Server) Rejections() Rejections {
+	if s.ctl == nil {
+		return Rejections{}
+	}
+	return s.ctl.rejections()
+}
+
+// Stats returns a snapshot of the loop and listener counters. It only
+// loads atomic counters and is cheap enough to be polled periodically.
+func (s Server) Stats() Stats {
+	if s.ctl == nil {
+		return Stats{}
+	}
+	return s.ctl.stats()
+}
+
+// Conn is connection.
+type Conn interface {
+	// Context returns a user-defined context.
+	Context() interface{}
+	// SetContext sets a user-defined context.
+	SetContext(interface{})
+	// AddrIndex is the index of server address that was passed to the Serve call.
+	// It is -1 for outbound connections.
+	AddrIndex() int
+	// LocalAddr is the connection's local socket address.
+	LocalAddr() net.Addr
+	// RemoteAddr is the connection's remote peer address.
+	RemoteAddr() net.Addr
+	// Wake triggers a Data event for this connection.
+	Wake()
+	// Outbound reports whether the connection was opened with Server.Dial.
+	Outbound() bool
+	// AfterFunc schedules fn to run on the connection's loop once the
+	// duration d has elapsed. Use the out return value of fn to write data
+	// to the connection. AfterFunc must be called from inside an event
+	// callback. Available for UDP connections only with WithUDPSessions.
+	AfterFunc(d time.Duration, fn func(c Conn) (out []byte, action Action)) Timer
+	// ProxyHeader returns the PROXY protocol header received on the
+	// connection, or nil when the listener doesn't use the proxyproto
+	// address option.
+	ProxyHeader() *ProxyHeader
+	// SendFile writes out followed by count bytes of the file f from
+	// offset, after the pending output of the connection. The output of
+	// the current event and of the later ones follows the file. The file
+	// is closed once written, when the connection closes or when SendFile
+	// fails. The poll backend writes the file with sendfile(2) on Linux,
+	// the std backend copies it on a goroutine. SendFile must be called
+	// from inside an event callback. Not available for UDP connections.
+	SendFile(out []byte, f *os.File, offset, count int64) error
+}
+
+// LoadBalance sets the load balancing method.
+type LoadBalance int
+
+const (
+	// Random requests that connections are randomly distributed.
+	Random LoadBalance = iota
+	// RoundRobin requests that connections are distributed to a loop in a
+	// round-robin fashion.
+	RoundRobin
+	// LeastConnections assigns the next accepted connection to the loop with
+	// the least number of active connections.
+	LeastConnections
+)
+
+// Events represents the server events for the Serve call.
+// Each event has an Action return value that is used manage the state
+// of the connection and server.
+type Events struct {
+	// NumLoops sets the number of loops to use for the server. Setting this
+	// to a value greater than 1 will effectively make the server
+	// multithreading for multi-core machines. Which means you must take care
+	// with synchronize memory between all event callbacks. Setting to 0 or 1
+	// will run the server single-threaded. Setting to -1 will automatically
+	// assign this value equal to runtime.NumProcs().
+	NumLoops int
+	// LoadBalance sets the load balancing method. Load balancing is always
+	// the best effort to attempt to distribute the incoming connections between
+	// multiple loops. This option is only works when NumLoops is set.
+	LoadBalance LoadBalance
+	// Serving fires when the server can accept connections. The server
+	// parameter has information and various utilities.
+	Serving func(server Server) (action Action)
+	// Opened fires when a new connection has opened.
+	// The info parameter has information about the connection such as
+	// its local and remote address.
+	// Use the out return value to write data to the connection.
+	// The opts return value is used to set connection options.
+	Opened func(c Conn) (out []byte, opts Options, action Action)
+	// Closed fires when a connection has closed.
+	// The err parameter is the last known connection error.
+	Closed func(c Conn, err error) (action Action)
+	// Detached fires when a connection has been previously detached.
+	// Once detached it's up to the receiver of this event to manage the
+	// state of the connection. The Closed event will not be called for
+	// this connection.
+	// The conn parameter is a ReadWriteCloser that represents the
+	// underlying socket connection. It can be freely used in goroutines
+	// and should be closed when it's no longer needed.
+	Detached func(c Conn, rwc io.ReadWriteCloser) (action Action)
+	// PreWrite fires just before any data is written to any client socket.
+	PreWrite func()
+	// Data fires when a connection sends the server data.
+	// The in parameter is the incoming data.
+	// Use the out return value to write data to the connection.
+	Data func(c Conn, in []byte) (out []byte, action Action)
+	// Tick fires immediately after the server starts and will fire again
+	// following the duration specified by the delay return value.
+	Tick func() (delay time.Duration, action Action)
+	// Codec splits the incoming data into frames for the React event and
+	// frames the outgoing data returned by it. When Codec is nil, React
+	// receives the incoming data as is.
+	Codec Codec
+	// React fires for every whole frame decoded from the incoming data.
+	// Use the out return value to write a frame to the connection.
+	// When React is set, the Data event only fires for Wake calls.
+	// The connection is closed when the incoming data can't be decoded.
+	React func(c Conn, frame []byte) (out []byte, action Action)
+	// Rejected fires when a connection is closed right after accepting it,
+	// or a datagram is dropped, because of an ACL or the connection limits.
+	// The addr parameter is the client address and the reason is one of
+	// ErrDenied, ErrMaxConns, ErrMaxConnsPerIP or ErrRateLimited.
+	Rejected func(addr net.Addr, reason error) (action Action)
+	// Draining fires once when the server starts to drain, with Drain,
+	// Upgrade or the upgrade signal. It fires on the goroutine that started
+	// the drain, which may be a loop, so it must not wait for the loops.
+	Draining func()
+}
+
+// Serve starts handling events for the specified addresses.
+//
+// Addresses should use a scheme prefix and be formatted
+// like `tcp://192.168.0.10:9851` or `unix://socket`.
+// Valid network schemes:
+//  tcp     - bind to both IPv4 and IPv6
+//  tcp4    - IPv4
+//  tcp6    - IPv6
+//  udp     - bind to both IPv4 and IPv6
+//  udp4    - IPv4
+//  udp6    - IPv6
+//  unix    - Unix Domain Socket
+//  fd      - inherited listener file descriptor, like `fd://3`
+//  systemd - systemd socket activation by name, like `systemd://http`
+//
+// Unix socket addresses accept the mode, owner and group query options,
+// like `unix:///run/app.sock?mode=0660&owner=www&group=www`. Addresses
+// starting with "@", like `unix://@app`, are bound in the Linux abstract
+// namespace. An existing socket file at the address is replaced, any other
+// file is refused.
+//
+// Stream addresses accept the proxyproto query option, like
+// `tcp://:9851?proxyproto=1`, for listeners behind a proxy that sends the
+// PROXY protocol version 1 or 2 header. The header is read before the
+// Opened event, the connection addresses are replaced with the ones of the
+// proxied connection, and connections with an invalid header are closed
+// without any event.
+//
+// UDP addresses accept the gso and gro query options, like
+// `udp://:9851?gso=1&gro=1`, that enable the Linux UDP segmentation and
+// receive offloads for the poll backend.
+//
+// UDP addresses with the multicast query option bind the multicast group
+// address and join the group, like `udp://239.1.2.3:5000?iface=eth0&multicast=1`.
+// The iface option selects the interface, the loop option loops the sent
+// multicast datagrams back, which is off by default, and the ttl option,
+// or hoplimit for IPv6, sets the multicast TTL. The broadcast option allows
+// sending datagrams to broadcast addresses.
+//
+// Stream addresses accept the backlog query option, that sets the listen
+// backlog size, and TCP addresses accept the fastopen option, that enables
+// TCP Fast Open with the queue length, and the defer_accept option, that
+// defers accepting the connections until data arrives, for at most the
+// number of seconds, like `tcp://:9851?fastopen=256&defer_accept=5`.
+// Fast Open is available on Linux and macOS, defer_accept on Linux only.
+//
+// Stream addresses accept the maxconns query option, that limits the
+// connections of the listener, see WithMaxConns.
+//
+// The "tcp" network scheme is assumed when one is not specified.
+func Serve(events Events, addr ...string) error {
+	return Run(events, addr)
+}
+
+// Run starts handling events for the specified addresses, like Serve,
+// with the server configured by opts.
+func Run(events Events, addrs []string, opts ...Option) error {
+	cfg := newConfig(events)
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	events = cfg.apply(events)
+	if events.React != nil {
+		events.Data = reactData(events)
+	}
+	var lns []*listener
+	defer func() {
+		for _, ln := range lns {
+			ln.close()
+		}
+	}()
+	// the TLS connections are served by the std loops
+	stdlib := cfg.tls != nil
+	for _, addr := range addrs {
+		var ln listener
+		var stdlibt bool
+		var err error
+		ln.source = addr
+		ln.network, ln.addr, ln.opts, stdlibt, err = parseAddr(addr)
+		if err != nil {
+			return err
+		}
+		if stdlibt {
+			stdlib = true
+		}
+		fd, upgrade := upgradeFd(addr)
+		switch {
+		case upgrade:
+			// the listener is passed by the parent process, which has
+			// already set it up.
+			err = ln.inheritFd(fd)
+			ln.inherited = false
+		case ln.network == "fd", ln.network == "systemd":
+			err = ln.inherit()
+		default:
+			err = ln.listen()
+		}
+		if err != nil {
+			return err
+		}
+		lns = append(lns, &ln)
+		if ln.network == "unix" && !ln.inherited && !upgrade {
+			if err := setupUnixSocket(ln.addr, ln.opts); err != nil {
+				return err
+			}
+		}
+		if ln.pConn != nil {
+			ln.lnAddr = ln.pConn.LocalAddr()
+		} else {
+			ln.lnAddr = ln.ln.Addr()
+		}
+		if !stdlib {
+			if err := ln.system(); err != nil {
+				return err
+			}
+		}
+	}
+	if stdlib {
+		return stdserve(events, lns, cfg)
+	}
+	return serve(events, lns, cfg)
+}
+
+// listen binds the listener to its address.
+func (ln *listener) listen() (err error) {
+	if ln.network == "unix" {
+		if err := removeUnixSocket(ln.addr); err != nil {
+			return err
+		}
+	}
+	if isUDP(ln.network) {
+		switch {
+		case ln.opts.multicast:
+			ln.pConn, err = listenMulticast(ln.network, ln.addr, ln.opts)
+		case ln.opts.reusePort:
+			ln.pConn, err = reuseportListenPacket(ln.network, ln.addr)
+		default:
+			ln.pConn, err = net.ListenPacket(ln.network, ln.addr)
+		}
+		if conn, ok := ln.pConn.(*net.UDPConn); ok && err == nil {
+			err = setUDPOptions(conn, ln.opts)
+		}
+	} else {
+		if ln.opts.reusePort {
+			ln.ln, err = reuseportListen(ln.network, ln.addr)
+		} else {
+			ln.ln, err = net.Listen(ln.network, ln.addr)
+		}
+		if err == nil {
+			err = setListenerOptions(ln.ln, ln.opts)
+		}
+	}
+	return err
+}
+
+// InputStream is a helper type for managing input streams from inside
+// the Data event.
+type InputStream struct{ b []byte }
+
+// Begin accepts a new packet and returns a working sequence of
+// unprocessed bytes.
+func (is *InputStream) Begin(packet []byte) (data []byte) {
+	data = packet
+	if len(is.b) > 0 {
+		is.b = append(is.b, data...)
+		data = is.b
+	}
+	return data
+}
+
+// End shifts the stream to match the unprocessed data.
+func (is *InputStream) End(data []byte) {
+	if len(data) > 0 {
+		if len(data) != len(is.b) {
+			is.b = append(is.b[:0], data...)
+		}
+	} else if len(is.b) > 0 {
+		is.b = is.b[:0]
+	}
+}
+
+type listener struct {
+	ln      net.Listener
+	lnAddr  net.Addr
+	pConn   net.PacketConn
+	opts    addrOpts
+	f       *os.File
+	fd      int
+	network string
+	addr    string
+	// inherited is set for listeners created from file descriptors passed
+	// by the parent process.
+	inherited bool
+	// handedOff is set once the listener is passed to a new process on
+	// upgrade.
+	handedOff int32
+	// source is the address as passed to Run.
+	source string
+}
+
+type addrOpts struct {
+	reusePort   bool
+	proxyProto  bool          // read the PROXY protocol header on accept
+	gso         bool          // send UDP replies with generic segmentation offload
+	gro         bool          // receive UDP datagrams with generic receive offload
+	multicast   bool          // join the multicast group of the address
+	iface       string        // multicast interface name
+	broadcast   bool          // allow sending to broadcast addresses
+	ttl         int           // multicast TTL or IPv6 hop limit
+	fastOpen    int           // TCP Fast Open queue length
+	deferAccept time.Duration // defer accepting until data arrives
+	backlog     int           // listen backlog size
+	maxConns    int           // listener connection limit
+	unixMode    os.FileMode   // unix socket file mode, zero keeps the umask default
+	unixOwner   string        // unix socket owner, user name or uid
+	unixGroup   string        // unix socket group, group name or gid
+	// multicastLoop loops the sent multicast datagrams back, nil keeps the
+	// default.
+	multicastLoop *bool
+}
+
+func parseAddr(addr string) (network, address string, opts addrOpts, stdlib bool, err error) {
+	network = "tcp"
+	address = addr
+	opts.reusePort = false
+	if strings.Contains(address, "://") {
+		network = strings.Split(address, "://")[0]
+		address = strings.Split(address, "://")[1]
+	}
+	if strings.HasSuffix(network, "-net") {
+		stdlib = true
+		network = network[:len(network)-4]
+	}
+	q := strings.Index(address, "?")
+	if q != -1 {
+		for _, part := range strings.Split(address[q+1:], "&") {
+			kv := strings.Split(part, "=")
+			if len(kv) == 2 {
+				switch kv[0] {
+				case "reuseport":
+					opts.reusePort = parseBool(kv[1])
+				case "multicast":
+					opts.multicast = parseBool(kv[1])
+				case "iface":
+					opts.iface = kv[1]
+				case "broadcast":
+					opts.broadcast = parseBool(kv[1])
+				case "loop":
+					loop := parseBool(kv[1])
+					opts.multicastLoop = &loop
+				case "ttl", "hoplimit":
+					ttl, perr := strconv.Atoi(kv[1])
+					if perr != nil || ttl < 1 || ttl > 255 {
+						return network, address, opts, stdlib, fmt.Errorf("invalid %s %q", kv[0], kv[1])
+					}
+					opts.ttl = ttl
+				case "fastopen", "backlog":
+					n, perr := strconv.Atoi(kv[1])
+					if perr != nil || n < 0 {
+						return network, address, opts, stdlib, fmt.Errorf("invalid %s %q", kv[0], kv[1])
+					}
+					if kv[0] == "fastopen" {
+						opts.fastOpen = n
+					} else {
+						opts.backlog = n
+					}
+				case "maxconns":
+					n, perr := strconv.Atoi(kv[1])
+					if perr != nil || n < 0 {
+						return network, address, opts, stdlib, fmt.Errorf("invalid %s %q", kv[0], kv[1])
+					}
+					opts.maxConns = n
+				case "defer_accept":
+					secs, perr := strconv.Atoi(kv[1])
+					if perr != nil || secs < 0 {
+						return network, address, opts, stdlib, fmt.Errorf("invalid %s %q", kv[0], kv[1])
+					}
+					opts.deferAccept = time.Duration(secs) * time.Second
+				case "gso":
+					opts.gso = parseBool(kv[1])
+				case "gro":
+					opts.gro = parseBool(kv[1])
+				case "proxyproto":
+					opts.proxyProto = parseBool(kv[1])
+				case "mode":
+					mode, perr := strconv.ParseUint(kv[1], 8, 32)
+					if perr != nil || mode > 0777 {
+						return network, address, opts, stdlib, fmt.Errorf("invalid socket mode %q", kv[1])
+					}
+					opts.unixMode = os.FileMode(mode)
+				case "owner":
+					opts.unixOwner = kv[1]
+				case "group":
+					opts.unixGroup = kv[1]
+				}
+			}
+		}
+		address = address[:q]
+	}
+	return
+}
+
+// parseBool parses a boolean address option value.
+func parseBool(v string) bool {
+	if len(v) == 0 {
+		return false
+	}
+	switch v[0] {
+	case 'T', 't', 'Y', 'y':
+		return true
+	}
+	return v[0] >= '1' && v[0] <= '9'
+}
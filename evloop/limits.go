@@ -0,0 +1,235 @@
+package evloop
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// acceptBackoff is the pause of a listener that can't accept connections
+// because the process is out of file descriptors.
+const acceptBackoff = 50 * time.Millisecond
+
+// The reasons of the Rejected event for the connections over the limits.
+var (
+	ErrMaxConns      = errors.New("too many connections")
+	ErrMaxConnsPerIP = errors.New("too many connections from the address")
+	ErrRateLimited   = errors.New("accept rate exceeded")
+)
+
+// Rejections counts the connections that the server closed right after
+// accepting them.
+type Rejections struct {
+	// MaxConns counts the connections over the server or the listener
+	// connection limit.
+	MaxConns uint64
+	// MaxConnsPerIP counts the connections over the per source IP limit.
+	MaxConnsPerIP uint64
+	// RateLimited counts the connections over the accept rate.
+	RateLimited uint64
+	// FdExhausted counts the connections closed while the process was out
+	// of file descriptors.
+	FdExhausted uint64
+	// Denied counts the connections and datagrams denied by an ACL.
+	Denied uint64
+}
+
+// limiter admits the accepted connections within the connection limits and
+// the accept rate. It is shared by all the loops of a server.
+type limiter struct {
+	maxConns int32   // server connection limit
+	conns    int32   // server connections
+	lnMax    []int32 // listener connection limits
+	lnConns  []int32 // listener connections
+	perIP    int     // per source IP connection limit
+	mu       sync.Mutex
+	ips      map[string]int // connections per source IP
+	bucket   *tokenBucket
+	rejected Rejections
+	reserve  fdReserve
+	acls     []*ACL // listener access control lists
+}
+
+func newLimiter(cfg *config, lns []*listener) *limiter {
+	lm := &limiter{
+		maxConns: int32(cfg.maxConns),
+		lnMax:    make([]int32, len(lns)),
+		lnConns:  make([]int32, len(lns)),
+		perIP:    cfg.maxConnsPerIP,
+		ips:      make(map[string]int),
+		acls:     make([]*ACL, len(lns)),
+	}
+	for i, ln := range lns {
+		lm.lnMax[i] = int32(ln.opts.maxConns)
+		lm.acls[i] = cfg.acl
+		if acl, ok := cfg.listenerACLs[i]; ok {
+			lm.acls[i] = acl
+		}
+	}
+	if cfg.acceptRate > 0 {
+		lm.bucket = newTokenBucket(cfg.acceptRate, cfg.acceptBurst)
+	}
+	lm.reserve.open()
+	return lm
+}
+
+// allowed checks the client IP against the listener ACL.
+func (lm *limiter) allowed(lnidx int, ip net.IP) error {
+	if !lm.acls[lnidx].Allowed(ip) {
+		atomic.AddUint64(&lm.rejected.Denied, 1)
+		return ErrDenied
+	}
+	return nil
+}
+
+// admit checks whether the connection accepted on the listener may be
+// served, and returns the reason of the rejection otherwise. Admitted
+// connections must be released once closed.
+func (lm *limiter) admit(lnidx int, ip net.IP) error {
+	if err := lm.allowed(lnidx, ip); err != nil {
+		return err
+	}
+	if lm.bucket != nil && !lm.bucket.allow() {
+		atomic.AddUint64(&lm.rejected.RateLimited, 1)
+		return ErrRateLimited
+	}
+	n := atomic.AddInt32(&lm.conns, 1)
+	ln := atomic.AddInt32(&lm.lnConns[lnidx], 1)
+	if (lm.maxConns > 0 && n > lm.maxConns) || (lm.lnMax[lnidx] > 0 && ln > lm.lnMax[lnidx]) {
+		atomic.AddInt32(&lm.conns, -1)
+		atomic.AddInt32(&lm.lnConns[lnidx], -1)
+		atomic.AddUint64(&lm.rejected.MaxConns, 1)
+		return ErrMaxConns
+	}
+	if lm.perIP > 0 && ip != nil {
+		lm.mu.Lock()
+		key := string(ip.To16())
+		if lm.ips[key] >= lm.perIP {
+			lm.mu.Unlock()
+			atomic.AddInt32(&lm.conns, -1)
+			atomic.AddInt32(&lm.lnConns[lnidx], -1)
+			atomic.AddUint64(&lm.rejected.MaxConnsPerIP, 1)
+			return ErrMaxConnsPerIP
+		}
+		lm.ips[key]++
+		lm.mu.Unlock()
+	}
+	return nil
+}
+
+// release releases an admitted connection.
+func (lm *limiter) release(lnidx int, ip net.IP) {
+	atomic.AddInt32(&lm.conns, -1)
+	atomic.AddInt32(&lm.lnConns[lnidx], -1)
+	if lm.perIP > 0 && ip != nil {
+		lm.mu.Lock()
+		key := string(ip.To16())
+		if lm.ips[key]--; lm.ips[key] <= 0 {
+			delete(lm.ips, key)
+		}
+		lm.mu.Unlock()
+	}
+}
+
+// rejections returns a snapshot of the rejection counters.
+func (lm *limiter) rejections() Rejections {
+	return Rejections{
+		MaxConns:      atomic.LoadUint64(&lm.rejected.MaxConns),
+		MaxConnsPerIP: atomic.LoadUint64(&lm.rejected.MaxConnsPerIP),
+		RateLimited:   atomic.LoadUint64(&lm.rejected.RateLimited),
+		FdExhausted:   atomic.LoadUint64(&lm.rejected.FdExhausted),
+		Denied:        atomic.LoadUint64(&lm.rejected.Denied),
+	}
+}
+
+// exhausted handles an accept error for running out of file descriptors.
+// The spare descriptor is released to accept and close one pending
+// connection, so that the listener doesn't stay readable. It reports
+// whether a connection was closed, otherwise the listener should back off.
+func (lm *limiter) exhausted(accept func() bool) bool {
+	if lm.reserve.use(accept) {
+		atomic.AddUint64(&lm.rejected.FdExhausted, 1)
+		return true
+	}
+	return false
+}
+
+// isFdExhausted reports whether the error is for running out of file
+// descriptors or socket buffers.
+func isFdExhausted(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) ||
+		errors.Is(err, syscall.ENOBUFS) || errors.Is(err, syscall.ENOMEM)
+}
+
+// fdReserve is a spare file descriptor.
+type fdReserve struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func (r *fdReserve) open() {
+	r.f, _ = os.Open(os.DevNull)
+}
+
+// use closes the spare descriptor, calls accept and reopens it. It reports
+// whether accept succeeded.
+func (r *fdReserve) use(accept func() bool) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		r.open()
+		if r.f == nil {
+			return false
+		}
+	}
+	r.f.Close()
+	ok := accept()
+	r.open()
+	return ok
+}
+
+func (r *fdReserve) close() {
+	r.mu.Lock()
+	if r.f != nil {
+		r.f.Close()
+		r.f = nil
+	}
+	r.mu.Unlock()
+}
+
+// tokenBucket limits the rate of events.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// allow takes a token if one is available.
+func (b *tokenBucket) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,36 @@
+package evloop
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// isUDP reports whether the network is a datagram network.
+func isUDP(network string) bool {
+	return strings.HasPrefix(network, "udp")
+}
+
+// listenMulticast binds the multicast group address and joins the group on
+// the iface address option interface, or on the system default one.
+func listenMulticast(network, address string, opts addrOpts) (*net.UDPConn, error) {
+	gaddr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if !gaddr.IP.IsMulticast() {
+		return nil, fmt.Errorf("%s is not a multicast address", address)
+	}
+	var ifi *net.Interface
+	if opts.iface != "" {
+		if ifi, err = net.InterfaceByName(opts.iface); err != nil {
+			return nil, err
+		}
+	}
+	return net.ListenMulticastUDP(network, ifi, gaddr)
+}
+
+// hasUDPOptions reports whether any datagram socket option is set.
+func (opts addrOpts) hasUDPOptions() bool {
+	return opts.broadcast || opts.multicastLoop != nil || opts.ttl > 0
+}
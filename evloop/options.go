@@ -0,0 +1,168 @@
+package evloop
+
+import (
+	"crypto/tls"
+	"os"
+	"time"
+)
+
+// Option configures a server started with Run.
+type Option func(*config)
+
+// config is the server configuration built from the Events and the
+// options passed to Run.
+type config struct {
+	numLoops    int
+	loadBalance LoadBalance
+	codec       Codec
+	// drainTimeout limits the duration of a graceful drain.
+	drainTimeout time.Duration
+	// upgradeSignal triggers an upgrade of the running server.
+	upgradeSignal os.Signal
+	// udpSessions keeps a session for every UDP peer, udpIdle expires
+	// idle sessions and udpMaxSessions limits their number.
+	udpSessions    bool
+	udpIdle        time.Duration
+	udpMaxSessions int
+	// udpBatchSize is the number of datagrams read at once.
+	udpBatchSize int
+	// maxConns and maxConnsPerIP limit the connections, acceptRate and
+	// acceptBurst limit the rate of accepted connections.
+	maxConns      int
+	maxConnsPerIP int
+	acceptRate    float64
+	acceptBurst   int
+	// acl filters the clients of all the listeners, unless the listener
+	// has its own in listenerACLs.
+	acl          *ACL
+	listenerACLs map[int]*ACL
+	// tls serves the stream listeners over TLS.
+	tls *tls.Config
+}
+
+func newConfig(events Events) *config {
+	return &config{
+		numLoops:     events.NumLoops,
+		loadBalance:  events.LoadBalance,
+		codec:        events.Codec,
+		udpBatchSize: 16,
+	}
+}
+
+// apply returns a copy of events updated with the configuration.
+func (cfg *config) apply(events Events) Events {
+	events.NumLoops = cfg.numLoops
+	events.LoadBalance = cfg.loadBalance
+	events.Codec = cfg.codec
+	return events
+}
+
+// WithNumLoops sets the number of loops, see Events.NumLoops.
+func WithNumLoops(n int) Option {
+	return func(cfg *config) {
+		cfg.numLoops = n
+	}
+}
+
+// WithLoadBalance sets the load balancing method, see Events.LoadBalance.
+func WithLoadBalance(balance LoadBalance) Option {
+	return func(cfg *config) {
+		cfg.loadBalance = balance
+	}
+}
+
+// WithCodec sets the codec used by the React event, see Events.Codec.
+func WithCodec(codec Codec) Option {
+	return func(cfg *config) {
+		cfg.codec = codec
+	}
+}
+
+// WithDrainTimeout limits the duration of Server.Drain and Server.Upgrade.
+// Once the timeout has elapsed, the remaining connections are closed.
+// Default is no limit.
+func WithDrainTimeout(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.drainTimeout = d
+	}
+}
+
+// WithUpgradeSignal upgrades the server, as Server.Upgrade does, whenever
+// the process receives the signal, like syscall.SIGUSR2.
+func WithUpgradeSignal(sig os.Signal) Option {
+	return func(cfg *config) {
+		cfg.upgradeSignal = sig
+	}
+}
+
+// WithUDPSessions keeps a session for every UDP peer, keyed by the listener
+// and the remote address, so that the connection context persists across
+// datagrams. The Opened event fires for the first datagram of a peer, and
+// the Closed event fires with ErrIdleTimeout once the peer has been idle
+// for the idle duration, or when an event returns the Close action. Zero
+// idle keeps the sessions until they are closed. While the server has max
+// sessions the datagrams of new peers are dropped, zero max is no limit.
+func WithUDPSessions(idle time.Duration, max int) Option {
+	return func(cfg *config) {
+		cfg.udpSessions = true
+		cfg.udpIdle = idle
+		cfg.udpMaxSessions = max
+	}
+}
+
+// WithUDPBatchSize sets the number of datagrams that a loop reads at once
+// with recvmmsg, and the replies are sent at once with sendmmsg. Batches
+// are Linux only. Default is 16.
+func WithUDPBatchSize(n int) Option {
+	return func(cfg *config) {
+		cfg.udpBatchSize = n
+	}
+}
+
+// WithMaxConns limits the number of connections of the server. The
+// connections over the limit are closed right after accepting them, without
+// any event. Use the maxconns address option to limit the connections of a
+// single listener. Outbound connections don't count.
+func WithMaxConns(n int) Option {
+	return func(cfg *config) {
+		cfg.maxConns = n
+	}
+}
+
+// WithMaxConnsPerIP limits the number of connections from a single source
+// IP address, like WithMaxConns does.
+func WithMaxConnsPerIP(n int) Option {
+	return func(cfg *config) {
+		cfg.maxConnsPerIP = n
+	}
+}
+
+// WithAcceptRate limits the rate of accepted connections to rate per second,
+// with bursts of up to burst connections. The connections over the rate are
+// closed right after accepting them, without any event.
+func WithAcceptRate(rate float64, burst int) Option {
+	return func(cfg *config) {
+		cfg.acceptRate = rate
+		cfg.acceptBurst = burst
+	}
+}
+
+// WithACL filters the clients of all the listeners with the access control
+// list. Denied connections are closed right after accepting them and denied
+// datagrams are dropped, without any event but Rejected.
+func WithACL(acl *ACL) Option {
+	return func(cfg *config) {
+		cfg.acl = acl
+	}
+}
+
+// WithListenerACL filters the clients of a single listener, by the index of
+// its address, instead of the ACL set with WithACL.
+func WithListenerACL(index int, acl *ACL) Option {
+	return func(cfg *config) {
+		if cfg.listenerACLs == nil {
+			cfg.listenerACLs = make(map[int]*ACL)
+		}
+		cfg.listenerACLs[index] = acl
+	}
+}
@@ -0,0 +1,77 @@
+// +build !darwin,!netbsd,!freebsd,!openbsd,!dragonfly,!linux
+
+package evloop
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+func (ln *listener) close() {
+	if ln.ln != nil {
+		ln.ln.Close()
+	}
+	if ln.pConn != nil {
+		ln.pConn.Close()
+	}
+	if ln.network == "unix" && !ln.inherited && atomic.LoadInt32(&ln.handedOff) == 0 {
+		removeUnixSocket(ln.addr)
+	}
+}
+
+func (ln *listener) system() error {
+	return nil
+}
+
+func setUDPOptions(conn *net.UDPConn, opts addrOpts) error {
+	if opts.hasUDPOptions() {
+		return errors.New("udp socket options are not available")
+	}
+	return nil
+}
+
+func setConnOptions(conn net.Conn, opts Options) {
+	c, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if opts.TCPKeepAlive > 0 {
+		c.SetKeepAlive(true)
+		c.SetKeepAlivePeriod(opts.TCPKeepAlive)
+	}
+	if opts.TCPNoDelay {
+		c.SetNoDelay(true)
+	}
+	if opts.Linger > 0 {
+		c.SetLinger(int((opts.Linger + time.Second - 1) / time.Second))
+	} else if opts.Linger < 0 {
+		c.SetLinger(0)
+	}
+	if opts.ReadBuffer > 0 {
+		c.SetReadBuffer(opts.ReadBuffer)
+	}
+	if opts.WriteBuffer > 0 {
+		c.SetWriteBuffer(opts.WriteBuffer)
+	}
+}
+
+func setListenerOptions(ln net.Listener, opts addrOpts) error {
+	if opts.fastOpen != 0 || opts.deferAccept != 0 || opts.backlog != 0 {
+		return errors.New("listener options are not available")
+	}
+	return nil
+}
+
+func serve(events Events, listeners []*listener, cfg *config) error {
+	return stdserve(events, listeners, cfg)
+}
+
+func reuseportListenPacket(proto, addr string) (l net.PacketConn, err error) {
+	return nil, errors.New("reuseport is not available")
+}
+
+func reuseportListen(proto, addr string) (l net.Listener, err error) {
+	return nil, errors.New("reuseport is not available")
+}
@@ -0,0 +1,242 @@
+package evloop
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidProxyHeader is returned for connections that don't start with a
+// valid PROXY protocol header.
+var ErrInvalidProxyHeader = errors.New("invalid proxy protocol header")
+
+// proxyHeaderTimeout limits the time to receive the PROXY protocol header.
+const proxyHeaderTimeout = 10 * time.Second
+
+// PROXY protocol version 2 TLV types.
+const (
+	ProxyTLVALPN      byte = 0x01
+	ProxyTLVAuthority byte = 0x02
+	ProxyTLVCRC32C    byte = 0x03
+	ProxyTLVNoop      byte = 0x04
+	ProxyTLVUniqueID  byte = 0x05
+	ProxyTLVSSL       byte = 0x20
+	ProxyTLVNetNS     byte = 0x30
+)
+
+var (
+	proxyV1Prefix = []byte("PROXY ")
+	proxyV2Sig    = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const (
+	proxyV1MaxLength = 107 // the longest version 1 header, with CRLF
+	proxyV2HeadLen   = 16  // signature, command, family and length
+)
+
+// ProxyHeader is the PROXY protocol header received on a connection of a
+// listener with the proxyproto address option.
+type ProxyHeader struct {
+	// Version is the protocol version, 1 or 2.
+	Version int
+	// Local is set for the version 2 LOCAL command, that the proxy sends for
+	// its own connections, like health checks.
+	Local bool
+	// SourceAddr and DestAddr are the addresses of the proxied connection.
+	// They are nil for the LOCAL command and for unknown address families.
+	SourceAddr net.Addr
+	DestAddr   net.Addr
+	// TLVs are the version 2 type-length-value extensions.
+	TLVs []ProxyTLV
+}
+
+// ProxyTLV is a PROXY protocol version 2 type-length-value extension.
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// TLV returns the value of the first extension of the type.
+func (h *ProxyHeader) TLV(typ byte) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == typ {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// ServerName returns the TLS server name (SNI) that the proxy passed in the
+// authority extension.
+func (h *ProxyHeader) ServerName() string {
+	v, _ := h.TLV(ProxyTLVAuthority)
+	return string(v)
+}
+
+// parseProxyHeader parses the PROXY protocol header at the start of b and
+// returns its length. A nil header with no error means that b holds an
+// incomplete header.
+func parseProxyHeader(b []byte) (*ProxyHeader, int, error) {
+	switch {
+	case hasPrefix(b, proxyV2Sig):
+		return parseProxyV2(b)
+	case hasPrefix(b, proxyV1Prefix):
+		return parseProxyV1(b)
+	}
+	return nil, 0, ErrInvalidProxyHeader
+}
+
+// hasPrefix reports whether b starts with prefix, or is a beginning of it.
+func hasPrefix(b, prefix []byte) bool {
+	if len(b) < len(prefix) {
+		return bytes.Equal(b, prefix[:len(b)])
+	}
+	return bytes.HasPrefix(b, prefix)
+}
+
+// parseProxyV1 parses the text header, like
+// "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n".
+func parseProxyV1(b []byte) (*ProxyHeader, int, error) {
+	end := bytes.Index(b, []byte("\r\n"))
+	if end == -1 {
+		if len(b) >= proxyV1MaxLength {
+			return nil, 0, ErrInvalidProxyHeader
+		}
+		return nil, 0, nil
+	}
+	if end+2 > proxyV1MaxLength {
+		return nil, 0, ErrInvalidProxyHeader
+	}
+	hdr := &ProxyHeader{Version: 1}
+	fields := strings.Split(string(b[:end]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return hdr, end + 2, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, 0, ErrInvalidProxyHeader
+	}
+	src, err := parseProxyV1Addr(fields[1], fields[2], fields[4])
+	if err != nil {
+		return nil, 0, err
+	}
+	dst, err := parseProxyV1Addr(fields[1], fields[3], fields[5])
+	if err != nil {
+		return nil, 0, err
+	}
+	hdr.SourceAddr, hdr.DestAddr = src, dst
+	return hdr, end + 2, nil
+}
+
+func parseProxyV1Addr(proto, host, port string) (net.Addr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil || (proto == "TCP4") != (ip.To4() != nil) {
+		return nil, ErrInvalidProxyHeader
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (len(port) > 1 && port[0] == '0') {
+		return nil, ErrInvalidProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// parseProxyV2 parses the binary header.
+func parseProxyV2(b []byte) (*ProxyHeader, int, error) {
+	if len(b) < proxyV2HeadLen {
+		return nil, 0, nil
+	}
+	n := proxyV2HeadLen + int(binary.BigEndian.Uint16(b[14:16]))
+	if len(b) < n {
+		return nil, 0, nil
+	}
+	if b[12]>>4 != 2 {
+		return nil, 0, ErrInvalidProxyHeader
+	}
+	hdr := &ProxyHeader{Version: 2}
+	switch b[12] & 0xF {
+	case 0:
+		hdr.Local = true
+	case 1:
+	default:
+		return nil, 0, ErrInvalidProxyHeader
+	}
+	payload := b[proxyV2HeadLen:n]
+	var alen int
+	switch b[13] {
+	case 0x11, 0x12: // TCP and UDP over IPv4
+		alen = 12
+	case 0x21, 0x22: // TCP and UDP over IPv6
+		alen = 36
+	case 0x31, 0x32: // unix stream and datagram
+		alen = 216
+	case 0x00: // unspecified
+	default:
+		return nil, 0, ErrInvalidProxyHeader
+	}
+	if len(payload) < alen {
+		return nil, 0, ErrInvalidProxyHeader
+	}
+	if !hdr.Local {
+		hdr.SourceAddr, hdr.DestAddr = proxyV2Addrs(b[13], payload[:alen])
+	}
+	for tlvs := payload[alen:]; len(tlvs) > 0; {
+		if len(tlvs) < 3 {
+			return nil, 0, ErrInvalidProxyHeader
+		}
+		l := 3 + int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < l {
+			return nil, 0, ErrInvalidProxyHeader
+		}
+		tlv := ProxyTLV{Type: tlvs[0], Value: append([]byte{}, tlvs[3:l]...)}
+		if tlv.Type == ProxyTLVCRC32C && !proxyV2Checksum(b[:n], len(b[:n])-len(tlvs)+3, tlv.Value) {
+			return nil, 0, ErrInvalidProxyHeader
+		}
+		hdr.TLVs = append(hdr.TLVs, tlv)
+		tlvs = tlvs[l:]
+	}
+	return hdr, n, nil
+}
+
+// proxyV2Addrs returns the source and destination addresses of the family.
+func proxyV2Addrs(family byte, b []byte) (src, dst net.Addr) {
+	switch family {
+	case 0x11, 0x21:
+		n := len(b)/2 - 2
+		src = &net.TCPAddr{IP: net.IP(append([]byte{}, b[:n]...)), Port: int(binary.BigEndian.Uint16(b[2*n:]))}
+		dst = &net.TCPAddr{IP: net.IP(append([]byte{}, b[n:2*n]...)), Port: int(binary.BigEndian.Uint16(b[2*n+2:]))}
+	case 0x12, 0x22:
+		n := len(b)/2 - 2
+		src = &net.UDPAddr{IP: net.IP(append([]byte{}, b[:n]...)), Port: int(binary.BigEndian.Uint16(b[2*n:]))}
+		dst = &net.UDPAddr{IP: net.IP(append([]byte{}, b[n:2*n]...)), Port: int(binary.BigEndian.Uint16(b[2*n+2:]))}
+	case 0x31, 0x32:
+		network := "unix"
+		if family == 0x32 {
+			network = "unixgram"
+		}
+		src = &net.UnixAddr{Name: cString(b[:108]), Net: network}
+		dst = &net.UnixAddr{Name: cString(b[108:]), Net: network}
+	}
+	return src, dst
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i != -1 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// proxyV2Checksum verifies the CRC32C checksum of the header, computed with
+// the checksum value at offset zeroed.
+func proxyV2Checksum(hdr []byte, offset int, sum []byte) bool {
+	if len(sum) != 4 {
+		return false
+	}
+	b := append([]byte{}, hdr...)
+	copy(b[offset:offset+4], make([]byte, 4))
+	return crc32.Checksum(b, crc32.MakeTable(crc32.Castagnoli)) == binary.BigEndian.Uint32(sum)
+}
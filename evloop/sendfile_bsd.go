@@ -0,0 +1,8 @@
+// +build darwin netbsd freebsd openbsd dragonfly
+
+package evloop
+
+// sendFile writes the file to the socket from the buffer.
+func sendFile(fd int, f *outFile, buf []byte) (int, error) {
+	return copyFile(fd, f, buf)
+}
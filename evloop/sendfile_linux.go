@@ -0,0 +1,23 @@
+package evloop
+
+import "syscall"
+
+// maxSendFile limits the count of a single sendfile(2) call.
+const maxSendFile = 1 << 30
+
+// sendFile writes the file to the socket with sendfile(2), or from the
+// buffer when the file doesn't support it.
+func sendFile(fd int, f *outFile, buf []byte) (int, error) {
+	count := f.n
+	if count > maxSendFile {
+		count = maxSendFile
+	}
+	n, err := syscall.Sendfile(fd, int(f.f.Fd()), &f.off, int(count))
+	if err == syscall.EINVAL || err == syscall.ENOSYS {
+		return copyFile(fd, f, buf)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
@@ -0,0 +1,146 @@
+// +build darwin netbsd freebsd openbsd dragonfly linux
+
+package evloop
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+
+	src "github.com/konstantin-kukharev/pureserver/internal/pure"
+)
+
+// setUDPOptions applies the broadcast, loop and ttl address options to a
+// datagram socket. The multicast options of IPv6 sockets are applied to
+// the IPv6 hop limit.
+func setUDPOptions(conn *net.UDPConn, opts addrOpts) error {
+	if !opts.hasUDPOptions() {
+		return nil
+	}
+	ipv6 := true
+	if laddr, ok := conn.LocalAddr().(*net.UDPAddr); ok && laddr.IP.To4() != nil {
+		ipv6 = false
+	}
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		s := int(fd)
+		if opts.broadcast {
+			serr = syscall.SetsockoptInt(s, syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+		}
+		if serr == nil && opts.multicastLoop != nil {
+			var v int
+			if *opts.multicastLoop {
+				v = 1
+			}
+			if ipv6 {
+				serr = syscall.SetsockoptInt(s, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_LOOP, v)
+			} else {
+				serr = syscall.SetsockoptByte(s, syscall.IPPROTO_IP, syscall.IP_MULTICAST_LOOP, byte(v))
+			}
+		}
+		if serr == nil && opts.ttl > 0 {
+			if ipv6 {
+				serr = syscall.SetsockoptInt(s, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, opts.ttl)
+			} else {
+				serr = syscall.SetsockoptByte(s, syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, byte(opts.ttl))
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// setSockOptions applies the connection options to a socket. The options
+// that the platform doesn't support are ignored.
+func setSockOptions(fd int, opts Options) {
+	if opts.TCPKeepAlive > 0 {
+		src.SetKeepAlive(fd, int(opts.TCPKeepAlive/time.Second))
+	}
+	if opts.TCPNoDelay {
+		syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_NODELAY, 1)
+	}
+	if opts.Linger != 0 {
+		var l syscall.Linger
+		if opts.Linger > 0 {
+			l.Onoff = 1
+			l.Linger = int32((opts.Linger + time.Second - 1) / time.Second)
+		} else {
+			l.Onoff = 1 // reset on close
+		}
+		syscall.SetsockoptLinger(fd, syscall.SOL_SOCKET, syscall.SO_LINGER, &l)
+	}
+	if opts.ReadBuffer > 0 {
+		syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, opts.ReadBuffer)
+	}
+	if opts.WriteBuffer > 0 {
+		syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF, opts.WriteBuffer)
+	}
+	if opts.TCPUserTimeout > 0 {
+		src.SetUserTimeout(fd, int(opts.TCPUserTimeout/time.Millisecond))
+	}
+	if opts.TCPQuickAck {
+		src.SetQuickAck(fd)
+	}
+	if opts.TCPNotSentLowat > 0 {
+		src.SetNotSentLowat(fd, opts.TCPNotSentLowat)
+	}
+	if opts.Mark != 0 {
+		src.SetMark(fd, opts.Mark)
+	}
+}
+
+// setConnOptions applies the connection options to a stdlib connection.
+func setConnOptions(conn net.Conn, opts Options) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return
+	}
+	rc.Control(func(fd uintptr) {
+		setSockOptions(int(fd), opts)
+	})
+}
+
+// setListenerOptions applies the fastopen, defer_accept and backlog
+// address options to a stream listener.
+func setListenerOptions(ln net.Listener, opts addrOpts) error {
+	if opts.fastOpen == 0 && opts.deferAccept == 0 && opts.backlog == 0 {
+		return nil
+	}
+	sc, ok := ln.(syscall.Conn)
+	if !ok {
+		return errors.New("listener options are not available")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		s := int(fd)
+		if opts.fastOpen > 0 {
+			serr = src.SetFastOpen(s, opts.fastOpen)
+		}
+		if serr == nil && opts.deferAccept > 0 {
+			serr = src.SetDeferAccept(s, int(opts.deferAccept/time.Second))
+		}
+		if serr == nil && opts.backlog > 0 {
+			// listen again to change the backlog of the listening socket
+			serr = syscall.Listen(s, opts.backlog)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,201 @@
+package evloop
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// Stats is a snapshot of the counters of a running server.
+type Stats struct {
+	// Loops has the counters of every loop.
+	Loops []LoopStats
+	// Listeners has the counters of every listener, in the order of the
+	// addresses passed to Run.
+	Listeners []ListenerStats
+	// Rejections counts the connections closed right after accepting them.
+	Rejections Rejections
+}
+
+// LoopStats are the counters of a loop.
+type LoopStats struct {
+	// Conns is the number of open connections, outbound included.
+	Conns int
+	// Accepted and Closed count the connections opened and closed on the
+	// loop since the server started.
+	Accepted uint64
+	Closed   uint64
+	// BytesIn and BytesOut count the bytes read from and written to the
+	// connections and the UDP peers.
+	BytesIn  uint64
+	BytesOut uint64
+	// PendingOut is the number of output bytes waiting for the connections
+	// to become writable. The stdlib backend writes synchronously and
+	// keeps it zero.
+	PendingOut uint64
+	// Wakeups counts the returns from the poller, and Notes the
+	// notifications processed by the loop, like Wake calls.
+	Wakeups uint64
+	Notes   uint64
+	// Timers is the number of timers in the loop heap, the stopped ones
+	// not dropped yet included.
+	Timers int
+	// Errors counts the connection errors by kind.
+	Errors ErrorStats
+}
+
+// ListenerStats are the counters of a listener.
+type ListenerStats struct {
+	// Addr is the listener address.
+	Addr net.Addr
+	// Conns is the number of open connections accepted by the listener.
+	Conns int
+	// Accepted and Closed count the connections accepted by the listener
+	// since the server started.
+	Accepted uint64
+	Closed   uint64
+	// BytesIn and BytesOut count the bytes read from and written to the
+	// connections or the UDP peers of the listener.
+	BytesIn  uint64
+	BytesOut uint64
+}
+
+// ErrorStats counts the errors by kind.
+type ErrorStats struct {
+	// Accept counts the failed accepts, connections aborted by the peer
+	// included.
+	Accept uint64
+	// Read and Write count the failed reads and writes, the end of file
+	// excluded.
+	Read  uint64
+	Write uint64
+	// Dial counts the failed outbound connections.
+	Dial uint64
+}
+
+// loopCounters are the counters of a loop, updated atomically.
+type loopCounters struct {
+	accepted, closed  uint64
+	bytesIn, bytesOut uint64
+	pending           int64
+	wakeups, notes    uint64
+	timers            int64
+	errors            ErrorStats
+}
+
+// listenerCounters are the counters of a listener, updated atomically.
+type listenerCounters struct {
+	accepted, closed  uint64
+	bytesIn, bytesOut uint64
+}
+
+// counters are the counters of a server. The listener index of outbound
+// connections is negative.
+type counters struct {
+	loops []loopCounters
+	lns   []listenerCounters
+}
+
+func newCounters(loops, lns int) *counters {
+	return &counters{
+		loops: make([]loopCounters, loops),
+		lns:   make([]listenerCounters, lns),
+	}
+}
+
+func (sc *counters) opened(loop, lnidx int) {
+	atomic.AddUint64(&sc.loops[loop].accepted, 1)
+	if lnidx >= 0 {
+		atomic.AddUint64(&sc.lns[lnidx].accepted, 1)
+	}
+}
+
+func (sc *counters) closed(loop, lnidx int) {
+	atomic.AddUint64(&sc.loops[loop].closed, 1)
+	if lnidx >= 0 {
+		atomic.AddUint64(&sc.lns[lnidx].closed, 1)
+	}
+}
+
+func (sc *counters) read(loop, lnidx, n int) {
+	atomic.AddUint64(&sc.loops[loop].bytesIn, uint64(n))
+	if lnidx >= 0 {
+		atomic.AddUint64(&sc.lns[lnidx].bytesIn, uint64(n))
+	}
+}
+
+func (sc *counters) wrote(loop, lnidx, n int) {
+	atomic.AddUint64(&sc.loops[loop].bytesOut, uint64(n))
+	if lnidx >= 0 {
+		atomic.AddUint64(&sc.lns[lnidx].bytesOut, uint64(n))
+	}
+}
+
+func (sc *counters) pending(loop, delta int) {
+	atomic.AddInt64(&sc.loops[loop].pending, int64(delta))
+}
+
+func (sc *counters) wakeup(loop int) {
+	atomic.AddUint64(&sc.loops[loop].wakeups, 1)
+}
+
+func (sc *counters) note(loop int) {
+	atomic.AddUint64(&sc.loops[loop].notes, 1)
+}
+
+func (sc *counters) acceptError(loop int) {
+	atomic.AddUint64(&sc.loops[loop].errors.Accept, 1)
+}
+
+func (sc *counters) readError(loop int) {
+	atomic.AddUint64(&sc.loops[loop].errors.Read, 1)
+}
+
+func (sc *counters) writeError(loop int) {
+	atomic.AddUint64(&sc.loops[loop].errors.Write, 1)
+}
+
+func (sc *counters) dialError(loop int) {
+	atomic.AddUint64(&sc.loops[loop].errors.Dial, 1)
+}
+
+// snapshot returns the current counters.
+func (sc *counters) snapshot(lns []*listener, lim *limiter) Stats {
+	st := Stats{
+		Loops:      make([]LoopStats, len(sc.loops)),
+		Listeners:  make([]ListenerStats, len(sc.lns)),
+		Rejections: lim.rejections(),
+	}
+	for i := range sc.loops {
+		c := &sc.loops[i]
+		ls := &st.Loops[i]
+		// closed first, so that the connections never look negative
+		ls.Closed = atomic.LoadUint64(&c.closed)
+		ls.Accepted = atomic.LoadUint64(&c.accepted)
+		ls.Conns = int(ls.Accepted - ls.Closed)
+		ls.BytesIn = atomic.LoadUint64(&c.bytesIn)
+		ls.BytesOut = atomic.LoadUint64(&c.bytesOut)
+		if n := atomic.LoadInt64(&c.pending); n > 0 {
+			ls.PendingOut = uint64(n)
+		}
+		ls.Wakeups = atomic.LoadUint64(&c.wakeups)
+		ls.Notes = atomic.LoadUint64(&c.notes)
+		ls.Timers = int(atomic.LoadInt64(&c.timers))
+		ls.Errors = ErrorStats{
+			Accept: atomic.LoadUint64(&c.errors.Accept),
+			Read:   atomic.LoadUint64(&c.errors.Read),
+			Write:  atomic.LoadUint64(&c.errors.Write),
+			Dial:   atomic.LoadUint64(&c.errors.Dial),
+		}
+	}
+	for i := range sc.lns {
+		c := &sc.lns[i]
+		ls := &st.Listeners[i]
+		ls.Addr = lns[i].lnAddr
+		ls.Closed = atomic.LoadUint64(&c.closed)
+		ls.Accepted = atomic.LoadUint64(&c.accepted)
+		ls.Conns = int(ls.Accepted - ls.Closed)
+		ls.BytesIn = atomic.LoadUint64(&c.bytesIn)
+		ls.BytesOut = atomic.LoadUint64(&c.bytesOut)
+	}
+	return st
+}
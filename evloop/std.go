@@ -0,0 +1,957 @@
+package evloop
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errClosing = errors.New("closing")
+var errCloseConns = errors.New("close conns")
+
+type stdserver struct {
+	events   Events         // user events
+	loops    []*stdloop     // all the loops
+	lns      []*listener    // all the listeners
+	loopwg   sync.WaitGroup // loop close waitgroup
+	lnwg     sync.WaitGroup // listener close waitgroup
+	cond     *sync.Cond     // shutdown signaler
+	serr     error          // signal error
+	accepted uintptr        // accept counter
+	dialed   uintptr        // dial counter
+	done     chan struct{}  // closed when the server stops
+	drainset int32          // set once the server starts draining
+	drained  int32          // number of drained loops
+	sessions int32          // number of UDP sessions
+	cfg      *config        // server configuration
+	lim      *limiter       // connection limits
+	counters *counters      // loop and listener counters
+}
+
+type stdudpconn struct {
+	addrIndex  int
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	in         []byte
+}
+
+func (c *stdudpconn) Context() interface{}       { return nil }
+func (c *stdudpconn) SetContext(ctx interface{}) {}
+func (c *stdudpconn) AddrIndex() int             { return c.addrIndex }
+func (c *stdudpconn) LocalAddr() net.Addr        { return c.localAddr }
+func (c *stdudpconn) RemoteAddr() net.Addr       { return c.remoteAddr }
+func (c *stdudpconn) Wake()                      {}
+func (c *stdudpconn) Outbound() bool             { return false }
+func (c *stdudpconn) ProxyHeader() *ProxyHeader  { return nil }
+func (c *stdudpconn) SendFile(out []byte, f *os.File, offset, count int64) error {
+	f.Close()
+	return errSendFileUDP
+}
+func (c *stdudpconn) AfterFunc(d time.Duration, fn func(c Conn) (out []byte, action Action)) Timer {
+	return stoppedTimer{}
+}
+
+type stdloop struct {
+	idx      int               // loop index
+	ch       chan interface{}  // command channel
+	conns    map[*stdconn]bool // track all the conns bound to this loop
+	timers   timerHeap         // scheduled callbacks
+	svr      *stdserver        // owner server
+	drain    int               // 0: serving, 1: draining, 2: drained
+	sessions *udpSessions      // UDP sessions, nil when disabled
+}
+
+type stdconn struct {
+	addrIndex  int
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	conn       net.Conn     // original connection
+	ctx        interface{}  // user-defined context
+	loop       *stdloop     // owner loop
+	lnidx      int          // index of listener
+	donein     []byte       // extra data for done connection
+	done       int32        // 0: attached, 1: closed, 2: detached
+	timers     connTimers   // scheduled callbacks
+	outbound   bool         // connection opened with Dial
+	stream     InputStream  // input stream for the React event
+	proxy      *ProxyHeader // PROXY protocol header
+	pending    []byte       // input read ahead of the Opened event
+	admitted   bool         // counted by the server limiter
+	ip         net.IP       // source IP for the limiter
+	sending    bool         // a file is being sent, see SendFile
+	sendq      []stdsend    // output queued behind the file being sent
+	failed     *stderr      // read error handled once the file is sent
+}
+
+// stdsend is an output queued behind a file being sent, or a file to send
+// when f is not nil.
+type stdsend struct {
+	out   []byte
+	f     *os.File
+	count int64
+}
+
+// stdsent is a loop message of a file sent by its goroutine.
+type stdsent struct {
+	c   *stdconn
+	n   int64
+	err error
+}
+
+// stdrejected is a client rejected by a listener.
+type stdrejected struct {
+	addr   net.Addr
+	reason error
+}
+
+type wakeReq struct {
+	c *stdconn
+}
+
+// drainReq is a loop message that starts a graceful drain.
+type drainReq struct{}
+
+type dialErr struct {
+	c   *stdconn
+	err error
+}
+
+func (c *stdconn) Context() interface{}       { return c.ctx }
+func (c *stdconn) SetContext(ctx interface{}) { c.ctx = ctx }
+func (c *stdconn) AddrIndex() int             { return c.addrIndex }
+func (c *stdconn) LocalAddr() net.Addr        { return c.localAddr }
+func (c *stdconn) RemoteAddr() net.Addr       { return c.remoteAddr }
+func (c *stdconn) Wake()                      { c.loop.ch <- wakeReq{c} }
+func (c *stdconn) Outbound() bool             { return c.outbound }
+func (c *stdconn) ProxyHeader() *ProxyHeader  { return c.proxy }
+func (c *stdconn) inputStream() *InputStream  { return &c.stream }
+
+// SendFile queues out and the file behind the pending output. The file is
+// copied by a goroutine, so that the loop serves its other connections
+// meanwhile, and the output of the later events is written once it is sent.
+func (c *stdconn) SendFile(out []byte, f *os.File, offset, count int64) error {
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	c.sendq = append(c.sendq, stdsend{out: append([]byte(nil), out...), f: f, count: count})
+	if !c.sending {
+		stdsendNext(c.loop.svr, c.loop, c)
+	}
+	return nil
+}
+func (c *stdconn) AfterFunc(d time.Duration, fn func(c Conn) (out []byte, action Action)) Timer {
+	l := c.loop
+	t := l.timers.schedule(d, func() error {
+		return stdloopTimer(l.svr, l, c, fn)
+	})
+	c.timers.add(t)
+	return t
+}
+
+type stdin struct {
+	c  *stdconn
+	in []byte
+}
+
+type stderr struct {
+	c   *stdconn
+	err error
+}
+
+// waitForShutdown waits for a signal to shutdown
+func (s *stdserver) waitForShutdown() error {
+	s.cond.L.Lock()
+	s.cond.Wait()
+	err := s.serr
+	s.cond.L.Unlock()
+	return err
+}
+
+// signalShutdown signals a shutdown an begins server closing
+func (s *stdserver) signalShutdown(err error) {
+	s.cond.L.Lock()
+	s.serr = err
+	s.cond.Signal()
+	s.cond.L.Unlock()
+}
+
+func stdserve(events Events, listeners []*listener, cfg *config) error {
+	numLoops := events.NumLoops
+	if numLoops <= 0 {
+		if numLoops == 0 {
+			numLoops = 1
+		} else {
+			numLoops = runtime.NumCPU()
+		}
+	}
+
+	s := &stdserver{}
+	s.events = events
+	s.lns = listeners
+	s.cond = sync.NewCond(&sync.Mutex{})
+	s.done = make(chan struct{})
+	s.cfg = cfg
+	s.lim = newLimiter(cfg, listeners)
+	s.counters = newCounters(numLoops, len(listeners))
+	defer s.lim.reserve.close()
+	for i := 0; i < numLoops; i++ {
+		l := &stdloop{
+			idx:   i,
+			ch:    make(chan interface{}),
+			conns: make(map[*stdconn]bool),
+			svr:   s,
+		}
+		l.timers.gauge = &s.counters.loops[i].timers
+		l.sessions = newUDPSessions(events, cfg, &s.sessions, &l.timers)
+		s.loops = append(s.loops, l)
+	}
+
+	//println("-- server starting")
+	if events.Serving != nil {
+		var svr Server
+		svr.NumLoops = numLoops
+		svr.Addresses = make([]net.Addr, len(listeners))
+		for i, ln := range listeners {
+			svr.Addresses[i] = ln.lnAddr
+		}
+		svr.ctl = s
+		action := events.Serving(svr)
+		switch action {
+		case Shutdown:
+			close(s.done)
+			return nil
+		}
+	}
+	var ferr error
+	var stopUpgrade func()
+	defer func() {
+		// wait on a signal for shutdown
+		ferr = s.waitForShutdown()
+		if stopUpgrade != nil {
+			stopUpgrade()
+		}
+
+		// notify all loops to close by closing all listeners
+		for _, l := range s.loops {
+			l.ch <- errClosing
+		}
+
+		// wait on all loops to main loop channel events
+		s.loopwg.Wait()
+
+		// shutdown all listeners
+		for i := 0; i < len(s.lns); i++ {
+			s.lns[i].close()
+		}
+
+		// wait on all listeners to complete
+		s.lnwg.Wait()
+
+		// close all connections
+		s.loopwg.Add(len(s.loops))
+		for _, l := range s.loops {
+			l.ch <- errCloseConns
+		}
+		s.loopwg.Wait()
+		close(s.done)
+
+	}()
+	if cfg.upgradeSignal != nil {
+		// the watch is stopped by the shutdown above
+		stopUpgrade = watchUpgradeSignal(cfg.upgradeSignal, s)
+	}
+	s.loopwg.Add(numLoops)
+	for i := 0; i < numLoops; i++ {
+		go stdloopRun(s, s.loops[i])
+	}
+	s.lnwg.Add(len(listeners))
+	for i := 0; i < len(listeners); i++ {
+		go stdlistenerRun(s, listeners[i], i)
+	}
+	return ferr
+}
+
+func stdlistenerRun(s *stdserver, ln *listener, lnidx int) {
+	var ferr error
+	defer func() {
+		if atomic.LoadInt32(&s.drainset) == 0 {
+			s.signalShutdown(ferr)
+		}
+		s.lnwg.Done()
+	}()
+	var packet [0xFFFF]byte
+	for {
+		if ln.pConn != nil {
+			// udp
+			n, addr, err := ln.pConn.ReadFrom(packet[:])
+			if err != nil {
+				ferr = err
+				return
+			}
+			var ip net.IP
+			uaddr, ok := addr.(*net.UDPAddr)
+			if ok {
+				ip = uaddr.IP
+			}
+			if err := s.lim.allowed(lnidx, ip); err != nil {
+				stdreject(s, addr, err)
+				continue
+			}
+			l := s.loops[int(atomic.AddUintptr(&s.accepted, 1))%len(s.loops)]
+			if ok && s.cfg.udpSessions {
+				// the peer sessions are owned by a single loop
+				l = s.loops[udpAddrKey(lnidx, uaddr).loop(len(s.loops))]
+			}
+			l.ch <- &stdudpconn{
+				addrIndex:  lnidx,
+				localAddr:  ln.lnAddr,
+				remoteAddr: addr,
+				in:         append([]byte{}, packet[:n]...),
+			}
+		} else {
+			// tcp
+			conn, err := ln.ln.Accept()
+			if err != nil {
+				if isFdExhausted(err) && atomic.LoadInt32(&s.drainset) == 0 {
+					// the listeners don't belong to a loop, the errors
+					// are counted by the first one
+					s.counters.acceptError(0)
+					stdlistenerExhausted(s, ln)
+					continue
+				}
+				ferr = err
+				return
+			}
+			var ip net.IP
+			if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+				ip = addr.IP
+			}
+			if err := s.lim.admit(lnidx, ip); err != nil {
+				conn.Close()
+				stdreject(s, conn.RemoteAddr(), err)
+				continue
+			}
+			l := s.loops[int(atomic.AddUintptr(&s.accepted, 1))%len(s.loops)]
+			c := &stdconn{conn: conn, loop: l, lnidx: lnidx, admitted: true, ip: ip}
+			if ln.opts.proxyProto {
+				go stdproxyRun(s, l, c)
+				continue
+			}
+			if s.cfg.tls != nil {
+				c.conn = tls.Server(conn, s.cfg.tls)
+			}
+			l.ch <- c
+			go stdconnRun(l, c)
+		}
+	}
+}
+
+// stdlistenerExhausted closes a pending connection with the spare file
+// descriptor, or pauses the listener for a while.
+func stdlistenerExhausted(s *stdserver, ln *listener) {
+	if s.lim.exhausted(func() bool {
+		dl, ok := ln.ln.(interface{ SetDeadline(time.Time) error })
+		if !ok {
+			return false
+		}
+		dl.SetDeadline(time.Now().Add(acceptBackoff))
+		defer dl.SetDeadline(time.Time{})
+		conn, err := ln.ln.Accept()
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}) {
+		return
+	}
+	time.Sleep(acceptBackoff)
+}
+
+// stdreject hands a rejected client over to a loop for the Rejected event.
+func stdreject(s *stdserver, addr net.Addr, reason error) {
+	if s.events.Rejected == nil {
+		return
+	}
+	l := s.loops[int(atomic.AddUintptr(&s.accepted, 1))%len(s.loops)]
+	select {
+	case l.ch <- &stdrejected{addr, reason}:
+	case <-s.done:
+	}
+}
+
+// stdwrite writes the output of an event to the connection, or queues it
+// behind the file being sent.
+func stdwrite(s *stdserver, l *stdloop, c *stdconn, out []byte) {
+	if c.sending {
+		c.sendq = append(c.sendq, stdsend{out: append([]byte(nil), out...)})
+		return
+	}
+	if s.events.PreWrite != nil {
+		s.events.PreWrite()
+	}
+	n, err := c.conn.Write(out)
+	s.counters.wrote(l.idx, c.lnidx, n)
+	if err != nil {
+		s.counters.writeError(l.idx)
+	}
+}
+
+// stdsendNext writes the queued output up to the next file and starts the
+// goroutine copying the file.
+func stdsendNext(s *stdserver, l *stdloop, c *stdconn) {
+	for len(c.sendq) > 0 {
+		q := c.sendq[0]
+		c.sendq = c.sendq[1:]
+		if len(q.out) > 0 {
+			stdwrite(s, l, c, q.out)
+		}
+		if q.f == nil {
+			continue
+		}
+		c.sending = true
+		go func() {
+			// the copy uses sendfile(2) where the net package does
+			n, err := io.CopyN(c.conn, q.f, q.count)
+			q.f.Close()
+			select {
+			case l.ch <- &stdsent{c, n, err}:
+			case <-s.done:
+			}
+		}()
+		return
+	}
+	c.sendq = nil
+}
+
+// stdloopSent resumes the output of a connection once its file is sent,
+// and handles the read error that came meanwhile.
+func stdloopSent(s *stdserver, l *stdloop, v *stdsent) error {
+	c := v.c
+	c.sending = false
+	s.counters.wrote(l.idx, c.lnidx, int(v.n))
+	if v.err != nil {
+		s.counters.writeError(l.idx)
+	}
+	stdsendNext(s, l, c)
+	if c.sending || c.failed == nil {
+		return nil
+	}
+	err := c.failed.err
+	c.failed = nil
+	return stdloopError(s, l, c, err)
+}
+
+// stdrelease releases an accepted connection from the server limiter.
+func stdrelease(s *stdserver, c *stdconn) {
+	if c.admitted {
+		c.admitted = false
+		s.lim.release(c.lnidx, c.ip)
+	}
+}
+
+// shutdown notifies the first loop to close, which closes the server.
+func (s *stdserver) shutdown() {
+	go func() {
+		select {
+		case s.loops[0].ch <- errClosing:
+		case <-s.done:
+		}
+	}()
+}
+
+// drain closes the listeners and notifies all the loops to shutdown once
+// their connections are closed.
+func (s *stdserver) drain() {
+	if !atomic.CompareAndSwapInt32(&s.drainset, 0, 1) {
+		return
+	}
+	if s.events.Draining != nil {
+		s.events.Draining()
+	}
+	for _, ln := range s.lns {
+		ln.close()
+	}
+	for _, l := range s.loops {
+		go func(l *stdloop) {
+			select {
+			case l.ch <- drainReq{}:
+			case <-s.done:
+			}
+		}(l)
+	}
+}
+
+func (s *stdserver) draining() bool {
+	return atomic.LoadInt32(&s.drainset) != 0
+}
+
+// rejections returns the counts of the connections refused by the limits.
+func (s *stdserver) rejections() Rejections {
+	return s.lim.rejections()
+}
+
+func (s *stdserver) stats() Stats {
+	return s.counters.snapshot(s.lns, s.lim)
+}
+
+// upgrade hands the listeners over to a new process and drains the server.
+func (s *stdserver) upgrade() error {
+	if err := startUpgrade(s.lns); err != nil {
+		return err
+	}
+	s.drain()
+	return nil
+}
+
+// stdconnRun reads the connection and feeds the input to its loop.
+func stdconnRun(l *stdloop, c *stdconn) {
+	var packet [0xFFFF]byte
+	for {
+		n, err := c.conn.Read(packet[:])
+		if err != nil {
+			c.conn.SetReadDeadline(time.Time{})
+			l.ch <- &stderr{c, err}
+			return
+		}
+		l.ch <- &stdin{c, append([]byte{}, packet[:n]...)}
+	}
+}
+
+// stdproxyRun reads the PROXY protocol header of a new connection and hands
+// the connection over to its loop. Connections with an invalid header are
+// closed.
+func stdproxyRun(s *stdserver, l *stdloop, c *stdconn) {
+	var packet [0xFFFF]byte
+	var buf []byte
+	c.conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	for c.proxy == nil {
+		n, err := c.conn.Read(packet[:])
+		if err != nil {
+			c.conn.Close()
+			stdrelease(s, c)
+			return
+		}
+		buf = append(buf, packet[:n]...)
+		hdr, hlen, err := parseProxyHeader(buf)
+		if err != nil {
+			c.conn.Close()
+			stdrelease(s, c)
+			return
+		}
+		if hdr != nil {
+			c.proxy = hdr
+			c.pending = buf[hlen:]
+		}
+	}
+	c.conn.SetReadDeadline(time.Time{})
+	if s.cfg.tls != nil {
+		// the input after the header starts the handshake
+		c.conn = tls.Server(&prefixConn{c.conn, c.pending}, s.cfg.tls)
+		c.pending = nil
+	}
+	select {
+	case l.ch <- c:
+	case <-s.done:
+		c.conn.Close()
+		stdrelease(s, c)
+		return
+	}
+	stdconnRun(l, c)
+}
+
+// dial connects in the background and hands the connection over to the
+// next loop.
+func (s *stdserver) dial(network, addr string, ctx interface{}) error {
+	switch network {
+	case "tcp", "tcp4", "tcp6", "unix":
+	default:
+		return net.UnknownNetworkError(network)
+	}
+	select {
+	case <-s.done:
+		return ErrServerClosed
+	default:
+	}
+	l := s.loops[int(atomic.AddUintptr(&s.dialed, 1))%len(s.loops)]
+	c := &stdconn{loop: l, lnidx: -1, ctx: ctx, outbound: true}
+	go func() {
+		conn, err := net.Dial(network, addr)
+		if err != nil {
+			select {
+			case l.ch <- &dialErr{c, err}:
+			case <-s.done:
+			}
+			return
+		}
+		c.conn = conn
+		select {
+		case l.ch <- c:
+		case <-s.done:
+			conn.Close()
+			return
+		}
+		stdconnRun(l, c)
+	}()
+	return nil
+}
+
+func stdloopRun(s *stdserver, l *stdloop) {
+	var err error
+	defer func() {
+		//fmt.Println("-- loop stopped --", l.idx)
+		s.signalShutdown(err)
+		s.loopwg.Done()
+		stdloopEgress(s, l)
+		s.loopwg.Done()
+	}()
+	if l.idx == 0 && s.events.Tick != nil {
+		l.timers.schedule(0, func() error {
+			return stdloopTick(s, l)
+		})
+	}
+	//fmt.Println("-- loop started --", l.idx)
+	for {
+		var timeout *time.Timer
+		var expired <-chan time.Time
+		if d := l.timers.next(); d >= 0 {
+			timeout = time.NewTimer(d)
+			expired = timeout.C
+		}
+		select {
+		case <-expired:
+			err = l.timers.expire()
+		case v := <-l.ch:
+			switch v.(type) {
+			case error, wakeReq, drainReq, *dialErr:
+				s.counters.note(l.idx)
+			}
+			switch v := v.(type) {
+			case error:
+				err = v
+			case *stdconn:
+				err = stdloopAccept(s, l, v)
+			case *stdin:
+				err = stdloopRead(s, l, v.c, v.in)
+			case *stdudpconn:
+				err = stdloopReadUDP(s, l, v)
+			case *stderr:
+				err = stdloopError(s, l, v.c, v.err)
+			case *stdsent:
+				err = stdloopSent(s, l, v)
+			case *stdrejected:
+				err = stdloopRejected(s, l, v)
+			case wakeReq:
+				err = stdloopRead(s, l, v.c, nil)
+			case *dialErr:
+				err = stdloopDialError(s, l, v.c, v.err)
+			case drainReq:
+				err = stdloopDrain(s, l)
+			}
+		}
+		s.counters.wakeup(l.idx)
+		if timeout != nil {
+			timeout.Stop()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// stdloopTick fires the Tick event and schedules the next one on the loop
+// timer heap.
+func stdloopTick(s *stdserver, l *stdloop) error {
+	delay, action := s.events.Tick()
+	switch action {
+	case Shutdown:
+		return errClosing
+	}
+	l.timers.schedule(delay, func() error {
+		return stdloopTick(s, l)
+	})
+	return nil
+}
+
+// stdloopTimer fires a connection timer scheduled with AfterFunc.
+func stdloopTimer(s *stdserver, l *stdloop, c *stdconn, fn func(c Conn) (out []byte, action Action)) error {
+	if !l.conns[c] || atomic.LoadInt32(&c.done) != 0 {
+		return nil // ignore stale timers
+	}
+	out, action := fn(c)
+	if len(out) > 0 {
+		stdwrite(s, l, c, out)
+	}
+	switch action {
+	case Shutdown:
+		return errClosing
+	case Detach:
+		return stdloopDetach(s, l, c)
+	case Close:
+		return stdloopClose(s, l, c)
+	}
+	return nil
+}
+
+func stdloopEgress(s *stdserver, l *stdloop) {
+	var closed bool
+loop:
+	for v := range l.ch {
+		switch v := v.(type) {
+		case error:
+			if v == errCloseConns {
+				closed = true
+				for c := range l.conns {
+					stdloopClose(s, l, c)
+					if c.sending {
+						// the file being sent is cut short
+						c.conn.Close()
+					}
+				}
+				if l.sessions != nil {
+					l.sessions.closeAll()
+				}
+			}
+		case *stderr:
+			stdloopError(s, l, v.c, v.err)
+		case *stdsent:
+			stdloopSent(s, l, v)
+		}
+		if len(l.conns) == 0 && closed {
+			break loop
+		}
+	}
+}
+
+func stdloopRejected(s *stdserver, l *stdloop, r *stdrejected) error {
+	switch s.events.Rejected(r.addr, r.reason) {
+	case Shutdown:
+		return errClosing
+	}
+	return nil
+}
+
+func stdloopError(s *stdserver, l *stdloop, c *stdconn, err error) error {
+	if c.sending {
+		// the connection is closed or detached once the file is sent
+		c.failed = &stderr{c, err}
+		return nil
+	}
+	delete(l.conns, c)
+	c.timers.stop()
+	stdrelease(s, c)
+	s.counters.closed(l.idx, c.lnidx)
+	closeEvent := true
+	switch atomic.LoadInt32(&c.done) {
+	case 0: // read error
+		c.conn.Close()
+		if err == io.EOF {
+			err = nil
+		} else {
+			s.counters.readError(l.idx)
+		}
+	case 1: // closed
+		c.conn.Close()
+		err = nil
+	case 2: // detached
+		err = nil
+		if s.events.Detached == nil {
+			c.conn.Close()
+		} else {
+			closeEvent = false
+			switch s.events.Detached(c, &stddetachedConn{c.conn, c.donein}) {
+			case Shutdown:
+				return errClosing
+			}
+		}
+	}
+	if closeEvent {
+		if s.events.Closed != nil {
+			switch s.events.Closed(c, err) {
+			case Shutdown:
+				return errClosing
+			}
+		}
+	}
+	return stdloopDrained(s, l)
+}
+
+// stdloopDrain marks the loop as draining.
+func stdloopDrain(s *stdserver, l *stdloop) error {
+	if l.drain != 0 {
+		return nil
+	}
+	l.drain = 1
+	if l.idx == 0 && s.cfg.drainTimeout > 0 {
+		l.timers.schedule(s.cfg.drainTimeout, func() error {
+			return errClosing
+		})
+	}
+	return stdloopDrained(s, l)
+}
+
+// stdloopDrained marks a draining loop as drained once it has no
+// connections left. The server shutdowns when all of the loops are drained.
+func stdloopDrained(s *stdserver, l *stdloop) error {
+	if l.drain != 1 || len(l.conns) != 0 {
+		return nil
+	}
+	l.drain = 2
+	if int(atomic.AddInt32(&s.drained, 1)) == len(s.loops) {
+		return errClosing
+	}
+	return nil
+}
+
+func stdloopDialError(s *stdserver, l *stdloop, c *stdconn, err error) error {
+	s.counters.dialError(l.idx)
+	if s.events.Closed != nil {
+		switch s.events.Closed(c, err) {
+		case Shutdown:
+			return errClosing
+		}
+	}
+	return nil
+}
+
+type stddetachedConn struct {
+	conn net.Conn // original conn
+	in   []byte   // extra input data
+}
+
+func (c *stddetachedConn) Read(p []byte) (n int, err error) {
+	if len(c.in) > 0 {
+		if len(c.in) <= len(p) {
+			copy(p, c.in)
+			n = len(c.in)
+			c.in = nil
+			return
+		}
+		copy(p, c.in[:len(p)])
+		n = len(p)
+		c.in = c.in[n:]
+		return
+	}
+	return c.conn.Read(p)
+}
+
+func (c *stddetachedConn) Write(p []byte) (n int, err error) {
+	return c.conn.Write(p)
+}
+
+func (c *stddetachedConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *stddetachedConn) Wake() {}
+
+func stdloopRead(s *stdserver, l *stdloop, c *stdconn, in []byte) error {
+	if atomic.LoadInt32(&c.done) == 2 {
+		// should not ignore reads for detached connections
+		c.donein = append(c.donein, in...)
+		return nil
+	}
+	s.counters.read(l.idx, c.lnidx, len(in))
+	if s.events.Data != nil {
+		out, action := s.events.Data(c, in)
+		if len(out) > 0 {
+			stdwrite(s, l, c, out)
+		}
+		switch action {
+		case Shutdown:
+			return errClosing
+		case Detach:
+			return stdloopDetach(s, l, c)
+		case Close:
+			return stdloopClose(s, l, c)
+		}
+	}
+	return nil
+}
+
+func stdloopReadUDP(s *stdserver, l *stdloop, c *stdudpconn) error {
+	s.counters.read(l.idx, c.addrIndex, len(c.in))
+	if uaddr, ok := c.remoteAddr.(*net.UDPAddr); ok && l.sessions != nil {
+		pConn := s.lns[c.addrIndex].pConn
+		return l.sessions.datagram(udpAddrKey(c.addrIndex, uaddr), c.localAddr, c.remoteAddr, c.in, func(out []byte) {
+			if s.events.PreWrite != nil {
+				s.events.PreWrite()
+			}
+			n, _ := pConn.WriteTo(out, uaddr)
+			s.counters.wrote(l.idx, c.addrIndex, n)
+		})
+	}
+	if s.events.Data != nil {
+		out, action := s.events.Data(c, c.in)
+		if len(out) > 0 {
+			if s.events.PreWrite != nil {
+				s.events.PreWrite()
+			}
+			n, _ := s.lns[c.addrIndex].pConn.WriteTo(out, c.remoteAddr)
+			s.counters.wrote(l.idx, c.addrIndex, n)
+		}
+		switch action {
+		case Shutdown:
+			return errClosing
+		}
+	}
+	return nil
+}
+
+func stdloopDetach(s *stdserver, l *stdloop, c *stdconn) error {
+	atomic.StoreInt32(&c.done, 2)
+	c.conn.SetReadDeadline(time.Now())
+	return nil
+}
+
+func stdloopClose(s *stdserver, l *stdloop, c *stdconn) error {
+	atomic.StoreInt32(&c.done, 1)
+	c.conn.SetReadDeadline(time.Now())
+	return nil
+}
+
+func stdloopAccept(s *stdserver, l *stdloop, c *stdconn) error {
+	l.conns[c] = true
+	s.counters.opened(l.idx, c.lnidx)
+	c.addrIndex = c.lnidx
+	if c.outbound {
+		c.localAddr = c.conn.LocalAddr()
+	} else {
+		c.localAddr = s.lns[c.lnidx].lnAddr
+	}
+	c.remoteAddr = c.conn.RemoteAddr()
+	if c.proxy != nil && c.proxy.SourceAddr != nil {
+		c.remoteAddr = c.proxy.SourceAddr
+		c.localAddr = c.proxy.DestAddr
+	}
+
+	if s.events.Opened != nil {
+		out, opts, action := s.events.Opened(c)
+		if len(out) > 0 {
+			stdwrite(s, l, c, out)
+		}
+		setConnOptions(c.conn, opts)
+		switch action {
+		case Shutdown:
+			return errClosing
+		case Detach:
+			return stdloopDetach(s, l, c)
+		case Close:
+			return stdloopClose(s, l, c)
+		}
+	}
+	if len(c.pending) > 0 {
+		// the input that followed the PROXY protocol header
+		in := c.pending
+		c.pending = nil
+		return stdloopRead(s, l, c, in)
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package evloop
+
+import (
+	"container/heap"
+	"sync/atomic"
+	"time"
+)
+
+// Timer is a callback scheduled with Conn.AfterFunc.
+type Timer interface {
+	// Stop cancels the timer. It returns false if the timer has already
+	// fired or has been stopped. Stop is safe to call from any goroutine.
+	Stop() bool
+}
+
+// Timer states.
+const (
+	timerPending int32 = iota
+	timerFired
+	timerStopped
+)
+
+// timer is a single entry of a loop timer heap.
+type timer struct {
+	when  time.Time    // fire time
+	fire  func() error // callback, runs on the owner loop
+	index int          // heap index, -1 once out of the heap
+	h     *timerHeap   // owner heap
+	state int32        // timerPending, timerFired or timerStopped
+}
+
+// Stop only marks the timer as stopped, as it may run outside of the loop.
+// The loop drops the stopped timers from the heap when they come due, or
+// all at once when they outnumber the pending ones, see timerHeap.compact.
+func (t *timer) Stop() bool {
+	if !atomic.CompareAndSwapInt32(&t.state, timerPending, timerStopped) {
+		return false
+	}
+	atomic.AddInt32(&t.h.stopped, 1)
+	return true
+}
+
+// remove stops the timer and removes it from the heap. It must only be
+// called from the loop goroutine.
+func (t *timer) remove() {
+	t.Stop()
+	if t.index >= 0 {
+		heap.Remove(&t.h.timers, t.index)
+		atomic.AddInt32(&t.h.stopped, -1)
+		t.h.resized()
+	}
+}
+
+// stoppedTimer is returned for connections that can't schedule callbacks.
+type stoppedTimer struct{}
+
+func (stoppedTimer) Stop() bool { return false }
+
+// timerHeap is a min-heap of timers ordered by fire time. It is owned by a
+// single loop and must only be used from that loop's goroutine, the stopped
+// count aside.
+type timerHeap struct {
+	timers  timerList
+	stopped int32  // stopped timers still in the heap
+	gauge   *int64 // heap size of the loop stats, if any
+}
+
+// timerList is the heap.Interface of the timers.
+type timerList []*timer
+
+func (h timerList) Len() int           { return len(h) }
+func (h timerList) Less(i, j int) bool { return h[i].when.Before(h[j].when) }
+func (h timerList) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *timerList) Push(x interface{}) {
+	t := x.(*timer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *timerList) Pop() interface{} {
+	old := *h
+	n := len(old)
+	t := old[n-1]
+	old[n-1] = nil
+	t.index = -1
+	*h = old[:n-1]
+	return t
+}
+
+// schedule adds a callback that fires after d.
+func (h *timerHeap) schedule(d time.Duration, fire func() error) *timer {
+	h.compact()
+	t := &timer{when: time.Now().Add(d), fire: fire, h: h}
+	heap.Push(&h.timers, t)
+	h.resized()
+	return t
+}
+
+// compact drops the stopped timers once they outnumber the pending ones, so
+// that a timeout stopped and scheduled again on every event doesn't pile up
+// until it comes due.
+func (h *timerHeap) compact() {
+	if int(atomic.LoadInt32(&h.stopped))*2 <= len(h.timers) {
+		return
+	}
+	live := h.timers[:0]
+	for _, t := range h.timers {
+		if atomic.LoadInt32(&t.state) == timerPending {
+			t.index = len(live)
+			live = append(live, t)
+		} else {
+			t.index = -1
+			atomic.AddInt32(&h.stopped, -1)
+		}
+	}
+	for i := len(live); i < len(h.timers); i++ {
+		h.timers[i] = nil
+	}
+	h.timers = live
+	heap.Init(&h.timers)
+	h.resized()
+}
+
+// resized updates the heap size of the loop stats.
+func (h *timerHeap) resized() {
+	if h.gauge != nil {
+		atomic.StoreInt64(h.gauge, int64(len(h.timers)))
+	}
+}
+
+// next returns the duration until the earliest timer fires, or -1 when the
+// heap is empty.
+func (h *timerHeap) next() time.Duration {
+	if len(h.timers) == 0 {
+		return -1
+	}
+	d := time.Until(h.timers[0].when)
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+// expire fires all timers that are due, and drops the stopped ones.
+func (h *timerHeap) expire() error {
+	defer h.resized()
+	now := time.Now()
+	for len(h.timers) > 0 && !h.timers[0].when.After(now) {
+		t := heap.Pop(&h.timers).(*timer)
+		if !atomic.CompareAndSwapInt32(&t.state, timerPending, timerFired) {
+			atomic.AddInt32(&h.stopped, -1)
+			continue
+		}
+		if err := t.fire(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// connTimers tracks the timers that belong to a single connection so that
+// they can be cancelled when the connection goes away.
+type connTimers []*timer
+
+func (ts *connTimers) add(t *timer) {
+	live := (*ts)[:0]
+	for _, t := range *ts {
+		if atomic.LoadInt32(&t.state) == timerPending {
+			live = append(live, t)
+		}
+	}
+	for i := len(live); i < len(*ts); i++ {
+		(*ts)[i] = nil
+	}
+	*ts = append(live, t)
+}
+
+// stop stops the timers and removes them from the heap, on the loop.
+func (ts *connTimers) stop() {
+	for _, t := range *ts {
+		t.remove()
+	}
+	*ts = nil
+}
@@ -0,0 +1,33 @@
+package evloop
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// WithTLS serves the stream listeners over TLS with the config. The TLS
+// connections are served by the standard library backend, as with the
+// "-net" schemes, since the records are handled by the crypto/tls package.
+// The handshake completes on the first read of the connection, apart from
+// the loop. Dialed connections and datagrams are not affected.
+func WithTLS(tlsConfig *tls.Config) Option {
+	return func(cfg *config) {
+		cfg.tls = tlsConfig
+	}
+}
+
+// prefixConn is a connection with the input read ahead of the handshake,
+// like after the PROXY protocol header.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(p, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
@@ -0,0 +1,194 @@
+package evloop
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// ErrIdleTimeout is passed to the Closed event of UDP sessions that expired.
+var ErrIdleTimeout = errors.New("idle timeout")
+
+// errSendFileUDP is returned by SendFile on the UDP connections.
+var errSendFileUDP = errors.New("sendfile is not available for udp")
+
+// udpKey identifies a UDP peer of a listener.
+type udpKey struct {
+	lnidx int
+	ip    [16]byte
+	port  int
+	zone  string
+}
+
+func udpAddrKey(lnidx int, addr *net.UDPAddr) udpKey {
+	k := udpKey{lnidx: lnidx, port: addr.Port, zone: addr.Zone}
+	copy(k.ip[:], addr.IP.To16())
+	return k
+}
+
+// loop returns the index of the loop that owns the peer sessions.
+func (k udpKey) loop(n int) int {
+	h := uint32(2166136261)
+	for _, b := range k.ip {
+		h = (h ^ uint32(b)) * 16777619
+	}
+	h = (h ^ uint32(k.port)) * 16777619
+	return int(h % uint32(n))
+}
+
+// udpconn is a UDP peer session.
+type udpconn struct {
+	key        udpKey
+	addrIndex  int
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	ctx        interface{}
+	last       time.Time        // last datagram time
+	ss         *udpSessions     // owner session table
+	send       func(out []byte) // writes a datagram to the peer
+}
+
+func (c *udpconn) Context() interface{}       { return c.ctx }
+func (c *udpconn) SetContext(ctx interface{}) { c.ctx = ctx }
+func (c *udpconn) AddrIndex() int             { return c.addrIndex }
+func (c *udpconn) LocalAddr() net.Addr        { return c.localAddr }
+func (c *udpconn) RemoteAddr() net.Addr       { return c.remoteAddr }
+func (c *udpconn) Wake()                      {}
+func (c *udpconn) Outbound() bool             { return false }
+func (c *udpconn) ProxyHeader() *ProxyHeader  { return nil }
+func (c *udpconn) SendFile(out []byte, f *os.File, offset, count int64) error {
+	f.Close()
+	return errSendFileUDP
+}
+func (c *udpconn) AfterFunc(d time.Duration, fn func(c Conn) (out []byte, action Action)) Timer {
+	ss := c.ss
+	return ss.timers.schedule(d, func() error {
+		if ss.m[c.key] != c {
+			return nil // ignore stale timers
+		}
+		out, action := fn(c)
+		if len(out) > 0 {
+			c.send(out)
+		}
+		return ss.action(c, action)
+	})
+}
+
+// udpSessions is the UDP session table of a loop. It must only be used
+// from that loop's goroutine.
+type udpSessions struct {
+	events Events
+	idle   time.Duration
+	max    int
+	count  *int32     // number of sessions of the server
+	timers *timerHeap // owner loop timers
+	m      map[udpKey]*udpconn
+}
+
+// newUDPSessions returns the session table of a loop, or nil when UDP
+// sessions are not enabled.
+func newUDPSessions(events Events, cfg *config, count *int32, timers *timerHeap) *udpSessions {
+	if !cfg.udpSessions {
+		return nil
+	}
+	return &udpSessions{
+		events: events,
+		idle:   cfg.udpIdle,
+		max:    cfg.udpMaxSessions,
+		count:  count,
+		timers: timers,
+		m:      make(map[udpKey]*udpconn),
+	}
+}
+
+// datagram fires the events for a datagram of the peer. The first datagram
+// of a peer opens its session, unless the server has reached the session
+// limit, then the datagram is dropped.
+func (ss *udpSessions) datagram(key udpKey, laddr, raddr net.Addr, in []byte, send func(out []byte)) error {
+	c := ss.m[key]
+	if c == nil {
+		if n := atomic.AddInt32(ss.count, 1); ss.max > 0 && int(n) > ss.max {
+			atomic.AddInt32(ss.count, -1)
+			return nil
+		}
+		c = &udpconn{
+			key:        key,
+			addrIndex:  key.lnidx,
+			localAddr:  laddr,
+			remoteAddr: raddr,
+			last:       time.Now(),
+			ss:         ss,
+			send:       send,
+		}
+		ss.m[key] = c
+		if ss.idle > 0 {
+			ss.expireAfter(c, ss.idle)
+		}
+		if ss.events.Opened != nil {
+			out, _, action := ss.events.Opened(c)
+			if len(out) > 0 {
+				c.send(out)
+			}
+			if action != None {
+				return ss.action(c, action)
+			}
+		}
+	}
+	c.last = time.Now()
+	if ss.events.Data != nil {
+		out, action := ss.events.Data(c, in)
+		if len(out) > 0 {
+			c.send(out)
+		}
+		return ss.action(c, action)
+	}
+	return nil
+}
+
+// action applies an event action to the session.
+func (ss *udpSessions) action(c *udpconn, action Action) error {
+	switch action {
+	case Close:
+		return ss.close(c, nil)
+	case Shutdown:
+		return errClosing
+	}
+	return nil
+}
+
+// expireAfter closes the session once it has been idle for the idle
+// duration.
+func (ss *udpSessions) expireAfter(c *udpconn, d time.Duration) {
+	ss.timers.schedule(d, func() error {
+		if ss.m[c.key] != c {
+			return nil
+		}
+		if d := time.Until(c.last.Add(ss.idle)); d > 0 {
+			ss.expireAfter(c, d)
+			return nil
+		}
+		return ss.close(c, ErrIdleTimeout)
+	})
+}
+
+// close removes the session and fires the Closed event.
+func (ss *udpSessions) close(c *udpconn, err error) error {
+	delete(ss.m, c.key)
+	atomic.AddInt32(ss.count, -1)
+	if ss.events.Closed != nil {
+		switch ss.events.Closed(c, err) {
+		case Shutdown:
+			return errClosing
+		}
+	}
+	return nil
+}
+
+// closeAll closes all the sessions when the server stops.
+func (ss *udpSessions) closeAll() {
+	for _, c := range ss.m {
+		ss.close(c, nil)
+	}
+}
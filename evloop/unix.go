@@ -0,0 +1,1152 @@
+// +build darwin netbsd freebsd openbsd dragonfly linux
+
+package evloop
+
+import (
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	src "github.com/konstantin-kukharev/pureserver/internal/pure"
+	rp "github.com/konstantin-kukharev/pureserver/internal/reuseport"
+)
+
+type conn struct {
+	fd         int              // file descriptor
+	lnidx      int              // listener index in the server lns list
+	out        []byte           // write buffer
+	sa         syscall.Sockaddr // remote socket address
+	reuse      bool             // should reuse input buffer
+	opened     bool             // connection opened event fired
+	outbound   bool             // connection opened with Dial
+	action     Action           // next user action
+	ctx        interface{}      // user-defined context
+	addrIndex  int              // index of listening address
+	localAddr  net.Addr         // local addre
+	remoteAddr net.Addr         // remote addr
+	loop       *loop            // connected loop
+	timers     connTimers       // scheduled callbacks
+	stream     InputStream      // input stream for the React event
+	proxyWait  bool             // waiting for the PROXY protocol header
+	proxy      *ProxyHeader     // PROXY protocol header
+	pending    []byte           // input read ahead of the Opened event
+	admitted   bool             // counted by the server limiter
+	ip         net.IP           // source IP for the limiter
+	outlen     int              // output length accounted as pending
+	files      []*outFile       // files to write after out
+}
+
+// outFile is a part of a file to write to a connection, followed by the
+// output queued after it.
+type outFile struct {
+	f     *os.File
+	off   int64
+	n     int64
+	after []byte
+}
+
+func (c *conn) Context() interface{}       { return c.ctx }
+func (c *conn) SetContext(ctx interface{}) { c.ctx = ctx }
+func (c *conn) AddrIndex() int             { return c.addrIndex }
+func (c *conn) LocalAddr() net.Addr        { return c.localAddr }
+func (c *conn) RemoteAddr() net.Addr       { return c.remoteAddr }
+func (c *conn) Outbound() bool             { return c.outbound }
+func (c *conn) ProxyHeader() *ProxyHeader  { return c.proxy }
+func (c *conn) inputStream() *InputStream  { return &c.stream }
+func (c *conn) SendFile(out []byte, f *os.File, offset, count int64) error {
+	c.write(out)
+	if count <= 0 {
+		return f.Close()
+	}
+	c.files = append(c.files, &outFile{f: f, off: offset, n: count})
+	return nil
+}
+
+// write queues the output of an event after the pending files.
+func (c *conn) write(out []byte) {
+	if n := len(c.files); n > 0 {
+		c.files[n-1].after = append(c.files[n-1].after, out...)
+	} else {
+		c.out = append(c.out, out...)
+	}
+}
+
+// writing reports whether the connection has output to write.
+func (c *conn) writing() bool {
+	return len(c.out) != 0 || len(c.files) != 0
+}
+
+// closeFiles closes the files not written.
+func (c *conn) closeFiles() {
+	for _, f := range c.files {
+		f.f.Close()
+	}
+	c.files = nil
+}
+func (c *conn) Wake() {
+	if c.loop != nil {
+		c.loop.poll.Trigger(c)
+	}
+}
+func (c *conn) AfterFunc(d time.Duration, fn func(c Conn) (out []byte, action Action)) Timer {
+	if c.loop == nil {
+		return stoppedTimer{}
+	}
+	l := c.loop
+	t := l.timers.schedule(d, func() error {
+		return loopTimer(l.svr, l, c, fn)
+	})
+	c.timers.add(t)
+	return t
+}
+
+type server struct {
+	events   Events         // user events
+	loops    []*loop        // all the loops
+	lns      []*listener    // all the listeners
+	wg       sync.WaitGroup // loop close waitgroup
+	cond     *sync.Cond     // shutdown signaler
+	balance  LoadBalance    // load balancing method
+	accepted uintptr        // accept counter
+	dialed   uintptr        // dial counter
+	drained  int32          // number of drained loops
+	detached int32          // number of loops that stopped accepting
+	drainset int32          // set once the server starts draining
+	dialmu   sync.Mutex     // guards closed against the dials
+	closed   bool           // the loops are stopped, set under dialmu
+	sessions int32          // number of UDP sessions
+	cfg      *config        // server configuration
+	lim      *limiter       // connection limits
+	counters *counters      // loop and listener counters
+}
+
+type loop struct {
+	idx      int           // loop index in the server loops list
+	poll     *src.Poll     // epoll or kqueue
+	packet   []byte        // read packet buffer
+	fdconns  map[int]*conn // loop connections fd -> conn
+	count    int32         // connection count
+	timers   timerHeap     // scheduled callbacks
+	svr      *server       // owner server
+	drain    int           // 0: serving, 1: draining, 2: drained
+	sessions *udpSessions  // UDP sessions, nil when disabled
+	udp      *src.UDPBatch // UDP datagram batch, nil without UDP listeners
+}
+
+// waitForShutdown waits for a signal to shutdown
+func (s *server) waitForShutdown() {
+	s.cond.L.Lock()
+	s.cond.Wait()
+	s.cond.L.Unlock()
+}
+
+// signalShutdown signals a shutdown an begins server closing
+func (s *server) signalShutdown() {
+	s.cond.L.Lock()
+	s.cond.Signal()
+	s.cond.L.Unlock()
+}
+
+func serve(events Events, listeners []*listener, cfg *config) error {
+	// figure out the correct number of loops/goroutines to use.
+	numLoops := events.NumLoops
+	if numLoops <= 0 {
+		if numLoops == 0 {
+			numLoops = 1
+		} else {
+			numLoops = runtime.NumCPU()
+		}
+	}
+
+	s := &server{}
+	s.events = events
+	s.lns = listeners
+	s.cond = sync.NewCond(&sync.Mutex{})
+	s.balance = events.LoadBalance
+	s.cfg = cfg
+	s.lim = newLimiter(cfg, listeners)
+	s.counters = newCounters(numLoops, len(listeners))
+
+	// create loops locally and bind the listeners.
+	for i := 0; i < numLoops; i++ {
+		l := &loop{
+			idx:     i,
+			poll:    src.OpenPoll(),
+			packet:  make([]byte, 0xFFFF),
+			fdconns: make(map[int]*conn),
+			svr:     s,
+		}
+		l.timers.gauge = &s.counters.loops[i].timers
+		l.sessions = newUDPSessions(events, cfg, &s.sessions, &l.timers)
+		for _, ln := range listeners {
+			l.poll.AddRead(ln.fd)
+			if ln.pConn != nil && l.udp == nil {
+				l.udp = src.NewUDPBatch(cfg.udpBatchSize)
+			}
+		}
+		s.loops = append(s.loops, l)
+	}
+
+	//println("-- server starting")
+	if s.events.Serving != nil {
+		var svr Server
+		svr.NumLoops = numLoops
+		svr.Addresses = make([]net.Addr, len(listeners))
+		for i, ln := range listeners {
+			svr.Addresses[i] = ln.lnAddr
+		}
+		svr.ctl = s
+		action := s.events.Serving(svr)
+		switch action {
+		case None:
+		case Shutdown:
+			for _, l := range s.loops {
+				l.poll.Close()
+			}
+			s.lim.reserve.close()
+			return nil
+		}
+	}
+
+	var stopUpgrade func()
+	defer func() {
+		// wait on a signal for shutdown
+		s.waitForShutdown()
+		if stopUpgrade != nil {
+			stopUpgrade()
+		}
+
+		// notify all loops to close by closing all listeners
+		for _, l := range s.loops {
+			l.poll.Trigger(errClosing)
+		}
+
+		// wait on all loops to complete reading events
+		s.wg.Wait()
+
+		// refuse the later dials, and close the sockets of the dials no
+		// loop has registered
+		s.dialmu.Lock()
+		s.closed = true
+		s.dialmu.Unlock()
+		for _, l := range s.loops {
+			for _, note := range l.poll.Notes() {
+				if v, ok := note.(dialReq); ok {
+					syscall.Close(v.c.fd)
+				}
+			}
+		}
+
+		// close loops and all outstanding connections
+		for _, l := range s.loops {
+			for _, c := range l.fdconns {
+				loopCloseConn(s, l, c, nil)
+			}
+			if l.sessions != nil {
+				l.sessions.closeAll()
+			}
+			l.poll.Close()
+		}
+		s.lim.reserve.close()
+		//println("-- server stopped")
+	}()
+
+	if cfg.upgradeSignal != nil {
+		// the watch is stopped by the shutdown above
+		stopUpgrade = watchUpgradeSignal(cfg.upgradeSignal, s)
+	}
+
+	// start loops in background
+	s.wg.Add(len(s.loops))
+	for _, l := range s.loops {
+		go loopRun(s, l)
+	}
+	return nil
+}
+
+// dial creates a non-blocking outbound socket and hands it over to the
+// next loop. The connection is opened by the loop once the connect
+// completes. The host names are resolved on a goroutine, as Dial may be
+// called from the loops, and their errors are reported by the Closed event.
+func (s *server) dial(network, addr string, ctx interface{}) error {
+	switch network {
+	case "tcp", "tcp4", "tcp6", "unix":
+	default:
+		return net.UnknownNetworkError(network)
+	}
+	s.dialmu.Lock()
+	closed := s.closed
+	s.dialmu.Unlock()
+	if closed {
+		return ErrServerClosed
+	}
+	l := s.loops[int(atomic.AddUintptr(&s.dialed, 1))%len(s.loops)]
+	c := &conn{fd: -1, lnidx: -1, loop: l, outbound: true, ctx: ctx}
+	if isHostName(network, addr) {
+		go func() {
+			if err := s.connect(c, network, addr); err != nil {
+				s.dialmu.Lock()
+				if !s.closed {
+					l.poll.Trigger(&dialFailed{c, err})
+				}
+				s.dialmu.Unlock()
+			}
+		}()
+		return nil
+	}
+	return s.connect(c, network, addr)
+}
+
+// connect starts the connect of an outbound connection and hands it over
+// to its loop.
+func (s *server) connect(c *conn, network, addr string) error {
+	sa, domain, err := src.ResolveSockaddr(network, addr)
+	if err != nil {
+		return err
+	}
+	syscall.ForkLock.RLock()
+	fd, err := syscall.Socket(domain, syscall.SOCK_STREAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fd)
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return err
+	}
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+	if err := syscall.Connect(fd, sa); err != nil && err != syscall.EINPROGRESS {
+		syscall.Close(fd)
+		return err
+	}
+	c.fd, c.sa = fd, sa
+	s.dialmu.Lock()
+	defer s.dialmu.Unlock()
+	if s.closed {
+		err = ErrServerClosed
+	} else {
+		err = c.loop.poll.Trigger(dialReq{c})
+	}
+	if err != nil {
+		syscall.Close(fd)
+	}
+	return err
+}
+
+// isHostName reports whether the TCP address has a host name to resolve,
+// rather than an IP address.
+func isHostName(network, addr string) bool {
+	if network == "unix" {
+		return false
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return false
+	}
+	if i := strings.LastIndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+	return net.ParseIP(host) == nil
+}
+
+// shutdown notifies the first loop to close, which closes the server.
+func (s *server) shutdown() {
+	s.loops[0].poll.Trigger(errClosing)
+}
+
+// drain notifies all the loops to stop accepting connections.
+func (s *server) drain() {
+	if atomic.CompareAndSwapInt32(&s.drainset, 0, 1) && s.events.Draining != nil {
+		s.events.Draining()
+	}
+	for _, l := range s.loops {
+		l.poll.Trigger(drainReq{})
+	}
+}
+
+func (s *server) draining() bool {
+	return atomic.LoadInt32(&s.drainset) != 0
+}
+
+// rejections returns the counts of the connections refused by the limits.
+func (s *server) rejections() Rejections {
+	return s.lim.rejections()
+}
+
+func (s *server) stats() Stats {
+	return s.counters.snapshot(s.lns, s.lim)
+}
+
+// upgrade hands the listeners over to a new process and drains the server.
+func (s *server) upgrade() error {
+	if err := startUpgrade(s.lns); err != nil {
+		return err
+	}
+	s.drain()
+	return nil
+}
+
+// dialReq is a loop note that registers an outbound connection.
+type dialReq struct {
+	c *conn
+}
+
+// dialFailed is a loop note of an outbound connection that failed before
+// its connect started.
+type dialFailed struct {
+	c   *conn
+	err error
+}
+
+// udpReq is a datagram passed to the loop that owns the peer session.
+type udpReq struct {
+	key udpKey
+	fd  int
+	sa  syscall.Sockaddr
+	in  []byte
+}
+
+// loopForget removes the connection from the loop.
+func loopForget(s *server, l *loop, c *conn) {
+	atomic.AddInt32(&l.count, -1)
+	delete(l.fdconns, c.fd)
+	c.timers.stop()
+	if c.admitted {
+		c.admitted = false
+		s.lim.release(c.lnidx, c.ip)
+	}
+	s.counters.closed(l.idx, c.lnidx)
+	s.counters.pending(l.idx, -c.outlen)
+	c.outlen = 0
+	c.closeFiles()
+}
+
+// loopOutput accounts the change of the connection output as pending.
+func loopOutput(s *server, l *loop, c *conn) {
+	if n := len(c.out); n != c.outlen {
+		s.counters.pending(l.idx, n-c.outlen)
+		c.outlen = n
+	}
+}
+
+func loopCloseConn(s *server, l *loop, c *conn, err error) error {
+	loopForget(s, l, c)
+	syscall.Close(c.fd)
+	if s.events.Closed != nil {
+		switch s.events.Closed(c, err) {
+		case None:
+		case Shutdown:
+			return errClosing
+		}
+	}
+	return loopDrained(s, l)
+}
+
+// loopRejectConn closes a connection that has not been opened yet, without
+// firing the Closed event.
+func loopRejectConn(s *server, l *loop, c *conn) error {
+	loopForget(s, l, c)
+	syscall.Close(c.fd)
+	return loopDrained(s, l)
+}
+
+func loopDetachConn(s *server, l *loop, c *conn, err error) error {
+	if s.events.Detached == nil {
+		return loopCloseConn(s, l, c, err)
+	}
+	l.poll.ModDetach(c.fd)
+
+	loopForget(s, l, c)
+	if err := syscall.SetNonblock(c.fd, false); err != nil {
+		return err
+	}
+	switch s.events.Detached(c, &detachedConn{fd: c.fd}) {
+	case None:
+	case Shutdown:
+		return errClosing
+	}
+	return loopDrained(s, l)
+}
+
+// loopDrain stops accepting connections on the loop.
+func loopDrain(s *server, l *loop) error {
+	if l.drain != 0 {
+		return nil
+	}
+	l.drain = 1
+	for _, ln := range s.lns {
+		l.poll.DelRead(ln.fd)
+	}
+	if int(atomic.AddInt32(&s.detached, 1)) == len(s.loops) {
+		// no loop polls the listeners anymore
+		for _, ln := range s.lns {
+			ln.close()
+		}
+	}
+	if l.idx == 0 && s.cfg.drainTimeout > 0 {
+		l.timers.schedule(s.cfg.drainTimeout, func() error {
+			return errClosing
+		})
+	}
+	return loopDrained(s, l)
+}
+
+// loopDrained marks a draining loop as drained once it has no connections
+// left. The server shutdowns when all of the loops are drained.
+func loopDrained(s *server, l *loop) error {
+	if l.drain != 1 || atomic.LoadInt32(&l.count) != 0 {
+		return nil
+	}
+	l.drain = 2
+	if int(atomic.AddInt32(&s.drained, 1)) == len(s.loops) {
+		return errClosing
+	}
+	return nil
+}
+
+func loopNote(s *server, l *loop, note interface{}) error {
+	var err error
+	if note == nil {
+		s.counters.wakeup(l.idx)
+	} else {
+		s.counters.note(l.idx)
+	}
+	switch v := note.(type) {
+	case nil: // poll wakeup
+		err = l.timers.expire()
+		if l.udp != nil {
+			l.udp.Flush()
+		}
+	case error: // shutdown
+		err = v
+	case *conn:
+		// Wake called for connection
+		if l.fdconns[v.fd] != v {
+			return nil // ignore stale wakes
+		}
+		return loopWake(s, l, v)
+	case drainReq:
+		return loopDrain(s, l)
+	case *udpReq:
+		err = loopUDPSession(s, l, v)
+		l.udp.Flush()
+	case dialReq:
+		// outbound connection, opened once the connect completes
+		l.fdconns[v.c.fd] = v.c
+		l.poll.AddReadWrite(v.c.fd)
+		atomic.AddInt32(&l.count, 1)
+		s.counters.opened(l.idx, -1)
+	case *dialFailed:
+		s.counters.dialError(l.idx)
+		if s.events.Closed != nil {
+			switch s.events.Closed(v.c, v.err) {
+			case Shutdown:
+				err = errClosing
+			}
+		}
+	}
+	return err
+}
+
+func loopRun(s *server, l *loop) {
+	defer func() {
+		//fmt.Println("-- loop stopped --", l.idx)
+		s.signalShutdown()
+		s.wg.Done()
+	}()
+
+	if l.idx == 0 && s.events.Tick != nil {
+		l.timers.schedule(0, func() error {
+			return loopTick(s, l)
+		})
+	}
+
+	//fmt.Println("-- loop started --", l.idx)
+	l.poll.Wait(l.timers.next, func(fd int, note interface{}) error {
+		if fd == 0 {
+			return loopNote(s, l, note)
+		}
+		c := l.fdconns[fd]
+		switch {
+		case c == nil:
+			return loopAccept(s, l, fd)
+		case c.proxyWait:
+			return loopProxyRead(s, l, c)
+		case !c.opened:
+			return loopOpened(s, l, c)
+		case c.writing():
+			return loopWrite(s, l, c)
+		case c.action != None:
+			return loopAction(s, l, c)
+		default:
+			return loopRead(s, l, c)
+		}
+	})
+}
+
+// loopTick fires the Tick event and schedules the next one on the loop
+// timer heap.
+func loopTick(s *server, l *loop) error {
+	delay, action := s.events.Tick()
+	switch action {
+	case None:
+	case Shutdown:
+		return errClosing
+	}
+	l.timers.schedule(delay, func() error {
+		return loopTick(s, l)
+	})
+	return nil
+}
+
+// loopTimer fires a connection timer scheduled with AfterFunc.
+func loopTimer(s *server, l *loop, c *conn, fn func(c Conn) (out []byte, action Action)) error {
+	if l.fdconns[c.fd] != c {
+		return nil // ignore stale timers
+	}
+	out, action := fn(c)
+	if len(out) > 0 {
+		c.write(out)
+	}
+	if action != None {
+		c.action = action
+	}
+	loopOutput(s, l, c)
+	if c.writing() || c.action != None {
+		l.poll.ModReadWrite(c.fd)
+	}
+	return nil
+}
+
+func loopAccept(s *server, l *loop, fd int) error {
+	if l.drain != 0 {
+		return nil
+	}
+	for i, ln := range s.lns {
+		if ln.fd == fd {
+			if len(s.loops) > 1 {
+				switch s.balance {
+				case LeastConnections:
+					n := atomic.LoadInt32(&l.count)
+					for _, lp := range s.loops {
+						if lp.idx != l.idx {
+							if atomic.LoadInt32(&lp.count) < n {
+								return nil // do not accept
+							}
+						}
+					}
+				case RoundRobin:
+					idx := int(atomic.LoadUintptr(&s.accepted)) % len(s.loops)
+					if idx != l.idx {
+						return nil // do not accept
+					}
+					atomic.AddUintptr(&s.accepted, 1)
+				}
+			}
+			if ln.pConn != nil {
+				return loopUDPRead(s, l, i, fd)
+			}
+			nfd, sa, err := syscall.Accept(fd)
+			if err != nil {
+				if err == syscall.EAGAIN {
+					return nil
+				}
+				s.counters.acceptError(l.idx)
+				switch {
+				case err == syscall.EINTR, err == syscall.ECONNABORTED,
+					err == syscall.EPROTO, err == syscall.EPERM:
+					return nil
+				case isFdExhausted(err):
+					return loopAcceptExhausted(s, l, fd)
+				}
+				return err
+			}
+			ip := sockaddrIP(sa)
+			if err := s.lim.admit(i, ip); err != nil {
+				syscall.Close(nfd)
+				return loopRejected(s, src.SockaddrToAddr(sa), err)
+			}
+			if err := syscall.SetNonblock(nfd, true); err != nil {
+				syscall.Close(nfd)
+				s.lim.release(i, ip)
+				return nil
+			}
+			c := &conn{fd: nfd, sa: sa, lnidx: i, loop: l, admitted: true, ip: ip}
+			c.out = nil
+			l.fdconns[c.fd] = c
+			if ln.opts.proxyProto {
+				// the connection opens once the header is read
+				c.proxyWait = true
+				l.poll.AddRead(c.fd)
+				c.timers.add(l.timers.schedule(proxyHeaderTimeout, func() error {
+					return loopRejectConn(s, l, c)
+				}))
+			} else {
+				l.poll.AddReadWrite(c.fd)
+			}
+			atomic.AddInt32(&l.count, 1)
+			s.counters.opened(l.idx, i)
+			break
+		}
+	}
+	return nil
+}
+
+// loopRejected fires the Rejected event.
+func loopRejected(s *server, addr net.Addr, reason error) error {
+	if s.events.Rejected != nil {
+		switch s.events.Rejected(addr, reason) {
+		case Shutdown:
+			return errClosing
+		}
+	}
+	return nil
+}
+
+// loopAcceptExhausted closes a pending connection with the spare file
+// descriptor, or pauses accepting on the loop for a while.
+func loopAcceptExhausted(s *server, l *loop, fd int) error {
+	if s.lim.exhausted(func() bool {
+		nfd, _, err := syscall.Accept(fd)
+		if err != nil {
+			return false
+		}
+		syscall.Close(nfd)
+		return true
+	}) {
+		return nil
+	}
+	l.poll.DelRead(fd)
+	l.timers.schedule(acceptBackoff, func() error {
+		if l.drain == 0 {
+			l.poll.AddRead(fd)
+		}
+		return nil
+	})
+	return nil
+}
+
+// sockaddrIP returns the IP address of an inet socket address.
+func sockaddrIP(sa syscall.Sockaddr) net.IP {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return append(net.IP{}, sa.Addr[:]...)
+	case *syscall.SockaddrInet6:
+		return append(net.IP{}, sa.Addr[:]...)
+	}
+	return nil
+}
+
+func loopUDPRead(s *server, l *loop, lnidx, fd int) error {
+	var err error
+	l.udp.Read(fd, func(p []byte, sa syscall.Sockaddr) {
+		if err != nil {
+			return
+		}
+		if rerr := s.lim.allowed(lnidx, sockaddrIP(sa)); rerr != nil {
+			err = loopRejected(s, src.SockaddrToUDPAddr(sa), rerr)
+			return
+		}
+		s.counters.read(l.idx, lnidx, len(p))
+		if s.events.Data != nil {
+			err = loopUDPPacket(s, l, lnidx, fd, append([]byte{}, p...), sa)
+		}
+	})
+	l.udp.Flush()
+	return err
+}
+
+// loopUDPPacket fires the events for a datagram.
+func loopUDPPacket(s *server, l *loop, lnidx, fd int, in []byte, sa syscall.Sockaddr) error {
+	if l.sessions != nil {
+		r := &udpReq{key: udpSockaddrKey(lnidx, sa), fd: fd, sa: sa, in: in}
+		if owner := r.key.loop(len(s.loops)); owner != l.idx {
+			return s.loops[owner].poll.Trigger(r)
+		}
+		return loopUDPSession(s, l, r)
+	}
+	c := &conn{}
+	c.addrIndex = lnidx
+	c.localAddr = s.lns[lnidx].lnAddr
+	c.remoteAddr = src.SockaddrToUDPAddr(sa)
+	out, action := s.events.Data(c, in)
+	if len(out) > 0 {
+		loopUDPWrite(s, l, lnidx, fd, out, sa)
+	}
+	switch action {
+	case Shutdown:
+		return errClosing
+	}
+	return nil
+}
+
+// loopUDPSession fires the session events for a datagram.
+func loopUDPSession(s *server, l *loop, r *udpReq) error {
+	laddr := s.lns[r.key.lnidx].lnAddr
+	return l.sessions.datagram(r.key, laddr, src.SockaddrToUDPAddr(r.sa), r.in, func(out []byte) {
+		loopUDPWrite(s, l, r.key.lnidx, r.fd, out, r.sa)
+	})
+}
+
+// loopUDPWrite queues a datagram on the loop batch, which is flushed once
+// the current event is handled.
+func loopUDPWrite(s *server, l *loop, lnidx, fd int, out []byte, sa syscall.Sockaddr) {
+	if s.events.PreWrite != nil {
+		s.events.PreWrite()
+	}
+	s.counters.wrote(l.idx, lnidx, len(out))
+	l.udp.Queue(fd, out, sa, s.lns[lnidx].opts.gso)
+}
+
+// udpSockaddrKey returns the session key of the peer. IPv4 addresses are
+// mapped to IPv6, like udpAddrKey does.
+func udpSockaddrKey(lnidx int, sa syscall.Sockaddr) udpKey {
+	k := udpKey{lnidx: lnidx}
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		copy(k.ip[:], net.IP(sa.Addr[:]).To16())
+		k.port = sa.Port
+	case *syscall.SockaddrInet6:
+		k.ip = sa.Addr
+		k.port = sa.Port
+		if sa.ZoneId != 0 {
+			k.zone = strconv.Itoa(int(sa.ZoneId))
+		}
+	}
+	return k
+}
+
+func loopOpened(s *server, l *loop, c *conn) error {
+	if c.outbound {
+		errno, err := syscall.GetsockoptInt(c.fd, syscall.SOL_SOCKET, syscall.SO_ERROR)
+		if err == nil && errno != 0 {
+			err = syscall.Errno(errno)
+		}
+		if err != nil {
+			s.counters.dialError(l.idx)
+			return loopCloseConn(s, l, c, err)
+		}
+		sa, _ := syscall.Getsockname(c.fd)
+		c.localAddr = src.SockaddrToAddr(sa)
+	} else {
+		c.localAddr = s.lns[c.lnidx].lnAddr
+	}
+	c.opened = true
+	c.addrIndex = c.lnidx
+	c.remoteAddr = src.SockaddrToAddr(c.sa)
+	if c.proxy != nil && c.proxy.SourceAddr != nil {
+		c.remoteAddr = c.proxy.SourceAddr
+		c.localAddr = c.proxy.DestAddr
+	}
+	if s.events.Opened != nil {
+		out, opts, action := s.events.Opened(c)
+		if len(out) > 0 {
+			c.write(out)
+		}
+		c.action = action
+		c.reuse = opts.ReuseInputBuffer
+		if _, ok := c.sa.(*syscall.SockaddrUnix); !ok {
+			setSockOptions(c.fd, opts)
+		}
+	}
+	if len(c.pending) > 0 && c.action == None && s.events.Data != nil {
+		// the input that followed the PROXY protocol header
+		in := c.pending
+		c.pending = nil
+		out, action := s.events.Data(c, in)
+		c.action = action
+		if len(out) > 0 {
+			c.write(out)
+		}
+	}
+	loopOutput(s, l, c)
+	if !c.writing() && c.action == None {
+		l.poll.ModRead(c.fd)
+	}
+	return nil
+}
+
+// loopProxyRead reads the PROXY protocol header of a new connection.
+func loopProxyRead(s *server, l *loop, c *conn) error {
+	n, err := syscall.Read(c.fd, l.packet)
+	if n == 0 || err != nil {
+		if err == syscall.EAGAIN {
+			return nil
+		}
+		if err != nil {
+			s.counters.readError(l.idx)
+		}
+		return loopRejectConn(s, l, c)
+	}
+	s.counters.read(l.idx, c.lnidx, n)
+	c.pending = append(c.pending, l.packet[:n]...)
+	hdr, hlen, err := parseProxyHeader(c.pending)
+	if err != nil {
+		return loopRejectConn(s, l, c)
+	}
+	if hdr == nil {
+		return nil
+	}
+	c.timers.stop()
+	c.proxyWait = false
+	c.proxy = hdr
+	c.pending = c.pending[hlen:]
+	l.poll.ModReadWrite(c.fd)
+	return nil
+}
+
+func loopWrite(s *server, l *loop, c *conn) error {
+	if s.events.PreWrite != nil {
+		s.events.PreWrite()
+	}
+	if len(c.out) == 0 {
+		return loopSendFile(s, l, c)
+	}
+	n, err := syscall.Write(c.fd, c.out)
+	if err != nil {
+		if err == syscall.EAGAIN {
+			return nil
+		}
+		s.counters.writeError(l.idx)
+		return loopCloseConn(s, l, c, err)
+	}
+	s.counters.wrote(l.idx, c.lnidx, n)
+	if n == len(c.out) {
+		// release the connection output page if it goes over page size,
+		// otherwise keep reusing existing page.
+		if cap(c.out) > 4096 {
+			c.out = nil
+		} else {
+			c.out = c.out[:0]
+		}
+	} else {
+		c.out = c.out[n:]
+	}
+	loopOutput(s, l, c)
+	if !c.writing() && c.action == None {
+		l.poll.ModRead(c.fd)
+	}
+	return nil
+}
+
+// loopSendFile writes the next file of the connection output.
+func loopSendFile(s *server, l *loop, c *conn) error {
+	f := c.files[0]
+	n, err := sendFile(c.fd, f, l.packet)
+	if err == nil && n == 0 {
+		// the file is shorter than the count
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		if err == syscall.EAGAIN {
+			return nil
+		}
+		s.counters.writeError(l.idx)
+		return loopCloseConn(s, l, c, err)
+	}
+	s.counters.wrote(l.idx, c.lnidx, n)
+	if f.n -= int64(n); f.n == 0 {
+		f.f.Close()
+		c.files[0] = nil
+		c.files = c.files[1:]
+		if len(c.files) == 0 {
+			c.files = nil
+		}
+		c.out = append(c.out, f.after...)
+	}
+	loopOutput(s, l, c)
+	if !c.writing() && c.action == None {
+		l.poll.ModRead(c.fd)
+	}
+	return nil
+}
+
+// copyFile writes the file from the buffer, when sendfile(2) is not
+// available.
+func copyFile(fd int, f *outFile, buf []byte) (int, error) {
+	if int64(len(buf)) > f.n {
+		buf = buf[:f.n]
+	}
+	n, err := f.f.ReadAt(buf, f.off)
+	if n == 0 {
+		if err == io.EOF {
+			err = nil
+		}
+		return 0, err
+	}
+	n, err = syscall.Write(fd, buf[:n])
+	if err != nil {
+		return 0, err
+	}
+	f.off += int64(n)
+	return n, nil
+}
+
+func loopAction(s *server, l *loop, c *conn) error {
+	switch c.action {
+	default:
+		c.action = None
+	case Close:
+		return loopCloseConn(s, l, c, nil)
+	case Shutdown:
+		return errClosing
+	case Detach:
+		return loopDetachConn(s, l, c, nil)
+	}
+	if !c.writing() && c.action == None {
+		l.poll.ModRead(c.fd)
+	}
+	return nil
+}
+
+func loopWake(s *server, l *loop, c *conn) error {
+	if s.events.Data == nil {
+		return nil
+	}
+	out, action := s.events.Data(c, nil)
+	c.action = action
+	if len(out) > 0 {
+		// a wake may come while the previous output is still pending
+		c.write(out)
+	}
+	loopOutput(s, l, c)
+	if c.writing() || c.action != None {
+		l.poll.ModReadWrite(c.fd)
+	}
+	return nil
+}
+
+func loopRead(s *server, l *loop, c *conn) error {
+	var in []byte
+	n, err := syscall.Read(c.fd, l.packet)
+	if n == 0 || err != nil {
+		if err == syscall.EAGAIN {
+			return nil
+		}
+		if err != nil {
+			s.counters.readError(l.idx)
+		}
+		return loopCloseConn(s, l, c, err)
+	}
+	s.counters.read(l.idx, c.lnidx, n)
+	in = l.packet[:n]
+	if !c.reuse {
+		in = append([]byte{}, in...)
+	}
+	if s.events.Data != nil {
+		out, action := s.events.Data(c, in)
+		c.action = action
+		if len(out) > 0 {
+			c.write(out)
+		}
+	}
+	loopOutput(s, l, c)
+	if c.writing() || c.action != None {
+		l.poll.ModReadWrite(c.fd)
+	}
+	return nil
+}
+
+type detachedConn struct {
+	fd int
+}
+
+func (c *detachedConn) Close() error {
+	err := syscall.Close(c.fd)
+	if err != nil {
+		return err
+	}
+	c.fd = -1
+	return nil
+}
+
+func (c *detachedConn) Read(p []byte) (n int, err error) {
+	n, err = syscall.Read(c.fd, p)
+	if err != nil {
+		return n, err
+	}
+	if n == 0 {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func (c *detachedConn) Write(p []byte) (n int, err error) {
+	n = len(p)
+	for len(p) > 0 {
+		nn, err := syscall.Write(c.fd, p)
+		if err != nil {
+			return n, err
+		}
+		p = p[nn:]
+	}
+	return n, nil
+}
+
+func (ln *listener) close() {
+	if ln.fd != 0 {
+		syscall.Close(ln.fd)
+		ln.fd = 0
+	}
+	if ln.f != nil {
+		ln.f.Close()
+		ln.f = nil
+	}
+	if ln.ln != nil {
+		ln.ln.Close()
+	}
+	if ln.pConn != nil {
+		ln.pConn.Close()
+	}
+	if ln.network == "unix" && !ln.inherited && atomic.LoadInt32(&ln.handedOff) == 0 {
+		removeUnixSocket(ln.addr)
+	}
+}
+
+// system takes the net listener and detaches it from it's parent
+// event loop, grabs the file descriptor, and makes it non-blocking.
+func (ln *listener) system() error {
+	var err error
+	switch netln := ln.ln.(type) {
+	case nil:
+		switch pconn := ln.pConn.(type) {
+		case *net.UDPConn:
+			ln.f, err = pconn.File()
+		}
+	case *net.TCPListener:
+		ln.f, err = netln.File()
+	case *net.UnixListener:
+		ln.f, err = netln.File()
+	}
+	if err != nil {
+		ln.close()
+		return err
+	}
+	ln.fd = int(ln.f.Fd())
+	if ln.pConn != nil && ln.opts.gro {
+		if err := src.SetUDPGRO(ln.fd); err != nil {
+			return err
+		}
+	}
+	return syscall.SetNonblock(ln.fd, true)
+}
+
+func reuseportListenPacket(proto, addr string) (l net.PacketConn, err error) {
+	return rp.ListenPacket(proto, addr)
+}
+
+func reuseportListen(proto, addr string) (l net.Listener, err error) {
+	return rp.Listen(proto, addr)
+}
@@ -0,0 +1,120 @@
+package evloop
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// Listen binds a stream listener for a server running apart from the event
+// loops, at an address in the form of the Serve addresses. A unix socket
+// gets the mode, owner and group query options, and an existing socket file
+// at the address is replaced, any other file is refused.
+func Listen(addr string) (net.Listener, error) {
+	network, address, opts, _, err := parseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if isUDP(network) {
+		return nil, fmt.Errorf("%s: not a stream address", addr)
+	}
+	if network == "unix" {
+		if err := removeUnixSocket(address); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" {
+		if err := setupUnixSocket(address, opts); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// isAbstractSocket reports whether the unix socket address is in the Linux
+// abstract namespace.
+func isAbstractSocket(addr string) bool {
+	return len(addr) > 0 && addr[0] == '@'
+}
+
+// removeUnixSocket removes the unix socket file at addr. It refuses to
+// remove a file that is not a socket.
+func removeUnixSocket(addr string) error {
+	if isAbstractSocket(addr) {
+		return nil
+	}
+	fi, err := os.Lstat(addr)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s: file exists and is not a socket", addr)
+	}
+	return os.Remove(addr)
+}
+
+// setupUnixSocket applies the mode and ownership address options to a bound
+// unix socket file.
+func setupUnixSocket(addr string, opts addrOpts) error {
+	if isAbstractSocket(addr) {
+		return nil
+	}
+	if opts.unixOwner != "" || opts.unixGroup != "" {
+		uid, gid := -1, -1
+		if opts.unixOwner != "" {
+			id, err := lookupUser(opts.unixOwner)
+			if err != nil {
+				return err
+			}
+			uid = id
+		}
+		if opts.unixGroup != "" {
+			id, err := lookupGroup(opts.unixGroup)
+			if err != nil {
+				return err
+			}
+			gid = id
+		}
+		if err := os.Chown(addr, uid, gid); err != nil {
+			return err
+		}
+	}
+	if opts.unixMode != 0 {
+		return os.Chmod(addr, opts.unixMode)
+	}
+	return nil
+}
+
+// lookupUser returns the uid of a user name or a numeric uid.
+func lookupUser(name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// lookupGroup returns the gid of a group name or a numeric gid.
+func lookupGroup(name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(g.Gid)
+}
@@ -0,0 +1,134 @@
+package evloop
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// upgradeEnv is the environment variable that passes the listener
+// addresses to the new process on upgrade. The listener file descriptors
+// follow the standard streams in the same order as the addresses.
+const upgradeEnv = "PURESERVER_UPGRADE_FDS"
+
+var errUpgradeListener = errors.New("listener can't be handed over")
+
+var upgraded struct {
+	once sync.Once
+	mu   sync.Mutex
+	fds  map[string]int
+}
+
+// upgradeFd returns the file descriptor that the parent process passed for
+// the address on upgrade. Every descriptor is only returned once.
+func upgradeFd(addr string) (int, bool) {
+	upgraded.once.Do(func() {
+		v := os.Getenv(upgradeEnv)
+		if v == "" {
+			return
+		}
+		upgraded.fds = make(map[string]int)
+		for i, name := range strings.Split(v, ",") {
+			if addr, err := url.QueryUnescape(name); err == nil {
+				upgraded.fds[addr] = listenFdsStart + i
+			}
+		}
+	})
+	upgraded.mu.Lock()
+	defer upgraded.mu.Unlock()
+	fd, ok := upgraded.fds[addr]
+	delete(upgraded.fds, addr)
+	return fd, ok
+}
+
+// file returns a duplicate of the listener file descriptor.
+func (ln *listener) file() (*os.File, error) {
+	switch l := ln.ln.(type) {
+	case *net.TCPListener:
+		return l.File()
+	case *net.UnixListener:
+		return l.File()
+	}
+	if pconn, ok := ln.pConn.(*net.UDPConn); ok {
+		return pconn.File()
+	}
+	return nil, errUpgradeListener
+}
+
+// startUpgrade starts a new process of the running binary with the same
+// arguments, which inherits all the listeners.
+func startUpgrade(lns []*listener) error {
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	var names []string
+	for _, ln := range lns {
+		f, err := ln.file()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		names = append(names, url.QueryEscape(ln.source))
+	}
+	path, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, upgradeEnv+"=") && !strings.HasPrefix(kv, "LISTEN_") {
+			env = append(env, kv)
+		}
+	}
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Env = append(env, upgradeEnv+"="+strings.Join(names, ","))
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// the new process owns the unix socket files now
+	for _, ln := range lns {
+		atomic.StoreInt32(&ln.handedOff, 1)
+		if l, ok := ln.ln.(*net.UnixListener); ok {
+			l.SetUnlinkOnClose(false)
+		}
+	}
+	return nil
+}
+
+// watchUpgradeSignal upgrades the server whenever the signal arrives,
+// until the returned stop func is called.
+func watchUpgradeSignal(sig os.Signal, ctl controller) (stop func()) {
+	ch := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(ch, sig)
+	go func() {
+		for {
+			select {
+			case <-ch:
+				if err := ctl.upgrade(); err != nil {
+					log.Printf("evloop: upgrade failed: %v", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(ch)
+		close(done)
+	}
+}
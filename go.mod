@@ -2,4 +2,9 @@ module github.com/konstantin-kukharev/pureserver
 
 go 1.16
 
-require github.com/gorilla/mux v1.8.0
+require (
+	github.com/gorilla/mux v1.8.0
+	golang.org/x/net v0.0.0-20201021035429-f5854403a974
+	google.golang.org/grpc v1.46.2
+	google.golang.org/protobuf v1.27.1
+)
@@ -0,0 +1,522 @@
+// Package grpcserver serves gRPC services over the HTTP/2 connections of a
+// pureserver.Server, apart from its router. The HTTP servers that don't
+// serve gRPC don't import it, nor grpc.
+package grpcserver
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/konstantin-kukharev/pureserver"
+	"github.com/konstantin-kukharev/pureserver/evloop"
+	"github.com/konstantin-kukharev/pureserver/internal/http"
+	"golang.org/x/net/http2/hpack"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultMaxRecvMsgSize limits the request messages when
+// Config.MaxRecvMsgSize is zero.
+const defaultMaxRecvMsgSize = 4 << 20
+
+// errFinished is returned when sending on a finished call.
+var errFinished = status.Error(codes.Canceled, "grpc: the call is finished")
+
+// Config configures the gRPC services, see New.
+type Config struct {
+	// Codec marshals the messages of the "application/grpc" and
+	// "application/grpc+proto" calls, the proto codec of grpc when nil.
+	// The other content subtypes use the codecs registered with the
+	// encoding package of grpc.
+	Codec encoding.Codec
+	// Interceptor is passed to the unary method handlers.
+	Interceptor grpc.UnaryServerInterceptor
+	// MaxRecvMsgSize limits the size of the request messages, 4MB when
+	// zero.
+	MaxRecvMsgSize int
+}
+
+// Server holds the registered services. It is a grpc.ServiceRegistrar for
+// the Register functions generated by protoc-gen-go-grpc.
+type Server struct {
+	cfg     Config
+	methods map[string]*method // by the full method name
+}
+
+type method struct {
+	name   string
+	impl   interface{}
+	unary  *grpc.MethodDesc
+	stream *grpc.StreamDesc
+}
+
+// New returns the gRPC server of the HTTP server. The calls are served over
+// HTTP/2, which is enabled with the default settings unless SetHTTP2 is
+// called. Every call runs its handler in a goroutine, the messages are
+// framed by the event loop of the connection.
+func New(server pureserver.Server, cfg Config) *Server {
+	gs := &Server{cfg: cfg, methods: make(map[string]*method)}
+	server.SetStreamHandler(gs)
+	return gs
+}
+
+// RegisterService registers the implementation of a gRPC service. It
+// panics when impl doesn't implement the HandlerType of the service.
+func (gs *Server) RegisterService(desc *grpc.ServiceDesc, impl interface{}) {
+	if desc.HandlerType != nil {
+		ht := reflect.TypeOf(desc.HandlerType).Elem()
+		if !reflect.TypeOf(impl).Implements(ht) {
+			panic(fmt.Sprintf("grpc: %T does not implement %v", impl, ht))
+		}
+	}
+	for i := range desc.Methods {
+		name := "/" + desc.ServiceName + "/" + desc.Methods[i].MethodName
+		gs.methods[name] = &method{name: name, impl: impl, unary: &desc.Methods[i]}
+	}
+	for i := range desc.Streams {
+		name := "/" + desc.ServiceName + "/" + desc.Streams[i].StreamName
+		gs.methods[name] = &method{name: name, impl: impl, stream: &desc.Streams[i]}
+	}
+}
+
+// Accept reports whether the request is a gRPC call, by its content type.
+func (gs *Server) Accept(req http.HttpRequestInterface) bool {
+	contentType := http.HeaderValue(req.GetHead(), "Content-Type")
+	return contentType == "application/grpc" || strings.HasPrefix(contentType, "application/grpc+") ||
+		strings.HasPrefix(contentType, "application/grpc;")
+}
+
+// codec returns the codec of the content subtype, nil when none is
+// registered.
+func (gs *Server) codec(subtype string) encoding.Codec {
+	if gs.cfg.Codec != nil && (subtype == "" || subtype == gs.cfg.Codec.Name()) {
+		return gs.cfg.Codec
+	}
+	if subtype == "" {
+		subtype = "proto"
+	}
+	return encoding.GetCodec(subtype)
+}
+
+// contentSubtype returns the subtype of a gRPC content type, like "proto"
+// of "application/grpc+proto".
+func contentSubtype(contentType string) string {
+	if !strings.HasPrefix(contentType, "application/grpc+") {
+		return ""
+	}
+	subtype := contentType[len("application/grpc+"):]
+	if i := strings.IndexByte(subtype, ';'); i >= 0 {
+		subtype = subtype[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(subtype))
+}
+
+// call is a gRPC call served by its handler in a goroutine. The response
+// parts are queued by the handler and pulled by the loop of the
+// connection, see Pull.
+type call struct {
+	gs          *Server
+	codec       encoding.Codec
+	contentType string
+	path        string
+	method      *method
+	conn        evloop.Conn
+	ctx         context.Context
+	cancel      context.CancelFunc
+	in          []byte // the request messages not received yet
+
+	mu       sync.Mutex
+	pulledc  *sync.Cond // signalled on a pull and when the call finishes
+	header   metadata.MD
+	trailer  metadata.MD
+	headers  []hpack.HeaderField // the response header to send
+	sent     bool                // the response header has been queued
+	out      []byte              // the framed messages to send
+	window   int                 // the bytes the flow control windows took at the last pull
+	trailers []hpack.HeaderField // the trailer to send once finished
+	finished bool
+	pulled   bool // the trailer has been pulled
+	woken    bool // a wake is pending
+	timer    *time.Timer
+}
+
+// transportStream is the grpc.ServerTransportStream of the call context,
+// which serves grpc.SetHeader, grpc.SendHeader and grpc.SetTrailer in the
+// unary handlers.
+type transportStream struct {
+	*call
+}
+
+func (ts transportStream) Method() string {
+	return ts.path
+}
+
+func (ts transportStream) SetTrailer(md metadata.MD) error {
+	ts.call.SetTrailer(md)
+	return nil
+}
+
+// Start starts the gRPC call of the complete request.
+func (gs *Server) Start(c evloop.Conn, req http.HttpRequestInterface) http.Stream {
+	head := req.GetHead()
+	subtype := contentSubtype(http.HeaderValue(head, "Content-Type"))
+	gc := &call{
+		gs:          gs,
+		codec:       gs.codec(subtype),
+		contentType: "application/grpc",
+		path:        req.GetPath().Path,
+		method:      gs.methods[req.GetPath().Path],
+		conn:        c,
+		in:          []byte(req.GetBody()),
+		header:      metadata.MD{},
+		trailer:     metadata.MD{},
+		// the loop pulls the call after the dispatch, there is nothing
+		// to wake before
+		woken: true,
+	}
+	if subtype != "" {
+		gc.contentType += "+" + subtype
+	}
+	gc.pulledc = sync.NewCond(&gc.mu)
+	ctx := metadata.NewIncomingContext(http.RequestContext(req), requestMetadata(head))
+	ctx = grpc.NewContextWithServerTransportStream(ctx, transportStream{gc})
+	if timeout, ok := parseTimeout(http.HeaderValue(head, "Grpc-Timeout")); ok {
+		ctx, gc.cancel = context.WithTimeout(ctx, timeout)
+		gc.timer = time.AfterFunc(timeout, func() {
+			gc.finish(status.Error(codes.DeadlineExceeded, "deadline exceeded"))
+		})
+	} else {
+		ctx, gc.cancel = context.WithCancel(ctx)
+	}
+	gc.ctx = ctx
+	switch enc := http.HeaderValue(head, "Grpc-Encoding"); {
+	case gc.method == nil:
+		gc.finish(status.Errorf(codes.Unimplemented, "unknown method %s", gc.path))
+	case gc.codec == nil:
+		gc.finish(status.Errorf(codes.Unimplemented, "content-subtype %s is not supported", subtype))
+	case enc != "" && enc != "identity":
+		gc.finish(status.Errorf(codes.Unimplemented, "grpc-encoding %s is not supported", enc))
+	default:
+		go gc.run()
+	}
+	return gc
+}
+
+// run runs the handler of the call.
+func (gc *call) run() {
+	defer func() {
+		if r := recover(); r != nil {
+			gc.finish(status.Errorf(codes.Internal, "panic: %v", r))
+		}
+	}()
+	m := gc.method
+	if m.stream != nil {
+		gc.finish(m.stream.Handler(m.impl, gc))
+		return
+	}
+	dec := func(v interface{}) error {
+		if err := gc.RecvMsg(v); err == io.EOF {
+			return status.Error(codes.Internal, "missing request message")
+		} else if err != nil {
+			return err
+		}
+		return nil
+	}
+	resp, err := m.unary.Handler(m.impl, gc.ctx, dec, gc.gs.cfg.Interceptor)
+	if err == nil {
+		err = gc.SendMsg(resp)
+	}
+	gc.finish(err)
+}
+
+func (gc *call) Context() context.Context {
+	return gc.ctx
+}
+
+func (gc *call) SetHeader(md metadata.MD) error {
+	if md.Len() == 0 {
+		return nil
+	}
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	if gc.sent || gc.finished {
+		return status.Error(codes.Internal, "grpc: the header has been sent")
+	}
+	for k, v := range md {
+		gc.header[strings.ToLower(k)] = append(gc.header[strings.ToLower(k)], v...)
+	}
+	return nil
+}
+
+func (gc *call) SendHeader(md metadata.MD) error {
+	if err := gc.SetHeader(md); err != nil {
+		return err
+	}
+	gc.mu.Lock()
+	if gc.sent || gc.finished {
+		gc.mu.Unlock()
+		return status.Error(codes.Internal, "grpc: the header has been sent")
+	}
+	gc.queueHeader()
+	c := gc.pendingWake()
+	gc.mu.Unlock()
+	if c != nil {
+		c.Wake()
+	}
+	return nil
+}
+
+func (gc *call) SetTrailer(md metadata.MD) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	for k, v := range md {
+		gc.trailer[strings.ToLower(k)] = append(gc.trailer[strings.ToLower(k)], v...)
+	}
+}
+
+// SendMsg queues the message. It blocks while the queued messages exceed
+// the flow control windows of the stream at the last pull, until the loop
+// pulls them.
+func (gc *call) SendMsg(m interface{}) error {
+	b, err := gc.codec.Marshal(m)
+	if err != nil {
+		return status.Errorf(codes.Internal, "marshal: %v", err)
+	}
+	n := len(b)
+	gc.mu.Lock()
+	for !gc.finished && len(gc.out) > 0 && len(gc.out)+5+n > gc.window {
+		gc.pulledc.Wait()
+	}
+	if gc.finished {
+		gc.mu.Unlock()
+		return errFinished
+	}
+	gc.queueHeader()
+	gc.out = append(gc.out, 0, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	gc.out = append(gc.out, b...)
+	c := gc.pendingWake()
+	gc.mu.Unlock()
+	if c != nil {
+		c.Wake()
+	}
+	return nil
+}
+
+func (gc *call) RecvMsg(m interface{}) error {
+	if len(gc.in) == 0 {
+		return io.EOF
+	}
+	if len(gc.in) < 5 {
+		return status.Error(codes.Internal, "truncated message")
+	}
+	if gc.in[0] != 0 {
+		return status.Error(codes.Unimplemented, "compressed messages are not supported")
+	}
+	n := int(gc.in[1])<<24 | int(gc.in[2])<<16 | int(gc.in[3])<<8 | int(gc.in[4])
+	max := gc.gs.cfg.MaxRecvMsgSize
+	if max <= 0 {
+		max = defaultMaxRecvMsgSize
+	}
+	if n > max {
+		return status.Errorf(codes.ResourceExhausted, "message larger than %d bytes", max)
+	}
+	if len(gc.in) < 5+n {
+		return status.Error(codes.Internal, "truncated message")
+	}
+	b := gc.in[5 : 5+n]
+	gc.in = gc.in[5+n:]
+	if err := gc.codec.Unmarshal(b, m); err != nil {
+		return status.Errorf(codes.Internal, "unmarshal: %v", err)
+	}
+	return nil
+}
+
+// queueHeader queues the response header. The caller must hold the lock.
+func (gc *call) queueHeader() {
+	if gc.sent {
+		return
+	}
+	gc.sent = true
+	gc.headers = append(gc.responseHeader(), metadataFields(gc.header)...)
+}
+
+func (gc *call) responseHeader() []hpack.HeaderField {
+	return []hpack.HeaderField{
+		{Name: ":status", Value: "200"},
+		{Name: "content-type", Value: gc.contentType},
+	}
+}
+
+// finish ends the call with the status of the error, once.
+func (gc *call) finish(err error) {
+	s, ok := status.FromError(err)
+	if !ok {
+		s = status.FromContextError(err)
+	}
+	gc.mu.Lock()
+	if gc.finished {
+		gc.mu.Unlock()
+		return
+	}
+	gc.finished = true
+	if gc.timer != nil {
+		gc.timer.Stop()
+	}
+	if !gc.sent {
+		// a trailers-only response
+		gc.sent = true
+		gc.trailers = append(gc.responseHeader(), metadataFields(gc.header)...)
+	}
+	gc.trailers = append(gc.trailers, hpack.HeaderField{Name: "grpc-status", Value: strconv.Itoa(int(s.Code()))})
+	if s.Message() != "" {
+		gc.trailers = append(gc.trailers, hpack.HeaderField{Name: "grpc-message", Value: percentEncode(s.Message())})
+	}
+	if p := s.Proto(); p != nil && len(p.Details) > 0 {
+		if b, err := proto.Marshal(p); err == nil {
+			gc.trailers = append(gc.trailers, hpack.HeaderField{Name: "grpc-status-details-bin", Value: base64.RawStdEncoding.EncodeToString(b)})
+		}
+	}
+	gc.trailers = append(gc.trailers, metadataFields(gc.trailer)...)
+	gc.pulledc.Broadcast()
+	c := gc.pendingWake()
+	gc.mu.Unlock()
+	if c != nil {
+		c.Wake()
+	}
+	gc.cancel()
+}
+
+// Abort cancels the call of a reset stream or a closed connection.
+func (gc *call) Abort() {
+	gc.mu.Lock()
+	gc.finished = true
+	if gc.timer != nil {
+		gc.timer.Stop()
+	}
+	gc.pulledc.Broadcast()
+	gc.mu.Unlock()
+	gc.cancel()
+}
+
+// pendingWake marks a wake pending and returns the connection to wake, or
+// nil when a wake is pending already. The caller must hold the lock and
+// wake the connection without it, as the loop takes it in Pull.
+func (gc *call) pendingWake() evloop.Conn {
+	if gc.woken {
+		return nil
+	}
+	gc.woken = true
+	return gc.conn
+}
+
+// Pull returns the response parts queued since the last pull, window is
+// the size the flow control windows of the stream take. The trailer is
+// returned once the call is finished.
+func (gc *call) Pull(window int) (headers []hpack.HeaderField, data []byte, trailers []hpack.HeaderField, done bool) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	gc.woken = false
+	headers, data = gc.headers, gc.out
+	gc.headers, gc.out = nil, nil
+	if gc.window = window - len(data); gc.window < 0 {
+		gc.window = 0
+	}
+	gc.pulledc.Broadcast()
+	if gc.finished && !gc.pulled {
+		gc.pulled = true
+		return headers, data, gc.trailers, true
+	}
+	return headers, data, nil, false
+}
+
+// metadataFields returns the header fields of the metadata, the values of the
+// binary keys are base64 encoded.
+func metadataFields(md metadata.MD) []hpack.HeaderField {
+	var fields []hpack.HeaderField
+	for k, values := range md {
+		for _, v := range values {
+			if strings.HasSuffix(k, "-bin") {
+				v = base64.RawStdEncoding.EncodeToString([]byte(v))
+			}
+			fields = append(fields, hpack.HeaderField{Name: k, Value: v})
+		}
+	}
+	return fields
+}
+
+// requestMetadata returns the metadata of the request head, without
+// the reserved headers. The values of the binary keys are decoded.
+func requestMetadata(head string) metadata.MD {
+	md := metadata.MD{}
+	for _, line := range strings.Split(head, "\r\n") {
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:i]))
+		switch {
+		case key == "content-type", key == "te", key == "host", strings.HasPrefix(key, "grpc-"):
+			continue
+		}
+		value := strings.TrimSpace(line[i+1:])
+		if strings.HasSuffix(key, "-bin") {
+			enc := base64.RawStdEncoding
+			if len(value)%4 == 0 {
+				enc = base64.StdEncoding
+			}
+			b, err := enc.DecodeString(value)
+			if err != nil {
+				continue
+			}
+			value = string(b)
+		}
+		md[key] = append(md[key], value)
+	}
+	return md
+}
+
+// parseTimeout parses the grpc-timeout header, like "100m".
+func parseTimeout(s string) (time.Duration, bool) {
+	if len(s) < 2 || len(s) > 9 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	unit := map[byte]time.Duration{
+		'H': time.Hour,
+		'M': time.Minute,
+		'S': time.Second,
+		'm': time.Millisecond,
+		'u': time.Microsecond,
+		'n': time.Nanosecond,
+	}[s[len(s)-1]]
+	if unit == 0 {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+// percentEncode encodes the grpc-message value.
+func percentEncode(s string) string {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c > 0x7e || c == '%' {
+			b = append(b, fmt.Sprintf("%%%02X", c)...)
+		} else {
+			b = append(b, c)
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,282 @@
+package http
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	mrand "math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AccessLogFormat is the format of the access log lines.
+type AccessLogFormat int
+
+const (
+	// LogCommon is the Common Log Format, followed by the duration in
+	// microseconds, the request ID and the matched route.
+	LogCommon AccessLogFormat = iota
+	// LogCombined is the Combined Log Format, with the same extra fields
+	// as LogCommon.
+	LogCombined
+	// LogJSON writes a JSON object per request.
+	LogJSON
+)
+
+// AccessLogger receives the access log entries as a message and key-value
+// pairs. A *slog.Logger satisfies the interface.
+type AccessLogger interface {
+	Info(msg string, args ...interface{})
+}
+
+// AccessLog configures the access log of the server.
+type AccessLog struct {
+	// Format is the format of the lines written to Output.
+	Format AccessLogFormat
+	// Output receives the log lines. Default is os.Stdout.
+	Output io.Writer
+	// Logger, when set, receives the entries instead of Output.
+	Logger AccessLogger
+	// SampleRate is the fraction of the requests that are logged, between
+	// 0 and 1. Zero logs every request.
+	SampleRate float64
+	// Skip lists the route patterns that are not logged, like health
+	// checks.
+	Skip []string
+	// BufferSize is the number of entries waiting to be written. Entries
+	// are dropped when the buffer is full, so that the event loop never
+	// blocks. Default is 1024.
+	BufferSize int
+}
+
+// accessEntry is a logged request.
+type accessEntry struct {
+	time      time.Time
+	remote    string
+	method    string
+	path      string
+	proto     string
+	status    int
+	bytes     int
+	duration  time.Duration
+	requestID string
+	route     string
+	referer   string
+	userAgent string
+}
+
+// accessLogger writes the access log entries in the background while the
+// server is running.
+type accessLogger struct {
+	cfg     AccessLog
+	skip    map[string]bool
+	mu      sync.RWMutex // guards entries against stop
+	entries chan *accessEntry
+	done    chan struct{}
+	dropped uint64
+	prefix  string // request ID prefix
+	seq     uint64 // request ID sequence
+}
+
+func newAccessLogger(cfg AccessLog) *accessLogger {
+	if cfg.Output == nil {
+		cfg.Output = os.Stdout
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = 1024
+	}
+	al := &accessLogger{
+		cfg:  cfg,
+		skip: make(map[string]bool),
+	}
+	for _, pat := range cfg.Skip {
+		al.skip[pat] = true
+	}
+	var p [6]byte
+	rand.Read(p[:])
+	al.prefix = hex.EncodeToString(p[:]) + "-"
+	return al
+}
+
+// start starts the writer of the entries.
+func (al *accessLogger) start() {
+	al.mu.Lock()
+	al.entries = make(chan *accessEntry, al.cfg.BufferSize)
+	al.done = make(chan struct{})
+	al.mu.Unlock()
+	go al.run(al.entries, al.done)
+}
+
+// stop writes the queued entries and stops the writer. The entries logged
+// afterwards are dropped.
+func (al *accessLogger) stop() {
+	al.mu.Lock()
+	entries, done := al.entries, al.done
+	al.entries = nil
+	al.mu.Unlock()
+	if entries != nil {
+		close(entries)
+		<-done
+	}
+}
+
+// requestID returns the X-Request-Id of the request, or a new ID.
+func (al *accessLogger) requestID(req HttpRequestInterface) string {
+	if id := headerValue(req.GetHead(), "X-Request-Id"); id != "" {
+		return id
+	}
+	return al.prefix + strconv.FormatUint(atomic.AddUint64(&al.seq, 1), 10)
+}
+
+// log queues the entry of a handled request, unless it is skipped, not
+// sampled, or the buffer is full.
+func (al *accessLogger) log(req HttpRequestInterface, target string, w *Writer, start time.Time, d time.Duration, id string) {
+	if al.skip[w.route] {
+		return
+	}
+	if al.cfg.SampleRate > 0 && al.cfg.SampleRate < 1 && mrand.Float64() >= al.cfg.SampleRate {
+		return
+	}
+	e := &accessEntry{
+		time:      start,
+		remote:    req.GetRemoteAddr(),
+		method:    req.GetMethod(),
+		path:      target,
+		proto:     req.GetProto(),
+		status:    w.statusCode,
+		bytes:     w.bodySize(),
+		duration:  d,
+		requestID: id,
+		route:     w.route,
+	}
+	if e.status == 0 {
+		e.status = StatusOK
+	}
+	if al.cfg.Format == LogCombined || al.cfg.Logger != nil || al.cfg.Format == LogJSON {
+		e.referer = headerValue(req.GetHead(), "Referer")
+		e.userAgent = headerValue(req.GetHead(), "User-Agent")
+	}
+	al.mu.RLock()
+	select {
+	case al.entries <- e:
+	default:
+		atomic.AddUint64(&al.dropped, 1)
+	}
+	al.mu.RUnlock()
+}
+
+func (al *accessLogger) run(entries <-chan *accessEntry, done chan<- struct{}) {
+	defer close(done)
+	bw := bufio.NewWriter(al.cfg.Output)
+	defer bw.Flush()
+	var b []byte
+	for e := range entries {
+		if al.cfg.Logger != nil {
+			al.cfg.Logger.Info("access",
+				"method", e.method,
+				"path", e.path,
+				"status", e.status,
+				"bytes", e.bytes,
+				"duration", e.duration,
+				"remote_addr", e.remote,
+				"request_id", e.requestID,
+				"route", e.route,
+				"referer", e.referer,
+				"user_agent", e.userAgent,
+			)
+			continue
+		}
+		b = al.appendEntry(b[:0], e)
+		bw.Write(b)
+		if len(entries) == 0 {
+			bw.Flush()
+		}
+	}
+}
+
+func (al *accessLogger) appendEntry(b []byte, e *accessEntry) []byte {
+	if al.cfg.Format == LogJSON {
+		line, _ := json.Marshal(struct {
+			Time      string `json:"time"`
+			Method    string `json:"method"`
+			Path      string `json:"path"`
+			Proto     string `json:"proto"`
+			Status    int    `json:"status"`
+			Bytes     int    `json:"bytes"`
+			Duration  int64  `json:"duration_us"`
+			Remote    string `json:"remote_addr"`
+			RequestID string `json:"request_id"`
+			Route     string `json:"route,omitempty"`
+			Referer   string `json:"referer,omitempty"`
+			UserAgent string `json:"user_agent,omitempty"`
+		}{
+			e.time.Format(time.RFC3339Nano), e.method, e.path, e.proto, e.status, e.bytes,
+			e.duration.Microseconds(), e.remote, e.requestID, e.route, e.referer, e.userAgent,
+		})
+		return append(append(b, line...), '\n')
+	}
+	host := e.remote
+	if i := strings.LastIndexByte(host, ':'); i > 0 {
+		host = strings.Trim(host[:i], "[]")
+	}
+	b = append(b, host...)
+	b = append(b, " - - ["...)
+	b = e.time.AppendFormat(b, "02/Jan/2006:15:04:05 -0700")
+	b = append(b, "] \""...)
+	b = append(b, e.method...)
+	b = append(b, ' ')
+	b = append(b, e.path...)
+	b = append(b, ' ')
+	b = append(b, e.proto...)
+	b = append(b, "\" "...)
+	b = strconv.AppendInt(b, int64(e.status), 10)
+	b = append(b, ' ')
+	if e.bytes > 0 {
+		b = strconv.AppendInt(b, int64(e.bytes), 10)
+	} else {
+		b = append(b, '-')
+	}
+	if al.cfg.Format == LogCombined {
+		b = append(b, ' ')
+		b = strconv.AppendQuote(b, e.referer)
+		b = append(b, ' ')
+		b = strconv.AppendQuote(b, e.userAgent)
+	}
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, e.duration.Microseconds(), 10)
+	b = append(b, ' ')
+	b = append(b, e.requestID...)
+	b = append(b, ' ')
+	b = strconv.AppendQuote(b, e.route)
+	return append(b, '\n')
+}
+
+// HeaderValue returns the first value of the header in the raw head of a
+// request, like the Content-Type of a request accepted by a StreamHandler.
+func HeaderValue(head, key string) string {
+	return headerValue(head, key)
+}
+
+// headerValue returns the first value of the header in the raw head of a
+// request.
+func headerValue(head, key string) string {
+	for len(head) > 0 {
+		var line string
+		if i := strings.IndexByte(head, '\n'); i >= 0 {
+			line, head = head[:i], head[i+1:]
+		} else {
+			line, head = head, ""
+		}
+		i := strings.IndexByte(line, ':')
+		if i > 0 && strings.EqualFold(strings.TrimSpace(line[:i]), key) {
+			return strings.TrimSpace(line[i+1:])
+		}
+	}
+	return ""
+}
@@ -0,0 +1,190 @@
+package http
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/konstantin-kukharev/pureserver/evloop"
+	"net"
+	nethttp "net/http"
+	"net/http/pprof"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Admin configures the admin listener, that serves the profiles and the
+// state of the server with the net/http package, apart from the event loop.
+type Admin struct {
+	// Address is the admin listener address, like "unix:///run/app.sock"
+	// or "tcp://127.0.0.1:6060". The "tcp" scheme is assumed. A unix
+	// socket accepts the mode, owner and group query options of the server
+	// addresses, like "unix:///run/app.sock?mode=0600", and an existing
+	// file at the path that is not a socket is refused.
+	Address string
+	// Token, when set, is required as a bearer token in the Authorization
+	// header of every admin request. The listeners other than the unix
+	// sockets at a path, the abstract ones like "unix://@admin" included,
+	// require a Token or an ACL.
+	Token string
+	// ACL, when set, filters the admin clients by IP address. The clients
+	// without an IP address are refused, but on the unix sockets at a path.
+	ACL *evloop.ACL
+}
+
+// Route is a route registered on the router.
+type Route struct {
+	Method  string `json:"method"`
+	Pattern string `json:"pattern"`
+}
+
+// adminConfig is the JSON report of the server configuration.
+type adminConfig struct {
+	Loops       int      `json:"loops"`
+	Ports       []int    `json:"ports,omitempty"`
+	UnixSockets []string `json:"unix_sockets,omitempty"`
+	Listeners   []string `json:"listeners,omitempty"`
+	ACL         bool     `json:"acl"`
+	Metrics     string   `json:"metrics,omitempty"`
+	AccessLog   bool     `json:"access_log"`
+	Tracing     bool     `json:"tracing"`
+	Health      []string `json:"health,omitempty"`
+	Options     int      `json:"event_loop_options"`
+}
+
+// adminRuntime is the JSON report of the runtime statistics.
+type adminRuntime struct {
+	Version      string  `json:"version"`
+	GOMAXPROCS   int     `json:"gomaxprocs"`
+	NumCPU       int     `json:"num_cpu"`
+	Goroutines   int     `json:"goroutines"`
+	HeapAlloc    uint64  `json:"heap_alloc"`
+	HeapInuse    uint64  `json:"heap_inuse"`
+	HeapObjects  uint64  `json:"heap_objects"`
+	Sys          uint64  `json:"sys"`
+	TotalAlloc   uint64  `json:"total_alloc"`
+	NumGC        uint32  `json:"num_gc"`
+	PauseTotalMs float64 `json:"gc_pause_total_ms"`
+}
+
+// listenAdmin starts the admin listener. The returned function stops it.
+func (server *Server) listenAdmin() (func(), error) {
+	network, path := "tcp", ""
+	if i := strings.Index(server.admin.Address, "://"); i >= 0 {
+		network, path = server.admin.Address[:i], server.admin.Address[i+3:]
+	}
+	// the file mode guards the unix sockets at a path, not the abstract ones
+	local := network == "unix" && !strings.HasPrefix(path, "@")
+	if !local && server.admin.Token == "" && server.admin.ACL == nil {
+		return nil, fmt.Errorf("admin listener %s requires a token or an ACL", server.admin.Address)
+	}
+	ln, err := evloop.Listen(server.admin.Address)
+	if err != nil {
+		return nil, err
+	}
+	mux := nethttp.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/goroutines", pprof.Handler("goroutine"))
+	mux.HandleFunc("/debug/runtime", server.adminRuntime)
+	mux.HandleFunc("/debug/loops", server.adminLoops)
+	mux.HandleFunc("/debug/routes", server.adminRoutes)
+	mux.HandleFunc("/debug/config", server.adminConfig)
+	hs := &nethttp.Server{Handler: server.adminAuth(mux, local)}
+	go hs.Serve(ln)
+	// closing a unix listener removes the socket file
+	return func() { hs.Close() }, nil
+}
+
+// adminAuth checks the ACL and the token of the admin requests. The ACL
+// lets the clients without an IP address in only on a local listener, a
+// unix socket at a path.
+func (server *Server) adminAuth(h nethttp.Handler, local bool) nethttp.Handler {
+	return nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		if server.admin.ACL != nil {
+			host, _, _ := net.SplitHostPort(r.RemoteAddr)
+			if i := strings.LastIndexByte(host, '%'); i >= 0 {
+				host = host[:i]
+			}
+			ip := net.ParseIP(host)
+			if ip == nil && !local || ip != nil && !server.admin.ACL.Allowed(ip) {
+				nethttp.Error(w, "forbidden", StatusForbidden)
+				return
+			}
+		}
+		if server.admin.Token != "" {
+			auth := r.Header.Get("Authorization")
+			if !strings.HasPrefix(auth, "Bearer ") ||
+				subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(server.admin.Token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				nethttp.Error(w, "unauthorized", StatusUnauthorized)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func writeAdminJSON(w nethttp.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func (server *Server) adminRuntime(w nethttp.ResponseWriter, r *nethttp.Request) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	writeAdminJSON(w, adminRuntime{
+		Version:      runtime.Version(),
+		GOMAXPROCS:   runtime.GOMAXPROCS(0),
+		NumCPU:       runtime.NumCPU(),
+		Goroutines:   runtime.NumGoroutine(),
+		HeapAlloc:    ms.HeapAlloc,
+		HeapInuse:    ms.HeapInuse,
+		HeapObjects:  ms.HeapObjects,
+		Sys:          ms.Sys,
+		TotalAlloc:   ms.TotalAlloc,
+		NumGC:        ms.NumGC,
+		PauseTotalMs: float64(ms.PauseTotalNs) / float64(time.Millisecond),
+	})
+}
+
+func (server *Server) adminLoops(w nethttp.ResponseWriter, r *nethttp.Request) {
+	srv, ok := server.srv.Load().(evloop.Server)
+	if !ok {
+		nethttp.Error(w, "server not running", StatusServiceUnavailable)
+		return
+	}
+	writeAdminJSON(w, srv.Stats())
+}
+
+func (server *Server) adminRoutes(w nethttp.ResponseWriter, r *nethttp.Request) {
+	var routes []Route
+	if rt, ok := server.router.(interface{ Routes() []Route }); ok {
+		routes = rt.Routes()
+	}
+	writeAdminJSON(w, routes)
+}
+
+func (server *Server) adminConfig(w nethttp.ResponseWriter, r *nethttp.Request) {
+	cfg := adminConfig{
+		Loops:       server.loops,
+		Ports:       server.port,
+		UnixSockets: server.unixSocket,
+		Listeners:   server.listeners,
+		ACL:         server.acl != nil,
+		Metrics:     server.metricsPath,
+		AccessLog:   server.accessLog != nil,
+		Tracing:     server.exporter != nil,
+		Health:      server.healthPaths,
+		Options:     len(server.options),
+	}
+	if srv, ok := server.srv.Load().(evloop.Server); ok {
+		cfg.Loops = srv.NumLoops
+	}
+	writeAdminJSON(w, cfg)
+}
@@ -1,6 +1,7 @@
 package http
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 )
@@ -164,10 +165,33 @@ type HttpRequestInterface interface {
 	SetRemoteAddr(string)
 }
 
+// ContextRequest is implemented by the requests that carry a context, like
+// *Request. The context carries the trace span when tracing is enabled.
+type ContextRequest interface {
+	Context() context.Context
+	SetContext(context.Context)
+}
+
+// RequestContext returns the context of the request, or the background
+// context for the requests that don't carry one.
+func RequestContext(r HttpRequestInterface) context.Context {
+	if cr, ok := r.(ContextRequest); ok {
+		return cr.Context()
+	}
+	return context.Background()
+}
+
 type CallableHandler interface {
 	Handle(w ResponseWriter, r HttpRequestInterface)
 }
 
+// handlerFunc adapts a function to a CallableHandler.
+type handlerFunc func(w ResponseWriter, r HttpRequestInterface)
+
+func (f handlerFunc) Handle(w ResponseWriter, r HttpRequestInterface) {
+	f(w, r)
+}
+
 type PatternServeMuxInterface interface {
 	RouterInterface
 	Head(pat string, h CallableHandler)
@@ -186,6 +210,7 @@ type RouterInterface interface {
 func Error(w ResponseWriter, error string, code int) {
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
 	w.SetBody([]byte(fmt.Sprintf("%d %s", code, error)))
 }
 
@@ -0,0 +1,255 @@
+package http
+
+import (
+	"errors"
+	"github.com/konstantin-kukharev/pureserver/evloop"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// eventStreamBuffer is the number of the events an EventStream queues
+// before Send fails.
+const eventStreamBuffer = 256
+
+var (
+	// ErrEventStreamClosed is returned by Send once the stream is closed.
+	ErrEventStreamClosed = errors.New("eventstream: stream closed")
+	// ErrEventStreamFull is returned by Send when the client doesn't keep
+	// up with the queued events.
+	ErrEventStreamFull = errors.New("eventstream: queue full")
+)
+
+// Event is a Server-Sent Events message. The fields left empty are not
+// sent, multi-line data is sent as multiple data lines.
+type Event struct {
+	ID    string
+	Event string
+	Data  string
+	// Retry is the reconnection time of the client.
+	Retry time.Duration
+}
+
+// EventStream is a Server-Sent Events stream, see NewEventStream. The
+// events are queued by Send, which may be called from any goroutine, and
+// written by the event loop of the connection.
+type EventStream struct {
+	lastID    string
+	heartbeat time.Duration
+	queue     chan Event
+	done      chan struct{}
+
+	mu      sync.Mutex
+	conn    evloop.Conn // set once the response is written
+	woken   bool        // a wake is pending
+	closing bool        // Close was called
+	ended   bool        // the connection is closed
+}
+
+// NewEventStream switches the response to a Server-Sent Events stream. The
+// handler returns as usual, the connection is kept open once the response
+// head is written, and the events are sent with Send until the stream is
+// closed with Close or by the client.
+func NewEventStream(w ResponseWriter, r HttpRequestInterface) (*EventStream, error) {
+	tw, ok := w.(takeOverWriter)
+	if !ok {
+		return nil, errors.New("eventstream: response writer does not support streaming")
+	}
+	es := &EventStream{
+		lastID: headerValue(r.GetHead(), "Last-Event-ID"),
+		queue:  make(chan Event, eventStreamBuffer),
+		done:   make(chan struct{}),
+	}
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(StatusOK)
+	tw.takeOver(es)
+	return es, nil
+}
+
+// LastEventID returns the Last-Event-ID header of the request, set by the
+// clients resuming a stream, see EventHistory.
+func (es *EventStream) LastEventID() string {
+	return es.lastID
+}
+
+// SetHeartbeat sends a comment every d to keep the idle connection open
+// through proxies. It must be called before the handler returns.
+func (es *EventStream) SetHeartbeat(d time.Duration) {
+	es.heartbeat = d
+}
+
+// Send queues the event. It fails with ErrEventStreamFull when the client
+// doesn't read the queued events, and with ErrEventStreamClosed once the
+// stream is closed.
+func (es *EventStream) Send(ev Event) error {
+	es.mu.Lock()
+	if es.closing || es.ended {
+		es.mu.Unlock()
+		return ErrEventStreamClosed
+	}
+	select {
+	case es.queue <- ev:
+	default:
+		es.mu.Unlock()
+		return ErrEventStreamFull
+	}
+	c := es.pendingWake()
+	es.mu.Unlock()
+	if c != nil {
+		c.Wake()
+	}
+	return nil
+}
+
+// Close ends the stream once the queued events are written.
+func (es *EventStream) Close() {
+	var c evloop.Conn
+	es.mu.Lock()
+	if !es.closing && !es.ended {
+		es.closing = true
+		c = es.pendingWake()
+	}
+	es.mu.Unlock()
+	if c != nil {
+		c.Wake()
+	}
+}
+
+// Done returns a channel that is closed once the connection is closed.
+func (es *EventStream) Done() <-chan struct{} {
+	return es.done
+}
+
+// pendingWake marks a wake pending and returns the connection to wake, or
+// nil when a wake is pending already or the response is not written yet.
+// The wake is made without the lock, as the loop takes it in data.
+func (es *EventStream) pendingWake() evloop.Conn {
+	if es.conn == nil || es.woken {
+		return nil
+	}
+	es.woken = true
+	return es.conn
+}
+
+func (es *EventStream) open(c evloop.Conn, _ HttpRequestInterface) streamConn {
+	es.mu.Lock()
+	es.conn = c
+	es.mu.Unlock()
+	if es.heartbeat > 0 {
+		c.AfterFunc(es.heartbeat, es.beat)
+	}
+	return es
+}
+
+// beat sends the heartbeat comment and schedules the next one.
+func (es *EventStream) beat(c evloop.Conn) ([]byte, evloop.Action) {
+	c.AfterFunc(es.heartbeat, es.beat)
+	return []byte(":\n\n"), evloop.None
+}
+
+// data writes the queued events. The input of the client is discarded.
+func (es *EventStream) data(in []byte) (out []byte, action evloop.Action) {
+	es.mu.Lock()
+	es.woken = false
+	closing := es.closing
+	es.mu.Unlock()
+	for n := len(es.queue); n > 0; n-- {
+		out = appendEvent(out, <-es.queue)
+	}
+	if closing {
+		action = evloop.Close
+	}
+	return
+}
+
+func (es *EventStream) closed() {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if !es.ended {
+		es.ended = true
+		close(es.done)
+	}
+}
+
+// appendEvent appends the event in the text/event-stream format.
+func appendEvent(b []byte, ev Event) []byte {
+	if ev.ID != "" {
+		b = append(b, "id: "...)
+		b = append(b, eventField(ev.ID)...)
+		b = append(b, '\n')
+	}
+	if ev.Event != "" {
+		b = append(b, "event: "...)
+		b = append(b, eventField(ev.Event)...)
+		b = append(b, '\n')
+	}
+	if ev.Retry > 0 {
+		b = append(b, "retry: "...)
+		b = strconv.AppendInt(b, int64(ev.Retry/time.Millisecond), 10)
+		b = append(b, '\n')
+	}
+	if ev.Data != "" {
+		data := strings.Replace(ev.Data, "\r\n", "\n", -1)
+		for _, line := range strings.Split(data, "\n") {
+			b = append(b, "data: "...)
+			b = append(b, line...)
+			b = append(b, '\n')
+		}
+	}
+	return append(b, '\n')
+}
+
+// lineBreaks removes the line breaks from the single line fields.
+var lineBreaks = strings.NewReplacer("\r", "", "\n", "")
+
+func eventField(s string) string {
+	return lineBreaks.Replace(s)
+}
+
+// EventHistory keeps the recent events with IDs, so the streams of the
+// clients resuming with Last-Event-ID can replay the missed events. It may
+// be used from any goroutine.
+type EventHistory struct {
+	mu     sync.Mutex
+	events []Event
+	size   int
+}
+
+// NewEventHistory returns a history of the last size events.
+func NewEventHistory(size int) *EventHistory {
+	return &EventHistory{size: size}
+}
+
+// Add records the event.
+func (h *EventHistory) Add(ev Event) {
+	if h.size <= 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.events) == h.size {
+		h.events = append(h.events[:0], h.events[1:]...)
+	}
+	h.events = append(h.events, ev)
+}
+
+// Since returns the events recorded after the event with the id. It
+// returns false when the event is not in the history anymore, then the
+// client has to start over. An empty id returns no events.
+func (h *EventHistory) Since(id string) ([]Event, bool) {
+	if id == "" {
+		return nil, true
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := len(h.events) - 1; i >= 0; i-- {
+		if h.events[i].ID == id {
+			return append([]Event{}, h.events[i+1:]...), true
+		}
+	}
+	return nil, false
+}
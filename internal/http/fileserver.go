@@ -0,0 +1,253 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	nethttp "net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// indexPage is the file serving a directory.
+const indexPage = "index.html"
+
+// timeFormat is the format of the HTTP dates.
+const timeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// errRange is returned for a range that can't be satisfied.
+var errRange = errors.New("range not satisfiable")
+
+// FileServer returns a handler serving the files of the root directory by
+// the request path. The path is cleaned so the requests can't reach out of
+// the root, and a directory is served by its index.html file. Use
+// StripPrefix to serve the files under a pattern prefix, like
+//
+//	mux.Get("/static/", StripPrefix("/static", FileServer("/var/www")))
+func FileServer(root string) CallableHandler {
+	return &fileHandler{root: root}
+}
+
+type fileHandler struct {
+	root string
+}
+
+func (h *fileHandler) Handle(w ResponseWriter, r HttpRequestInterface) {
+	p := r.GetPath().Path
+	if filepath.Separator != '/' && strings.ContainsRune(p, filepath.Separator) {
+		NotFound(w, r)
+		return
+	}
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	serveFile(w, r, filepath.Join(h.root, filepath.FromSlash(path.Clean(p))), true)
+}
+
+// StripPrefix returns a handler serving the requests by h with the prefix
+// removed from the path, and NotFound for the paths without the prefix.
+func StripPrefix(prefix string, h CallableHandler) CallableHandler {
+	return handlerFunc(func(w ResponseWriter, r HttpRequestInterface) {
+		u := r.GetPath()
+		p := strings.TrimPrefix(u.Path, prefix)
+		if len(p) == len(u.Path) && prefix != "" {
+			NotFound(w, r)
+			return
+		}
+		u.Path, u.RawPath = p, ""
+		h.Handle(w, r)
+	})
+}
+
+// ServeFile replies to the request with the named file, or the index.html
+// file of the named directory. The requests with ".." in the path are
+// rejected, as the name is usually built from it.
+func ServeFile(w ResponseWriter, r HttpRequestInterface, name string) {
+	for _, part := range strings.FieldsFunc(r.GetPath().Path, func(c rune) bool { return c == '/' || c == '\\' }) {
+		if part == ".." {
+			Error(w, "Bad Request", StatusBadRequest)
+			return
+		}
+	}
+	serveFile(w, r, name, false)
+}
+
+// serveFile serves the named file, a request for a directory without the
+// trailing slash is redirected when redirect is set.
+func serveFile(w ResponseWriter, r HttpRequestInterface, name string, redirect bool) {
+	f, err := os.Open(name)
+	if err != nil {
+		fileError(w, r, err)
+		return
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		fileError(w, r, err)
+		return
+	}
+	if st.IsDir() {
+		f.Close()
+		if u := r.GetPath().Path; redirect && !strings.HasSuffix(u, "/") {
+			w.Header().Set("Location", path.Base(u)+"/")
+			w.Header().Set("Content-Length", "0")
+			w.WriteHeader(StatusMovedPermanently)
+			return
+		}
+		name = filepath.Join(name, indexPage)
+		if f, err = os.Open(name); err != nil {
+			fileError(w, r, err)
+			return
+		}
+		if st, err = f.Stat(); err != nil || st.IsDir() {
+			f.Close()
+			NotFound(w, r)
+			return
+		}
+	}
+	serveContent(w, r, name, f, st)
+}
+
+// serveContent serves the opened file, the file is closed or handed over
+// to the response writer.
+func serveContent(w ResponseWriter, r HttpRequestInterface, name string, f *os.File, st os.FileInfo) {
+	size, modtime := st.Size(), st.ModTime()
+	etag := fmt.Sprintf(`"%x-%x"`, modtime.UnixNano(), size)
+	h := w.Header()
+	h.Set("Etag", etag)
+	h.Set("Last-Modified", modtime.UTC().Format(timeFormat))
+	h.Set("Accept-Ranges", "bytes")
+	if notModified(r.GetHead(), etag, modtime) {
+		f.Close()
+		w.WriteHeader(StatusNotModified)
+		return
+	}
+	if h.Get("Content-Type") == "" {
+		ctype := mime.TypeByExtension(filepath.Ext(name))
+		if ctype == "" {
+			var buf [512]byte
+			n, _ := f.ReadAt(buf[:], 0)
+			ctype = nethttp.DetectContentType(buf[:n])
+		}
+		h.Set("Content-Type", ctype)
+	}
+
+	offset, count := int64(0), size
+	if rng := headerValue(r.GetHead(), "Range"); rng != "" && ifRange(r.GetHead(), etag, modtime) {
+		o, n, err := parseRange(rng, size)
+		switch {
+		case err != nil:
+			f.Close()
+			h.Del("Content-Type")
+			h.Set("Content-Range", "bytes */"+strconv.FormatInt(size, 10))
+			Error(w, "Requested Range Not Satisfiable", StatusRequestedRangeNotSatisfiable)
+			return
+		case n > 0:
+			offset, count = o, n
+			h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", o, o+n-1, size))
+			w.WriteHeader(StatusPartialContent)
+		}
+	}
+	if r.GetMethod() == "HEAD" || count == 0 {
+		f.Close()
+		h.Set("Content-Length", strconv.FormatInt(count, 10))
+		return
+	}
+	if fw, ok := w.(fileWriter); ok {
+		fw.setFile(f, offset, count)
+		return
+	}
+	w.SetBody((&fileBody{f: f, offset: offset, count: count}).read())
+}
+
+// fileError replies to the request with the status of the file error.
+func fileError(w ResponseWriter, r HttpRequestInterface, err error) {
+	switch {
+	case os.IsNotExist(err):
+		NotFound(w, r)
+	case os.IsPermission(err):
+		Error(w, "Forbidden", StatusForbidden)
+	default:
+		Error(w, "Internal Server Error", StatusInternalServerError)
+	}
+}
+
+// notModified evaluates the If-None-Match and If-Modified-Since
+// conditions, RFC 7232, 6.
+func notModified(head, etag string, modtime time.Time) bool {
+	if inm := headerValues(head, "If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := headerValue(head, "If-Modified-Since"); ims != "" {
+		t, err := time.Parse(timeFormat, ims)
+		return err == nil && !modtime.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+// ifRange evaluates the If-Range condition, RFC 7233, 3.2.
+func ifRange(head, etag string, modtime time.Time) bool {
+	ir := headerValue(head, "If-Range")
+	switch {
+	case ir == "":
+		return true
+	case strings.HasPrefix(ir, `"`):
+		return ir == etag
+	}
+	t, err := time.Parse(timeFormat, ir)
+	return err == nil && modtime.Truncate(time.Second).Equal(t)
+}
+
+// parseRange parses a single byte range of the Range header, RFC 7233,
+// 2.1. A zero count means the header is ignored, like for the multiple
+// ranges, and errRange is returned when the range can't be satisfied.
+func parseRange(s string, size int64) (offset, count int64, err error) {
+	if !strings.HasPrefix(s, "bytes=") || strings.Contains(s, ",") {
+		return 0, 0, nil
+	}
+	i := strings.IndexByte(s, '-')
+	if i < 0 {
+		return 0, 0, nil
+	}
+	first, last := strings.TrimSpace(s[len("bytes="):i]), strings.TrimSpace(s[i+1:])
+	if first == "" {
+		// the suffix range
+		n, err := strconv.ParseInt(last, 10, 64)
+		switch {
+		case err != nil || n < 0:
+			return 0, 0, nil
+		case n == 0 || size == 0:
+			return 0, 0, errRange
+		case n > size:
+			n = size
+		}
+		return size - n, n, nil
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, nil
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, 0, nil
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	if start >= size {
+		return 0, 0, errRange
+	}
+	return start, end - start + 1, nil
+}
@@ -0,0 +1,180 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// HealthCheck checks a dependency of the server, like a database. It should
+// return once the context is done.
+type HealthCheck func(ctx context.Context) error
+
+const (
+	// defaultCheckTimeout is the timeout of the checks added without one.
+	defaultCheckTimeout = 5 * time.Second
+	// healthInterval is the pause between the rounds of the checks.
+	healthInterval = time.Second
+)
+
+// health serves the liveness and readiness endpoints. The readiness checks
+// run in the background while the server is running, and the readiness
+// handler reports the results of the last round, so the event loop never
+// waits for a check.
+type health struct {
+	mu       sync.Mutex
+	checks   []namedCheck
+	results  map[string]checkResult // nil until the first round ends
+	stopc    chan struct{}
+	donec    chan struct{}
+	draining func() bool
+}
+
+type namedCheck struct {
+	name    string
+	timeout time.Duration
+	check   HealthCheck
+}
+
+// checkResult is the JSON result of a readiness check.
+type checkResult struct {
+	Status   string  `json:"status"`
+	Error    string  `json:"error,omitempty"`
+	Duration float64 `json:"duration_ms"`
+}
+
+// healthReport is the JSON body of the health endpoints.
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks,omitempty"`
+}
+
+func (h *health) add(name string, timeout time.Duration, check HealthCheck) {
+	if timeout <= 0 {
+		timeout = defaultCheckTimeout
+	}
+	h.mu.Lock()
+	h.checks = append(h.checks, namedCheck{name, timeout, check})
+	h.mu.Unlock()
+}
+
+// start starts the rounds of the checks.
+func (h *health) start() {
+	h.mu.Lock()
+	h.results = nil
+	h.stopc = make(chan struct{})
+	h.donec = make(chan struct{})
+	h.mu.Unlock()
+	go h.run(h.stopc, h.donec)
+}
+
+// stop stops the rounds of the checks, the checks left running are
+// cancelled.
+func (h *health) stop() {
+	close(h.stopc)
+	<-h.donec
+}
+
+func (h *health) run(stopc <-chan struct{}, donec chan<- struct{}) {
+	defer close(donec)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stopc
+		cancel()
+	}()
+	for {
+		h.mu.Lock()
+		checks := h.checks
+		h.mu.Unlock()
+		results := make([]checkResult, len(checks))
+		var wg sync.WaitGroup
+		for i, c := range checks {
+			wg.Add(1)
+			go func(i int, c namedCheck) {
+				defer wg.Done()
+				results[i] = runCheck(ctx, c)
+			}(i, c)
+		}
+		wg.Wait()
+		m := make(map[string]checkResult, len(checks))
+		for i, c := range checks {
+			m[c.name] = results[i]
+		}
+		h.mu.Lock()
+		h.results = m
+		h.mu.Unlock()
+		select {
+		case <-stopc:
+			return
+		case <-time.After(healthInterval):
+		}
+	}
+}
+
+// live reports that the server is serving.
+func (h *health) live(w ResponseWriter, r HttpRequestInterface) {
+	writeHealth(w, StatusOK, healthReport{Status: "ok"})
+}
+
+// ready reports the results of the last round of the checks, with 503 when
+// one of them failed, before the first round ends, or once the server has
+// started to drain.
+func (h *health) ready(w ResponseWriter, r HttpRequestInterface) {
+	if h.draining() {
+		writeHealth(w, StatusServiceUnavailable, healthReport{Status: "draining"})
+		return
+	}
+	h.mu.Lock()
+	n, results := len(h.checks), h.results
+	h.mu.Unlock()
+	if n == 0 {
+		writeHealth(w, StatusOK, healthReport{Status: "ok"})
+		return
+	}
+	if results == nil {
+		writeHealth(w, StatusServiceUnavailable, healthReport{Status: "starting"})
+		return
+	}
+	report := healthReport{Status: "ok", Checks: results}
+	code := StatusOK
+	for _, res := range results {
+		if res.Status != "ok" {
+			report.Status = "fail"
+			code = StatusServiceUnavailable
+		}
+	}
+	writeHealth(w, code, report)
+}
+
+// runCheck runs a check within its timeout. A check that doesn't return in
+// time fails and is left running in the background.
+func runCheck(ctx context.Context, c namedCheck) checkResult {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- c.check(ctx)
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	res := checkResult{Status: "ok", Duration: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		res.Status = "fail"
+		res.Error = err.Error()
+	}
+	return res
+}
+
+func writeHealth(w ResponseWriter, code int, report healthReport) {
+	body, _ := json.Marshal(report)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	w.SetBody(body)
+}
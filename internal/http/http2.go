@@ -0,0 +1,769 @@
+package http
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"github.com/konstantin-kukharev/pureserver/evloop"
+	"golang.org/x/net/http2/hpack"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTP2 configures the HTTP/2 support, see Server.SetHTTP2.
+type HTTP2 struct {
+	// MaxConcurrentStreams limits the open streams of a connection, 250
+	// when zero.
+	MaxConcurrentStreams uint32
+	// InitialWindowSize is the flow control window of the connections and
+	// the streams for the request bodies, 1MB when zero.
+	InitialWindowSize uint32
+	// MaxFrameSize is the largest frame payload the server accepts, 16KB
+	// when zero.
+	MaxFrameSize uint32
+}
+
+// h2MaxHeaderBlock limits the size of a header block continued by
+// CONTINUATION frames.
+const h2MaxHeaderBlock = 1 << 20
+
+// h2cSwitching is the response to an h2c upgrade request.
+const h2cSwitching = "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n"
+
+// h2ConnHeaders are the connection-specific headers not allowed in HTTP/2,
+// RFC 7540, 8.1.2.2.
+var h2ConnHeaders = map[string]bool{
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
+// withDefaults returns the configuration with the zero values replaced by
+// the defaults.
+func (cfg HTTP2) withDefaults() HTTP2 {
+	if cfg.MaxConcurrentStreams == 0 {
+		cfg.MaxConcurrentStreams = 250
+	}
+	if cfg.InitialWindowSize == 0 {
+		cfg.InitialWindowSize = 1 << 20
+	} else if cfg.InitialWindowSize > h2MaxWindowSizeLimit {
+		cfg.InitialWindowSize = h2MaxWindowSizeLimit
+	}
+	if cfg.MaxFrameSize < h2DefaultFrameSize {
+		cfg.MaxFrameSize = h2DefaultFrameSize
+	} else if cfg.MaxFrameSize > h2MaxFrameSizeLimit {
+		cfg.MaxFrameSize = h2MaxFrameSizeLimit
+	}
+	return cfg
+}
+
+// h2Conns are the open HTTP/2 connections of the server, woken to send
+// GOAWAY once the server starts to drain.
+type h2Conns struct {
+	mu    sync.Mutex
+	conns map[*h2Conn]struct{}
+}
+
+func (cs *h2Conns) add(hc *h2Conn) {
+	cs.mu.Lock()
+	if cs.conns == nil {
+		cs.conns = make(map[*h2Conn]struct{})
+	}
+	cs.conns[hc] = struct{}{}
+	cs.mu.Unlock()
+}
+
+func (cs *h2Conns) remove(hc *h2Conn) {
+	cs.mu.Lock()
+	delete(cs.conns, hc)
+	cs.mu.Unlock()
+}
+
+// drain wakes the connections, the wakes are made in the background as the
+// drain may be started on a loop.
+func (cs *h2Conns) drain() {
+	cs.mu.Lock()
+	conns := make([]evloop.Conn, 0, len(cs.conns))
+	for hc := range cs.conns {
+		conns = append(conns, hc.conn)
+	}
+	cs.mu.Unlock()
+	if len(conns) > 0 {
+		go func() {
+			for _, c := range conns {
+				c.Wake()
+			}
+		}()
+	}
+}
+
+// h2Upgrade opens the HTTP/2 connection, after the client connection
+// preface or after the h2c upgrade of the request.
+type h2Upgrade struct {
+	server   *Server
+	req      *Request    // the upgraded request, served on the stream 1
+	settings []h2Setting // the settings of the HTTP2-Settings header
+}
+
+// h2cUpgrade returns the HTTP/2 upgrade of the request when HTTP/2 is
+// enabled and the request asks for an h2c upgrade, RFC 7540, 3.2.
+func (server *Server) h2cUpgrade(req *Request) *h2Upgrade {
+	if server.http2 == nil {
+		return nil
+	}
+	head := req.GetHead()
+	if !headerToken(headerValues(head, "Upgrade"), "h2c") ||
+		!headerToken(headerValues(head, "Connection"), "upgrade") {
+		return nil
+	}
+	p, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(headerValue(head, "HTTP2-Settings"), "="))
+	if err != nil {
+		return nil
+	}
+	settings, err := parseH2Settings(p)
+	if err != nil {
+		return nil
+	}
+	return &h2Upgrade{server: server, req: req, settings: settings}
+}
+
+func (u *h2Upgrade) open(c evloop.Conn, _ HttpRequestInterface) streamConn {
+	cfg := u.server.http2.withDefaults()
+	hc := &h2Conn{
+		server:        u.server,
+		cfg:           cfg,
+		conn:          c,
+		streams:       make(map[uint32]*h2Stream),
+		recvWindow:    int32(cfg.InitialWindowSize),
+		sendWindow:    h2DefaultWindowSize,
+		peerWindow:    h2DefaultWindowSize,
+		peerFrameSize: h2DefaultFrameSize,
+	}
+	hc.dec = hpack.NewDecoder(4096, nil)
+	hc.enc = hpack.NewEncoder(&hc.encBuf)
+	u.server.h2conns.add(hc)
+	// the server connection preface
+	hc.out = appendH2Settings(hc.out,
+		h2Setting{h2SettingMaxConcurrentStreams, cfg.MaxConcurrentStreams},
+		h2Setting{h2SettingInitialWindowSize, cfg.InitialWindowSize},
+		h2Setting{h2SettingMaxFrameSize, cfg.MaxFrameSize},
+		h2Setting{h2SettingEnablePush, 0},
+	)
+	if cfg.InitialWindowSize > h2DefaultWindowSize {
+		hc.out = appendH2WindowUpdate(hc.out, 0, cfg.InitialWindowSize-h2DefaultWindowSize)
+	}
+	if u.req != nil {
+		hc.applySettings(u.settings)
+		st := hc.newStream(1)
+		st.req = *u.req
+		st.remoteDone = true
+		hc.lastID = 1
+		hc.streams[1] = st
+		if err := hc.dispatch(st); err != nil {
+			hc.streamError(err.(*h2Error))
+		}
+	}
+	return hc
+}
+
+// h2Conn is an HTTP/2 connection, RFC 7540. The streams are served on the
+// event loop of the connection, one at a time as their requests complete,
+// and their responses are multiplexed with the flow control of the peer.
+type h2Conn struct {
+	server *Server
+	cfg    HTTP2
+	conn   evloop.Conn
+	in     []byte // unparsed input
+	out    []byte // frames to write
+
+	preface  bool // the client connection preface has been received
+	settings bool // the first SETTINGS frame has been received
+	goaway   bool // the client sent GOAWAY
+	draining bool // the server sent GOAWAY as it drains
+
+	dec    *hpack.Decoder
+	enc    *hpack.Encoder
+	encBuf bytes.Buffer
+
+	streams map[uint32]*h2Stream
+	lastID  uint32 // the highest stream opened by the client
+
+	// the header block continued by CONTINUATION frames
+	block    []byte
+	blockID  uint32
+	blockEnd bool // the HEADERS frame ends the stream
+	contID   uint32
+
+	recvWindow    int32 // connection window for the client
+	sendWindow    int64 // connection window of the client
+	peerWindow    int32 // initial stream window of the client
+	peerFrameSize uint32
+}
+
+// StreamHandler serves the HTTP/2 requests it accepts in the background,
+// see Server.SetStreamHandler.
+type StreamHandler interface {
+	// Accept reports whether the handler serves the request.
+	Accept(req HttpRequestInterface) bool
+	// Start starts to serve the complete request received by the
+	// connection. The loop of the connection pulls the response of the
+	// stream once the connection is woken.
+	Start(c evloop.Conn, req HttpRequestInterface) Stream
+}
+
+// Stream is the response of a StreamHandler, pulled by the loop of its
+// connection.
+type Stream interface {
+	// Pull returns the response parts queued since the last pull, window
+	// is the size the flow control windows of the stream take. The trailer
+	// is returned once, with done set, when the response is complete.
+	Pull(window int) (headers []hpack.HeaderField, data []byte, trailers []hpack.HeaderField, done bool)
+	// Abort cancels the response of a reset stream or a closed connection.
+	Abort()
+}
+
+// h2Stream is a stream of an HTTP/2 connection.
+type h2Stream struct {
+	id         uint32
+	req        Request
+	body       []byte
+	remoteDone bool   // the client ended the stream
+	recvWindow int32  // stream window for the client
+	sendWindow int64  // stream window of the client, negative after a settings decrease
+	out        []byte // response body not sent yet
+	done       bool   // the response is complete once out and trailer are sent
+	trailer    []hpack.HeaderField
+	call       Stream // the stream of the StreamHandler pulled for the response
+}
+
+func (hc *h2Conn) newStream(id uint32) *h2Stream {
+	return &h2Stream{
+		id:         id,
+		recvWindow: int32(hc.cfg.InitialWindowSize),
+		sendWindow: int64(hc.peerWindow),
+	}
+}
+
+// data handles the frames of the input and returns the frames to write.
+func (hc *h2Conn) data(in []byte) (out []byte, action evloop.Action) {
+	hc.in = append(hc.in, in...)
+	b := hc.in
+	if !hc.preface {
+		n := len(h2Preface)
+		if len(b) < n {
+			n = len(b)
+		}
+		if string(b[:n]) != h2Preface[:n] {
+			return hc.flush(), evloop.Close
+		}
+		if n < len(h2Preface) {
+			return hc.flush(), evloop.None
+		}
+		b, hc.preface = b[n:], true
+	}
+	for len(b) >= h2FrameHeaderLen {
+		length := uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+		if length > hc.cfg.MaxFrameSize {
+			hc.connError(h2ConnError(h2FrameSizeError, "frame too large").(*h2Error))
+			return hc.flush(), evloop.Close
+		}
+		size := h2FrameHeaderLen + int(length)
+		if len(b) < size {
+			break
+		}
+		typ, flags, id := b[3], b[4], binary.BigEndian.Uint32(b[5:])&0x7fffffff
+		err := hc.frame(typ, flags, id, b[h2FrameHeaderLen:size])
+		b = b[size:]
+		if he, _ := err.(*h2Error); he != nil && he.stream != 0 {
+			hc.streamError(he)
+		} else if he != nil {
+			hc.connError(he)
+			return hc.flush(), evloop.Close
+		}
+	}
+	hc.in = append(hc.in[:0], b...)
+	if !hc.draining && hc.server.Draining() {
+		// the streams up to the last one are served, the client opens
+		// the next ones on a new connection
+		hc.draining = true
+		hc.out = appendH2GoAway(hc.out, hc.lastID, h2NoError, "")
+	}
+	out = hc.flush()
+	if (hc.goaway || hc.draining) && len(hc.streams) == 0 {
+		action = evloop.Close
+	}
+	return
+}
+
+// closed cancels the handler streams of the connection.
+func (hc *h2Conn) closed() {
+	hc.server.h2conns.remove(hc)
+	for id := range hc.streams {
+		hc.removeStream(id)
+	}
+}
+
+// removeStream removes the stream and cancels its handler stream.
+func (hc *h2Conn) removeStream(id uint32) {
+	if st := hc.streams[id]; st != nil && st.call != nil {
+		st.call.Abort()
+	}
+	delete(hc.streams, id)
+}
+
+// flush writes the pending response bodies the flow control windows allow
+// and returns the frames to write.
+func (hc *h2Conn) flush() []byte {
+	for id, st := range hc.streams {
+		// the parts of a handler stream are pulled once the ones pulled
+		// before are written, so a gRPC call blocks in SendMsg while the
+		// flow control windows are closed
+		for {
+			hc.writeData(st)
+			if st.call == nil || len(st.out) > 0 || !hc.pull(st) {
+				break
+			}
+		}
+		if st.done && len(st.out) == 0 {
+			if st.trailer != nil {
+				hc.appendFields(id, st.trailer, true)
+			}
+			delete(hc.streams, id)
+		}
+	}
+	out := hc.out
+	hc.out = nil
+	return out
+}
+
+// writeData appends the DATA frames of the response body the flow control
+// windows allow.
+func (hc *h2Conn) writeData(st *h2Stream) {
+	for len(st.out) > 0 && hc.sendWindow > 0 && st.sendWindow > 0 {
+		n := int64(len(st.out))
+		if n > hc.sendWindow {
+			n = hc.sendWindow
+		}
+		if n > st.sendWindow {
+			n = st.sendWindow
+		}
+		if n > int64(hc.peerFrameSize) {
+			n = int64(hc.peerFrameSize)
+		}
+		var flags byte
+		if int(n) == len(st.out) && st.done && st.trailer == nil {
+			flags = h2FlagEndStream
+		}
+		hc.out = appendH2Frame(hc.out, h2FrameData, flags, st.id, st.out[:n])
+		st.out = st.out[n:]
+		hc.sendWindow -= n
+		st.sendWindow -= n
+	}
+}
+
+// frame handles a frame, RFC 7540, 6.
+func (hc *h2Conn) frame(typ, flags byte, id uint32, p []byte) error {
+	if hc.contID != 0 && (typ != h2FrameContinuation || id != hc.contID) {
+		return h2ConnError(h2ProtocolError, "expected continuation frame")
+	}
+	if !hc.settings && typ != h2FrameSettings {
+		return h2ConnError(h2ProtocolError, "expected settings frame")
+	}
+	switch typ {
+	case h2FrameData:
+		return hc.dataFrame(flags, id, p)
+	case h2FrameHeaders:
+		return hc.headersFrame(flags, id, p)
+	case h2FramePriority:
+		if id == 0 {
+			return h2ConnError(h2ProtocolError, "priority on the connection")
+		}
+		if len(p) != 5 {
+			return h2StreamError(id, h2FrameSizeError, "invalid priority frame")
+		}
+	case h2FrameRSTStream:
+		if id == 0 || id > hc.lastID {
+			return h2ConnError(h2ProtocolError, "reset of an idle stream")
+		}
+		if len(p) != 4 {
+			return h2ConnError(h2FrameSizeError, "invalid reset frame")
+		}
+		hc.removeStream(id)
+	case h2FrameSettings:
+		return hc.settingsFrame(flags, id, p)
+	case h2FramePushPromise:
+		return h2ConnError(h2ProtocolError, "push promise from the client")
+	case h2FramePing:
+		if id != 0 {
+			return h2ConnError(h2ProtocolError, "ping on a stream")
+		}
+		if len(p) != 8 {
+			return h2ConnError(h2FrameSizeError, "invalid ping frame")
+		}
+		if flags&h2FlagAck == 0 {
+			hc.out = appendH2Frame(hc.out, h2FramePing, h2FlagAck, 0, p)
+		}
+	case h2FrameGoAway:
+		if id != 0 {
+			return h2ConnError(h2ProtocolError, "goaway on a stream")
+		}
+		hc.goaway = true
+	case h2FrameWindowUpdate:
+		return hc.windowUpdateFrame(id, p)
+	case h2FrameContinuation:
+		if hc.contID == 0 {
+			return h2ConnError(h2ProtocolError, "unexpected continuation frame")
+		}
+		if hc.block = append(hc.block, p...); len(hc.block) > h2MaxHeaderBlock {
+			return h2ConnError(h2EnhanceYourCalm, "header block too large")
+		}
+		if flags&h2FlagEndHeaders != 0 {
+			return hc.endHeaders()
+		}
+	}
+	// the unknown frame types are ignored
+	return nil
+}
+
+func (hc *h2Conn) settingsFrame(flags byte, id uint32, p []byte) error {
+	if id != 0 {
+		return h2ConnError(h2ProtocolError, "settings on a stream")
+	}
+	if flags&h2FlagAck != 0 {
+		if len(p) != 0 {
+			return h2ConnError(h2FrameSizeError, "invalid settings ack")
+		}
+		return nil
+	}
+	settings, err := parseH2Settings(p)
+	if err != nil {
+		return err
+	}
+	if err := hc.applySettings(settings); err != nil {
+		return err
+	}
+	hc.settings = true
+	hc.out = appendH2Frame(hc.out, h2FrameSettings, h2FlagAck, 0, nil)
+	return nil
+}
+
+// applySettings applies the validated settings of the client.
+func (hc *h2Conn) applySettings(settings []h2Setting) error {
+	for _, s := range settings {
+		switch s.id {
+		case h2SettingHeaderTableSize:
+			hc.enc.SetMaxDynamicTableSizeLimit(s.value)
+		case h2SettingInitialWindowSize:
+			delta := int64(s.value) - int64(hc.peerWindow)
+			for _, st := range hc.streams {
+				st.sendWindow += delta
+				if st.sendWindow > h2MaxWindowSizeLimit {
+					return h2ConnError(h2FlowControlError, "stream window overflow")
+				}
+			}
+			hc.peerWindow = int32(s.value)
+		case h2SettingMaxFrameSize:
+			hc.peerFrameSize = s.value
+		}
+	}
+	return nil
+}
+
+func (hc *h2Conn) windowUpdateFrame(id uint32, p []byte) error {
+	if len(p) != 4 {
+		return h2ConnError(h2FrameSizeError, "invalid window update frame")
+	}
+	inc := int64(binary.BigEndian.Uint32(p) & 0x7fffffff)
+	if id == 0 {
+		if inc == 0 {
+			return h2ConnError(h2ProtocolError, "zero window increment")
+		}
+		if hc.sendWindow += inc; hc.sendWindow > h2MaxWindowSizeLimit {
+			return h2ConnError(h2FlowControlError, "connection window overflow")
+		}
+		return nil
+	}
+	if id > hc.lastID {
+		return h2ConnError(h2ProtocolError, "window update of an idle stream")
+	}
+	if inc == 0 {
+		return h2StreamError(id, h2ProtocolError, "zero window increment")
+	}
+	if st := hc.streams[id]; st != nil {
+		if st.sendWindow += inc; st.sendWindow > h2MaxWindowSizeLimit {
+			return h2StreamError(id, h2FlowControlError, "stream window overflow")
+		}
+	}
+	return nil
+}
+
+func (hc *h2Conn) headersFrame(flags byte, id uint32, p []byte) error {
+	if id == 0 || id%2 == 0 {
+		return h2ConnError(h2ProtocolError, "invalid stream id")
+	}
+	p, err := h2Unpad(flags, p)
+	if err != nil {
+		return err
+	}
+	if flags&h2FlagPriority != 0 {
+		if len(p) < 5 {
+			return h2ConnError(h2FrameSizeError, "invalid headers frame")
+		}
+		p = p[5:]
+	}
+	hc.block = append(hc.block[:0], p...)
+	hc.blockID, hc.blockEnd = id, flags&h2FlagEndStream != 0
+	if flags&h2FlagEndHeaders == 0 {
+		hc.contID = id
+		return nil
+	}
+	return hc.endHeaders()
+}
+
+// endHeaders decodes the complete header block and opens its stream, or
+// ends the stream with the trailers.
+func (hc *h2Conn) endHeaders() error {
+	id := hc.blockID
+	hc.contID = 0
+	// the block is decoded even for a refused stream, to keep the state of
+	// the decoder
+	fields, err := hc.dec.DecodeFull(hc.block)
+	if err != nil {
+		return h2ConnError(h2CompressionError, "invalid header block")
+	}
+	if st := hc.streams[id]; st != nil {
+		if st.remoteDone {
+			return h2StreamError(id, h2StreamClosed, "headers on a closed stream")
+		}
+		if !hc.blockEnd {
+			return h2StreamError(id, h2ProtocolError, "trailers without the end of the stream")
+		}
+		st.remoteDone = true
+		return hc.dispatch(st)
+	}
+	if id <= hc.lastID {
+		return h2ConnError(h2StreamClosed, "headers on a closed stream")
+	}
+	hc.lastID = id
+	if hc.goaway || hc.draining || uint32(len(hc.streams)) >= hc.cfg.MaxConcurrentStreams {
+		return h2StreamError(id, h2RefusedStream, "too many streams")
+	}
+	st := hc.newStream(id)
+	if err := st.setHeaders(fields); err != nil {
+		return err
+	}
+	hc.streams[id] = st
+	if hc.blockEnd {
+		st.remoteDone = true
+		return hc.dispatch(st)
+	}
+	return nil
+}
+
+func (hc *h2Conn) dataFrame(flags byte, id uint32, p []byte) error {
+	if id == 0 {
+		return h2ConnError(h2ProtocolError, "data on the connection")
+	}
+	n := int32(len(p))
+	if n > hc.recvWindow {
+		return h2ConnError(h2FlowControlError, "connection window exceeded")
+	}
+	hc.recvWindow -= n
+	if hc.recvWindow < int32(hc.cfg.InitialWindowSize/2) {
+		hc.out = appendH2WindowUpdate(hc.out, 0, hc.cfg.InitialWindowSize-uint32(hc.recvWindow))
+		hc.recvWindow = int32(hc.cfg.InitialWindowSize)
+	}
+	st := hc.streams[id]
+	if id > hc.lastID {
+		return h2ConnError(h2ProtocolError, "data on an idle stream")
+	}
+	if st == nil || st.remoteDone {
+		return h2StreamError(id, h2StreamClosed, "data on a closed stream")
+	}
+	if n > st.recvWindow {
+		return h2StreamError(id, h2FlowControlError, "stream window exceeded")
+	}
+	st.recvWindow -= n
+	body, err := h2Unpad(flags, p)
+	if err != nil {
+		return err
+	}
+	st.body = append(st.body, body...)
+	if flags&h2FlagEndStream != 0 {
+		st.remoteDone = true
+		return hc.dispatch(st)
+	}
+	if st.recvWindow < int32(hc.cfg.InitialWindowSize/2) {
+		hc.out = appendH2WindowUpdate(hc.out, id, hc.cfg.InitialWindowSize-uint32(st.recvWindow))
+		st.recvWindow = int32(hc.cfg.InitialWindowSize)
+	}
+	return nil
+}
+
+// setHeaders sets the request of the stream from the decoded header
+// fields, RFC 7540, 8.1.2.
+func (st *h2Stream) setHeaders(fields []hpack.HeaderField) error {
+	var method, scheme, path, authority string
+	var regular bool
+	var head []byte
+	for _, f := range fields {
+		if strings.HasPrefix(f.Name, ":") {
+			if regular {
+				return h2StreamError(st.id, h2ProtocolError, "pseudo header after regular headers")
+			}
+			switch f.Name {
+			case ":method":
+				method = f.Value
+			case ":scheme":
+				scheme = f.Value
+			case ":path":
+				path = f.Value
+			case ":authority":
+				authority = f.Value
+			default:
+				return h2StreamError(st.id, h2ProtocolError, "unknown pseudo header")
+			}
+			continue
+		}
+		regular = true
+		if strings.ToLower(f.Name) != f.Name || h2ConnHeaders[f.Name] || f.Name == "te" && f.Value != "trailers" {
+			return h2StreamError(st.id, h2ProtocolError, "invalid header "+f.Name)
+		}
+		head = append(head, textproto.CanonicalMIMEHeaderKey(f.Name)...)
+		head = append(head, ": "...)
+		head = append(head, f.Value...)
+		head = append(head, '\r', '\n')
+	}
+	if method == "" || scheme == "" || path == "" {
+		return h2StreamError(st.id, h2ProtocolError, "missing pseudo header")
+	}
+	if authority != "" && headerValue(string(head), "Host") == "" {
+		head = append([]byte("Host: "+authority+"\r\n"), head...)
+	}
+	st.req.SetProto("HTTP/2.0")
+	st.req.SetMethod(method)
+	st.req.SetPath(path)
+	if q := strings.IndexByte(path, '?'); q >= 0 {
+		st.req.SetQuery(path[q+1:])
+	}
+	st.req.SetHead(string(head))
+	return nil
+}
+
+// dispatch serves the complete request of the stream and sends the
+// response headers, the body is sent by flush.
+func (hc *h2Conn) dispatch(st *h2Stream) error {
+	st.req.SetBody(string(st.body))
+	st.req.SetRemoteAddr(hc.conn.RemoteAddr().String())
+	size := len(st.body)
+	st.body = nil
+	if hc.server.streams != nil && hc.server.streams.Accept(&st.req) {
+		st.call = hc.server.streams.Start(hc.conn, &st.req)
+		return nil
+	}
+	w := Writer{head: Header{}, http2: true}
+	hc.server.handle(&w, &st.req, size)
+	if w.takeover != nil {
+		return h2StreamError(st.id, h2HTTP11Required, "protocol switch over http2")
+	}
+	status := w.statusCode
+	if status == 0 {
+		status = StatusOK
+	}
+	hc.encBuf.Reset()
+	hc.enc.WriteField(hpack.HeaderField{Name: ":status", Value: strconv.Itoa(status)})
+	hc.enc.WriteField(hpack.HeaderField{Name: "server", Value: "pure server"})
+	hc.enc.WriteField(hpack.HeaderField{Name: "date", Value: time.Now().Format("Mon, 02 Jan 2006 15:04:05 GMT")})
+	if len(w.body) > 0 {
+		hc.enc.WriteField(hpack.HeaderField{Name: "content-length", Value: strconv.Itoa(len(w.body))})
+	}
+	for key, values := range w.head {
+		name := strings.ToLower(key)
+		if h2ConnHeaders[name] || name == "content-length" {
+			continue
+		}
+		for _, v := range values {
+			hc.enc.WriteField(hpack.HeaderField{Name: name, Value: v})
+		}
+	}
+	st.out = w.body
+	if st.req.GetMethod() == "HEAD" {
+		st.out = nil
+	}
+	st.done = true
+	hc.appendHeaders(st.id, hc.encBuf.Bytes(), len(st.out) == 0)
+	if len(st.out) == 0 {
+		delete(hc.streams, st.id)
+	}
+	return nil
+}
+
+// appendHeaders appends the header block, split into a HEADERS frame and
+// CONTINUATION frames by the frame size of the client.
+func (hc *h2Conn) appendHeaders(id uint32, block []byte, end bool) {
+	typ, flags := byte(h2FrameHeaders), byte(0)
+	if end {
+		flags = h2FlagEndStream
+	}
+	for {
+		n := len(block)
+		if n > int(hc.peerFrameSize) {
+			n = int(hc.peerFrameSize)
+		}
+		if n == len(block) {
+			flags |= h2FlagEndHeaders
+		}
+		hc.out = appendH2Frame(hc.out, typ, flags, id, block[:n])
+		if block = block[n:]; len(block) == 0 {
+			return
+		}
+		typ, flags = h2FrameContinuation, 0
+	}
+}
+
+// pull sends the response header of the handler stream and queues its
+// data, the trailer is sent once the data is written. It reports whether a
+// part was pulled.
+func (hc *h2Conn) pull(st *h2Stream) bool {
+	window := hc.sendWindow
+	if st.sendWindow < window {
+		window = st.sendWindow
+	}
+	if window < 0 {
+		window = 0
+	}
+	headers, data, trailers, done := st.call.Pull(int(window))
+	if headers != nil {
+		hc.appendFields(st.id, headers, false)
+	}
+	st.out = append(st.out, data...)
+	if done {
+		st.call, st.done, st.trailer = nil, true, trailers
+	}
+	return headers != nil || len(data) > 0 || done
+}
+
+// appendFields encodes the header fields and appends the header block.
+func (hc *h2Conn) appendFields(id uint32, fields []hpack.HeaderField, end bool) {
+	hc.encBuf.Reset()
+	for _, f := range fields {
+		hc.enc.WriteField(f)
+	}
+	hc.appendHeaders(id, hc.encBuf.Bytes(), end)
+}
+
+// streamError resets the stream.
+func (hc *h2Conn) streamError(err *h2Error) {
+	hc.removeStream(err.stream)
+	hc.out = appendH2RSTStream(hc.out, err.stream, err.code)
+}
+
+// connError sends GOAWAY before the connection is closed.
+func (hc *h2Conn) connError(err *h2Error) {
+	hc.out = appendH2GoAway(hc.out, hc.lastID, err.code, err.reason)
+}
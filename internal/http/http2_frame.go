@@ -0,0 +1,164 @@
+package http
+
+import (
+	"encoding/binary"
+)
+
+// h2Preface is the client connection preface, RFC 7540, 3.5.
+const h2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// h2FrameHeaderLen is the length of the frame header, RFC 7540, 4.1.
+const h2FrameHeaderLen = 9
+
+// HTTP/2 frame types, RFC 7540, 6.
+const (
+	h2FrameData         = 0x0
+	h2FrameHeaders      = 0x1
+	h2FramePriority     = 0x2
+	h2FrameRSTStream    = 0x3
+	h2FrameSettings     = 0x4
+	h2FramePushPromise  = 0x5
+	h2FramePing         = 0x6
+	h2FrameGoAway       = 0x7
+	h2FrameWindowUpdate = 0x8
+	h2FrameContinuation = 0x9
+)
+
+// HTTP/2 frame flags.
+const (
+	h2FlagEndStream  = 0x1
+	h2FlagAck        = 0x1
+	h2FlagEndHeaders = 0x4
+	h2FlagPadded     = 0x8
+	h2FlagPriority   = 0x20
+)
+
+// HTTP/2 settings, RFC 7540, 6.5.2.
+const (
+	h2SettingHeaderTableSize      = 0x1
+	h2SettingEnablePush           = 0x2
+	h2SettingMaxConcurrentStreams = 0x3
+	h2SettingInitialWindowSize    = 0x4
+	h2SettingMaxFrameSize         = 0x5
+	h2SettingMaxHeaderListSize    = 0x6
+)
+
+// HTTP/2 error codes, RFC 7540, 7.
+const (
+	h2NoError          = 0x0
+	h2ProtocolError    = 0x1
+	h2InternalError    = 0x2
+	h2FlowControlError = 0x3
+	h2StreamClosed     = 0x5
+	h2FrameSizeError   = 0x6
+	h2RefusedStream    = 0x7
+	h2CompressionError = 0x9
+	h2EnhanceYourCalm  = 0xb
+	h2HTTP11Required   = 0xd
+)
+
+// HTTP/2 window and frame sizes, RFC 7540, 6.5.2.
+const (
+	h2DefaultWindowSize  = 65535
+	h2DefaultFrameSize   = 16384
+	h2MaxFrameSizeLimit  = 1<<24 - 1
+	h2MaxWindowSizeLimit = 1<<31 - 1
+)
+
+// h2Error is a connection error when the stream is zero, or a stream
+// error, RFC 7540, 5.4.
+type h2Error struct {
+	stream uint32
+	code   uint32
+	reason string
+}
+
+func (e *h2Error) Error() string {
+	return "http2: " + e.reason
+}
+
+func h2ConnError(code uint32, reason string) error {
+	return &h2Error{code: code, reason: reason}
+}
+
+func h2StreamError(stream, code uint32, reason string) error {
+	return &h2Error{stream: stream, code: code, reason: reason}
+}
+
+// h2Setting is a single parameter of a SETTINGS frame.
+type h2Setting struct {
+	id    uint16
+	value uint32
+}
+
+// parseH2Settings parses and validates the payload of a SETTINGS frame.
+func parseH2Settings(p []byte) ([]h2Setting, error) {
+	if len(p)%6 != 0 {
+		return nil, h2ConnError(h2FrameSizeError, "invalid settings length")
+	}
+	settings := make([]h2Setting, 0, len(p)/6)
+	for ; len(p) > 0; p = p[6:] {
+		s := h2Setting{id: binary.BigEndian.Uint16(p), value: binary.BigEndian.Uint32(p[2:])}
+		switch {
+		case s.id == h2SettingEnablePush && s.value > 1:
+			return nil, h2ConnError(h2ProtocolError, "invalid push setting")
+		case s.id == h2SettingInitialWindowSize && s.value > h2MaxWindowSizeLimit:
+			return nil, h2ConnError(h2FlowControlError, "invalid initial window size")
+		case s.id == h2SettingMaxFrameSize && (s.value < h2DefaultFrameSize || s.value > h2MaxFrameSizeLimit):
+			return nil, h2ConnError(h2ProtocolError, "invalid max frame size")
+		}
+		settings = append(settings, s)
+	}
+	return settings, nil
+}
+
+// appendH2Frame appends a frame.
+func appendH2Frame(b []byte, typ, flags byte, stream uint32, payload []byte) []byte {
+	n := len(payload)
+	b = append(b, byte(n>>16), byte(n>>8), byte(n), typ, flags,
+		byte(stream>>24)&0x7f, byte(stream>>16), byte(stream>>8), byte(stream))
+	return append(b, payload...)
+}
+
+// appendH2Settings appends a SETTINGS frame.
+func appendH2Settings(b []byte, settings ...h2Setting) []byte {
+	p := make([]byte, 0, 6*len(settings))
+	for _, s := range settings {
+		p = append(p, byte(s.id>>8), byte(s.id),
+			byte(s.value>>24), byte(s.value>>16), byte(s.value>>8), byte(s.value))
+	}
+	return appendH2Frame(b, h2FrameSettings, 0, 0, p)
+}
+
+// appendH2WindowUpdate appends a WINDOW_UPDATE frame.
+func appendH2WindowUpdate(b []byte, stream, inc uint32) []byte {
+	var p [4]byte
+	binary.BigEndian.PutUint32(p[:], inc)
+	return appendH2Frame(b, h2FrameWindowUpdate, 0, stream, p[:])
+}
+
+// appendH2RSTStream appends a RST_STREAM frame.
+func appendH2RSTStream(b []byte, stream, code uint32) []byte {
+	var p [4]byte
+	binary.BigEndian.PutUint32(p[:], code)
+	return appendH2Frame(b, h2FrameRSTStream, 0, stream, p[:])
+}
+
+// appendH2GoAway appends a GOAWAY frame with the reason as debug data.
+func appendH2GoAway(b []byte, last, code uint32, reason string) []byte {
+	p := make([]byte, 8, 8+len(reason))
+	binary.BigEndian.PutUint32(p, last)
+	binary.BigEndian.PutUint32(p[4:], code)
+	return appendH2Frame(b, h2FrameGoAway, 0, 0, append(p, reason...))
+}
+
+// h2Unpad removes the padding of a DATA or HEADERS frame payload.
+func h2Unpad(flags byte, p []byte) ([]byte, error) {
+	if flags&h2FlagPadded == 0 {
+		return p, nil
+	}
+	if len(p) == 0 || int(p[0]) >= len(p) {
+		return nil, h2ConnError(h2ProtocolError, "invalid padding")
+	}
+	return p[1 : len(p)-int(p[0])], nil
+}
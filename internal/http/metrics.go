@@ -0,0 +1,256 @@
+package http
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// unmatchedRoute is the route label of the requests that match no pattern.
+const unmatchedRoute = "unmatched"
+
+// otherMethod is the method label of the requests with a non-standard
+// method, so the clients can't grow the series without bound.
+const otherMethod = "OTHER"
+
+var (
+	durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	sizeBuckets     = []float64{100, 1000, 10000, 100000, 1e6, 1e7}
+)
+
+// routeRecorder is implemented by the response writers that keep the route
+// pattern matched by the mux.
+type routeRecorder interface {
+	setRoute(pat string)
+}
+
+// Metrics collects the request metrics of the server and renders them in
+// the Prometheus text format.
+type Metrics struct {
+	inFlight    int64
+	parseErrors uint64
+
+	mu        sync.Mutex
+	requests  map[requestKey]uint64
+	durations map[routeKey]*histogram
+	reqSizes  map[routeKey]*histogram
+	respSizes map[routeKey]*histogram
+}
+
+type routeKey struct {
+	route, method string
+}
+
+type requestKey struct {
+	routeKey
+	status int
+}
+
+// histogram is a cumulative histogram.
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// NewMetrics returns empty metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:  make(map[requestKey]uint64),
+		durations: make(map[routeKey]*histogram),
+		reqSizes:  make(map[routeKey]*histogram),
+		respSizes: make(map[routeKey]*histogram),
+	}
+}
+
+// begin counts a request in flight.
+func (m *Metrics) begin() {
+	atomic.AddInt64(&m.inFlight, 1)
+}
+
+// end records a handled request.
+func (m *Metrics) end(route, method string, status int, d time.Duration, reqSize, respSize int) {
+	atomic.AddInt64(&m.inFlight, -1)
+	if route == "" {
+		route = unmatchedRoute
+	}
+	if status == 0 {
+		status = StatusOK
+	}
+	rk := routeKey{route, methodLabel(method)}
+	m.mu.Lock()
+	m.requests[requestKey{rk, status}]++
+	observe(m.durations, rk, durationBuckets, d.Seconds())
+	observe(m.reqSizes, rk, sizeBuckets, float64(reqSize))
+	observe(m.respSizes, rk, sizeBuckets, float64(respSize))
+	m.mu.Unlock()
+}
+
+// methodLabel returns the method label of the request method.
+func methodLabel(method string) string {
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "CONNECT", "OPTIONS", "TRACE":
+		return method
+	}
+	return otherMethod
+}
+
+func observe(hs map[routeKey]*histogram, rk routeKey, buckets []float64, v float64) {
+	h := hs[rk]
+	if h == nil {
+		h = newHistogram(buckets)
+		hs[rk] = h
+	}
+	h.observe(v)
+}
+
+// parseError counts a request that could not be parsed.
+func (m *Metrics) parseError() {
+	atomic.AddUint64(&m.parseErrors, 1)
+}
+
+// Handle serves the metrics in the Prometheus text format.
+func (m *Metrics) Handle(w ResponseWriter, r HttpRequestInterface) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.SetBody(m.appendText(nil))
+}
+
+// appendText appends the metrics in the Prometheus text format.
+func (m *Metrics) appendText(b []byte) []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b = append(b, "# HELP pureserver_http_requests_total Number of handled HTTP requests.\n"...)
+	b = append(b, "# TYPE pureserver_http_requests_total counter\n"...)
+	keys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].routeKey != keys[j].routeKey {
+			return keys[i].routeKey.less(keys[j].routeKey)
+		}
+		return keys[i].status < keys[j].status
+	})
+	for _, k := range keys {
+		b = append(b, "pureserver_http_requests_total"...)
+		b = appendLabels(b, k.routeKey, "status", strconv.Itoa(k.status))
+		b = append(b, ' ')
+		b = strconv.AppendUint(b, m.requests[k], 10)
+		b = append(b, '\n')
+	}
+
+	b = appendHistograms(b, "pureserver_http_request_duration_seconds",
+		"Duration of the HTTP requests.", m.durations)
+
+	b = append(b, "# HELP pureserver_http_requests_in_flight Number of HTTP requests being handled.\n"...)
+	b = append(b, "# TYPE pureserver_http_requests_in_flight gauge\n"...)
+	b = append(b, "pureserver_http_requests_in_flight "...)
+	b = strconv.AppendInt(b, atomic.LoadInt64(&m.inFlight), 10)
+	b = append(b, '\n')
+
+	b = appendHistograms(b, "pureserver_http_request_size_bytes",
+		"Size of the HTTP requests.", m.reqSizes)
+	b = appendHistograms(b, "pureserver_http_response_size_bytes",
+		"Size of the HTTP responses.", m.respSizes)
+
+	b = append(b, "# HELP pureserver_http_parse_errors_total Number of HTTP requests that could not be parsed.\n"...)
+	b = append(b, "# TYPE pureserver_http_parse_errors_total counter\n"...)
+	b = append(b, "pureserver_http_parse_errors_total "...)
+	b = strconv.AppendUint(b, atomic.LoadUint64(&m.parseErrors), 10)
+	b = append(b, '\n')
+	return b
+}
+
+func (k routeKey) less(o routeKey) bool {
+	if k.route != o.route {
+		return k.route < o.route
+	}
+	return k.method < o.method
+}
+
+func appendHistograms(b []byte, name, help string, hs map[routeKey]*histogram) []byte {
+	b = append(b, "# HELP "+name+" "+help+"\n"...)
+	b = append(b, "# TYPE "+name+" histogram\n"...)
+	keys := make([]routeKey, 0, len(hs))
+	for k := range hs {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].less(keys[j]) })
+	for _, k := range keys {
+		h := hs[k]
+		for i, le := range h.buckets {
+			b = append(b, name+"_bucket"...)
+			b = appendLabels(b, k, "le", formatFloat(le))
+			b = append(b, ' ')
+			b = strconv.AppendUint(b, h.counts[i], 10)
+			b = append(b, '\n')
+		}
+		b = append(b, name+"_bucket"...)
+		b = appendLabels(b, k, "le", "+Inf")
+		b = append(b, ' ')
+		b = strconv.AppendUint(b, h.count, 10)
+		b = append(b, '\n')
+		b = append(b, name+"_sum"...)
+		b = appendLabels(b, k, "", "")
+		b = append(b, ' ')
+		b = append(b, formatFloat(h.sum)...)
+		b = append(b, '\n')
+		b = append(b, name+"_count"...)
+		b = appendLabels(b, k, "", "")
+		b = append(b, ' ')
+		b = strconv.AppendUint(b, h.count, 10)
+		b = append(b, '\n')
+	}
+	return b
+}
+
+// appendLabels appends the route and method labels, and the extra label
+// when its name is not empty.
+func appendLabels(b []byte, k routeKey, name, value string) []byte {
+	b = append(b, `{route="`...)
+	b = append(b, escapeLabel(k.route)...)
+	b = append(b, `",method="`...)
+	b = append(b, escapeLabel(k.method)...)
+	b = append(b, '"')
+	if name != "" {
+		b = append(b, ',')
+		b = append(b, name...)
+		b = append(b, `="`...)
+		b = append(b, escapeLabel(value)...)
+		b = append(b, '"')
+	}
+	return append(b, '}')
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -2,6 +2,7 @@ package http
 
 import (
 	"net/url"
+	"sort"
 	"strings"
 )
 
@@ -16,6 +17,9 @@ type PatternServeMux struct {
 func (p *PatternServeMux) ServeHTTP(w ResponseWriter, r HttpRequestInterface) {
 	for _, ph := range p.Handlers[r.GetMethod()] {
 		if params, ok := ph.try(r.GetPath().EscapedPath()); ok {
+			if rr, ok := w.(routeRecorder); ok {
+				rr.setRoute(ph.pat)
+			}
 			if len(params) > 0 && !ph.redirect {
 				r.GetPath().RawQuery = url.Values(params).Encode() + "&" + r.GetPath().RawQuery
 			}
@@ -52,6 +56,23 @@ func (p *PatternServeMux) ServeHTTP(w ResponseWriter, r HttpRequestInterface) {
 	return
 }
 
+// Routes returns the registered routes, sorted by pattern and method.
+func (p *PatternServeMux) Routes() []Route {
+	var routes []Route
+	for meth, handlers := range p.Handlers {
+		for _, ph := range handlers {
+			routes = append(routes, Route{Method: meth, Pattern: ph.pat})
+		}
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Pattern != routes[j].Pattern {
+			return routes[i].Pattern < routes[j].Pattern
+		}
+		return routes[i].Method < routes[j].Method
+	})
+	return routes
+}
+
 // Head will register a pattern with a handler for HEAD requests.
 func (p *PatternServeMux) Head(pat string, h CallableHandler) {
 	p.Add("HEAD", pat, h)
@@ -1,12 +1,29 @@
 package http
 
-import "net/url"
+import (
+	"context"
+	"net/url"
+)
 
 type Request struct {
 	Proto, Method     string
 	Path              *url.URL
 	Query, Head, Body string
 	RemoteAddr        string
+	ctx               context.Context
+}
+
+// Context returns the context of the request, which carries the trace
+// span when tracing is enabled.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+func (r *Request) SetContext(ctx context.Context) {
+	r.ctx = ctx
 }
 
 func (r *Request) GetProto() string {
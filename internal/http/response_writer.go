@@ -1,7 +1,10 @@
 package http
 
 import (
+	"github.com/konstantin-kukharev/pureserver/evloop"
+	"io"
 	"net/textproto"
+	"os"
 	"strconv"
 	"time"
 )
@@ -90,11 +93,48 @@ func (h Header) Clone() Header {
 	return h2
 }
 
+// streamConn is a connection taken over by a protocol once the response
+// of its request is written, like a WebSocket or an event stream.
+type streamConn interface {
+	// data handles the input of the connection, or a wake when in is nil.
+	data(in []byte) (out []byte, action evloop.Action)
+	// closed handles the Closed event of the connection.
+	closed()
+}
+
+// connTakeover opens the stream of a connection taken over by a handler.
+type connTakeover interface {
+	open(c evloop.Conn, req HttpRequestInterface) streamConn
+}
+
+// takeOverWriter is implemented by the response writers that can hand the
+// connection over to another protocol.
+type takeOverWriter interface {
+	takeOver(t connTakeover)
+}
+
+// fileWriter is implemented by the response writers that can send the body
+// from a file, without reading it into memory.
+type fileWriter interface {
+	setFile(f *os.File, offset, count int64)
+}
+
+// fileBody is a part of a file sent as the response body.
+type fileBody struct {
+	f      *os.File
+	offset int64
+	count  int64
+}
+
 type Writer struct {
 	head       Header
 	body       []byte
 	response   []byte
 	statusCode int
+	route      string       // pattern matched by the mux
+	takeover   connTakeover // protocol taking over the connection
+	http2      bool         // the response is framed by an HTTP/2 stream
+	file       *fileBody    // body sent from a file by the connection
 }
 
 func (w *Writer) Header() Header {
@@ -102,21 +142,47 @@ func (w *Writer) Header() Header {
 }
 
 func (w *Writer) Write() {
+	if w.http2 {
+		// the stream frames the status, the head and the body
+		if w.file != nil {
+			w.body = w.file.read()
+			w.file = nil
+		}
+		w.response = w.body
+		return
+	}
 	var b []byte
 	b = append(b, "HTTP/1.1"...)
 	b = append(b, ' ')
-	b = append(b, "200 OK"...)
+	code := w.statusCode
+	if code == 0 {
+		code = StatusOK
+	}
+	b = strconv.AppendInt(b, int64(code), 10)
+	b = append(b, ' ')
+	b = append(b, statusText[code]...)
 	b = append(b, '\r', '\n')
 	b = append(b, "Server: pure server\r\n"...)
 	b = append(b, "Date: "...)
 	b = time.Now().AppendFormat(b, "Mon, 02 Jan 2006 15:04:05 GMT")
 	b = append(b, '\r', '\n')
-	if len(w.body) > 0 {
+	if w.file != nil {
+		b = append(b, "Content-Length: "...)
+		b = strconv.AppendInt(b, w.file.count, 10)
+		b = append(b, '\r', '\n')
+	} else if len(w.body) > 0 {
 		b = append(b, "Content-Length: "...)
 		b = strconv.AppendInt(b, int64(len(w.body)), 10)
 		b = append(b, '\r', '\n')
 	}
-	//b = append(b, ""...)
+	for key, values := range w.head {
+		for _, v := range values {
+			b = append(b, key...)
+			b = append(b, ": "...)
+			b = append(b, v...)
+			b = append(b, '\r', '\n')
+		}
+	}
 	b = append(b, '\r', '\n')
 	if len(w.body) > 0 {
 		b = append(b, w.body...)
@@ -132,3 +198,37 @@ func (w *Writer) WriteHeader(statusCode int) {
 func (w *Writer) SetBody(body []byte) {
 	w.body = body
 }
+
+func (w *Writer) setRoute(pat string) {
+	w.route = pat
+}
+
+func (w *Writer) takeOver(t connTakeover) {
+	w.takeover = t
+}
+
+// setFile sets the body to count bytes of the file from offset, the
+// writer owns the file.
+func (w *Writer) setFile(f *os.File, offset, count int64) {
+	if w.file != nil {
+		w.file.f.Close()
+	}
+	w.body = nil
+	w.file = &fileBody{f: f, offset: offset, count: count}
+}
+
+// bodySize returns the size of the response body.
+func (w *Writer) bodySize() int {
+	if w.file != nil {
+		return int(w.file.count)
+	}
+	return len(w.body)
+}
+
+// read reads and closes the file, for the writers that can't send it.
+func (fb *fileBody) read() []byte {
+	defer fb.f.Close()
+	b := make([]byte, fb.count)
+	n, _ := io.ReadFull(io.NewSectionReader(fb.f, fb.offset, fb.count), b)
+	return b[:n]
+}
@@ -1,12 +1,14 @@
 package http
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
-	ps "github.com/konstantin-kukharev/pureserver/internal"
+	"github.com/konstantin-kukharev/pureserver/evloop"
 	"log"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,7 +17,23 @@ type Server struct {
 	loops      int
 	port       []int
 	unixSocket []string
+	listeners  []string
 	router     PatternServeMuxInterface
+	options    []evloop.Option
+	acl        *evloop.ACL
+	metrics    *Metrics
+	accessLog  *accessLogger
+	exporter   SpanExporter
+	health     *health
+	admin      Admin
+	http2      *HTTP2
+	h2conns    h2Conns
+	tls        *tls.Config
+	streams    StreamHandler
+	srv        atomic.Value // evloop.Server of the running server
+	// metricsPath and healthPaths are reported by the admin listener.
+	metricsPath string
+	healthPaths []string
 }
 
 func (server *Server) SetLoops(loops int) {
@@ -26,49 +44,217 @@ func (server *Server) SetPort(port ...int) {
 	server.port = port
 }
 
+// SetUnixSocket sets the unix socket paths to listen on. A path may carry
+// the mode, owner and group options, like
+// "/run/app.sock?mode=0660&owner=www&group=www", and a path starting with
+// "@" is bound in the Linux abstract namespace.
 func (server *Server) SetUnixSocket(socket ...string) {
 	server.unixSocket = socket
 }
 
+// SetListeners sets event loop addresses to listen on in addition to the
+// ports and unix sockets, like "fd://3" for an inherited listener or
+// "systemd://http" for a socket passed with systemd socket activation.
+func (server *Server) SetListeners(address ...string) {
+	server.listeners = address
+}
+
+// SetOptions sets additional event loop options.
+func (server *Server) SetOptions(options ...evloop.Option) {
+	server.options = options
+}
+
+// SetACL filters the clients of all the listeners with the access control
+// list. The rules of the list may be replaced with ACL.Set while the server
+// is running.
+func (server *Server) SetACL(acl *evloop.ACL) {
+	server.acl = acl
+}
+
+// SetMetrics enables the request metrics and serves them in the Prometheus
+// text format at the path of the router, like "/metrics". The requests are
+// labeled with the route patterns of the router.
+func (server *Server) SetMetrics(path string) {
+	server.metrics = NewMetrics()
+	server.metricsPath = path
+	server.router.Get(path, server.metrics)
+}
+
+// SetAccessLog enables the access log of the requests.
+func (server *Server) SetAccessLog(cfg AccessLog) {
+	server.accessLog = newAccessLogger(cfg)
+}
+
+// SetTracing starts a trace span for every request, a child of the span of
+// the W3C traceparent header when the request has one, and passes the ended
+// spans to the exporter. Handlers get the span with SpanFromContext.
+func (server *Server) SetTracing(exporter SpanExporter) {
+	server.exporter = exporter
+}
+
+// SetHealth registers the liveness handler at the livePath and the
+// readiness handler at the readyPath of the router, like "/healthz" and
+// "/readyz". Both report their results as JSON. Readiness fails with 503 once
+// the server starts to drain, or when a check added with AddHealthCheck
+// fails.
+func (server *Server) SetHealth(livePath, readyPath string) {
+	if server.health == nil {
+		server.health = &health{draining: server.Draining}
+	}
+	server.healthPaths = []string{livePath, readyPath}
+	server.router.Get(livePath, handlerFunc(server.health.live))
+	server.router.Get(readyPath, handlerFunc(server.health.ready))
+}
+
+// AddHealthCheck adds a named dependency check to the readiness handler,
+// see SetHealth. The checks run every second in the background while the
+// server is running, and the handler reports the results of the last round.
+// A check fails when it doesn't return within the timeout, zero is a five
+// second timeout.
+func (server *Server) AddHealthCheck(name string, timeout time.Duration, check HealthCheck) {
+	if server.health == nil {
+		server.health = &health{draining: server.Draining}
+	}
+	server.health.add(name, timeout, check)
+}
+
+// SetAdmin enables the admin listener, that serves the pprof profiles at
+// /debug/pprof/, a goroutine dump at /debug/goroutines, and the runtime
+// statistics, the event loop statistics, the route table and the server
+// configuration as JSON at /debug/runtime, /debug/loops, /debug/routes and
+// /debug/config. Serve refuses an admin listener that is not a unix socket
+// unless it is protected by the ACL or the token.
+func (server *Server) SetAdmin(admin Admin) {
+	server.admin = admin
+}
+
+// SetHTTP2 enables HTTP/2, with the h2c upgrade of an HTTP/1.1 request and
+// the prior knowledge connection preface over cleartext connections, and
+// with ALPN "h2" over TLS, see SetTLS. The streams are served by the same
+// router as the HTTP/1.1 requests. Once the server starts to drain, the
+// connections get GOAWAY and are closed when their streams complete.
+func (server *Server) SetHTTP2(cfg HTTP2) {
+	server.http2 = &cfg
+}
+
+// SetTLS serves all the stream listeners over TLS with the config, see
+// evloop.WithTLS. When HTTP/2 is enabled, "h2" and "http/1.1" are offered
+// with ALPN.
+func (server *Server) SetTLS(cfg *tls.Config) {
+	server.tls = cfg
+}
+
+// SetStreamHandler serves the HTTP/2 requests that the handler accepts
+// apart from the router, like the gRPC calls of the grpcserver package.
+// HTTP/2 is enabled with the default settings unless SetHTTP2 is called.
+func (server *Server) SetStreamHandler(h StreamHandler) {
+	if server.http2 == nil {
+		server.http2 = &HTTP2{}
+	}
+	server.streams = h
+}
+
+// tlsConfig returns the TLS config of the listeners, with the ALPN
+// protocols of the server.
+func (server *Server) tlsConfig() *tls.Config {
+	cfg := server.tls.Clone()
+	if server.http2 != nil {
+		for _, proto := range []string{"http/1.1", "h2"} {
+			if !hasString(cfg.NextProtos, proto) {
+				cfg.NextProtos = append([]string{proto}, cfg.NextProtos...)
+			}
+		}
+	}
+	return cfg
+}
+
+func hasString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Drain gracefully shutdowns the running server, see evloop.Server.Drain.
+// Serve returns once the open connections are closed.
+func (server *Server) Drain() {
+	if srv, ok := server.srv.Load().(evloop.Server); ok {
+		srv.Drain()
+	}
+}
+
+// Draining reports whether the running server has started to drain.
+func (server *Server) Draining() bool {
+	srv, ok := server.srv.Load().(evloop.Server)
+	return ok && srv.Draining()
+}
+
 func (server *Server) Serve() error {
-	var events ps.Events
+	var events evloop.Events
 	var addresses []string
 
 	if server.loops == 0 {
 		server.loops = -1
 	}
 
-	events.NumLoops = server.loops
-	events.Serving = func(srv ps.Server) (action ps.Action) {
+	events.Serving = func(srv evloop.Server) (action evloop.Action) {
+		server.srv.Store(srv)
 		log.Printf("http server started on port %d (loops: %d)", server.port, srv.NumLoops)
 		if len(server.unixSocket) != 0 {
 			log.Printf("http server started at %v", server.unixSocket)
 		}
+		if len(server.listeners) != 0 {
+			log.Printf("http server started on listeners %v", server.listeners)
+		}
 		return
 	}
 
-	events.Opened = func(c ps.Conn) (out []byte, opts ps.Options, action ps.Action) {
-		c.SetContext(&ps.InputStream{})
+	events.Draining = server.h2conns.drain
+
+	events.Opened = func(c evloop.Conn) (out []byte, opts evloop.Options, action evloop.Action) {
+		c.SetContext(&evloop.InputStream{})
 		return
 	}
 
-	events.Closed = func(c ps.Conn, err error) (action ps.Action) {
+	events.Closed = func(c evloop.Conn, err error) (action evloop.Action) {
+		if sc, ok := c.Context().(streamConn); ok {
+			sc.closed()
+		}
 		return
 	}
 
-	events.Data = func(c ps.Conn, in []byte) (out []byte, action ps.Action) {
+	events.Data = func(c evloop.Conn, in []byte) (out []byte, action evloop.Action) {
+		if sc, ok := c.Context().(streamConn); ok {
+			return sc.data(in)
+		}
 		if in == nil {
 			return
 		}
-		is := c.Context().(*ps.InputStream)
+		is := c.Context().(*evloop.InputStream)
 		data := is.Begin(in)
+		if server.http2 != nil && len(data) > 0 && data[0] == h2Preface[0] {
+			// the prior knowledge connection preface
+			if n := len(data); n < len(h2Preface) && string(data) == h2Preface[:n] {
+				is.End(data)
+				return
+			} else if n >= len(h2Preface) && string(data[:len(h2Preface)]) == h2Preface {
+				sc := (&h2Upgrade{server: server}).open(c, nil)
+				c.SetContext(sc)
+				return sc.data(data)
+			}
+		}
 		// process the pipeline
 		var req Request
 		for {
 			leftover, err := server.parseRequest(data, &req)
 			if err != nil {
+				if server.metrics != nil {
+					server.metrics.parseError()
+				}
 				out = server.appendResponse(out, "500 Error", "", err.Error()+"\n")
-				action = ps.Close
+				action = evloop.Close
 				break
 			} else if len(leftover) == len(data) {
 				// request not ready, yet
@@ -76,8 +262,20 @@ func (server *Server) Serve() error {
 			}
 			// handle the request
 			req.RemoteAddr = c.RemoteAddr().String()
-			out = server.appendHandle(out, &req)
+			var t connTakeover
+			if up := server.h2cUpgrade(&req); up != nil {
+				out, t = append(out, h2cSwitching...), up
+			} else {
+				out, t = server.appendHandle(c, out, &req, len(data)-len(leftover))
+			}
 			data = leftover
+			if t != nil {
+				// the rest of the input belongs to the new protocol
+				sc := t.open(c, &req)
+				c.SetContext(sc)
+				sout, saction := sc.data(data)
+				return append(out, sout...), saction
+			}
 		}
 		is.End(data)
 		return
@@ -95,11 +293,37 @@ func (server *Server) Serve() error {
 		}
 	}
 
+	addresses = append(addresses, server.listeners...)
+
 	if len(addresses) == 0 {
 		return errors.New("no address specified")
 	}
 
-	return ps.Serve(events, addresses...)
+	if server.admin.Address != "" {
+		stop, err := server.listenAdmin()
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+
+	if server.accessLog != nil {
+		server.accessLog.start()
+		defer server.accessLog.stop()
+	}
+	if server.health != nil {
+		server.health.start()
+		defer server.health.stop()
+	}
+
+	options := append([]evloop.Option{evloop.WithNumLoops(server.loops)}, server.options...)
+	if server.acl != nil {
+		options = append(options, evloop.WithACL(server.acl))
+	}
+	if server.tls != nil {
+		options = append(options, evloop.WithTLS(server.tlsConfig()))
+	}
+	return evloop.Run(events, addresses, options...)
 }
 
 func (server *Server) SetHandler(handler PatternServeMuxInterface) {
@@ -107,14 +331,94 @@ func (server *Server) SetHandler(handler PatternServeMuxInterface) {
 }
 
 // appendHandle handles the incoming request and appends the response to
-// the provided bytes, which is then returned to the caller.
-func (server *Server) appendHandle(_ []byte, req HttpRequestInterface) []byte {
+// the provided bytes, which is then returned to the caller along with the
+// protocol taking over the connection, if any. A file body is sent by the
+// connection after the bytes, which are handed over with it.
+func (server *Server) appendHandle(c evloop.Conn, b []byte, req HttpRequestInterface, size int) ([]byte, connTakeover) {
 	writer := Writer{
 		head: Header{},
 	}
-	server.router.ServeHTTP(&writer, req)
+	server.handle(&writer, req, size)
+	b = append(b, writer.response...)
+	if fb := writer.file; fb != nil {
+		// the error is for the datagram connections only
+		c.SendFile(b, fb.f, fb.offset, fb.count)
+		b = nil
+	}
+	return b, writer.takeover
+}
+
+// handle serves the request with the router and writes the response,
+// recording the request metrics, access log and trace span when enabled.
+func (server *Server) handle(writer *Writer, req HttpRequestInterface, size int) {
+	if server.metrics == nil && server.accessLog == nil && server.exporter == nil {
+		server.router.ServeHTTP(writer, req)
+		writer.Write()
+		return
+	}
+	// the mux adds the route parameters to the query
+	target := req.GetPath().RequestURI()
+	var id string
+	if server.accessLog != nil {
+		id = server.accessLog.requestID(req)
+		writer.head.Set("X-Request-Id", id)
+	}
+	var sp *span
+	if server.exporter != nil {
+		sp = startSpan(server.exporter, req.GetHead())
+		if cr, ok := req.(ContextRequest); ok {
+			cr.SetContext(ContextWithSpan(cr.Context(), sp))
+		}
+	}
+	start := time.Now()
+	if server.metrics != nil {
+		server.metrics.begin()
+	}
+	server.router.ServeHTTP(writer, req)
 	writer.Write()
-	return writer.response
+	d := time.Since(start)
+	if sp != nil {
+		endSpan(sp, req, target, writer)
+	}
+	if server.metrics != nil {
+		written := len(writer.response)
+		if writer.file != nil {
+			written += int(writer.file.count)
+		}
+		server.metrics.end(writer.route, req.GetMethod(), writer.statusCode, d, size, written)
+	}
+	if server.accessLog != nil {
+		server.accessLog.log(req, target, writer, start, d, id)
+	}
+}
+
+// endSpan records the route and the status of the request and ends its
+// span.
+func endSpan(sp *span, req HttpRequestInterface, target string, w *Writer) {
+	route := w.route
+	if route == "" {
+		route = unmatchedRoute
+	}
+	status := w.statusCode
+	if status == 0 {
+		status = StatusOK
+	}
+	sp.mu.Lock()
+	if sp.ended {
+		sp.mu.Unlock()
+		return
+	}
+	sp.data.Name = req.GetMethod() + " " + route
+	sp.data.Attributes["http.method"] = req.GetMethod()
+	sp.data.Attributes["http.route"] = route
+	sp.data.Attributes["http.target"] = target
+	sp.data.Attributes["http.status_code"] = status
+	sp.data.Attributes["net.peer.addr"] = req.GetRemoteAddr()
+	if status >= 500 {
+		sp.data.Failed = true
+	}
+	sp.mu.Unlock()
+	sp.End()
 }
 
 // A Handler responds to an HTTP request.
@@ -184,11 +488,9 @@ func (server *Server) parseRequest(data []byte, req HttpRequestInterface) (lefto
 				if sData[i] == '?' && q == -1 {
 					q = i - s
 				} else if sData[i] == ' ' {
+					req.SetPath(sData[s:i])
 					if q != -1 {
-						req.SetPath(sData[s:q])
-						req.SetQuery(req.GetPath().EscapedPath()[q+1 : i])
-					} else {
-						req.SetPath(sData[s:i])
+						req.SetQuery(sData[s+q+1 : i])
 					}
 					for i, s = i+1, i+1; i < len(sData); i++ {
 						if sData[i] == '\n' && sData[i-1] == '\r' {
@@ -0,0 +1,189 @@
+package http
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SpanContext identifies a span, as carried by the W3C traceparent and
+// tracestate headers.
+type SpanContext struct {
+	TraceID    [16]byte
+	SpanID     [8]byte
+	Flags      byte   // trace flags, 1 for sampled
+	TraceState string // vendor state, passed along as is
+	Remote     bool   // set for the span contexts parsed from a request
+}
+
+// IsValid reports whether the trace and span IDs are set.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// TraceParent returns the traceparent header value of the span context.
+func (sc SpanContext) TraceParent() string {
+	b := make([]byte, 0, 55)
+	b = append(b, "00-"...)
+	b = append(b, hex.EncodeToString(sc.TraceID[:])...)
+	b = append(b, '-')
+	b = append(b, hex.EncodeToString(sc.SpanID[:])...)
+	b = append(b, '-')
+	b = append(b, hex.EncodeToString([]byte{sc.Flags})...)
+	return string(b)
+}
+
+// parseTraceParent parses a traceparent header value.
+func parseTraceParent(s string) (SpanContext, bool) {
+	var sc SpanContext
+	s = strings.TrimSpace(s)
+	if len(s) < 55 || s[2] != '-' || s[35] != '-' || s[52] != '-' || (len(s) > 55 && s[55] != '-') {
+		return sc, false
+	}
+	version, err := hex.DecodeString(s[:2])
+	if err != nil || version[0] == 0xff || (version[0] == 0 && len(s) != 55) {
+		return sc, false
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(sc.TraceID[:], []byte(s[3:35])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(s[36:52])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(flags[:], []byte(s[53:55])); err != nil {
+		return sc, false
+	}
+	sc.Flags = flags[0]
+	sc.Remote = true
+	return sc, sc.IsValid()
+}
+
+// Span is the trace span of a request.
+type Span interface {
+	// SpanContext returns the identity of the span.
+	SpanContext() SpanContext
+	// SetAttribute sets an attribute of the span.
+	SetAttribute(key string, value interface{})
+	// RecordError records an error and marks the span as failed.
+	RecordError(err error)
+	// End ends the span and exports it.
+	End()
+}
+
+// SpanData is an ended span, as passed to the exporter.
+type SpanData struct {
+	Name       string
+	Context    SpanContext
+	Parent     SpanContext // invalid for root spans
+	Start, End time.Time
+	Attributes map[string]interface{}
+	Errors     []error
+	// Failed is set for the spans with errors or a server error status.
+	Failed bool
+}
+
+// SpanExporter receives the ended spans. ExportSpan is called on the event
+// loop and must not block, exporters should queue the spans and send them
+// in the background.
+type SpanExporter interface {
+	ExportSpan(span *SpanData)
+}
+
+type spanKey struct{}
+
+// ContextWithSpan returns a copy of the context that carries the span.
+func ContextWithSpan(ctx context.Context, span Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// SpanFromContext returns the span of the context, or a no-op span.
+func SpanFromContext(ctx context.Context) Span {
+	if span, ok := ctx.Value(spanKey{}).(Span); ok {
+		return span
+	}
+	return noopSpan{}
+}
+
+// noopSpan is the span of untraced requests.
+type noopSpan struct{}
+
+func (noopSpan) SpanContext() SpanContext                   { return SpanContext{} }
+func (noopSpan) SetAttribute(key string, value interface{}) {}
+func (noopSpan) RecordError(err error)                      {}
+func (noopSpan) End()                                       {}
+
+// span is a recording span.
+type span struct {
+	mu       sync.Mutex
+	data     SpanData
+	exporter SpanExporter
+	ended    bool
+}
+
+func (s *span) SpanContext() SpanContext {
+	return s.data.Context
+}
+
+// SetAttribute sets an attribute, it is ignored once the span has ended.
+func (s *span) SetAttribute(key string, value interface{}) {
+	s.mu.Lock()
+	if !s.ended {
+		s.data.Attributes[key] = value
+	}
+	s.mu.Unlock()
+}
+
+func (s *span) RecordError(err error) {
+	if err == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.ended {
+		s.data.Errors = append(s.data.Errors, err)
+		s.data.Failed = true
+	}
+	s.mu.Unlock()
+}
+
+func (s *span) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	// the exporter owns the copy, later changes of the span are ignored
+	data := s.data
+	data.Attributes = make(map[string]interface{}, len(s.data.Attributes))
+	for k, v := range s.data.Attributes {
+		data.Attributes[k] = v
+	}
+	data.Errors = append([]error(nil), s.data.Errors...)
+	s.mu.Unlock()
+	s.exporter.ExportSpan(&data)
+}
+
+// startSpan starts the span of a request, a child of the traceparent of
+// the request head when it has one.
+func startSpan(exporter SpanExporter, head string) *span {
+	s := &span{exporter: exporter}
+	s.data.Start = time.Now()
+	s.data.Attributes = make(map[string]interface{})
+	if parent, ok := parseTraceParent(headerValue(head, "traceparent")); ok {
+		parent.TraceState = headerValue(head, "tracestate")
+		s.data.Parent = parent
+		s.data.Context.TraceID = parent.TraceID
+		s.data.Context.Flags = parent.Flags
+		s.data.Context.TraceState = parent.TraceState
+	} else {
+		rand.Read(s.data.Context.TraceID[:])
+		s.data.Context.Flags = 1
+	}
+	rand.Read(s.data.Context.SpanID[:])
+	return s
+}
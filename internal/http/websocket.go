@@ -0,0 +1,519 @@
+package http
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"github.com/konstantin-kukharev/pureserver/evloop"
+	"net"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// MessageType is the type of a WebSocket data message.
+type MessageType int
+
+// WebSocket message types, RFC 6455, 11.8.
+const (
+	TextMessage   MessageType = 1
+	BinaryMessage MessageType = 2
+)
+
+// WebSocket close codes, RFC 6455, 7.4.1.
+const (
+	CloseNormalClosure    = 1000
+	CloseGoingAway        = 1001
+	CloseProtocolError    = 1002
+	CloseUnsupportedData  = 1003
+	CloseNoStatusReceived = 1005
+	CloseAbnormalClosure  = 1006
+	CloseInvalidPayload   = 1007
+	ClosePolicyViolation  = 1008
+	CloseMessageTooBig    = 1009
+	CloseInternalError    = 1011
+)
+
+// ErrWebSocketClosed is returned when writing to a WebSocket connection
+// that has started the close handshake.
+var ErrWebSocketClosed = errors.New("websocket: connection closed")
+
+// websocketGUID is appended to the key of the opening handshake, RFC 6455,
+// 1.3.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// defaultMaxMessageSize limits the received messages when
+// WebSocket.MaxMessageSize is zero.
+const defaultMaxMessageSize = 1 << 20
+
+// WebSocket serves the WebSocket connections of a route, like
+// mux.Get("/ws/:room", &WebSocket{...}). The handshake is validated by the
+// HTTP server, and the connection then keeps running on its event loop, so
+// the callbacks are called on the loop and must not block. The data passed
+// to the callbacks is owned by the callee. A WebSocket must not be copied
+// after first use.
+type WebSocket struct {
+	// Open is called once the handshake completes.
+	Open func(c *WebSocketConn)
+	// Message is called for every text or binary message, once its
+	// fragments are joined and it is decompressed.
+	Message func(c *WebSocketConn, mt MessageType, data []byte)
+	// Pong is called for every pong frame.
+	Pong func(c *WebSocketConn, data []byte)
+	// Close is called once when the connection closes, with the close code
+	// of the peer, CloseNoStatusReceived when its close frame carries no
+	// code, or CloseAbnormalClosure when the connection is closed without
+	// the close handshake.
+	Close func(c *WebSocketConn, code int, reason string)
+	// CheckOrigin rejects the handshake with 403 when it returns false for
+	// the Origin header of the request, empty when the header is missing.
+	CheckOrigin func(origin string) bool
+	// Subprotocols are the supported subprotocols in the order of
+	// preference.
+	Subprotocols []string
+	// Compression negotiates the permessage-deflate extension, RFC 7692,
+	// without context takeover.
+	Compression bool
+	// MaxMessageSize limits the size of the received messages, 1MB when
+	// zero. Larger messages fail the connection with CloseMessageTooBig.
+	MaxMessageSize int
+	// FragmentSize splits the sent messages into fragments of at most
+	// this size, zero sends every message in a single frame.
+	FragmentSize int
+
+	mu    sync.Mutex
+	conns map[*WebSocketConn]struct{}
+}
+
+// wsUpgrade is the result of a successful opening handshake.
+type wsUpgrade struct {
+	ws          *WebSocket
+	subprotocol string
+	deflate     bool
+}
+
+// Handle validates the opening handshake of the request and switches the
+// connection to the WebSocket protocol, RFC 6455, 4.2.
+func (ws *WebSocket) Handle(w ResponseWriter, r HttpRequestInterface) {
+	tw, ok := w.(takeOverWriter)
+	if !ok {
+		Error(w, "websocket is not supported", StatusInternalServerError)
+		return
+	}
+	head := r.GetHead()
+	if r.GetMethod() != "GET" || r.GetProto() != "HTTP/1.1" ||
+		!headerToken(headerValues(head, "Connection"), "upgrade") ||
+		!headerToken(headerValues(head, "Upgrade"), "websocket") {
+		Error(w, "not a websocket handshake", StatusBadRequest)
+		return
+	}
+	if headerValue(head, "Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		Error(w, "unsupported websocket version", StatusUpgradeRequired)
+		return
+	}
+	key := headerValue(head, "Sec-WebSocket-Key")
+	if k, err := base64.StdEncoding.DecodeString(key); err != nil || len(k) != 16 {
+		Error(w, "invalid websocket key", StatusBadRequest)
+		return
+	}
+	if ws.CheckOrigin != nil && !ws.CheckOrigin(headerValue(head, "Origin")) {
+		Error(w, "origin not allowed", StatusForbidden)
+		return
+	}
+	up := &wsUpgrade{ws: ws}
+	h := w.Header()
+	h.Set("Upgrade", "websocket")
+	h.Set("Connection", "Upgrade")
+	h.Set("Sec-WebSocket-Accept", acceptKey(key))
+	if up.subprotocol = ws.subprotocol(headerValues(head, "Sec-WebSocket-Protocol")); up.subprotocol != "" {
+		h.Set("Sec-WebSocket-Protocol", up.subprotocol)
+	}
+	if ws.Compression && acceptDeflate(headerValues(head, "Sec-WebSocket-Extensions")) {
+		up.deflate = true
+		h.Set("Sec-WebSocket-Extensions", "permessage-deflate; server_no_context_takeover; client_no_context_takeover")
+	}
+	w.WriteHeader(StatusSwitchingProtocols)
+	tw.takeOver(up)
+}
+
+// Broadcast writes the message to all the open connections of the
+// WebSocket. It may be called from any goroutine.
+func (ws *WebSocket) Broadcast(mt MessageType, data []byte) {
+	// the writes wake the loops, which may wait for the lock to forget a
+	// closed connection, so they are made without it
+	ws.mu.Lock()
+	conns := make([]*WebSocketConn, 0, len(ws.conns))
+	for wc := range ws.conns {
+		conns = append(conns, wc)
+	}
+	ws.mu.Unlock()
+	var plain, compressed []byte
+	for _, wc := range conns {
+		if wc.deflate {
+			if compressed == nil {
+				compressed = appendMessage(nil, mt, data, true, ws.FragmentSize)
+			}
+			wc.write(compressed, false)
+		} else {
+			if plain == nil {
+				plain = appendMessage(nil, mt, data, false, ws.FragmentSize)
+			}
+			wc.write(plain, false)
+		}
+	}
+}
+
+// Conns returns the number of the open connections.
+func (ws *WebSocket) Conns() int {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return len(ws.conns)
+}
+
+func (ws *WebSocket) maxMessageSize() int {
+	if ws.MaxMessageSize > 0 {
+		return ws.MaxMessageSize
+	}
+	return defaultMaxMessageSize
+}
+
+// subprotocol selects the most preferred subprotocol offered by the client.
+func (ws *WebSocket) subprotocol(offer string) string {
+	for _, p := range ws.Subprotocols {
+		if headerToken(offer, p) {
+			return p
+		}
+	}
+	return ""
+}
+
+// open registers the connection switched to the WebSocket protocol.
+func (u *wsUpgrade) open(c evloop.Conn, req HttpRequestInterface) streamConn {
+	wc := &WebSocketConn{
+		ws:          u.ws,
+		conn:        c,
+		req:         req,
+		subprotocol: u.subprotocol,
+		deflate:     u.deflate,
+		serving:     true,
+	}
+	u.ws.mu.Lock()
+	if u.ws.conns == nil {
+		u.ws.conns = make(map[*WebSocketConn]struct{})
+	}
+	u.ws.conns[wc] = struct{}{}
+	u.ws.mu.Unlock()
+	if u.ws.Open != nil {
+		u.ws.Open(wc)
+	}
+	return wc
+}
+
+// WebSocketConn is a WebSocket connection. The write methods may be called
+// from any goroutine, the frames are written by the event loop of the
+// connection.
+type WebSocketConn struct {
+	ws          *WebSocket
+	conn        evloop.Conn
+	req         HttpRequestInterface
+	subprotocol string
+	deflate     bool
+	ctx         interface{}
+
+	in       []byte      // unparsed input
+	msg      []byte      // fragments of the current message
+	msgType  MessageType // type of the current message, zero when none
+	msgFlate bool        // the current message is compressed
+	done     bool        // the Close callback has been called
+
+	mu      sync.Mutex
+	out     []byte // frames written since the last event of the connection
+	serving bool   // the loop is serving the connection and flushes out
+	closing bool   // the close frame has been sent
+}
+
+// Context returns a user-defined context.
+func (wc *WebSocketConn) Context() interface{} { return wc.ctx }
+
+// SetContext sets a user-defined context.
+func (wc *WebSocketConn) SetContext(ctx interface{}) { wc.ctx = ctx }
+
+// Request returns the request of the opening handshake.
+func (wc *WebSocketConn) Request() HttpRequestInterface { return wc.req }
+
+// Subprotocol returns the negotiated subprotocol, if any.
+func (wc *WebSocketConn) Subprotocol() string { return wc.subprotocol }
+
+// RemoteAddr is the connection's remote peer address.
+func (wc *WebSocketConn) RemoteAddr() net.Addr { return wc.conn.RemoteAddr() }
+
+// WriteMessage writes a text or binary message, compressed when the
+// connection negotiated the permessage-deflate extension.
+func (wc *WebSocketConn) WriteMessage(mt MessageType, data []byte) error {
+	return wc.write(appendMessage(nil, mt, data, wc.deflate, wc.ws.FragmentSize), false)
+}
+
+// Ping writes a ping frame, the peer answers with a pong frame carrying
+// the same data.
+func (wc *WebSocketConn) Ping(data []byte) error {
+	if len(data) > maxControlPayload {
+		return errors.New("websocket: ping data too long")
+	}
+	return wc.write(appendFrame(nil, true, false, opPing, data), false)
+}
+
+// Close starts the close handshake, the connection is closed once the peer
+// replies with its close frame.
+func (wc *WebSocketConn) Close(code int, reason string) error {
+	return wc.write(closeFrame(code, reason), true)
+}
+
+// write queues the frames and wakes the loop of the connection, unless it
+// is serving the connection right now.
+func (wc *WebSocketConn) write(b []byte, closing bool) error {
+	wc.mu.Lock()
+	if wc.closing {
+		wc.mu.Unlock()
+		return ErrWebSocketClosed
+	}
+	wake := !wc.serving && len(wc.out) == 0
+	wc.out = append(wc.out, b...)
+	wc.closing = closing
+	wc.mu.Unlock()
+	if wake {
+		wc.conn.Wake()
+	}
+	return nil
+}
+
+// data handles the input of the connection, or a wake when in is nil, and
+// returns the queued frames.
+func (wc *WebSocketConn) data(in []byte) (out []byte, action evloop.Action) {
+	wc.mu.Lock()
+	wc.serving = true
+	wc.mu.Unlock()
+	wc.in = append(wc.in, in...)
+	var n int
+	for action == evloop.None {
+		var size int
+		size, action = wc.frame(wc.in[n:])
+		if size == 0 {
+			break
+		}
+		n += size
+	}
+	wc.in = append(wc.in[:0], wc.in[n:]...)
+	wc.mu.Lock()
+	out = append(out, wc.out...)
+	wc.out = wc.out[:0]
+	wc.serving = false
+	wc.mu.Unlock()
+	return
+}
+
+// frame handles the first frame of b and returns its size, zero when the
+// frame is not complete yet, RFC 6455, 5.2.
+func (wc *WebSocketConn) frame(b []byte) (int, evloop.Action) {
+	if len(b) < 2 {
+		return 0, evloop.None
+	}
+	fin, rsv, op := b[0]&0x80 != 0, b[0]&0x70, b[0]&0x0f
+	masked, plen := b[1]&0x80 != 0, uint64(b[1]&0x7f)
+	hlen := 2
+	switch plen {
+	case 126:
+		if len(b) < 4 {
+			return 0, evloop.None
+		}
+		plen, hlen = uint64(binary.BigEndian.Uint16(b[2:])), 4
+	case 127:
+		if len(b) < 10 {
+			return 0, evloop.None
+		}
+		plen, hlen = binary.BigEndian.Uint64(b[2:]), 10
+	}
+	switch {
+	case plen>>63 != 0:
+		return 0, wc.fail(CloseProtocolError, "invalid payload length")
+	case !masked:
+		return 0, wc.fail(CloseProtocolError, "unmasked frame")
+	case op > opBinary && op < opClose || op > opPong:
+		return 0, wc.fail(CloseProtocolError, "unknown opcode")
+	case rsv&0x30 != 0 || rsv != 0 && (!wc.deflate || op != opText && op != opBinary):
+		return 0, wc.fail(CloseProtocolError, "unexpected reserved bits")
+	case op >= opClose && (!fin || plen > maxControlPayload):
+		return 0, wc.fail(CloseProtocolError, "invalid control frame")
+	case op == opContinuation && wc.msgType == 0:
+		return 0, wc.fail(CloseProtocolError, "unexpected continuation frame")
+	case (op == opText || op == opBinary) && wc.msgType != 0:
+		return 0, wc.fail(CloseProtocolError, "expected continuation frame")
+	case op < opClose && plen > uint64(wc.ws.maxMessageSize()-len(wc.msg)):
+		return 0, wc.fail(CloseMessageTooBig, "message too big")
+	}
+	size := hlen + 4 + int(plen)
+	if len(b) < size {
+		return 0, evloop.None
+	}
+	mask, payload := b[hlen:hlen+4], b[hlen+4:size]
+	for i := range payload {
+		payload[i] ^= mask[i&3]
+	}
+	switch op {
+	case opPing:
+		wc.write(appendFrame(nil, true, false, opPong, payload), false)
+	case opPong:
+		if wc.ws.Pong != nil {
+			wc.ws.Pong(wc, append([]byte{}, payload...))
+		}
+	case opClose:
+		return size, wc.closeReceived(payload)
+	default:
+		if op != opContinuation {
+			wc.msgType, wc.msgFlate = MessageType(op), rsv != 0
+		}
+		wc.msg = append(wc.msg, payload...)
+		if fin {
+			return size, wc.message()
+		}
+	}
+	return size, evloop.None
+}
+
+// message passes the complete message to the Message callback.
+func (wc *WebSocketConn) message() evloop.Action {
+	mt, data := wc.msgType, wc.msg
+	wc.msgType, wc.msg = 0, nil
+	if wc.msgFlate {
+		var err error
+		if data, err = inflate(data, wc.ws.maxMessageSize()); err == errMessageTooBig {
+			return wc.fail(CloseMessageTooBig, "message too big")
+		} else if err != nil {
+			return wc.fail(CloseProtocolError, "invalid compressed message")
+		}
+	}
+	if mt == TextMessage && !utf8.Valid(data) {
+		return wc.fail(CloseInvalidPayload, "invalid utf-8 text")
+	}
+	if wc.ws.Message != nil {
+		wc.ws.Message(wc, mt, data)
+	}
+	return evloop.None
+}
+
+// closeReceived replies to the close frame of the peer, unless the close
+// handshake was started by the server, and closes the connection.
+func (wc *WebSocketConn) closeReceived(payload []byte) evloop.Action {
+	code, reason := CloseNoStatusReceived, ""
+	if len(payload) == 1 {
+		return wc.fail(CloseProtocolError, "invalid close frame")
+	} else if len(payload) >= 2 {
+		code, reason = int(binary.BigEndian.Uint16(payload)), string(payload[2:])
+		if !validCloseCode(code) {
+			return wc.fail(CloseProtocolError, "invalid close code")
+		}
+		if !utf8.ValidString(reason) {
+			return wc.fail(CloseInvalidPayload, "invalid utf-8 close reason")
+		}
+		payload = payload[:2]
+	}
+	wc.write(appendFrame(nil, true, false, opClose, payload), true)
+	wc.finish(code, reason)
+	return evloop.Close
+}
+
+// fail sends the close frame and closes the connection, RFC 6455, 7.1.7.
+func (wc *WebSocketConn) fail(code int, reason string) evloop.Action {
+	wc.write(closeFrame(code, reason), true)
+	wc.finish(code, reason)
+	return evloop.Close
+}
+
+// closed handles the Closed event of the connection.
+func (wc *WebSocketConn) closed() {
+	wc.mu.Lock()
+	wc.closing = true
+	wc.mu.Unlock()
+	wc.finish(CloseAbnormalClosure, "")
+}
+
+// finish unregisters the connection and calls the Close callback once.
+func (wc *WebSocketConn) finish(code int, reason string) {
+	if wc.done {
+		return
+	}
+	wc.done = true
+	wc.ws.mu.Lock()
+	delete(wc.ws.conns, wc)
+	wc.ws.mu.Unlock()
+	if wc.ws.Close != nil {
+		wc.ws.Close(wc, code, reason)
+	}
+}
+
+// acceptKey computes the Sec-WebSocket-Accept value of the key.
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// acceptDeflate reports whether the extension offers contain an acceptable
+// permessage-deflate offer. The server compresses with a 32KB window, so
+// the offers limiting the server window are declined.
+func acceptDeflate(offers string) bool {
+	for _, offer := range strings.Split(offers, ",") {
+		params := strings.Split(offer, ";")
+		if strings.TrimSpace(params[0]) != "permessage-deflate" {
+			continue
+		}
+		ok := true
+		for _, p := range params[1:] {
+			name, value := strings.TrimSpace(p), ""
+			if i := strings.IndexByte(name, '='); i >= 0 {
+				name, value = strings.TrimSpace(name[:i]), strings.Trim(strings.TrimSpace(name[i+1:]), `"`)
+			}
+			switch name {
+			case "server_no_context_takeover", "client_no_context_takeover", "client_max_window_bits":
+			case "server_max_window_bits":
+				ok = ok && value == "15"
+			default:
+				ok = false
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// headerValues returns the values of all the header lines of the key,
+// joined with commas.
+func headerValues(head, key string) string {
+	var values []string
+	for len(head) > 0 {
+		var line string
+		if i := strings.IndexByte(head, '\n'); i >= 0 {
+			line, head = head[:i], head[i+1:]
+		} else {
+			line, head = head, ""
+		}
+		i := strings.IndexByte(line, ':')
+		if i > 0 && strings.EqualFold(strings.TrimSpace(line[:i]), key) {
+			values = append(values, strings.TrimSpace(line[i+1:]))
+		}
+	}
+	return strings.Join(values, ", ")
+}
+
+// headerToken reports whether the comma separated header value contains
+// the token, ignoring the case.
+func headerToken(value, token string) bool {
+	for _, v := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(v), token) {
+			return true
+		}
+	}
+	return false
+}
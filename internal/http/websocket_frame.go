@@ -0,0 +1,137 @@
+package http
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// WebSocket opcodes, RFC 6455, 5.2.
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// maxControlPayload is the payload limit of the control frames.
+const maxControlPayload = 125
+
+var errMessageTooBig = errors.New("websocket: message too big")
+
+// flateTail ends the compressed message with the empty stored block removed
+// by the sender, followed by a final empty block, RFC 7692, 7.2.2.
+var flateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+var (
+	flateWriters = sync.Pool{New: func() interface{} {
+		fw, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return fw
+	}}
+	flateReaders sync.Pool
+)
+
+// appendFrame appends an unmasked frame.
+func appendFrame(b []byte, fin, rsv1 bool, op byte, payload []byte) []byte {
+	b0 := op
+	if fin {
+		b0 |= 0x80
+	}
+	if rsv1 {
+		b0 |= 0x40
+	}
+	switch n := len(payload); {
+	case n <= 125:
+		b = append(b, b0, byte(n))
+	case n <= 0xffff:
+		b = append(b, b0, 126, byte(n>>8), byte(n))
+	default:
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(n))
+		b = append(append(b, b0, 127), ext[:]...)
+	}
+	return append(b, payload...)
+}
+
+// appendMessage appends the frames of a data message, split into fragments
+// of at most fragment bytes when fragment is positive.
+func appendMessage(b []byte, mt MessageType, data []byte, compress bool, fragment int) []byte {
+	op, rsv1 := byte(mt), compress
+	if compress {
+		data = deflate(data)
+	}
+	for {
+		n := len(data)
+		if fragment > 0 && n > fragment {
+			n = fragment
+		}
+		fin := n == len(data)
+		b = appendFrame(b, fin, rsv1, op, data[:n])
+		if fin {
+			return b
+		}
+		data = data[n:]
+		op, rsv1 = opContinuation, false
+	}
+}
+
+// closeFrame returns a close frame with the code and the reason, truncated
+// to fit the control frame.
+func closeFrame(code int, reason string) []byte {
+	if len(reason) > maxControlPayload-2 {
+		reason = reason[:maxControlPayload-2]
+	}
+	payload := append([]byte{byte(code >> 8), byte(code)}, reason...)
+	return appendFrame(nil, true, false, opClose, payload)
+}
+
+// validCloseCode reports whether the code may be sent in a close frame,
+// RFC 6455, 7.4.
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// deflate compresses the message, RFC 7692, 7.2.1.
+func deflate(data []byte) []byte {
+	var buf bytes.Buffer
+	fw := flateWriters.Get().(*flate.Writer)
+	fw.Reset(&buf)
+	fw.Write(data)
+	fw.Flush()
+	flateWriters.Put(fw)
+	// remove the empty stored block of the flush
+	b := buf.Bytes()
+	return b[:len(b)-4]
+}
+
+// inflate decompresses the message, up to max bytes.
+func inflate(data []byte, max int) ([]byte, error) {
+	r := io.MultiReader(bytes.NewReader(data), bytes.NewReader(flateTail))
+	fr, _ := flateReaders.Get().(io.ReadCloser)
+	if fr == nil {
+		fr = flate.NewReader(r)
+	} else if err := fr.(flate.Resetter).Reset(r, nil); err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(fr, int64(max)+1))
+	flateReaders.Put(fr)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > max {
+		return nil, errMessageTooBig
+	}
+	return b, nil
+}
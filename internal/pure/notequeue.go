@@ -41,3 +41,12 @@ func (q *noteQueue) ForEach(iter func(note interface{}) error) error {
 	q.mu.Unlock()
 	return nil
 }
+
+// Take removes and returns the queued notes.
+func (q *noteQueue) Take() []interface{} {
+	q.mu.Lock()
+	notes := q.notes
+	q.notes = nil
+	q.mu.Unlock()
+	return notes
+}
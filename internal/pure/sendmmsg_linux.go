@@ -0,0 +1,7 @@
+// +build linux,!amd64,!386
+
+package pure
+
+import "syscall"
+
+const sysSendmmsg = syscall.SYS_SENDMMSG
@@ -0,0 +1,4 @@
+package pure
+
+// sysSendmmsg is missing in the syscall package for 386.
+const sysSendmmsg = 345
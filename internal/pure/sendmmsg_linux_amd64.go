@@ -0,0 +1,4 @@
+package pure
+
+// sysSendmmsg is missing in the syscall package for amd64.
+const sysSendmmsg = 307
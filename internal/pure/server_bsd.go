@@ -4,6 +4,7 @@ package pure
 
 import (
 	"syscall"
+	"time"
 )
 
 type Poll struct {
@@ -35,6 +36,11 @@ func (p *Poll) Close() error {
 	return syscall.Close(p.fd)
 }
 
+// Notes removes and returns the notes Wait has not handled.
+func (p *Poll) Notes() []interface{} {
+	return p.notes.Take()
+}
+
 func (p *Poll) Trigger(note interface{}) error {
 	p.notes.Add(note)
 	_, err := syscall.Kevent(p.fd, []syscall.Kevent_t{{
@@ -45,14 +51,25 @@ func (p *Poll) Trigger(note interface{}) error {
 	return err
 }
 
-func (p *Poll) Wait(iter func(fd int, note interface{}) error) error {
+// Wait waits for events. The next func returns how long the poll may
+// block, a negative value blocks until an event arrives. The iter func is
+// called with a zero fd and a nil note once per wakeup.
+func (p *Poll) Wait(next func() time.Duration, iter func(fd int, note interface{}) error) error {
 	events := make([]syscall.Kevent_t, 128)
 	for {
-		n, err := syscall.Kevent(p.fd, p.changes, events, nil)
+		var ts *syscall.Timespec
+		if d := next(); d >= 0 {
+			t := syscall.NsecToTimespec(int64(d))
+			ts = &t
+		}
+		n, err := syscall.Kevent(p.fd, p.changes, events, ts)
 		if err != nil && err != syscall.EINTR {
 			return err
 		}
 		p.changes = p.changes[:0]
+		if err := iter(0, nil); err != nil {
+			return err
+		}
 		if err := p.notes.ForEach(func(note interface{}) error {
 			return iter(0, note)
 		}); err != nil {
@@ -87,6 +104,12 @@ func (p *Poll) AddReadWrite(fd int) {
 	)
 }
 
+func (p *Poll) DelRead(fd int) {
+	p.changes = append(p.changes, syscall.Kevent_t{
+		Ident: uint64(fd), Flags: syscall.EV_DELETE, Filter: syscall.EVFILT_READ,
+	})
+}
+
 func (p *Poll) ModRead(fd int) {
 	p.changes = append(p.changes, syscall.Kevent_t{
 		Ident: uint64(fd), Flags: syscall.EV_DELETE, Filter: syscall.EVFILT_WRITE,
@@ -2,6 +2,7 @@ package pure
 
 import (
 	"syscall"
+	"time"
 	"unsafe"
 )
 
@@ -38,6 +39,11 @@ func (p *Poll) Close() error {
 	return syscall.Close(p.fd)
 }
 
+// Notes removes and returns the notes Wait has not handled.
+func (p *Poll) Notes() []interface{} {
+	return p.notes.Take()
+}
+
 // Trigger ...
 func (p *Poll) Trigger(note interface{}) error {
 	p.notes.Add(note)
@@ -47,13 +53,23 @@ func (p *Poll) Trigger(note interface{}) error {
 }
 
 // Wait ...
-func (p *Poll) Wait(iter func(fd int, note interface{}) error) error {
+// The next func returns how long the poll may block, a negative value
+// blocks until an event arrives. The iter func is called with a zero fd
+// and a nil note once per wakeup.
+func (p *Poll) Wait(next func() time.Duration, iter func(fd int, note interface{}) error) error {
 	events := make([]syscall.EpollEvent, 64)
 	for {
-		n, err := syscall.EpollWait(p.fd, events, 100)
+		msec := -1
+		if d := next(); d >= 0 {
+			msec = int((d + time.Millisecond - 1) / time.Millisecond)
+		}
+		n, err := syscall.EpollWait(p.fd, events, msec)
 		if err != nil && err != syscall.EINTR {
 			return err
 		}
+		if err := iter(0, nil); err != nil {
+			return err
+		}
 		if err := p.notes.ForEach(func(note interface{}) error {
 			return iter(0, note)
 		}); err != nil {
@@ -94,6 +110,17 @@ func (p *Poll) AddRead(fd int) {
 	}
 }
 
+// DelRead ...
+func (p *Poll) DelRead(fd int) {
+	if err := syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_DEL, fd,
+		&syscall.EpollEvent{Fd: int32(fd),
+			Events: syscall.EPOLLIN,
+		},
+	); err != nil {
+		panic(err)
+	}
+}
+
 // ModRead ...
 func (p *Poll) ModRead(fd int) {
 	if err := syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_MOD, fd,
@@ -0,0 +1,35 @@
+// +build netbsd freebsd openbsd dragonfly
+
+package pure
+
+import "syscall"
+
+// SetUserTimeout is not available on BSD.
+func SetUserTimeout(fd, msecs int) error {
+	return syscall.ENOPROTOOPT
+}
+
+// SetQuickAck is not available on BSD.
+func SetQuickAck(fd int) error {
+	return syscall.ENOPROTOOPT
+}
+
+// SetNotSentLowat is not available on BSD.
+func SetNotSentLowat(fd, bytes int) error {
+	return syscall.ENOPROTOOPT
+}
+
+// SetMark is not available on BSD.
+func SetMark(fd, mark int) error {
+	return syscall.ENOPROTOOPT
+}
+
+// SetFastOpen is not available on BSD.
+func SetFastOpen(fd, qlen int) error {
+	return syscall.ENOPROTOOPT
+}
+
+// SetDeferAccept is not available on BSD, use accept filters instead.
+func SetDeferAccept(fd, secs int) error {
+	return syscall.ENOPROTOOPT
+}
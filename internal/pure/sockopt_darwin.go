@@ -0,0 +1,39 @@
+package pure
+
+import "syscall"
+
+const (
+	tcpFastOpen     = 0x105 // TCP_FASTOPEN
+	tcpNotSentLowat = 0x201 // TCP_NOTSENT_LOWAT
+)
+
+// SetUserTimeout is not available on Darwin.
+func SetUserTimeout(fd, msecs int) error {
+	return syscall.ENOPROTOOPT
+}
+
+// SetQuickAck is not available on Darwin.
+func SetQuickAck(fd int) error {
+	return syscall.ENOPROTOOPT
+}
+
+// SetNotSentLowat limits the amount of unsent data in the write buffer.
+func SetNotSentLowat(fd, bytes int) error {
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, tcpNotSentLowat, bytes)
+}
+
+// SetMark is not available on Darwin.
+func SetMark(fd, mark int) error {
+	return syscall.ENOPROTOOPT
+}
+
+// SetFastOpen enables TCP Fast Open on the listener socket. Darwin has no
+// queue length, any positive qlen enables it.
+func SetFastOpen(fd, qlen int) error {
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, tcpFastOpen, 1)
+}
+
+// SetDeferAccept is not available on Darwin.
+func SetDeferAccept(fd, secs int) error {
+	return syscall.ENOPROTOOPT
+}
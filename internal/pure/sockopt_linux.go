@@ -0,0 +1,43 @@
+package pure
+
+import "syscall"
+
+const (
+	tcpUserTimeout  = 0x12 // TCP_USER_TIMEOUT
+	tcpFastOpen     = 0x17 // TCP_FASTOPEN
+	tcpNotSentLowat = 0x19 // TCP_NOTSENT_LOWAT
+	soMark          = 0x24 // SO_MARK
+)
+
+// SetUserTimeout sets the TCP user timeout of the connection in
+// milliseconds.
+func SetUserTimeout(fd, msecs int) error {
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, tcpUserTimeout, msecs)
+}
+
+// SetQuickAck enables the TCP quick ack mode of the connection.
+func SetQuickAck(fd int) error {
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_QUICKACK, 1)
+}
+
+// SetNotSentLowat limits the amount of unsent data in the write buffer.
+func SetNotSentLowat(fd, bytes int) error {
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, tcpNotSentLowat, bytes)
+}
+
+// SetMark sets the firewall mark of the socket packets.
+func SetMark(fd, mark int) error {
+	return syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, soMark, mark)
+}
+
+// SetFastOpen enables TCP Fast Open on the listener socket with the queue
+// length of pending fast open requests.
+func SetFastOpen(fd, qlen int) error {
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, tcpFastOpen, qlen)
+}
+
+// SetDeferAccept defers accepting the connections until data arrives, for
+// at most secs seconds.
+func SetDeferAccept(fd, secs int) error {
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_DEFER_ACCEPT, secs)
+}
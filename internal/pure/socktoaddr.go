@@ -33,3 +33,44 @@ func SockaddrToAddr(sa syscall.Sockaddr) net.Addr {
 	}
 	return a
 }
+
+// SockaddrToUDPAddr returns a go/net friendly UDP address
+func SockaddrToUDPAddr(sa syscall.Sockaddr) net.Addr {
+	if a, ok := SockaddrToAddr(sa).(*net.TCPAddr); ok {
+		return &net.UDPAddr{IP: a.IP, Port: a.Port, Zone: a.Zone}
+	}
+	return nil
+}
+
+// ResolveSockaddr resolves a stream network address and returns its socket
+// address along with the socket domain.
+func ResolveSockaddr(network, address string) (sa syscall.Sockaddr, domain int, err error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		addr, err := net.ResolveTCPAddr(network, address)
+		if err != nil {
+			return nil, -1, err
+		}
+		if ip4 := addr.IP.To4(); ip4 != nil && network != "tcp6" {
+			sa4 := &syscall.SockaddrInet4{Port: addr.Port}
+			copy(sa4.Addr[:], ip4)
+			return sa4, syscall.AF_INET, nil
+		}
+		if addr.IP == nil && network == "tcp4" {
+			return &syscall.SockaddrInet4{Port: addr.Port}, syscall.AF_INET, nil
+		}
+		sa6 := &syscall.SockaddrInet6{Port: addr.Port}
+		copy(sa6.Addr[:], addr.IP.To16())
+		if addr.Zone != "" {
+			ifi, err := net.InterfaceByName(addr.Zone)
+			if err != nil {
+				return nil, -1, err
+			}
+			sa6.ZoneId = uint32(ifi.Index)
+		}
+		return sa6, syscall.AF_INET6, nil
+	case "unix":
+		return &syscall.SockaddrUnix{Name: address}, syscall.AF_UNIX, nil
+	}
+	return nil, -1, net.UnknownNetworkError(network)
+}
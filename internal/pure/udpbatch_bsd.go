@@ -0,0 +1,60 @@
+// +build darwin netbsd freebsd openbsd dragonfly
+
+package pure
+
+import "syscall"
+
+// UDPBatch reads and writes datagrams one by one, the BSD systems have no
+// recvmmsg and sendmmsg. It must only be used from a single goroutine.
+type UDPBatch struct {
+	packet []byte
+	out    []udpOut // queued datagrams
+	obuf   []byte   // queued datagram data
+}
+
+// udpOut is a queued datagram.
+type udpOut struct {
+	fd  int
+	sa  syscall.Sockaddr
+	off int // data offset in obuf
+	n   int // data length
+}
+
+// NewUDPBatch returns a batch of a single message.
+func NewUDPBatch(n int) *UDPBatch {
+	return &UDPBatch{packet: make([]byte, 0xFFFF)}
+}
+
+// SetUDPGRO is a no-op, UDP generic receive offload is Linux only.
+func SetUDPGRO(fd int) error {
+	return nil
+}
+
+// Read reads a datagram from the socket and calls fn for it. The p slice
+// is only valid until fn returns.
+func (b *UDPBatch) Read(fd int, fn func(p []byte, sa syscall.Sockaddr)) error {
+	n, sa, err := syscall.Recvfrom(fd, b.packet, 0)
+	if err != nil {
+		return err
+	}
+	if n > 0 && sa != nil {
+		fn(b.packet[:n], sa)
+	}
+	return nil
+}
+
+// Queue copies the datagram to the send queue. GSO is not available.
+func (b *UDPBatch) Queue(fd int, p []byte, sa syscall.Sockaddr, gso bool) {
+	b.out = append(b.out, udpOut{fd: fd, sa: sa, off: len(b.obuf), n: len(p)})
+	b.obuf = append(b.obuf, p...)
+}
+
+// Flush sends the queued datagrams. Datagrams that can't be sent are
+// dropped.
+func (b *UDPBatch) Flush() {
+	for _, m := range b.out {
+		syscall.Sendto(m.fd, b.obuf[m.off:m.off+m.n], 0, m.sa)
+	}
+	b.out = b.out[:0]
+	b.obuf = b.obuf[:0]
+}
@@ -0,0 +1,279 @@
+package pure
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+const (
+	udpSegment     = 103    // UDP_SEGMENT socket option, GSO segment size
+	udpGRO         = 104    // UDP_GRO socket option
+	maxDatagram    = 0xFFFF // receive buffer size of a single message
+	maxGSOSegments = 64     // segments of a single GSO message
+	maxGSOPayload  = 0xFFFF - 8 - 40
+)
+
+var (
+	groOobSize = syscall.CmsgSpace(4)
+	gsoOobSize = syscall.CmsgSpace(2)
+)
+
+// mmsghdr is the message header of recvmmsg and sendmmsg.
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	n   uint32
+}
+
+// UDPBatch reads and writes datagrams in batches with recvmmsg and
+// sendmmsg. It must only be used from a single goroutine.
+type UDPBatch struct {
+	rhdrs  []mmsghdr
+	riovs  []syscall.Iovec
+	rnames []syscall.RawSockaddrAny
+	rbuf   []byte // receive buffers, maxDatagram bytes per message
+	roob   []byte // receive control messages
+
+	out    []udpOut // queued datagrams
+	obuf   []byte   // queued datagram data
+	wmsgs  []udpOut // messages of a single sendmmsg call
+	whdrs  []mmsghdr
+	wiovs  []syscall.Iovec
+	wnames []syscall.RawSockaddrAny
+	woob   []byte
+	nogso  bool // set once the kernel refused a GSO message
+}
+
+// udpOut is a queued datagram, or a GSO message of several datagrams.
+type udpOut struct {
+	fd  int
+	sa  syscall.Sockaddr
+	off int  // data offset in obuf
+	n   int  // data length
+	seg int  // GSO segment size, zero for a single datagram
+	gso bool // can be coalesced with GSO
+}
+
+// NewUDPBatch returns a batch of n messages.
+func NewUDPBatch(n int) *UDPBatch {
+	if n < 1 {
+		n = 1
+	}
+	b := &UDPBatch{
+		rhdrs:  make([]mmsghdr, n),
+		riovs:  make([]syscall.Iovec, n),
+		rnames: make([]syscall.RawSockaddrAny, n),
+		rbuf:   make([]byte, n*maxDatagram),
+		roob:   make([]byte, n*groOobSize),
+	}
+	for i := range b.rhdrs {
+		b.riovs[i].Base = &b.rbuf[i*maxDatagram]
+		b.riovs[i].SetLen(maxDatagram)
+		h := &b.rhdrs[i].hdr
+		h.Name = (*byte)(unsafe.Pointer(&b.rnames[i]))
+		h.Iov = &b.riovs[i]
+		h.Iovlen = 1
+	}
+	return b
+}
+
+// SetUDPGRO enables UDP generic receive offload on the socket.
+func SetUDPGRO(fd int) error {
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_UDP, udpGRO, 1)
+}
+
+// Read reads a batch of datagrams from the socket and calls fn for every
+// datagram. Datagrams coalesced with GRO are split into the segments. The
+// p slice is only valid until fn returns.
+func (b *UDPBatch) Read(fd int, fn func(p []byte, sa syscall.Sockaddr)) error {
+	for i := range b.rhdrs {
+		h := &b.rhdrs[i].hdr
+		h.Namelen = syscall.SizeofSockaddrAny
+		h.Control = &b.roob[i*groOobSize]
+		h.SetControllen(groOobSize)
+		h.Flags = 0
+	}
+	r, _, e := syscall.Syscall6(syscall.SYS_RECVMMSG, uintptr(fd),
+		uintptr(unsafe.Pointer(&b.rhdrs[0])), uintptr(len(b.rhdrs)), 0, 0, 0)
+	if e != 0 {
+		return e
+	}
+	for i := 0; i < int(r); i++ {
+		h := &b.rhdrs[i].hdr
+		p := b.rbuf[i*maxDatagram : i*maxDatagram+int(b.rhdrs[i].n)]
+		sa := rawToSockaddr(&b.rnames[i])
+		if sa == nil || len(p) == 0 {
+			continue
+		}
+		seg := len(p)
+		if h.Controllen > 0 {
+			if n := groSegment(b.roob[i*groOobSize : i*groOobSize+int(h.Controllen)]); n > 0 {
+				seg = n
+			}
+		}
+		for len(p) > seg {
+			fn(p[:seg], sa)
+			p = p[seg:]
+		}
+		fn(p, sa)
+	}
+	return nil
+}
+
+// groSegment returns the GRO segment size of a received message.
+func groSegment(oob []byte) int {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, m := range msgs {
+		if m.Header.Level == syscall.IPPROTO_UDP && m.Header.Type == udpGRO && len(m.Data) >= 4 {
+			return int(*(*int32)(unsafe.Pointer(&m.Data[0])))
+		}
+	}
+	return 0
+}
+
+// Queue copies the datagram to the send queue. With gso set, consecutive
+// datagrams of the same size to the same address are sent as a single GSO
+// message.
+func (b *UDPBatch) Queue(fd int, p []byte, sa syscall.Sockaddr, gso bool) {
+	b.out = append(b.out, udpOut{fd: fd, sa: sa, off: len(b.obuf), n: len(p), gso: gso && len(p) > 0})
+	b.obuf = append(b.obuf, p...)
+}
+
+// Flush sends the queued datagrams. Datagrams that can't be sent are
+// dropped.
+func (b *UDPBatch) Flush() {
+	for i := 0; i < len(b.out); {
+		j := i + 1
+		for j < len(b.out) && b.out[j].fd == b.out[i].fd {
+			j++
+		}
+		b.send(b.out[i:j])
+		i = j
+	}
+	b.out = b.out[:0]
+	b.obuf = b.obuf[:0]
+}
+
+// send sends the datagrams of a single socket.
+func (b *UDPBatch) send(outs []udpOut) {
+	b.wmsgs = b.wmsgs[:0]
+	for i := 0; i < len(outs); {
+		m := outs[i]
+		j := i + 1
+		if m.gso && !b.nogso {
+			for j < len(outs) && j-i < maxGSOSegments && outs[j].gso &&
+				outs[j].n <= outs[i].n && m.n+outs[j].n <= maxGSOPayload &&
+				sameSockaddr(outs[j].sa, m.sa) {
+				m.n += outs[j].n
+				j++
+				if outs[j-1].n < outs[i].n {
+					break // only the last segment can be shorter
+				}
+			}
+			if j-i > 1 {
+				m.seg = outs[i].n
+			}
+		}
+		b.wmsgs = append(b.wmsgs, m)
+		i = j
+	}
+	n := len(b.wmsgs)
+	if cap(b.whdrs) < n {
+		b.whdrs = make([]mmsghdr, n)
+		b.wiovs = make([]syscall.Iovec, n)
+		b.wnames = make([]syscall.RawSockaddrAny, n)
+		b.woob = make([]byte, n*gsoOobSize)
+	}
+	hdrs := b.whdrs[:n]
+	for i, m := range b.wmsgs {
+		hdrs[i] = mmsghdr{}
+		h := &hdrs[i].hdr
+		iov := &b.wiovs[i]
+		*iov = syscall.Iovec{}
+		if m.n > 0 {
+			iov.Base = &b.obuf[m.off]
+			iov.SetLen(m.n)
+		}
+		h.Iov = iov
+		h.Iovlen = 1
+		h.Name = (*byte)(unsafe.Pointer(&b.wnames[i]))
+		h.Namelen = sockaddrToRaw(m.sa, &b.wnames[i])
+		if m.seg > 0 {
+			oob := b.woob[i*gsoOobSize : (i+1)*gsoOobSize]
+			cmsg := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+			cmsg.Level = syscall.IPPROTO_UDP
+			cmsg.Type = udpSegment
+			cmsg.SetLen(syscall.CmsgLen(2))
+			*(*uint16)(unsafe.Pointer(&oob[syscall.CmsgLen(0)])) = uint16(m.seg)
+			h.Control = &oob[0]
+			h.SetControllen(gsoOobSize)
+		}
+	}
+	fd := outs[0].fd
+	for sent := 0; sent < n; {
+		r, _, e := syscall.Syscall6(sysSendmmsg, uintptr(fd),
+			uintptr(unsafe.Pointer(&hdrs[sent])), uintptr(n-sent), 0, 0, 0)
+		if e != 0 {
+			if sent == 0 && e != syscall.EAGAIN && !b.nogso && hdrs[0].hdr.Control != nil {
+				// the kernel or the device don't support GSO
+				b.nogso = true
+				b.send(outs)
+			}
+			return
+		}
+		sent += int(r)
+	}
+}
+
+// rawToSockaddr converts a raw inet socket address.
+func rawToSockaddr(rsa *syscall.RawSockaddrAny) syscall.Sockaddr {
+	switch rsa.Addr.Family {
+	case syscall.AF_INET:
+		raw := (*syscall.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		port := (*[2]byte)(unsafe.Pointer(&raw.Port))
+		return &syscall.SockaddrInet4{Port: int(port[0])<<8 | int(port[1]), Addr: raw.Addr}
+	case syscall.AF_INET6:
+		raw := (*syscall.RawSockaddrInet6)(unsafe.Pointer(rsa))
+		port := (*[2]byte)(unsafe.Pointer(&raw.Port))
+		return &syscall.SockaddrInet6{Port: int(port[0])<<8 | int(port[1]), ZoneId: raw.Scope_id, Addr: raw.Addr}
+	}
+	return nil
+}
+
+// sockaddrToRaw converts an inet socket address and returns its length.
+func sockaddrToRaw(sa syscall.Sockaddr, rsa *syscall.RawSockaddrAny) uint32 {
+	*rsa = syscall.RawSockaddrAny{}
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		raw := (*syscall.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		raw.Family = syscall.AF_INET
+		port := (*[2]byte)(unsafe.Pointer(&raw.Port))
+		port[0], port[1] = byte(sa.Port>>8), byte(sa.Port)
+		raw.Addr = sa.Addr
+		return syscall.SizeofSockaddrInet4
+	case *syscall.SockaddrInet6:
+		raw := (*syscall.RawSockaddrInet6)(unsafe.Pointer(rsa))
+		raw.Family = syscall.AF_INET6
+		port := (*[2]byte)(unsafe.Pointer(&raw.Port))
+		port[0], port[1] = byte(sa.Port>>8), byte(sa.Port)
+		raw.Scope_id = sa.ZoneId
+		raw.Addr = sa.Addr
+		return syscall.SizeofSockaddrInet6
+	}
+	return 0
+}
+
+// sameSockaddr reports whether the inet socket addresses are equal.
+func sameSockaddr(a, b syscall.Sockaddr) bool {
+	switch a := a.(type) {
+	case *syscall.SockaddrInet4:
+		b, ok := b.(*syscall.SockaddrInet4)
+		return ok && a.Port == b.Port && a.Addr == b.Addr
+	case *syscall.SockaddrInet6:
+		b, ok := b.(*syscall.SockaddrInet6)
+		return ok && a.Port == b.Port && a.ZoneId == b.ZoneId && a.Addr == b.Addr
+	}
+	return false
+}
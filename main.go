@@ -1,6 +1,12 @@
 package pureserver
 
-import "github.com/konstantin-kukharev/pureserver/internal/http"
+import (
+	"context"
+	"crypto/tls"
+	"github.com/konstantin-kukharev/pureserver/evloop"
+	"github.com/konstantin-kukharev/pureserver/internal/http"
+	"time"
+)
 
 type PatHandler http.PatHandler
 type HttpRequestInterface http.HttpRequestInterface
@@ -8,12 +14,117 @@ type ResponseWriter http.ResponseWriter
 type PatternServeMuxInterface http.PatternServeMuxInterface
 type PatternServeMux http.PatternServeMux
 type Router http.RouterInterface
+type AccessLog = http.AccessLog
+type AccessLogger = http.AccessLogger
+
+type Span = http.Span
+type SpanContext = http.SpanContext
+type SpanData = http.SpanData
+type SpanExporter = http.SpanExporter
+type ContextRequest = http.ContextRequest
+type HealthCheck = http.HealthCheck
+type Admin = http.Admin
+type WebSocket = http.WebSocket
+type WebSocketConn = http.WebSocketConn
+type MessageType = http.MessageType
+type EventStream = http.EventStream
+type Event = http.Event
+type EventHistory = http.EventHistory
+type HTTP2 = http.HTTP2
+type StreamHandler = http.StreamHandler
+type Stream = http.Stream
+
+// SpanFromContext returns the trace span of a request context, or a no-op
+// span when tracing is disabled.
+func SpanFromContext(ctx context.Context) Span {
+	return http.SpanFromContext(ctx)
+}
+
+// RequestContext returns the context of a request, which carries the trace
+// span when tracing is enabled.
+func RequestContext(r HttpRequestInterface) context.Context {
+	return http.RequestContext(r)
+}
+
+// NewEventStream switches the response of the handler to a Server-Sent
+// Events stream, see EventStream.
+func NewEventStream(w ResponseWriter, r HttpRequestInterface) (*EventStream, error) {
+	return http.NewEventStream(w, r)
+}
+
+// NewEventHistory returns a history of the last size events, see
+// EventHistory.
+func NewEventHistory(size int) *EventHistory {
+	return http.NewEventHistory(size)
+}
+
+// FileServer returns a handler serving the files of the root directory by
+// the request path, see StripPrefix.
+func FileServer(root string) http.CallableHandler {
+	return http.FileServer(root)
+}
+
+// StripPrefix returns a handler serving the requests by h with the prefix
+// removed from the path.
+func StripPrefix(prefix string, h http.CallableHandler) http.CallableHandler {
+	return http.StripPrefix(prefix, h)
+}
+
+// ServeFile replies to the request with the named file.
+func ServeFile(w ResponseWriter, r HttpRequestInterface, name string) {
+	http.ServeFile(w, r, name)
+}
+
+// Errors of the WebSocket connections and the event streams.
+var (
+	ErrWebSocketClosed   = http.ErrWebSocketClosed
+	ErrEventStreamClosed = http.ErrEventStreamClosed
+	ErrEventStreamFull   = http.ErrEventStreamFull
+)
+
+// Access log formats, see AccessLog.
+const (
+	LogCommon   = http.LogCommon
+	LogCombined = http.LogCombined
+	LogJSON     = http.LogJSON
+)
+
+// WebSocket message types and close codes.
+const (
+	TextMessage   = http.TextMessage
+	BinaryMessage = http.BinaryMessage
+
+	CloseNormalClosure    = http.CloseNormalClosure
+	CloseGoingAway        = http.CloseGoingAway
+	CloseProtocolError    = http.CloseProtocolError
+	CloseUnsupportedData  = http.CloseUnsupportedData
+	CloseNoStatusReceived = http.CloseNoStatusReceived
+	CloseAbnormalClosure  = http.CloseAbnormalClosure
+	CloseInvalidPayload   = http.CloseInvalidPayload
+	ClosePolicyViolation  = http.ClosePolicyViolation
+	CloseMessageTooBig    = http.CloseMessageTooBig
+	CloseInternalError    = http.CloseInternalError
+)
 
 type Server interface {
 	Serve() error
 	SetPort(...int)
 	SetUnixSocket(...string)
+	SetListeners(...string)
 	SetLoops(int)
+	SetOptions(...evloop.Option)
+	SetACL(*evloop.ACL)
+	SetMetrics(path string)
+	SetAccessLog(http.AccessLog)
+	SetTracing(http.SpanExporter)
+	SetHealth(livePath, readyPath string)
+	AddHealthCheck(name string, timeout time.Duration, check http.HealthCheck)
+	SetAdmin(http.Admin)
+	SetHTTP2(http.HTTP2)
+	SetTLS(*tls.Config)
+	SetStreamHandler(http.StreamHandler)
+	Drain()
+	Draining() bool
 }
 
 type HandlerFunc func(w ResponseWriter, r HttpRequestInterface)
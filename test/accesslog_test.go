@@ -0,0 +1,166 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	ps "github.com/konstantin-kukharev/pureserver"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// attrLogger records the key-value pairs passed to Info.
+type attrLogger struct {
+	mu    sync.Mutex
+	attrs []map[string]interface{}
+}
+
+func (l *attrLogger) Info(msg string, args ...interface{}) {
+	m := map[string]interface{}{"msg": msg}
+	for i := 0; i+1 < len(args); i += 2 {
+		m[args[i].(string)] = args[i+1]
+	}
+	l.mu.Lock()
+	l.attrs = append(l.attrs, m)
+	l.mu.Unlock()
+}
+
+func accessLogServer(port int, cfg ps.AccessLog) {
+	mux := ps.NewMux()
+	mux.Get("/hello/:name", ps.HandlerFunc(HelloServer))
+	mux.Get("/health", ps.HandlerFunc(func(w ps.ResponseWriter, r ps.HttpRequestInterface) {}))
+	server := ps.NewHttp(mux)
+	server.SetPort(port)
+	server.SetAccessLog(cfg)
+	go server.Serve()
+	waitPort(port)
+}
+
+func accessLogGet(port, path string) *http.Response {
+	req, err := http.NewRequest("GET", "http://127.0.0.1:"+port+path, nil)
+	must(err)
+	req.Header.Set("X-Request-Id", "req-1")
+	req.Header.Set("User-Agent", "test-agent")
+	resp, err := http.DefaultClient.Do(req)
+	must(err)
+	resp.Body.Close()
+	return resp
+}
+
+func TestHttpServerAccessLog(t *testing.T) {
+	var out syncBuffer
+	accessLogServer(8085, ps.AccessLog{Format: ps.LogJSON, Output: &out, Skip: []string{"/health"}})
+	resp := accessLogGet("8085", "/hello/3?x=1")
+	if resp.Header.Get("X-Request-Id") != "req-1" {
+		t.Fatal("request ID not echoed")
+	}
+	accessLogGet("8085", "/health")
+	time.Sleep(time.Millisecond * 100)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("unexpected log lines %q", out.String())
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range map[string]interface{}{
+		"method":     "GET",
+		"path":       "/hello/3?x=1",
+		"status":     float64(200),
+		"request_id": "req-1",
+		"route":      "/hello/:name",
+		"user_agent": "test-agent",
+	} {
+		if entry[key] != value {
+			t.Fatalf("unexpected %s in %s", key, lines[0])
+		}
+	}
+}
+
+func TestHttpServerAccessLogFormats(t *testing.T) {
+	var out syncBuffer
+	accessLogServer(8086, ps.AccessLog{Format: ps.LogCombined, Output: &out})
+	accessLogGet("8086", "/missing")
+	time.Sleep(time.Millisecond * 100)
+	combined := regexp.MustCompile(`^127\.0\.0\.1 - - \[[^]]+\] "GET /missing HTTP/1\.1" 404 \d+ "" "test-agent" \d+ req-1 ""\n$`)
+	if !combined.MatchString(out.String()) {
+		t.Fatalf("unexpected combined log %q", out.String())
+	}
+
+	var logger attrLogger
+	accessLogServer(8087, ps.AccessLog{Logger: &logger, SampleRate: 0.5})
+	for i := 0; i < 40; i++ {
+		accessLogGet("8087", "/hello/1")
+	}
+	time.Sleep(time.Millisecond * 100)
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	if len(logger.attrs) == 0 || len(logger.attrs) == 40 {
+		t.Fatalf("unexpected sampled entries %d", len(logger.attrs))
+	}
+	if a := logger.attrs[0]; a["msg"] != "access" || a["route"] != "/hello/:name" || a["status"] != 200 {
+		t.Fatalf("unexpected entry %v", a)
+	}
+}
+
+// slowWriter is a syncBuffer taking a while for every write.
+type slowWriter struct {
+	syncBuffer
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(time.Millisecond * 20)
+	return w.syncBuffer.Write(p)
+}
+
+func TestHttpServerAccessLogFlush(t *testing.T) {
+	var out slowWriter
+	mux := ps.NewMux()
+	mux.Get("/hello/:name", ps.HandlerFunc(HelloServer))
+	server := ps.NewHttp(mux)
+	server.SetPort(8104)
+	server.SetAccessLog(ps.AccessLog{Output: &out})
+	done := make(chan error, 1)
+	go func() { done <- server.Serve() }()
+	waitPort(8104)
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	for i := 0; i < 5; i++ {
+		resp, err := client.Get("http://127.0.0.1:8104/hello/1")
+		must(err)
+		resp.Body.Close()
+	}
+	server.Drain()
+	select {
+	case err := <-done:
+		must(err)
+	case <-time.After(time.Second):
+		t.Fatal("server not drained")
+	}
+	// the queued entries are written before Serve returns
+	if n := strings.Count(out.String(), "\n"); n != 5 {
+		t.Fatalf("unexpected log lines %q", out.String())
+	}
+}
@@ -0,0 +1,114 @@
+package test
+
+import (
+	"fmt"
+	ps "github.com/konstantin-kukharev/pureserver"
+	"github.com/konstantin-kukharev/pureserver/evloop"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestACL(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testACL("tcp://127.0.0.1:9991") })
+	t.Run("stdlib", func(t *testing.T) { testACL("tcp-net://127.0.0.1:9992") })
+	t.Run("poll-udp", func(t *testing.T) { testACL("udp://127.0.0.1:9991") })
+	t.Run("stdlib-udp", func(t *testing.T) { testACL("udp-net://127.0.0.1:9992") })
+}
+
+func testACL(addr string) {
+	acl, err := evloop.NewACL(nil, []string{"127.0.0.1"})
+	must(err)
+	udp := addr[:3] == "udp"
+	var rejected int32
+	var events evloop.Events
+	events.Serving = func(srv evloop.Server) (action evloop.Action) {
+		go func() {
+			defer srv.Shutdown()
+			lnAddr := srv.Addresses[0].String()
+			if udp {
+				c := udpPeer(lnAddr)
+				udpExpect(c, "")
+				must(acl.Set([]string{"127.0.0.0/8"}, []string{"10.0.0.0/8"}))
+				udpExpect(c, "x")
+				c.Close()
+			} else {
+				expectClosed(limitsDial(lnAddr))
+				must(acl.Set([]string{"127.0.0.0/8"}, []string{"10.0.0.0/8"}))
+				c := limitsDial(lnAddr)
+				limitsEcho(c, "x")
+				c.Close()
+			}
+			time.Sleep(time.Millisecond * 50)
+			if r := srv.Rejections(); r.Denied != 1 || atomic.LoadInt32(&rejected) != 1 {
+				panic("unexpected rejections")
+			}
+		}()
+		return
+	}
+	events.Data = func(c evloop.Conn, in []byte) (out []byte, action evloop.Action) {
+		return in, evloop.None
+	}
+	events.Rejected = func(addr net.Addr, reason error) (action evloop.Action) {
+		if reason != evloop.ErrDenied {
+			panic("unexpected reason " + reason.Error())
+		}
+		atomic.AddInt32(&rejected, 1)
+		return
+	}
+	must(evloop.Run(events, []string{addr}, evloop.WithACL(acl)))
+}
+
+func TestACLRules(t *testing.T) {
+	if _, err := evloop.NewACL([]string{"10.0.0.0/33"}, nil); err == nil {
+		t.Fatal("expected invalid CIDR error")
+	}
+	acl, err := evloop.NewACL([]string{"10.0.0.0/8", "2001:db8::/32"}, []string{"10.1.0.0/16", "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, allowed := range map[string]bool{
+		"10.0.0.1":        true,
+		"10.1.0.1":        false,
+		"::ffff:10.0.0.1": true,
+		"192.168.0.1":     false,
+		"2001:db8::2":     true,
+		"2001:db8::1":     false,
+	} {
+		if acl.Allowed(net.ParseIP(ip)) != allowed {
+			t.Fatalf("unexpected decision for %s", ip)
+		}
+	}
+	var none *evloop.ACL
+	if !none.Allowed(net.ParseIP("192.168.0.1")) {
+		t.Fatal("nil ACL should allow every client")
+	}
+}
+
+func TestHttpServerACL(t *testing.T) {
+	acl, err := evloop.NewACL(nil, []string{"127.0.0.0/8"})
+	must(err)
+	mux := ps.NewMux()
+	mux.Get("/hello/:name", ps.HandlerFunc(HelloServer))
+	server := ps.NewHttp(mux)
+	server.SetPort(8083)
+	server.SetACL(acl)
+	go server.Serve()
+	time.Sleep(time.Millisecond * 100)
+
+	if _, err := http.Get("http://127.0.0.1:8083/hello/1"); err == nil {
+		panic("expected denied request")
+	}
+	must(acl.Set(nil, nil))
+	resp, err := http.Get("http://127.0.0.1:8083/hello/1")
+	must(err)
+	_, err = ioutil.ReadAll(resp.Body)
+	must(err)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		panic(fmt.Sprintf("unexpected status %d", resp.StatusCode))
+	}
+}
@@ -0,0 +1,80 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package test
+
+import (
+	"fmt"
+	"github.com/konstantin-kukharev/pureserver/evloop"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestInheritedListener(t *testing.T) {
+	for _, network := range []string{"fd", "fd-net"} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		must(err)
+		f, err := ln.(*net.TCPListener).File()
+		must(err)
+		addr := ln.Addr().String()
+		ln.Close()
+		serveEcho(network+fmt.Sprintf("://%d", f.Fd()), addr)
+		f.Close()
+	}
+	var events evloop.Events
+	if err := evloop.Serve(events, "systemd://missing"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestSystemdActivation(t *testing.T) {
+	if addr := os.Getenv("PURESERVER_TEST_ACTIVATION"); addr != "" {
+		serveEcho("systemd://web", addr)
+		return
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	must(err)
+	f, err := ln.(*net.TCPListener).File()
+	must(err)
+	defer f.Close()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSystemdActivation$")
+	cmd.Env = append(os.Environ(),
+		"PURESERVER_TEST_ACTIVATION="+ln.Addr().String(),
+		"LISTEN_FDS=1",
+		"LISTEN_FDNAMES=web",
+	)
+	cmd.ExtraFiles = []*os.File{f}
+	ln.Close()
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+}
+
+// serveEcho serves a single echo connection on the listener address.
+func serveEcho(listener, addr string) {
+	var events evloop.Events
+	events.Serving = func(srv evloop.Server) (action evloop.Action) {
+		if srv.Addresses[0].String() != addr {
+			panic("unexpected listener address " + srv.Addresses[0].String())
+		}
+		go func() {
+			conn, err := net.Dial("tcp", addr)
+			must(err)
+			defer conn.Close()
+			conn.Write([]byte("ping"))
+			p := make([]byte, 4)
+			_, err = io.ReadFull(conn, p)
+			must(err)
+		}()
+		return
+	}
+	events.Data = func(c evloop.Conn, in []byte) (out []byte, action evloop.Action) {
+		return in, evloop.None
+	}
+	events.Closed = func(c evloop.Conn, err error) (action evloop.Action) {
+		return evloop.Shutdown
+	}
+	must(evloop.Serve(events, listener))
+}
@@ -0,0 +1,108 @@
+package test
+
+import (
+	"encoding/json"
+	ps "github.com/konstantin-kukharev/pureserver"
+	"github.com/konstantin-kukharev/pureserver/evloop"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func adminGet(url, token string) (int, []byte) {
+	req, err := http.NewRequest("GET", url, nil)
+	must(err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	must(err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	must(err)
+	return resp.StatusCode, body
+}
+
+func TestHttpServerAdmin(t *testing.T) {
+	mux := ps.NewMux()
+	mux.Get("/hello/:name", ps.HandlerFunc(HelloServer))
+	server := ps.NewHttp(mux)
+	server.SetPort(8090)
+	server.SetAdmin(ps.Admin{Address: "tcp://127.0.0.1:8091", Token: "secret"})
+	go server.Serve()
+	waitPort(8090)
+
+	const admin = "http://127.0.0.1:8091"
+	if code, _ := adminGet(admin+"/debug/routes", ""); code != http.StatusUnauthorized {
+		t.Fatalf("unexpected status %d without token", code)
+	}
+	if code, _ := adminGet(admin+"/debug/routes", "wrong"); code != http.StatusUnauthorized {
+		t.Fatalf("unexpected status %d with a wrong token", code)
+	}
+	// the token is accepted with the Bearer scheme only
+	req, err := http.NewRequest("GET", admin+"/debug/routes", nil)
+	must(err)
+	req.Header.Set("Authorization", "secret")
+	resp, err := http.DefaultClient.Do(req)
+	must(err)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unexpected status %d with a raw token", resp.StatusCode)
+	}
+	code, body := adminGet(admin+"/debug/routes", "secret")
+	if code != 200 || !strings.Contains(string(body), `"pattern": "/hello/:name"`) {
+		t.Fatalf("unexpected routes %d %s", code, body)
+	}
+	var stats struct{ Loops, Listeners []json.RawMessage }
+	code, body = adminGet(admin+"/debug/loops", "secret")
+	must(json.Unmarshal(body, &stats))
+	if code != 200 || len(stats.Loops) == 0 || len(stats.Listeners) != 1 {
+		t.Fatalf("unexpected loops %d %s", code, body)
+	}
+	var rt struct{ Goroutines int }
+	code, body = adminGet(admin+"/debug/runtime", "secret")
+	must(json.Unmarshal(body, &rt))
+	if code != 200 || rt.Goroutines == 0 {
+		t.Fatalf("unexpected runtime %d %s", code, body)
+	}
+	var cfg struct{ Ports []int }
+	code, body = adminGet(admin+"/debug/config", "secret")
+	must(json.Unmarshal(body, &cfg))
+	if code != 200 || len(cfg.Ports) != 1 || cfg.Ports[0] != 8090 {
+		t.Fatalf("unexpected config %d %s", code, body)
+	}
+	if code, body = adminGet(admin+"/debug/pprof/", "secret"); code != 200 || !strings.Contains(string(body), "goroutine") {
+		t.Fatalf("unexpected pprof index %d", code)
+	}
+	if code, body = adminGet(admin+"/debug/goroutines?debug=2", "secret"); code != 200 || !strings.Contains(string(body), "goroutine ") {
+		t.Fatalf("unexpected goroutine dump %d", code)
+	}
+}
+
+func TestHttpServerAdminACL(t *testing.T) {
+	acl, err := evloop.NewACL(nil, []string{"127.0.0.0/8"})
+	must(err)
+	server := ps.NewHttp(ps.NewMux())
+	server.SetPort(8092)
+	server.SetAdmin(ps.Admin{Address: "127.0.0.1:8093", ACL: acl})
+	go server.Serve()
+	waitPort(8092)
+	if code, _ := adminGet("http://127.0.0.1:8093/debug/runtime", ""); code != http.StatusForbidden {
+		t.Fatalf("unexpected status %d for a denied client", code)
+	}
+	must(acl.Set(nil, nil))
+	if code, _ := adminGet("http://127.0.0.1:8093/debug/runtime", ""); code != 200 {
+		t.Fatalf("unexpected status %d for an allowed client", code)
+	}
+}
+
+func TestHttpServerAdminUnprotected(t *testing.T) {
+	// a network admin listener needs a token or an ACL
+	server := ps.NewHttp(ps.NewMux())
+	server.SetPort(8105)
+	server.SetAdmin(ps.Admin{Address: "tcp://127.0.0.1:8106"})
+	if err := server.Serve(); err == nil || !strings.Contains(err.Error(), "token") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package test
+
+import (
+	"context"
+	ps "github.com/konstantin-kukharev/pureserver"
+	"github.com/konstantin-kukharev/pureserver/evloop"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestHttpServerAdminUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admin")
+	must(err)
+	defer os.RemoveAll(dir)
+	// a file that is not a socket is not replaced
+	file := filepath.Join(dir, "file")
+	must(ioutil.WriteFile(file, []byte("data"), 0644))
+	server := ps.NewHttp(ps.NewMux())
+	server.SetPort(8105)
+	server.SetAdmin(ps.Admin{Address: "unix://" + file})
+	if err := server.Serve(); err == nil || !strings.Contains(err.Error(), "not a socket") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if data, err := ioutil.ReadFile(file); err != nil || string(data) != "data" {
+		t.Fatalf("the file was replaced: %q %v", data, err)
+	}
+
+	sock := filepath.Join(dir, "admin.sock")
+	server = ps.NewHttp(ps.NewMux())
+	server.SetPort(8105)
+	server.SetAdmin(ps.Admin{Address: "unix://" + sock + "?mode=0600"})
+	go server.Serve()
+	waitPort(8105)
+	st, err := os.Stat(sock)
+	must(err)
+	if st.Mode()&os.ModeSocket == 0 || st.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected socket mode %v", st.Mode())
+	}
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("unix", sock)
+		},
+	}}
+	resp, err := client.Get("http://admin/debug/runtime")
+	must(err)
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+}
+
+func TestHttpServerAdminAbstract(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract unix sockets are linux only")
+	}
+	// the abstract sockets have no file mode to guard them
+	server := ps.NewHttp(ps.NewMux())
+	server.SetPort(8114)
+	server.SetAdmin(ps.Admin{Address: "unix://@pureserver-admin"})
+	if err := server.Serve(); err == nil || !strings.Contains(err.Error(), "token") {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// the clients of an abstract socket have no IP address for the ACL
+	acl, err := evloop.NewACL(nil, nil)
+	must(err)
+	server = ps.NewHttp(ps.NewMux())
+	server.SetPort(8114)
+	server.SetAdmin(ps.Admin{Address: "unix://@pureserver-admin", ACL: acl})
+	go server.Serve()
+	waitPort(8114)
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("unix", "@pureserver-admin")
+		},
+	}}
+	resp, err := client.Get("http://admin/debug/runtime")
+	must(err)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,138 @@
+package test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/konstantin-kukharev/pureserver/evloop"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestLengthFieldCodec(t *testing.T) {
+	for _, size := range []int{1, 2, 4, 8} {
+		for _, order := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
+			codec := &evloop.LengthFieldCodec{FieldLength: size, ByteOrder: order}
+			var stream []byte
+			for _, msg := range []string{"hello", "", "world"} {
+				enc, err := codec.Encode([]byte(msg))
+				if err != nil {
+					t.Fatal(err)
+				}
+				stream = append(stream, enc...)
+			}
+			frames, rest, err := codec.Decode(stream[:len(stream)-2])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(frames) != 2 || string(frames[0]) != "hello" || len(frames[1]) != 0 {
+				t.Fatalf("size %d: unexpected frames %q", size, frames)
+			}
+			frames, rest, err = codec.Decode(append(rest, stream[len(stream)-2:]...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(frames) != 1 || string(frames[0]) != "world" || len(rest) != 0 {
+				t.Fatalf("size %d: unexpected frames %q, rest %q", size, frames, rest)
+			}
+		}
+	}
+	codec := &evloop.LengthFieldCodec{FieldLength: 2, MaxFrameLength: 4}
+	if _, _, err := codec.Decode([]byte{0, 5, 'h'}); err != evloop.ErrFrameTooLarge {
+		t.Fatalf("expected %v, got %v", evloop.ErrFrameTooLarge, err)
+	}
+	codec = &evloop.LengthFieldCodec{FieldLength: 1}
+	if _, err := codec.Encode(make([]byte, 256)); err != evloop.ErrFrameTooLarge {
+		t.Fatalf("expected %v, got %v", evloop.ErrFrameTooLarge, err)
+	}
+}
+
+func TestDelimiterCodec(t *testing.T) {
+	frames, rest, err := evloop.NewCRLFCodec().Decode([]byte("one\r\ntwo\nthree\r\nfo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 2 || string(frames[0]) != "one" || string(frames[1]) != "two\nthree" || string(rest) != "fo" {
+		t.Fatalf("unexpected frames %q, rest %q", frames, rest)
+	}
+	frames, rest, err = evloop.NewLineCodec().Decode([]byte("one\ntwo\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 2 || string(frames[1]) != "two" || len(rest) != 0 {
+		t.Fatalf("unexpected frames %q, rest %q", frames, rest)
+	}
+	enc, _ := evloop.NewCRLFCodec().Encode([]byte("four"))
+	if string(enc) != "four\r\n" {
+		t.Fatalf("unexpected encoding %q", enc)
+	}
+	codec := &evloop.DelimiterCodec{Delimiter: []byte{'\n'}, MaxFrameLength: 3}
+	if _, _, err := codec.Decode([]byte("four")); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if _, _, err := codec.Decode([]byte("fourty")); err != evloop.ErrFrameTooLarge {
+		t.Fatalf("expected %v, got %v", evloop.ErrFrameTooLarge, err)
+	}
+}
+
+func TestFixedLengthCodec(t *testing.T) {
+	codec := &evloop.FixedLengthCodec{Length: 3}
+	frames, rest, err := codec.Decode([]byte("abcdefg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 2 || string(frames[0]) != "abc" || string(frames[1]) != "def" || string(rest) != "g" {
+		t.Fatalf("unexpected frames %q, rest %q", frames, rest)
+	}
+	if _, err := codec.Encode([]byte("ab")); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestReact(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testReact("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testReact("tcp", ":9992", true)
+	})
+}
+
+func testReact(network, addr string, stdlib bool) {
+	var events evloop.Events
+	events.Codec = evloop.NewCRLFCodec()
+	events.React = func(c evloop.Conn, frame []byte) (out []byte, action evloop.Action) {
+		if string(frame) == "quit" {
+			return []byte("bye"), evloop.Shutdown
+		}
+		return []byte(strings.ToUpper(string(frame))), evloop.None
+	}
+	events.Serving = func(srv evloop.Server) (action evloop.Action) {
+		go func() {
+			conn, err := net.Dial(network, addr)
+			must(err)
+			defer conn.Close()
+			rd := bufio.NewReader(conn)
+			// split frames over several writes
+			for _, part := range []string{"hel", "lo\r\nwor", "ld\r", "\n"} {
+				_, err = conn.Write([]byte(part))
+				must(err)
+			}
+			for _, expected := range []string{"HELLO\r\n", "WORLD\r\n"} {
+				line, err := rd.ReadString('\n')
+				must(err)
+				if line != expected {
+					panic("unexpected frame: " + line)
+				}
+			}
+			_, err = conn.Write([]byte("quit\r\n"))
+			must(err)
+		}()
+		return
+	}
+	if stdlib {
+		must(evloop.Serve(events, network+"-net://"+addr))
+	} else {
+		must(evloop.Serve(events, network+"://"+addr))
+	}
+}
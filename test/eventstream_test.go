@@ -0,0 +1,174 @@
+package test
+
+import (
+	"bufio"
+	"fmt"
+	ps "github.com/konstantin-kukharev/pureserver"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readEvent reads the lines of the stream up to the next blank line.
+func readEvent(r *bufio.Reader) string {
+	var ev string
+	for {
+		line, err := r.ReadString('\n')
+		must(err)
+		if line == "\n" {
+			return ev
+		}
+		ev += line
+	}
+}
+
+// nextEvent skips the heartbeats of the stream.
+func nextEvent(r *bufio.Reader) string {
+	for {
+		if ev := readEvent(r); ev != ":\n" {
+			return ev
+		}
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testEventStream(t, 8097, "") })
+	t.Run("stdlib", func(t *testing.T) { testEventStream(t, 8108, "tcp-net://127.0.0.1:8108") })
+}
+
+// testEventStream serves the stream at the port, or at the listener
+// address when it is set.
+func testEventStream(t *testing.T, port int, listener string) {
+	history := ps.NewEventHistory(2)
+	for i := 1; i <= 3; i++ {
+		history.Add(ps.Event{ID: fmt.Sprint(i), Data: fmt.Sprint("event ", i)})
+	}
+	streams := make(chan *ps.EventStream, 2)
+	mux := ps.NewMux()
+	mux.Get("/events", ps.HandlerFunc(func(w ps.ResponseWriter, r ps.HttpRequestInterface) {
+		es, err := ps.NewEventStream(w, r)
+		must(err)
+		es.SetHeartbeat(20 * time.Millisecond)
+		if missed, ok := history.Since(es.LastEventID()); ok {
+			for _, ev := range missed {
+				must(es.Send(ev))
+			}
+		} else {
+			must(es.Send(ps.Event{Event: "reset"}))
+		}
+		streams <- es
+	}))
+	holding, hold := make(chan struct{}), make(chan struct{})
+	mux.Get("/busy", ps.HandlerFunc(func(w ps.ResponseWriter, r ps.HttpRequestInterface) {
+		holding <- struct{}{}
+		<-hold
+	}))
+	server := ps.NewHttp(mux)
+	server.SetLoops(1)
+	if listener != "" {
+		server.SetListeners(listener)
+	} else {
+		server.SetPort(port)
+	}
+	go server.Serve()
+	waitPort(port)
+
+	dial := func(head string) (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		must(err)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(conn, "GET /events HTTP/1.1\r\nHost: localhost\r\n%s\r\n", head)
+		r := bufio.NewReader(conn)
+		var h string
+		for {
+			line, err := r.ReadString('\n')
+			must(err)
+			if line == "\r\n" {
+				break
+			}
+			h += line
+		}
+		if !strings.HasPrefix(h, "HTTP/1.1 200 ") || !strings.Contains(h, "Content-Type: text/event-stream\r\n") {
+			t.Fatalf("unexpected response head %q", h)
+		}
+		return conn, r
+	}
+
+	c1, r1 := dial("")
+	es1 := <-streams
+	go func() {
+		must(es1.Send(ps.Event{ID: "4", Event: "update", Data: "a\r\nb", Retry: 2 * time.Second}))
+	}()
+	if ev := nextEvent(r1); ev != "id: 4\nevent: update\nretry: 2000\ndata: a\ndata: b\n" {
+		t.Fatalf("unexpected event %q", ev)
+	}
+	if ev := readEvent(r1); ev != ":\n" {
+		t.Fatalf("expected heartbeat, got %q", ev)
+	}
+
+	// resume after the event 2
+	c2, r2 := dial("Last-Event-ID: 2\r\n")
+	es2 := <-streams
+	if ev := readEvent(r2); ev != "id: 3\ndata: event 3\n" {
+		t.Fatalf("unexpected replayed event %q", ev)
+	}
+	// the event 1 is not in the history anymore
+	c3, r3 := dial("Last-Event-ID: 1\r\n")
+	<-streams
+	if ev := readEvent(r3); ev != "event: reset\n" {
+		t.Fatalf("unexpected event %q", ev)
+	}
+	c3.Close()
+
+	// an event sent while the loop is busy doesn't hold up the connection
+	// closing meanwhile, the busy handler holds the only loop so that the
+	// close is handled before the wake
+	c4, r4 := dial("Last-Event-ID: 1\r\n")
+	es4 := <-streams
+	readEvent(r4)
+	go func() {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		must(err)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second))
+		fmt.Fprint(conn, "GET /busy HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		ioutil.ReadAll(conn)
+	}()
+	<-holding
+	c4.Close()
+	time.Sleep(50 * time.Millisecond)
+	go es4.Send(ps.Event{Data: "late"})
+	time.Sleep(50 * time.Millisecond)
+	close(hold)
+	select {
+	case <-es4.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream not closed")
+	}
+
+	// the client disconnects
+	c1.Close()
+	select {
+	case <-es1.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream not closed")
+	}
+	if err := es1.Send(ps.Event{Data: "late"}); err != ps.ErrEventStreamClosed {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// the server closes the stream once the queued events are written
+	must(es2.Send(ps.Event{Data: "last"}))
+	es2.Close()
+	if ev := nextEvent(r2); ev != "data: last\n" {
+		t.Fatalf("unexpected event %q", ev)
+	}
+	if _, err := r2.ReadByte(); err != io.EOF {
+		t.Fatalf("expected the stream to end, got %v", err)
+	}
+	c2.Close()
+	<-es2.Done()
+}
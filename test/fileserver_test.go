@@ -0,0 +1,202 @@
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	ps "github.com/konstantin-kukharev/pureserver"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileServer(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testFileServer(t, 8101, "") })
+	t.Run("stdlib", func(t *testing.T) { testFileServer(t, 8113, "tcp-net://127.0.0.1:8113") })
+}
+
+func testFileServer(t *testing.T, port int, listener string) {
+	dir, err := ioutil.TempDir("", "fileserver")
+	must(err)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "www")
+	must(os.MkdirAll(filepath.Join(root, "sub"), 0755))
+	must(ioutil.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0644))
+	must(ioutil.WriteFile(filepath.Join(root, "a.txt"), []byte("0123456789"), 0644))
+	must(ioutil.WriteFile(filepath.Join(root, "sub", "index.html"), []byte("<p>sub</p>"), 0644))
+	must(ioutil.WriteFile(filepath.Join(root, "doc"), []byte("%PDF-1.4"), 0644))
+	big := bytes.Repeat([]byte("abcdefghijklmnopq"), 300000)
+	must(ioutil.WriteFile(filepath.Join(root, "big.bin"), big, 0644))
+	// larger than the socket buffers of the loopback
+	must(ioutil.WriteFile(filepath.Join(root, "huge.bin"), bytes.Repeat(big, 10), 0644))
+
+	mux := ps.NewMux()
+	mux.Get("/static/", ps.StripPrefix("/static", ps.FileServer(root)))
+	mux.Get("/file", ps.HandlerFunc(func(w ps.ResponseWriter, r ps.HttpRequestInterface) {
+		ps.ServeFile(w, r, filepath.Join(root, "a.txt"))
+	}))
+	server := ps.NewHttp(mux)
+	server.SetLoops(1)
+	if listener != "" {
+		server.SetListeners(listener)
+	} else {
+		server.SetPort(port)
+	}
+	go server.Serve()
+	waitPort(port)
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	defer client.CloseIdleConnections()
+	get := func(path string, header ...string) (*http.Response, string) {
+		req, err := http.NewRequest("GET", "http://"+addr+path, nil)
+		must(err)
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := client.Do(req)
+		must(err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		must(err)
+		return resp, string(body)
+	}
+
+	resp, body := get("/static/a.txt")
+	if resp.StatusCode != 200 || body != "0123456789" || resp.ContentLength != 10 ||
+		resp.Header.Get("Content-Type") != "text/plain; charset=utf-8" || resp.Header.Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("unexpected response %d %q %v", resp.StatusCode, body, resp.Header)
+	}
+	etag, modified := resp.Header.Get("Etag"), resp.Header.Get("Last-Modified")
+	if etag == "" || modified == "" {
+		t.Fatalf("missing validators %v", resp.Header)
+	}
+	if resp, _ := get("/static/a.txt", "If-None-Match", `"x", `+etag); resp.StatusCode != 304 {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	if resp, _ := get("/static/a.txt", "If-Modified-Since", modified); resp.StatusCode != 304 {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	if resp, _ := get("/static/a.txt", "If-None-Match", `"x"`, "If-Modified-Since", modified); resp.StatusCode != 200 {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+
+	// the ranges
+	resp, body = get("/static/a.txt", "Range", "bytes=2-5")
+	if resp.StatusCode != 206 || body != "2345" || resp.Header.Get("Content-Range") != "bytes 2-5/10" {
+		t.Fatalf("unexpected range %d %q %v", resp.StatusCode, body, resp.Header)
+	}
+	if resp, body = get("/static/a.txt", "Range", "bytes=-3"); resp.StatusCode != 206 || body != "789" {
+		t.Fatalf("unexpected suffix range %d %q", resp.StatusCode, body)
+	}
+	if resp, body = get("/static/a.txt", "Range", "bytes=2-5", "If-Range", `"stale"`); resp.StatusCode != 200 || body != "0123456789" {
+		t.Fatalf("unexpected if-range %d %q", resp.StatusCode, body)
+	}
+	resp, _ = get("/static/a.txt", "Range", "bytes=10-")
+	if resp.StatusCode != 416 || resp.Header.Get("Content-Range") != "bytes */10" {
+		t.Fatalf("unexpected status %d %v", resp.StatusCode, resp.Header)
+	}
+
+	// the index files and the MIME sniffing
+	if resp, body = get("/static/sub/"); body != "<p>sub</p>" || resp.Header.Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Fatalf("unexpected index %q %v", body, resp.Header)
+	}
+	if resp, body = get("/static/sub"); resp.Request.URL.Path != "/static/sub/" || body != "<p>sub</p>" {
+		t.Fatalf("unexpected redirect %s %q", resp.Request.URL, body)
+	}
+	if resp, _ = get("/static/doc"); resp.Header.Get("Content-Type") != "application/pdf" {
+		t.Fatalf("unexpected type %v", resp.Header)
+	}
+	if resp, _ = get("/static/missing"); resp.StatusCode != 404 {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	if resp, body = get("/file"); body != "0123456789" {
+		t.Fatalf("unexpected file %d %q", resp.StatusCode, body)
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	must(err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	// readResponse reads a response with a Content-Length.
+	readResponse := func() (int, string) {
+		resp, err := http.ReadResponse(r, nil)
+		must(err)
+		body, err := ioutil.ReadAll(resp.Body)
+		must(err)
+		return resp.StatusCode, string(body)
+	}
+
+	// the paths can't reach out of the root
+	for _, path := range []string{"/static/../secret", "/static/..%2fsecret", "/static/sub/..%2f..%2fsecret"} {
+		fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: localhost\r\n\r\n", path)
+		if status, body := readResponse(); status != 404 || body == "secret" {
+			t.Fatalf("unexpected response of %s %d %q", path, status, body)
+		}
+	}
+	fmt.Fprint(conn, "GET /file?x=../secret HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if status, body := readResponse(); status != 200 || body != "0123456789" {
+		t.Fatalf("unexpected response %d %q", status, body)
+	}
+
+	// the pipelined responses keep their order around the file bodies
+	fmt.Fprint(conn, "GET /static/big.bin HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+		"GET /static/a.txt HTTP/1.1\r\nHost: localhost\r\nRange: bytes=0-0\r\n\r\n"+
+		"HEAD /static/big.bin HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if status, body := readResponse(); status != 200 || body != string(big) {
+		t.Fatalf("unexpected big file %d %d", status, len(body))
+	}
+	if status, body := readResponse(); status != 206 || body != "0" {
+		t.Fatalf("unexpected response %d %q", status, body)
+	}
+	resp, err = http.ReadResponse(r, &http.Request{Method: "HEAD"})
+	must(err)
+	if resp.ContentLength != int64(len(big)) {
+		t.Fatalf("unexpected head response %v", resp.Header)
+	}
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := r.ReadByte(); err == nil || err == io.EOF {
+		t.Fatalf("unexpected data after the responses: %v", err)
+	}
+
+	// the file is sent before the connection closes on the invalid request
+	// that comes meanwhile
+	closing, err := net.Dial("tcp", addr)
+	must(err)
+	defer closing.Close()
+	closing.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprint(closing, "GET /static/huge.bin HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	time.Sleep(100 * time.Millisecond)
+	fmt.Fprint(closing, "BROKEN\r\n\r\n")
+	rc := bufio.NewReader(closing)
+	resp, err = http.ReadResponse(rc, nil)
+	must(err)
+	n, err := io.Copy(ioutil.Discard, resp.Body)
+	must(err)
+	if n != int64(len(big)*10) {
+		t.Fatalf("unexpected file of %d bytes before the close", n)
+	}
+	resp, err = http.ReadResponse(rc, nil)
+	must(err)
+	if _, err := ioutil.ReadAll(rc); err != nil || resp.StatusCode != 500 {
+		t.Fatalf("unexpected response %d %v before the close", resp.StatusCode, err)
+	}
+
+	// a download the client doesn't read doesn't hold up the other
+	// connections of the loop
+	stalled, err := net.Dial("tcp", addr)
+	must(err)
+	defer stalled.Close()
+	fmt.Fprint(stalled, "GET /static/huge.bin HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	if resp, body = get("/static/a.txt"); body != "0123456789" || time.Since(start) > time.Second {
+		t.Fatalf("unexpected response %d %q after %v", resp.StatusCode, body, time.Since(start))
+	}
+}
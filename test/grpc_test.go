@@ -0,0 +1,217 @@
+package test
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	ps "github.com/konstantin-kukharev/pureserver"
+	"github.com/konstantin-kukharev/pureserver/grpcserver"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// floodCount is the number of messages of the "flood" watch.
+const floodCount = 100000
+
+// healthServer serves the health service generated by protoc-gen-go-grpc.
+type healthServer struct {
+	healthpb.UnimplementedHealthServer
+	release chan struct{}
+	resume  chan struct{} // resumes the "hold" watch
+	sent    int32         // the messages sent by the "flood" watch
+}
+
+func (h *healthServer) Check(ctx context.Context, in *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	switch in.Service {
+	case "missing":
+		return nil, status.Errorf(codes.NotFound, "no 100%% match")
+	case "slow":
+		if _, ok := ctx.Deadline(); !ok {
+			return nil, status.Error(codes.Internal, "no deadline")
+		}
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	if len(md["x-token"]) == 0 || md["x-token"][0] != "secret" {
+		return nil, status.Error(codes.PermissionDenied, "bad token")
+	}
+	must(grpc.SetHeader(ctx, metadata.MD{"x-service": {in.Service}, "x-data-bin": md["x-data-bin"]}))
+	must(grpc.SetTrailer(ctx, metadata.Pairs("x-checked", "1")))
+	return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING}, nil
+}
+
+func (h *healthServer) Watch(in *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	if in.Service == "flood" {
+		for i := 0; i < floodCount; i++ {
+			if err := stream.Send(&healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING}); err != nil {
+				return err
+			}
+			atomic.AddInt32(&h.sent, 1)
+		}
+		return nil
+	}
+	stream.SetTrailer(metadata.Pairs("x-count", "2"))
+	if err := stream.Send(&healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING}); err != nil {
+		return err
+	}
+	if in.Service == "hold" {
+		<-h.resume
+	} else {
+		<-h.release
+	}
+	return stream.Send(&healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_NOT_SERVING})
+}
+
+func grpcFrame(m proto.Message) []byte {
+	msg, err := proto.Marshal(m)
+	must(err)
+	b := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(b[1:], uint32(len(msg)))
+	return append(b, msg...)
+}
+
+func TestGRPC(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testGRPC(t, 8111, "") })
+	t.Run("stdlib", func(t *testing.T) { testGRPC(t, 8112, "tcp-net://127.0.0.1:8112") })
+}
+
+func testGRPC(t *testing.T, port int, listener string) {
+	h := &healthServer{release: make(chan struct{}), resume: make(chan struct{})}
+	var intercepted int32
+	mux := ps.NewMux()
+	holding, hold := make(chan struct{}), make(chan struct{})
+	mux.Get("/busy", ps.HandlerFunc(func(w ps.ResponseWriter, r ps.HttpRequestInterface) {
+		holding <- struct{}{}
+		<-hold
+	}))
+	server := ps.NewHttp(mux)
+	server.SetLoops(1)
+	if listener != "" {
+		server.SetListeners(listener)
+	} else {
+		server.SetPort(port)
+	}
+	gs := grpcserver.New(server, grpcserver.Config{Interceptor: func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if info.FullMethod == "/grpc.health.v1.Health/Check" {
+			atomic.AddInt32(&intercepted, 1)
+		}
+		return handler(ctx, req)
+	}})
+	healthpb.RegisterHealthServer(gs, h)
+	go server.Serve()
+	waitPort(port)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, fmt.Sprintf("127.0.0.1:%d", port),
+		grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+	must(err)
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+
+	var header, trailer metadata.MD
+	octx := metadata.NewOutgoingContext(ctx, metadata.Pairs("x-token", "secret", "x-data-bin", "\x00\xff"))
+	resp, err := client.Check(octx, &healthpb.HealthCheckRequest{Service: "db"}, grpc.Header(&header), grpc.Trailer(&trailer))
+	must(err)
+	if resp.Status != healthpb.HealthCheckResponse_SERVING || fmt.Sprint(header["x-service"], header["x-data-bin"]) != "[db] [\x00\xff]" ||
+		fmt.Sprint(trailer["x-checked"]) != "[1]" {
+		t.Fatalf("unexpected response %v %v %v", resp, header, trailer)
+	}
+	if atomic.LoadInt32(&intercepted) != 1 {
+		t.Fatal("the interceptor was not called")
+	}
+
+	// the status of the error is sent in a trailers-only response
+	_, err = client.Check(octx, &healthpb.HealthCheckRequest{Service: "missing"})
+	if s := status.Convert(err); s.Code() != codes.NotFound || s.Message() != "no 100% match" {
+		t.Fatalf("unexpected status %v", s)
+	}
+	_, err = client.Check(ctx, &healthpb.HealthCheckRequest{Service: "db"})
+	if s := status.Convert(err); s.Code() != codes.PermissionDenied {
+		t.Fatalf("unexpected status %v", s)
+	}
+	err = conn.Invoke(ctx, "/grpc.health.v1.Health/Missing", &healthpb.HealthCheckRequest{}, &healthpb.HealthCheckResponse{})
+	if s := status.Convert(err); s.Code() != codes.Unimplemented || s.Message() != "unknown method /grpc.health.v1.Health/Missing" {
+		t.Fatalf("unexpected status %v", s)
+	}
+
+	// the deadline of the grpc-timeout header
+	start := time.Now()
+	sctx, scancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	_, err = client.Check(sctx, &healthpb.HealthCheckRequest{Service: "slow"})
+	scancel()
+	if s := status.Convert(err); s.Code() != codes.DeadlineExceeded || time.Since(start) > 2*time.Second {
+		t.Fatalf("unexpected status %v after %v", s, time.Since(start))
+	}
+
+	// the messages of a server stream are sent as they are produced
+	stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{Service: "db"})
+	must(err)
+	if m, err := stream.Recv(); err != nil || m.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("unexpected first message %v %v", m, err)
+	}
+	close(h.release)
+	if m, err := stream.Recv(); err != nil || m.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Fatalf("unexpected second message %v %v", m, err)
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Fatalf("expected the end of the stream, got %v", err)
+	}
+	if fmt.Sprint(stream.Trailer()["x-count"]) != "[2]" {
+		t.Fatalf("unexpected trailer %v", stream.Trailer())
+	}
+
+	// a message sent while the loop is busy doesn't hold up the frames of
+	// the connection received meanwhile, the busy handler holds the only
+	// loop so that the frames are handled before the wake
+	c := h2Dial(port)
+	defer c.conn.Close()
+	id := c.open("POST", "/grpc.health.v1.Health/Watch", grpcFrame(&healthpb.HealthCheckRequest{Service: "hold"}),
+		"content-type", "application/grpc", "te", "trailers")
+	for len(c.resps[id].body) == 0 {
+		c.readFrame()
+	}
+	go func() {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		must(err)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second))
+		fmt.Fprint(conn, "GET /busy HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		ioutil.ReadAll(conn)
+	}()
+	<-holding
+	writeH2Frame(c.conn, 0x6, 0, 0, make([]byte, 8))
+	time.Sleep(50 * time.Millisecond)
+	close(h.resume)
+	time.Sleep(50 * time.Millisecond)
+	close(hold)
+	if r := c.response(id); len(r.body) != 14 || r.trailer["grpc-status"] != "0" {
+		t.Fatalf("unexpected held response %d %v", len(r.body), r.trailer)
+	}
+
+	// the handler blocks in SendMsg while the client doesn't open the flow
+	// control windows
+	id = c.open("POST", "/grpc.health.v1.Health/Watch", grpcFrame(&healthpb.HealthCheckRequest{Service: "flood"}),
+		"content-type", "application/grpc", "te", "trailers")
+	time.Sleep(300 * time.Millisecond)
+	if n := atomic.LoadInt32(&h.sent); n == 0 || n > floodCount/2 {
+		t.Fatalf("unexpected messages sent before the windows opened: %d", n)
+	}
+	r := c.response(id)
+	if len(r.body) != floodCount*len(grpcFrame(&healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING})) ||
+		r.trailer["grpc-status"] != "0" {
+		t.Fatalf("unexpected flood response %d %v", len(r.body), r.trailer)
+	}
+}
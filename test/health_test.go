@@ -0,0 +1,108 @@
+package test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	ps "github.com/konstantin-kukharev/pureserver"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHttpServerHealth(t *testing.T) {
+	var slow int32
+	mux := ps.NewMux()
+	server := ps.NewHttp(mux)
+	server.SetPort(8089)
+	server.AddHealthCheck("db", time.Millisecond*50, func(ctx context.Context) error {
+		return nil
+	})
+	server.SetHealth("/healthz", "/readyz")
+	server.AddHealthCheck("cache", time.Millisecond*50, func(ctx context.Context) error {
+		if atomic.LoadInt32(&slow) == 0 {
+			return nil
+		}
+		<-ctx.Done()
+		return errors.New("cache unavailable")
+	})
+	done := make(chan error, 1)
+	go func() { done <- server.Serve() }()
+	waitPort(8089)
+
+	type report struct {
+		Status string
+		Checks map[string]struct{ Status, Error string }
+	}
+	get := func(path string) (int, report) {
+		resp, err := http.Get("http://127.0.0.1:8089" + path)
+		must(err)
+		defer resp.Body.Close()
+		var r report
+		body, err := ioutil.ReadAll(resp.Body)
+		must(err)
+		must(json.Unmarshal(body, &r))
+		return resp.StatusCode, r
+	}
+	if code, r := get("/healthz"); code != 200 || r.Status != "ok" {
+		t.Fatalf("unexpected liveness %d %+v", code, r)
+	}
+	// the readiness reports the last round of the checks, run every second
+	// in the background
+	ready := func(code int) report {
+		deadline := time.Now().Add(3 * time.Second)
+		for {
+			c, r := get("/readyz")
+			if c == code || time.Now().After(deadline) {
+				if c != code {
+					t.Fatalf("unexpected readiness %d %+v", c, r)
+				}
+				return r
+			}
+			time.Sleep(time.Millisecond * 20)
+		}
+	}
+	if r := ready(200); r.Status != "ok" || r.Checks["db"].Status != "ok" || r.Checks["cache"].Status != "ok" {
+		t.Fatalf("unexpected readiness %+v", r)
+	}
+	atomic.StoreInt32(&slow, 1)
+	if r := ready(503); r.Status != "fail" || r.Checks["db"].Status != "ok" ||
+		r.Checks["cache"].Error != context.DeadlineExceeded.Error() {
+		t.Fatalf("unexpected failed readiness %+v", r)
+	}
+	atomic.StoreInt32(&slow, 0)
+	ready(200)
+
+	// an open connection sees the readiness flip once the drain starts
+	conn, err := net.Dial("tcp", "127.0.0.1:8089")
+	must(err)
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	readyz := func() int {
+		req, _ := http.NewRequest("GET", "http://127.0.0.1:8089/readyz", nil)
+		must(req.Write(conn))
+		resp, err := http.ReadResponse(rd, req)
+		must(err)
+		ioutil.ReadAll(resp.Body)
+		return resp.StatusCode
+	}
+	if readyz() != 200 {
+		t.Fatal("expected ready server")
+	}
+	server.Drain()
+	if !server.Draining() || readyz() != 503 {
+		t.Fatal("expected draining server")
+	}
+	conn.Close()
+	http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+	select {
+	case err := <-done:
+		must(err)
+	case <-time.After(time.Second):
+		t.Fatal("server not drained")
+	}
+}
@@ -0,0 +1,479 @@
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"fmt"
+	ps "github.com/konstantin-kukharev/pureserver"
+	"golang.org/x/net/http2/hpack"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type h2Frame struct {
+	typ, flags byte
+	stream     uint32
+	payload    []byte
+}
+
+func readH2Frame(r io.Reader) h2Frame {
+	var h [9]byte
+	_, err := io.ReadFull(r, h[:])
+	must(err)
+	f := h2Frame{typ: h[3], flags: h[4], stream: binary.BigEndian.Uint32(h[5:]) & 0x7fffffff}
+	f.payload = make([]byte, int(h[0])<<16|int(h[1])<<8|int(h[2]))
+	_, err = io.ReadFull(r, f.payload)
+	must(err)
+	return f
+}
+
+func h2FrameBytes(typ, flags byte, stream uint32, payload []byte) []byte {
+	n := len(payload)
+	return append([]byte{byte(n >> 16), byte(n >> 8), byte(n), typ, flags,
+		byte(stream >> 24), byte(stream >> 16), byte(stream >> 8), byte(stream)}, payload...)
+}
+
+func writeH2Frame(w io.Writer, typ, flags byte, stream uint32, payload []byte) {
+	_, err := w.Write(h2FrameBytes(typ, flags, stream, payload))
+	must(err)
+}
+
+func http2Server(port int) {
+	big := bytes.Repeat([]byte("0123456789"), 30000)
+	mux := ps.NewMux()
+	mux.Get("/hello/:name", ps.HandlerFunc(HelloServer))
+	mux.Get("/big", ps.HandlerFunc(func(w ps.ResponseWriter, r ps.HttpRequestInterface) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.SetBody(big)
+	}))
+	mux.Post("/echo", ps.HandlerFunc(func(w ps.ResponseWriter, r ps.HttpRequestInterface) {
+		w.Header().Set("X-Proto", r.GetProto())
+		w.SetBody([]byte(r.GetBody()))
+	}))
+	server := ps.NewHttp(mux)
+	server.SetPort(port)
+	server.SetHTTP2(ps.HTTP2{InitialWindowSize: 64 << 10})
+	go server.Serve()
+	waitPort(port)
+}
+
+// h2Client is an HTTP/2 client connection speaking the frames directly,
+// with the flow control of the request bodies and the responses.
+type h2Client struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	enc    *hpack.Encoder
+	encBuf bytes.Buffer
+	dec    *hpack.Decoder
+	next   uint32
+
+	sendWindow    int64            // connection window of the server
+	initialWindow int64            // initial stream window of the server
+	windows       map[uint32]int64 // stream windows of the server
+	resps         map[uint32]*h2Response
+	goaway        *h2Frame
+}
+
+// h2Response is the response of a stream.
+type h2Response struct {
+	header  map[string]string
+	trailer map[string]string
+	body    []byte
+	reset   bool
+	done    bool
+}
+
+// h2Connect sends the client connection preface.
+func h2Connect(conn net.Conn) *h2Client {
+	c := &h2Client{
+		conn:          conn,
+		r:             bufio.NewReader(conn),
+		dec:           hpack.NewDecoder(4096, nil),
+		next:          1,
+		sendWindow:    65535,
+		initialWindow: 65535,
+		windows:       make(map[uint32]int64),
+		resps:         make(map[uint32]*h2Response),
+	}
+	c.enc = hpack.NewEncoder(&c.encBuf)
+	_, err := io.WriteString(conn, "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+	must(err)
+	writeH2Frame(conn, 0x4, 0, 0, nil)
+	return c
+}
+
+// h2Dial connects to the port with prior knowledge.
+func h2Dial(port int) *h2Client {
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	must(err)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return h2Connect(conn)
+}
+
+// open sends the request headers, the name and value pairs of header
+// follow the pseudo headers, and the body, if any, and returns the stream.
+func (c *h2Client) open(method, path string, body []byte, header ...string) uint32 {
+	id := c.next
+	c.next += 2
+	c.encBuf.Reset()
+	fields := []string{":method", method, ":scheme", "http", ":path", path, ":authority", "localhost"}
+	for i := 0; i+1 < len(fields); i += 2 {
+		must(c.enc.WriteField(hpack.HeaderField{Name: fields[i], Value: fields[i+1]}))
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		must(c.enc.WriteField(hpack.HeaderField{Name: header[i], Value: header[i+1]}))
+	}
+	c.windows[id] = c.initialWindow
+	c.resps[id] = &h2Response{header: map[string]string{}}
+	if body == nil {
+		writeH2Frame(c.conn, 0x1, 0x5, id, c.encBuf.Bytes())
+		return id
+	}
+	writeH2Frame(c.conn, 0x1, 0x4, id, c.encBuf.Bytes())
+	c.send(id, body, true)
+	return id
+}
+
+// send sends the data of the stream within the windows of the server.
+func (c *h2Client) send(id uint32, data []byte, end bool) {
+	for {
+		n := int64(len(data))
+		if n > 16384 {
+			n = 16384
+		}
+		if n > c.sendWindow {
+			n = c.sendWindow
+		}
+		if n > c.windows[id] {
+			n = c.windows[id]
+		}
+		if n <= 0 && len(data) > 0 {
+			c.readFrame()
+			continue
+		}
+		var flags byte
+		if end && int(n) == len(data) {
+			flags = 0x1
+		}
+		writeH2Frame(c.conn, 0x0, flags, id, data[:n])
+		c.sendWindow -= n
+		c.windows[id] -= n
+		if data = data[n:]; len(data) == 0 {
+			return
+		}
+	}
+}
+
+// readFrame reads and handles a frame.
+func (c *h2Client) readFrame() h2Frame {
+	f := readH2Frame(c.r)
+	resp := c.resps[f.stream]
+	switch f.typ {
+	case 0x0:
+		resp.body = append(resp.body, f.payload...)
+		if n := len(f.payload); n > 0 {
+			inc := []byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}
+			// the connection may be closed once the last stream ends
+			c.conn.Write(h2FrameBytes(0x8, 0, 0, inc))
+			if f.flags&0x1 == 0 {
+				writeH2Frame(c.conn, 0x8, 0, f.stream, inc)
+			}
+		}
+		resp.done = f.flags&0x1 != 0
+	case 0x1:
+		fields, err := c.dec.DecodeFull(f.payload)
+		must(err)
+		m := resp.header
+		if len(m) > 0 {
+			resp.trailer = map[string]string{}
+			m = resp.trailer
+		}
+		for _, hf := range fields {
+			m[hf.Name] = hf.Value
+		}
+		resp.done = f.flags&0x1 != 0
+	case 0x3:
+		resp.reset, resp.done = true, true
+	case 0x4:
+		if f.flags&0x1 == 0 {
+			for p := f.payload; len(p) >= 6; p = p[6:] {
+				if binary.BigEndian.Uint16(p) == 0x4 {
+					v := int64(binary.BigEndian.Uint32(p[2:]))
+					for id := range c.windows {
+						c.windows[id] += v - c.initialWindow
+					}
+					c.initialWindow = v
+				}
+			}
+			writeH2Frame(c.conn, 0x4, 0x1, 0, nil)
+		}
+	case 0x7:
+		c.goaway = &f
+	case 0x8:
+		inc := int64(binary.BigEndian.Uint32(f.payload) & 0x7fffffff)
+		if f.stream == 0 {
+			c.sendWindow += inc
+		} else {
+			c.windows[f.stream] += inc
+		}
+	}
+	return f
+}
+
+// response reads the frames until the stream ends.
+func (c *h2Client) response(id uint32) *h2Response {
+	for !c.resps[id].done {
+		c.readFrame()
+	}
+	return c.resps[id]
+}
+
+func TestHTTP2PriorKnowledge(t *testing.T) {
+	http2Server(8098)
+	c := h2Dial(8098)
+	defer c.conn.Close()
+
+	resp := c.response(c.open("GET", "/big", nil))
+	if resp.header[":status"] != "200" || resp.header["content-type"] != "text/plain" ||
+		!bytes.Equal(resp.body, bytes.Repeat([]byte("0123456789"), 30000)) {
+		t.Fatalf("unexpected response %v %d", resp.header, len(resp.body))
+	}
+
+	// the request body is larger than the flow control window
+	payload := strings.Repeat("abcdefgh", 40000)
+	resp = c.response(c.open("POST", "/echo?x=1", []byte(payload), "content-type", "text/plain"))
+	if string(resp.body) != payload || resp.header["x-proto"] != "HTTP/2.0" {
+		t.Fatalf("unexpected echo %d %v", len(resp.body), resp.header)
+	}
+
+	// the concurrent requests are multiplexed on the connection
+	var ids []uint32
+	for i := 1; i <= 20; i++ {
+		ids = append(ids, c.open("GET", fmt.Sprintf("/hello/%d", i), nil))
+	}
+	for i, id := range ids {
+		resp := c.response(id)
+		if want := fmt.Sprintf(`{"A":%d,"B":0,"C":0}`, i+1); string(resp.body) != want {
+			t.Fatalf("unexpected body %q, want %q", resp.body, want)
+		}
+	}
+
+	if resp = c.response(c.open("GET", "/missing", nil)); resp.header[":status"] != "404" {
+		t.Fatalf("unexpected status %s", resp.header[":status"])
+	}
+}
+
+// selfSignedCert returns a certificate for 127.0.0.1.
+func selfSignedCert() tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	must(err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "pureserver test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	must(err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestHTTP2TLS(t *testing.T) {
+	mux := ps.NewMux()
+	mux.Get("/hello/:name", ps.HandlerFunc(HelloServer))
+	server := ps.NewHttp(mux)
+	server.SetPort(8109)
+	server.SetHTTP2(ps.HTTP2{})
+	server.SetTLS(&tls.Config{Certificates: []tls.Certificate{selfSignedCert()}})
+	go server.Serve()
+	waitPort(8109)
+
+	// the h2 protocol is negotiated with ALPN
+	conn, err := tls.Dial("tcp", "127.0.0.1:8109", &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2", "http/1.1"}})
+	must(err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if p := conn.ConnectionState().NegotiatedProtocol; p != "h2" {
+		t.Fatalf("unexpected protocol %q", p)
+	}
+	c := h2Connect(conn)
+	resp := c.response(c.open("GET", "/hello/5", nil))
+	if resp.header[":status"] != "200" || string(resp.body) != `{"A":5,"B":0,"C":0}` {
+		t.Fatalf("unexpected response %v %q", resp.header, resp.body)
+	}
+
+	// the HTTP/1.1 clients are served on the same listener
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}, Timeout: 5 * time.Second}
+	defer client.CloseIdleConnections()
+	r, err := client.Get("https://127.0.0.1:8109/hello/6")
+	must(err)
+	body, err := ioutil.ReadAll(r.Body)
+	must(err)
+	r.Body.Close()
+	if r.Proto != "HTTP/1.1" || string(body) != `{"A":6,"B":0,"C":0}` {
+		t.Fatalf("unexpected response %s %q", r.Proto, body)
+	}
+}
+
+func TestHTTP2Drain(t *testing.T) {
+	mux := ps.NewMux()
+	mux.Post("/echo", ps.HandlerFunc(func(w ps.ResponseWriter, r ps.HttpRequestInterface) {
+		w.SetBody([]byte(r.GetBody()))
+	}))
+	server := ps.NewHttp(mux)
+	server.SetPort(8110)
+	server.SetHTTP2(ps.HTTP2{})
+	done := make(chan error, 1)
+	go func() { done <- server.Serve() }()
+	waitPort(8110)
+
+	c := h2Dial(8110)
+	defer c.conn.Close()
+	c.response(c.open("POST", "/echo", []byte("first")))
+	// the stream 3 is open when the drain starts
+	c.encBuf.Reset()
+	for _, hf := range []hpack.HeaderField{{Name: ":method", Value: "POST"}, {Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/echo"}, {Name: ":authority", Value: "localhost"}} {
+		must(c.enc.WriteField(hf))
+	}
+	writeH2Frame(c.conn, 0x1, 0x4, 3, c.encBuf.Bytes())
+	c.resps[3] = &h2Response{header: map[string]string{}}
+	c.windows[3] = c.initialWindow
+	c.next = 5
+	time.Sleep(50 * time.Millisecond)
+	server.Drain()
+	for c.goaway == nil {
+		c.readFrame()
+	}
+	if last, code := binary.BigEndian.Uint32(c.goaway.payload), binary.BigEndian.Uint32(c.goaway.payload[4:]); last != 3 || code != 0 {
+		t.Fatalf("unexpected goaway %d %d", last, code)
+	}
+	// the open stream completes, the new one is refused
+	c.send(3, []byte("second"), true)
+	if resp := c.response(3); string(resp.body) != "second" {
+		t.Fatalf("unexpected response %v %q", resp.header, resp.body)
+	}
+	if _, err := c.r.ReadByte(); err != io.EOF {
+		t.Fatalf("expected the connection to close, got %v", err)
+	}
+	select {
+	case err := <-done:
+		must(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server not drained")
+	}
+}
+
+func TestHTTP2Upgrade(t *testing.T) {
+	http2Server(8099)
+	conn, err := net.Dial("tcp", "127.0.0.1:8099")
+	must(err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprint(conn, "GET /hello/2 HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade, HTTP2-Settings\r\n"+
+		"Upgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQAAP__\r\n\r\n")
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	must(err)
+	if line != "HTTP/1.1 101 Switching Protocols\r\n" {
+		t.Fatalf("unexpected status line %q", line)
+	}
+	for line != "\r\n" {
+		line, err = r.ReadString('\n')
+		must(err)
+	}
+	fmt.Fprint(conn, "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+	writeH2Frame(conn, 0x4, 0, 0, nil)
+
+	// the response to the upgraded request is sent on the stream 1
+	var status, body string
+	var acked bool
+	dec := hpack.NewDecoder(4096, nil)
+	for body == "" || !acked {
+		f := readH2Frame(r)
+		switch {
+		case f.typ == 0x4 && f.flags&0x1 != 0:
+			acked = true
+		case f.typ == 0x1 && f.stream == 1:
+			fields, err := dec.DecodeFull(f.payload)
+			must(err)
+			status = fields[0].Name + " " + fields[0].Value
+		case f.typ == 0x0 && f.stream == 1:
+			if f.flags&0x1 == 0 {
+				t.Fatal("expected the end of the stream")
+			}
+			body = string(f.payload)
+		}
+	}
+	if status != ":status 200" || body != `{"A":2,"B":0,"C":0}` {
+		t.Fatalf("unexpected response %q %q", status, body)
+	}
+
+	// a ping is acknowledged
+	writeH2Frame(conn, 0x6, 0, 0, []byte("12345678"))
+	if f := readH2Frame(r); f.typ != 0x6 || f.flags != 0x1 || string(f.payload) != "12345678" {
+		t.Fatalf("unexpected ping reply %+v", f)
+	}
+
+	// the response body waits for the flow control window of the client
+	var block bytes.Buffer
+	enc := hpack.NewEncoder(&block)
+	for _, hf := range []hpack.HeaderField{{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/big"}, {Name: ":authority", Value: "localhost"}} {
+		must(enc.WriteField(hf))
+	}
+	writeH2Frame(conn, 0x1, 0x5, 3, block.Bytes())
+	// the response of the stream 1 used a part of the connection window
+	received := len(body)
+	for received < 65535 {
+		if f := readH2Frame(r); f.typ == 0x0 && f.stream == 3 {
+			received += len(f.payload)
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := r.ReadByte(); err == nil {
+		t.Fatal("unexpected data beyond the flow control window")
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	inc := []byte{0, 0x10, 0, 0}
+	writeH2Frame(conn, 0x8, 0, 0, inc)
+	writeH2Frame(conn, 0x8, 0, 3, inc)
+	for {
+		f := readH2Frame(r)
+		if f.typ != 0x0 || f.stream != 3 {
+			continue
+		}
+		if received += len(f.payload); f.flags&0x1 != 0 {
+			break
+		}
+	}
+	if received != 300000+len(body) {
+		t.Fatalf("unexpected body size %d", received)
+	}
+
+	// the client streams must have odd ids
+	writeH2Frame(conn, 0x1, 0x5, 2, []byte{0x82, 0x86, 0x84})
+	f := readH2Frame(r)
+	if f.typ != 0x7 || binary.BigEndian.Uint32(f.payload[4:]) != 0x1 {
+		t.Fatalf("expected goaway, got %+v", f)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("expected the connection to close, got %v", err)
+	}
+}
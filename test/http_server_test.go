@@ -6,9 +6,11 @@ import (
 	"fmt"
 	ps "github.com/konstantin-kukharev/pureserver"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"strconv"
 	"testing"
+	"time"
 )
 
 var (
@@ -51,6 +53,7 @@ func HelloServer2(w ps.ResponseWriter, req ps.HttpRequestInterface) {
 
 func TestHttpServerRoutes(t *testing.T) {
 	go serverUp(8080)
+	waitPort(8080)
 
 	incr := 10
 	tr := TestResponse{1, 1, 1}
@@ -65,6 +68,62 @@ func TestHttpServerRoutes(t *testing.T) {
 	}
 }
 
+func TestHttpServerStatus(t *testing.T) {
+	mux := ps.NewMux()
+	mux.Post("/created", ps.HandlerFunc(func(w ps.ResponseWriter, r ps.HttpRequestInterface) {
+		w.Header().Set("Location", "/created/1")
+		w.WriteHeader(201)
+		w.SetBody([]byte("created"))
+	}))
+	server := ps.NewHttp(mux)
+	server.SetPort(8102)
+	go server.Serve()
+	waitPort(8102)
+
+	resp, err := Post("http://127.0.0.1:8102/created", nil, http.Header{})
+	must(err)
+	body, err := ioutil.ReadAll(resp.Body)
+	must(err)
+	resp.Body.Close()
+	if resp.StatusCode != 201 || resp.Header.Get("Location") != "/created/1" || string(body) != "created" {
+		t.Fatalf("unexpected response %d %v %q", resp.StatusCode, resp.Header, body)
+	}
+	resp, err = Get("http://127.0.0.1:8102/missing", nil, http.Header{})
+	must(err)
+	resp.Body.Close()
+	if resp.StatusCode != 404 || resp.Header.Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Fatalf("unexpected response %d %v", resp.StatusCode, resp.Header)
+	}
+}
+
+func TestHttpServerQuery(t *testing.T) {
+	mux := ps.NewMux()
+	mux.Get("/query/:id", ps.HandlerFunc(func(w ps.ResponseWriter, r ps.HttpRequestInterface) {
+		id, _ := r.GetParam("id")
+		x := r.GetPath().Query().Get("x")
+		w.SetBody([]byte(fmt.Sprintf("%s %s %s %s", r.GetPath().Path, id, x, r.GetQuery())))
+	}))
+	server := ps.NewHttp(mux)
+	server.SetPort(8103)
+	go server.Serve()
+	waitPort(8103)
+
+	for target, want := range map[string]string{
+		"/query/7?x=1&y=2": "/query/7 7 1 x=1&y=2",
+		"/query/8?":        "/query/8 8  ",
+		"/query/9":         "/query/9 9  ",
+	} {
+		resp, err := Get("http://127.0.0.1:8103"+target, nil, http.Header{})
+		must(err)
+		body, err := ioutil.ReadAll(resp.Body)
+		must(err)
+		resp.Body.Close()
+		if string(body) != want {
+			t.Fatalf("unexpected response to %s: %q, want %q", target, body, want)
+		}
+	}
+}
+
 func serverUp(ports ...int) {
 	mux := ps.NewMux()
 	mux.Get("/hello/:name", ps.HandlerFunc(HelloServer))
@@ -76,6 +135,19 @@ func serverUp(ports ...int) {
 	fmt.Println(server.Serve())
 }
 
+// waitPort waits until the server accepts connections on the port.
+func waitPort(port int) {
+	for i := 0; i < 100; i++ {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	panic(fmt.Sprintf("port %d is not ready", port))
+}
+
 func makeRequest(port int, route string, test []byte) (status string, body []byte, err error) {
 	resp, err := Get(fmt.Sprintf("http://0.0.0.0:%d/%s", port, route), test, http.Header{})
 	if err != nil {
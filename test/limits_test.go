@@ -0,0 +1,148 @@
+package test
+
+import (
+	"github.com/konstantin-kukharev/pureserver/evloop"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMaxConns(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testMaxConns("tcp://127.0.0.1:9991") })
+	t.Run("poll-listener", func(t *testing.T) { testMaxConns("tcp://127.0.0.1:9991?maxconns=2") })
+	t.Run("stdlib", func(t *testing.T) { testMaxConns("tcp-net://127.0.0.1:9992") })
+}
+
+func testMaxConns(addr string) {
+	var opened int32
+	var events evloop.Events
+	events.Serving = func(srv evloop.Server) (action evloop.Action) {
+		go func() {
+			defer srv.Shutdown()
+			lnAddr := srv.Addresses[0].String()
+			a, b := limitsDial(lnAddr), limitsDial(lnAddr)
+			limitsEcho(a, "a")
+			limitsEcho(b, "b")
+			// over the limit, closed without any event
+			c := limitsDial(lnAddr)
+			expectClosed(c)
+			a.Close()
+			time.Sleep(time.Millisecond * 100)
+			d := limitsDial(lnAddr)
+			limitsEcho(d, "d")
+			b.Close()
+			d.Close()
+			if r := srv.Rejections(); r.MaxConns != 1 {
+				panic("unexpected rejections")
+			}
+		}()
+		return
+	}
+	events.Opened = func(c evloop.Conn) (out []byte, opts evloop.Options, action evloop.Action) {
+		atomic.AddInt32(&opened, 1)
+		return
+	}
+	events.Data = func(c evloop.Conn, in []byte) (out []byte, action evloop.Action) {
+		return in, evloop.None
+	}
+	var opts []evloop.Option
+	if addr == "tcp://127.0.0.1:9991" || addr == "tcp-net://127.0.0.1:9992" {
+		opts = append(opts, evloop.WithMaxConns(2))
+	}
+	must(evloop.Run(events, []string{addr}, opts...))
+	if atomic.LoadInt32(&opened) != 3 {
+		panic("unexpected opened connections")
+	}
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testMaxConnsPerIP("tcp://127.0.0.1:9991") })
+	t.Run("stdlib", func(t *testing.T) { testMaxConnsPerIP("tcp-net://127.0.0.1:9992") })
+}
+
+func testMaxConnsPerIP(addr string) {
+	var events evloop.Events
+	events.Serving = func(srv evloop.Server) (action evloop.Action) {
+		go func() {
+			defer srv.Shutdown()
+			lnAddr := srv.Addresses[0].String()
+			a := limitsDial(lnAddr)
+			defer a.Close()
+			limitsEcho(a, "a")
+			expectClosed(limitsDial(lnAddr))
+			if r := srv.Rejections(); r.MaxConnsPerIP != 1 || r.MaxConns != 0 {
+				panic("unexpected rejections")
+			}
+		}()
+		return
+	}
+	events.Data = func(c evloop.Conn, in []byte) (out []byte, action evloop.Action) {
+		return in, evloop.None
+	}
+	must(evloop.Run(events, []string{addr}, evloop.WithMaxConnsPerIP(1)))
+}
+
+func TestAcceptRate(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testAcceptRate("tcp://127.0.0.1:9991") })
+	t.Run("stdlib", func(t *testing.T) { testAcceptRate("tcp-net://127.0.0.1:9992") })
+}
+
+func testAcceptRate(addr string) {
+	var events evloop.Events
+	events.Serving = func(srv evloop.Server) (action evloop.Action) {
+		go func() {
+			defer srv.Shutdown()
+			lnAddr := srv.Addresses[0].String()
+			for i := 0; i < 2; i++ {
+				c := limitsDial(lnAddr)
+				limitsEcho(c, "x")
+				c.Close()
+			}
+			// the burst is spent
+			expectClosed(limitsDial(lnAddr))
+			time.Sleep(time.Millisecond * 250)
+			c := limitsDial(lnAddr)
+			limitsEcho(c, "x")
+			c.Close()
+			if r := srv.Rejections(); r.RateLimited != 1 {
+				panic("unexpected rejections")
+			}
+		}()
+		return
+	}
+	events.Data = func(c evloop.Conn, in []byte) (out []byte, action evloop.Action) {
+		return in, evloop.None
+	}
+	must(evloop.Run(events, []string{addr}, evloop.WithAcceptRate(5, 2)))
+}
+
+func limitsDial(addr string) net.Conn {
+	conn, err := net.Dial("tcp", addr)
+	must(err)
+	return conn
+}
+
+// expectClosed expects the server to close the connection.
+func expectClosed(conn net.Conn) {
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 16)); err == nil {
+		panic("expected closed connection")
+	} else if err, ok := err.(net.Error); ok && err.Timeout() {
+		panic("connection not closed")
+	}
+}
+
+// limitsEcho expects the server to echo the message.
+func limitsEcho(conn net.Conn, msg string) {
+	conn.Write([]byte(msg))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	p := make([]byte, len(msg))
+	_, err := io.ReadFull(conn, p)
+	must(err)
+	if string(p) != msg {
+		panic("unexpected reply " + string(p))
+	}
+}
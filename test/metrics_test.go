@@ -0,0 +1,62 @@
+package test
+
+import (
+	ps "github.com/konstantin-kukharev/pureserver"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHttpServerMetrics(t *testing.T) {
+	mux := ps.NewMux()
+	mux.Get("/hello/:name", ps.HandlerFunc(HelloServer))
+	server := ps.NewHttp(mux)
+	server.SetPort(8084)
+	server.SetMetrics("/metrics")
+	go server.Serve()
+	waitPort(8084)
+
+	for _, path := range []string{"/hello/1", "/hello/2", "/missing"} {
+		resp, err := http.Get("http://127.0.0.1:8084" + path)
+		must(err)
+		resp.Body.Close()
+	}
+	for _, method := range []string{"FOO1", "FOO2"} {
+		req, err := http.NewRequest(method, "http://127.0.0.1:8084/missing", nil)
+		must(err)
+		resp, err := http.DefaultClient.Do(req)
+		must(err)
+		resp.Body.Close()
+	}
+	conn, err := net.Dial("tcp", "127.0.0.1:8084")
+	must(err)
+	conn.Write([]byte("garbage\r\n\r\n"))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	ioutil.ReadAll(conn)
+	conn.Close()
+
+	resp, err := http.Get("http://127.0.0.1:8084/metrics")
+	must(err)
+	body, err := ioutil.ReadAll(resp.Body)
+	must(err)
+	resp.Body.Close()
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected content type %q", resp.Header.Get("Content-Type"))
+	}
+	for _, line := range []string{
+		`pureserver_http_requests_total{route="/hello/:name",method="GET",status="200"} 2`,
+		`pureserver_http_requests_total{route="unmatched",method="GET",status="404"} 1`,
+		`pureserver_http_requests_total{route="unmatched",method="OTHER",status="404"} 2`,
+		`pureserver_http_request_duration_seconds_count{route="/hello/:name",method="GET"} 2`,
+		`pureserver_http_response_size_bytes_bucket{route="/hello/:name",method="GET",le="+Inf"} 2`,
+		`pureserver_http_requests_in_flight 1`,
+		`pureserver_http_parse_errors_total 1`,
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Fatalf("missing %q in\n%s", line, body)
+		}
+	}
+}
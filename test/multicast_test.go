@@ -0,0 +1,71 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package test
+
+import (
+	"github.com/konstantin-kukharev/pureserver/evloop"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMulticast(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testMulticast(t, "udp4://239.1.2.3:9993?multicast=1&loop=1&ttl=1") })
+	t.Run("stdlib", func(t *testing.T) { testMulticast(t, "udp4-net://239.1.2.3:9993?multicast=1&loop=1&ttl=1") })
+}
+
+func testMulticast(t *testing.T, addr string) {
+	var events evloop.Events
+	received := make(chan bool, 1)
+	events.Serving = func(srv evloop.Server) (action evloop.Action) {
+		go func() {
+			defer srv.Shutdown()
+			conn, err := net.Dial("udp4", "239.1.2.3:9993")
+			must(err)
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+			for i := 0; i < 5; i++ {
+				if _, err := conn.Write([]byte("tick")); err != nil {
+					break
+				}
+				select {
+				case <-received:
+					return
+				case <-time.After(time.Millisecond * 200):
+				}
+			}
+			panic("multicast datagram not received")
+		}()
+		return
+	}
+	events.Data = func(c evloop.Conn, in []byte) (out []byte, action evloop.Action) {
+		if string(in) == "tick" {
+			select {
+			case received <- true:
+			default:
+			}
+		}
+		return
+	}
+	if err := evloop.Serve(events, addr); err != nil {
+		// the host has no multicast capable interface
+		t.Skip(err)
+	}
+}
+
+func TestUDPOptions(t *testing.T) {
+	var events evloop.Events
+	events.Serving = func(srv evloop.Server) (action evloop.Action) {
+		return evloop.Shutdown
+	}
+	must(evloop.Serve(events, "udp://127.0.0.1:9993?broadcast=1&ttl=4"))
+	for _, addr := range []string{
+		"udp://127.0.0.1:9993?multicast=1",
+		"udp://239.1.2.3:9993?multicast=1&ttl=256",
+		"udp://239.1.2.3:9993?multicast=1&iface=missing0",
+	} {
+		if err := evloop.Serve(events, addr); err == nil {
+			t.Fatalf("%s: expected error", addr)
+		}
+	}
+}
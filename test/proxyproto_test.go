@@ -0,0 +1,92 @@
+package test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/konstantin-kukharev/pureserver/evloop"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProxyProto(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testProxyProto("tcp://127.0.0.1:9991?proxyproto=1") })
+	t.Run("stdlib", func(t *testing.T) { testProxyProto("tcp-net://127.0.0.1:9992?proxyproto=1") })
+}
+
+func testProxyProto(addr string) {
+	var opened int32
+	var events evloop.Events
+	events.Serving = func(srv evloop.Server) (action evloop.Action) {
+		go func() {
+			defer srv.Shutdown()
+			lnAddr := srv.Addresses[0].String()
+			proxyRequest(lnAddr,
+				[]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nping\n"),
+				"192.0.2.1:56324 198.51.100.1:443 \n")
+			proxyRequest(lnAddr,
+				proxyV2Header([]byte("example.com")),
+				"[2001:db8::1]:1000 [2001:db8::2]:2000 example.com\n")
+			proxyRequest(lnAddr,
+				[]byte("PROXY UNKNOWN\r\nping\n"),
+				"127.0.0.1")
+			// invalid headers are rejected without any event
+			for _, header := range []string{"GET / HTTP/1.1\r\n\r\n", "PROXY TCP4 256.0.0.1 198.51.100.1 1 2\r\n"} {
+				conn, err := net.Dial("tcp", lnAddr)
+				must(err)
+				conn.Write([]byte(header))
+				conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+				if _, err := conn.Read(make([]byte, 1)); err == nil {
+					panic("expected rejected connection")
+				}
+				conn.Close()
+			}
+			if n := atomic.LoadInt32(&opened); n != 3 {
+				panic("unexpected opened connections")
+			}
+		}()
+		return
+	}
+	events.Opened = func(c evloop.Conn) (out []byte, opts evloop.Options, action evloop.Action) {
+		atomic.AddInt32(&opened, 1)
+		return
+	}
+	events.Data = func(c evloop.Conn, in []byte) (out []byte, action evloop.Action) {
+		hdr := c.ProxyHeader()
+		if hdr == nil {
+			panic("no proxy header")
+		}
+		return []byte(c.RemoteAddr().String() + " " + c.LocalAddr().String() + " " + hdr.ServerName() + "\n"), evloop.None
+	}
+	must(evloop.Serve(events, addr))
+}
+
+// proxyRequest sends the request in two parts and checks the beginning of
+// the reply line.
+func proxyRequest(addr string, req []byte, reply string) {
+	conn, err := net.Dial("tcp", addr)
+	must(err)
+	defer conn.Close()
+	conn.Write(req[:10])
+	time.Sleep(time.Millisecond * 10)
+	conn.Write(req[10:])
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	must(err)
+	if len(line) < len(reply) || line[:len(reply)] != reply {
+		panic("unexpected reply " + line)
+	}
+}
+
+// proxyV2Header returns a PROXY protocol version 2 header for a TCP over
+// IPv6 connection with the authority TLV, followed by a request.
+func proxyV2Header(authority []byte) []byte {
+	b := []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x21\x00\x00")
+	b = append(b, net.ParseIP("2001:db8::1")...)
+	b = append(b, net.ParseIP("2001:db8::2")...)
+	b = append(b, 0x03, 0xE8, 0x07, 0xD0)
+	b = append(b, 0x02, 0x00, byte(len(authority)))
+	b = append(b, authority...)
+	binary.BigEndian.PutUint16(b[14:], uint16(len(b)-16))
+	return append(b, "ping\n"...)
+}
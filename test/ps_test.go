@@ -7,8 +7,9 @@ package test
 import (
 	"bufio"
 	"fmt"
-	"github.com/konstantin-kukharev/pureserver/internal"
+	"github.com/konstantin-kukharev/pureserver/evloop"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"net"
 	"os"
@@ -29,66 +30,66 @@ func TestServe(t *testing.T) {
 	t.Run("stdlib", func(t *testing.T) {
 		t.Run("tcp", func(t *testing.T) {
 			t.Run("1-loop", func(t *testing.T) {
-				testServe("tcp-net", ":9997", false, 10, 1, internal.Random)
+				testServe("tcp-net", ":9997", false, 10, 1, evloop.Random)
 			})
 			t.Run("5-loop", func(t *testing.T) {
-				testServe("tcp-net", ":9998", false, 10, 5, internal.LeastConnections)
+				testServe("tcp-net", ":9998", false, 10, 5, evloop.LeastConnections)
 			})
 			t.Run("N-loop", func(t *testing.T) {
-				testServe("tcp-net", ":9999", false, 10, -1, internal.RoundRobin)
+				testServe("tcp-net", ":9999", false, 10, -1, evloop.RoundRobin)
 			})
 		})
 		t.Run("unix", func(t *testing.T) {
 			t.Run("1-loop", func(t *testing.T) {
-				testServe("tcp-net", ":9989", true, 10, 1, internal.Random)
+				testServe("tcp-net", ":9989", true, 10, 1, evloop.Random)
 			})
 			t.Run("5-loop", func(t *testing.T) {
-				testServe("tcp-net", ":9988", true, 10, 5, internal.LeastConnections)
+				testServe("tcp-net", ":9988", true, 10, 5, evloop.LeastConnections)
 			})
 			t.Run("N-loop", func(t *testing.T) {
-				testServe("tcp-net", ":9987", true, 10, -1, internal.RoundRobin)
+				testServe("tcp-net", ":9987", true, 10, -1, evloop.RoundRobin)
 			})
 		})
 	})
 	t.Run("poll", func(t *testing.T) {
 		t.Run("tcp", func(t *testing.T) {
 			t.Run("1-loop", func(t *testing.T) {
-				testServe("tcp", ":9991", false, 10, 1, internal.Random)
+				testServe("tcp", ":9991", false, 10, 1, evloop.Random)
 			})
 			t.Run("5-loop", func(t *testing.T) {
-				testServe("tcp", ":9992", false, 10, 5, internal.LeastConnections)
+				testServe("tcp", ":9992", false, 10, 5, evloop.LeastConnections)
 			})
 			t.Run("N-loop", func(t *testing.T) {
-				testServe("tcp", ":9993", false, 10, -1, internal.RoundRobin)
+				testServe("tcp", ":9993", false, 10, -1, evloop.RoundRobin)
 			})
 		})
 		t.Run("unix", func(t *testing.T) {
 			t.Run("1-loop", func(t *testing.T) {
-				testServe("tcp", ":9994", true, 10, 1, internal.Random)
+				testServe("tcp", ":9994", true, 10, 1, evloop.Random)
 			})
 			t.Run("5-loop", func(t *testing.T) {
-				testServe("tcp", ":9995", true, 10, 5, internal.LeastConnections)
+				testServe("tcp", ":9995", true, 10, 5, evloop.LeastConnections)
 			})
 			t.Run("N-loop", func(t *testing.T) {
-				testServe("tcp", ":9996", true, 10, -1, internal.RoundRobin)
+				testServe("tcp", ":9996", true, 10, -1, evloop.RoundRobin)
 			})
 		})
 	})
 
 }
 
-func testServe(network, addr string, unix bool, nclients, nloops int, balance internal.LoadBalance) {
+func testServe(network, addr string, unix bool, nclients, nloops int, balance evloop.LoadBalance) {
 	var started int32
 	var connected int32
 	var disconnected int32
 
-	var events internal.Events
+	var events evloop.Events
 	events.LoadBalance = balance
 	events.NumLoops = nloops
-	events.Serving = func(srv internal.Server) (action internal.Action) {
+	events.Serving = func(srv evloop.Server) (action evloop.Action) {
 		return
 	}
-	events.Opened = func(c internal.Conn) (out []byte, opts internal.Options, action internal.Action) {
+	events.Opened = func(c evloop.Conn) (out []byte, opts evloop.Options, action evloop.Action) {
 		c.SetContext(c)
 		atomic.AddInt32(&connected, 1)
 		out = []byte("sweetness\r\n")
@@ -101,22 +102,22 @@ func testServe(network, addr string, unix bool, nclients, nloops int, balance in
 		}
 		return
 	}
-	events.Closed = func(c internal.Conn, err error) (action internal.Action) {
+	events.Closed = func(c evloop.Conn, err error) (action evloop.Action) {
 		if c.Context() != c {
 			panic("invalid context")
 		}
 		atomic.AddInt32(&disconnected, 1)
 		if atomic.LoadInt32(&connected) == atomic.LoadInt32(&disconnected) &&
 			atomic.LoadInt32(&disconnected) == int32(nclients) {
-			action = internal.Shutdown
+			action = evloop.Shutdown
 		}
 		return
 	}
-	events.Data = func(c internal.Conn, in []byte) (out []byte, action internal.Action) {
+	events.Data = func(c evloop.Conn, in []byte) (out []byte, action evloop.Action) {
 		out = in
 		return
 	}
-	events.Tick = func() (delay time.Duration, action internal.Action) {
+	events.Tick = func() (delay time.Duration, action evloop.Action) {
 		if atomic.LoadInt32(&started) == 0 {
 			for i := 0; i < nclients; i++ {
 				go startClient(network, addr, nloops)
@@ -131,9 +132,9 @@ func testServe(network, addr string, unix bool, nclients, nloops int, balance in
 		socket := strings.Replace(addr, ":", "socket", 1)
 		os.RemoveAll(socket)
 		defer os.RemoveAll(socket)
-		err = internal.Serve(events, network+"://"+addr, "unix://"+socket)
+		err = evloop.Serve(events, network+"://"+addr, "unix://"+socket)
 	} else {
-		err = internal.Serve(events, network+"://"+addr)
+		err = evloop.Serve(events, network+"://"+addr)
 	}
 	if err != nil {
 		panic(err)
@@ -209,12 +210,12 @@ func TestTick(t *testing.T) {
 	wg.Wait()
 }
 func testTick(network, addr string, stdlib bool) {
-	var events internal.Events
+	var events evloop.Events
 	var count int
 	start := time.Now()
-	events.Tick = func() (delay time.Duration, action internal.Action) {
+	events.Tick = func() (delay time.Duration, action evloop.Action) {
 		if count == 25 {
-			action = internal.Shutdown
+			action = evloop.Shutdown
 			return
 		}
 		count++
@@ -222,9 +223,9 @@ func testTick(network, addr string, stdlib bool) {
 		return
 	}
 	if stdlib {
-		must(internal.Serve(events, network+"-net://"+addr))
+		must(evloop.Serve(events, network+"-net://"+addr))
 	} else {
-		must(internal.Serve(events, network+"://"+addr))
+		must(evloop.Serve(events, network+"://"+addr))
 	}
 	dur := time.Since(start)
 	if dur < 250&time.Millisecond || dur > time.Second {
@@ -257,19 +258,19 @@ func TestShutdown(t *testing.T) {
 	wg.Wait()
 }
 func testShutdown(network, addr string, stdlib bool) {
-	var events internal.Events
+	var events evloop.Events
 	var count int
 	var clients int64
 	var N = 10
-	events.Opened = func(c internal.Conn) (out []byte, opts internal.Options, action internal.Action) {
+	events.Opened = func(c evloop.Conn) (out []byte, opts evloop.Options, action evloop.Action) {
 		atomic.AddInt64(&clients, 1)
 		return
 	}
-	events.Closed = func(c internal.Conn, err error) (action internal.Action) {
+	events.Closed = func(c evloop.Conn, err error) (action evloop.Action) {
 		atomic.AddInt64(&clients, -1)
 		return
 	}
-	events.Tick = func() (delay time.Duration, action internal.Action) {
+	events.Tick = func() (delay time.Duration, action evloop.Action) {
 		if count == 0 {
 			// start clients
 			for i := 0; i < N; i++ {
@@ -285,7 +286,7 @@ func testShutdown(network, addr string, stdlib bool) {
 			}
 		} else {
 			if int(atomic.LoadInt64(&clients)) == N {
-				action = internal.Shutdown
+				action = evloop.Shutdown
 			}
 		}
 		count++
@@ -293,9 +294,9 @@ func testShutdown(network, addr string, stdlib bool) {
 		return
 	}
 	if stdlib {
-		must(internal.Serve(events, network+"-net://"+addr))
+		must(evloop.Serve(events, network+"-net://"+addr))
 	} else {
-		must(internal.Serve(events, network+"://"+addr))
+		must(evloop.Serve(events, network+"://"+addr))
 	}
 	if clients != 0 {
 		panic("did not call close on all clients")
@@ -331,20 +332,20 @@ func testDetach(network, addr string, stdlib bool) {
 	}
 	expected := []byte(string(rdat) + "--detached--" + string(rdat))
 	var cin []byte
-	var events internal.Events
-	events.Data = func(c internal.Conn, in []byte) (out []byte, action internal.Action) {
+	var events evloop.Events
+	events.Data = func(c evloop.Conn, in []byte) (out []byte, action evloop.Action) {
 		cin = append(cin, in...)
 		if len(cin) >= len(expected) {
 			if string(cin) != string(expected) {
 				panic("mismatch client -> server")
 			}
-			return cin, internal.Detach
+			return cin, evloop.Detach
 		}
 		return
 	}
 
 	var done int64
-	events.Detached = func(c internal.Conn, conn io.ReadWriteCloser) (action internal.Action) {
+	events.Detached = func(c evloop.Conn, conn io.ReadWriteCloser) (action evloop.Action) {
 		go func() {
 			p := make([]byte, len(expected))
 			defer conn.Close()
@@ -355,7 +356,7 @@ func testDetach(network, addr string, stdlib bool) {
 		return
 	}
 
-	events.Serving = func(srv internal.Server) (action internal.Action) {
+	events.Serving = func(srv evloop.Server) (action evloop.Action) {
 		go func() {
 			p := make([]byte, len(expected))
 			_ = expected
@@ -372,38 +373,38 @@ func testDetach(network, addr string, stdlib bool) {
 		}()
 		return
 	}
-	events.Tick = func() (delay time.Duration, action internal.Action) {
+	events.Tick = func() (delay time.Duration, action evloop.Action) {
 		delay = time.Second / 5
 		if atomic.LoadInt64(&done) == 1 {
-			action = internal.Shutdown
+			action = evloop.Shutdown
 		}
 		return
 	}
 	if stdlib {
-		must(internal.Serve(events, network+"-net://"+addr))
+		must(evloop.Serve(events, network+"-net://"+addr))
 	} else {
-		must(internal.Serve(events, network+"://"+addr))
+		must(evloop.Serve(events, network+"://"+addr))
 	}
 }
 
 func TestBadAddresses(t *testing.T) {
-	var events internal.Events
-	events.Serving = func(srv internal.Server) (action internal.Action) {
-		return internal.Shutdown
+	var events evloop.Events
+	events.Serving = func(srv evloop.Server) (action evloop.Action) {
+		return evloop.Shutdown
 	}
-	if err := internal.Serve(events, "tulip://howdy"); err == nil {
+	if err := evloop.Serve(events, "tulip://howdy"); err == nil {
 		t.Fatalf("expected error")
 	}
-	if err := internal.Serve(events, "howdy"); err == nil {
+	if err := evloop.Serve(events, "howdy"); err == nil {
 		t.Fatalf("expected error")
 	}
-	if err := internal.Serve(events, "tcp://"); err != nil {
+	if err := evloop.Serve(events, "tcp://"); err != nil {
 		t.Fatalf("expected nil, got '%v'", err)
 	}
 }
 
 func TestInputStream(t *testing.T) {
-	var s internal.InputStream
+	var s evloop.InputStream
 	in := []byte("HELLO")
 	data := s.Begin(in)
 	if string(data) != string(in) {
@@ -424,13 +425,13 @@ func TestInputStream(t *testing.T) {
 func TestReuseInputBuffer(t *testing.T) {
 	reuses := []bool{true, false}
 	for _, reuse := range reuses {
-		var events internal.Events
-		events.Opened = func(c internal.Conn) (out []byte, opts internal.Options, action internal.Action) {
+		var events evloop.Events
+		events.Opened = func(c evloop.Conn) (out []byte, opts evloop.Options, action evloop.Action) {
 			opts.ReuseInputBuffer = reuse
 			return
 		}
 		var prev []byte
-		events.Data = func(c internal.Conn, in []byte) (out []byte, action internal.Action) {
+		events.Data = func(c evloop.Conn, in []byte) (out []byte, action evloop.Action) {
 			if prev == nil {
 				prev = in
 			} else {
@@ -438,11 +439,11 @@ func TestReuseInputBuffer(t *testing.T) {
 				if reused != reuse {
 					t.Fatalf("expected %v, got %v", reuse, reused)
 				}
-				action = internal.Shutdown
+				action = evloop.Shutdown
 			}
 			return
 		}
-		events.Serving = func(_ internal.Server) (action internal.Action) {
+		events.Serving = func(_ evloop.Server) (action evloop.Action) {
 			go func() {
 				c, err := net.Dial("tcp", ":9991")
 				must(err)
@@ -453,15 +454,15 @@ func TestReuseInputBuffer(t *testing.T) {
 			}()
 			return
 		}
-		must(internal.Serve(events, "tcp://:9991"))
+		must(evloop.Serve(events, "tcp://:9991"))
 	}
 
 }
 
 func TestReuseport(t *testing.T) {
-	var events internal.Events
-	events.Serving = func(s internal.Server) (action internal.Action) {
-		return internal.Shutdown
+	var events evloop.Events
+	events.Serving = func(s evloop.Server) (action evloop.Action) {
+		return evloop.Shutdown
 	}
 	var wg sync.WaitGroup
 	wg.Add(5)
@@ -472,8 +473,218 @@ func TestReuseport(t *testing.T) {
 		}
 		go func(t string) {
 			defer wg.Done()
-			must(internal.Serve(events, "tcp://:9991?reuseport="+t))
+			must(evloop.Serve(events, "tcp://:9991?reuseport="+t))
 		}(t)
 	}
 	wg.Wait()
 }
+
+func TestAfterFunc(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testAfterFunc("tcp", ":9991", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testAfterFunc("tcp", ":9992", true)
+	})
+}
+
+func testAfterFunc(network, addr string, stdlib bool) {
+	var events evloop.Events
+	var fired int32
+	events.Opened = func(c evloop.Conn) (out []byte, opts evloop.Options, action evloop.Action) {
+		cancelled := c.AfterFunc(time.Millisecond*10, func(c evloop.Conn) (out []byte, action evloop.Action) {
+			panic("stopped timer fired")
+		})
+		if !cancelled.Stop() {
+			panic("expected timer to stop")
+		}
+		// a timer may be stopped outside of the loop
+		remote := c.AfterFunc(time.Millisecond*20, func(c evloop.Conn) (out []byte, action evloop.Action) {
+			panic("timer stopped from another goroutine fired")
+		})
+		stopped := make(chan bool)
+		go func() { stopped <- remote.Stop() }()
+		if !<-stopped || remote.Stop() {
+			panic("expected timer to stop once")
+		}
+		c.AfterFunc(time.Millisecond*50, func(c evloop.Conn) (out []byte, action evloop.Action) {
+			atomic.AddInt32(&fired, 1)
+			c.AfterFunc(time.Millisecond*10, func(c evloop.Conn) (out []byte, action evloop.Action) {
+				return []byte("done\r\n"), evloop.Close
+			})
+			return []byte("tick\r\n"), evloop.None
+		})
+		return
+	}
+	events.Closed = func(c evloop.Conn, err error) (action evloop.Action) {
+		return evloop.Shutdown
+	}
+	events.Serving = func(srv evloop.Server) (action evloop.Action) {
+		go func() {
+			conn, err := net.Dial(network, addr)
+			must(err)
+			defer conn.Close()
+			msg, err := ioutil.ReadAll(conn)
+			must(err)
+			if string(msg) != "tick\r\ndone\r\n" {
+				panic("unexpected timer output: " + string(msg))
+			}
+		}()
+		return
+	}
+	if stdlib {
+		must(evloop.Serve(events, network+"-net://"+addr))
+	} else {
+		must(evloop.Serve(events, network+"://"+addr))
+	}
+	if atomic.LoadInt32(&fired) != 1 {
+		panic("timer did not fire")
+	}
+}
+
+func TestAfterFuncRearm(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testAfterFuncRearm("tcp://127.0.0.1:9991") })
+	t.Run("stdlib", func(t *testing.T) { testAfterFuncRearm("tcp-net://127.0.0.1:9992") })
+}
+
+// testAfterFuncRearm stops and schedules again an idle timeout on every
+// event, the stopped timers don't pile up in the loop heap.
+func testAfterFuncRearm(addr string) {
+	var events evloop.Events
+	var n int
+	events.Data = func(c evloop.Conn, in []byte) (out []byte, action evloop.Action) {
+		if t, ok := c.Context().(evloop.Timer); ok {
+			if n++; n%2 == 0 {
+				// a timer may be stopped outside of the loop
+				stopped := make(chan bool)
+				go func() { stopped <- t.Stop() }()
+				<-stopped
+			} else {
+				t.Stop()
+			}
+		}
+		c.SetContext(c.AfterFunc(time.Hour, func(c evloop.Conn) (out []byte, action evloop.Action) {
+			return nil, evloop.Close
+		}))
+		return in, evloop.None
+	}
+	events.Serving = func(srv evloop.Server) (action evloop.Action) {
+		go func() {
+			defer srv.Shutdown()
+			conn := limitsDial(srv.Addresses[0].String())
+			defer conn.Close()
+			for i := 0; i < 2000; i++ {
+				limitsEcho(conn, "x")
+			}
+			if timers := srv.Stats().Loops[0].Timers; timers > 3 {
+				panic(fmt.Sprintf("%d timers in the heap", timers))
+			}
+		}()
+		return
+	}
+	must(evloop.Serve(events, addr))
+}
+
+func TestDial(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		t.Run("tcp", func(t *testing.T) {
+			testDial("tcp", ":9991", false)
+		})
+		t.Run("unix", func(t *testing.T) {
+			testDial("unix", "socket1", false)
+		})
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		t.Run("tcp", func(t *testing.T) {
+			testDial("tcp", ":9992", true)
+		})
+		t.Run("unix", func(t *testing.T) {
+			testDial("unix", "socket2", true)
+		})
+	})
+}
+
+func testDial(network, addr string, stdlib bool) {
+	var events evloop.Events
+	var replied, failed int32
+	var server evloop.Server
+	events.Serving = func(srv evloop.Server) (action evloop.Action) {
+		server = srv
+		if network == "tcp" {
+			// the host name is resolved off the loop
+			must(srv.Dial(network, "localhost"+addr, "client"))
+		} else {
+			must(srv.Dial(network, addr, "client"))
+		}
+		must(srv.Dial("tcp", "127.0.0.1:1", "refused"))
+		return
+	}
+	events.Opened = func(c evloop.Conn) (out []byte, opts evloop.Options, action evloop.Action) {
+		if c.Outbound() {
+			if c.Context() != "client" || c.AddrIndex() != -1 {
+				panic("invalid outbound conn")
+			}
+			out = []byte("ping")
+		}
+		return
+	}
+	events.Data = func(c evloop.Conn, in []byte) (out []byte, action evloop.Action) {
+		if !c.Outbound() {
+			return in, evloop.None
+		}
+		if string(in) != "ping" {
+			panic("unexpected echo: " + string(in))
+		}
+		atomic.StoreInt32(&replied, 1)
+		return nil, evloop.Close
+	}
+	events.Closed = func(c evloop.Conn, err error) (action evloop.Action) {
+		switch c.Context() {
+		case "refused":
+			if err == nil {
+				panic("expected connect error")
+			}
+			atomic.StoreInt32(&failed, 1)
+		case "client":
+			if atomic.LoadInt32(&replied) != 1 {
+				panic("outbound conn closed before reply")
+			}
+		}
+		if atomic.LoadInt32(&replied) == 1 && atomic.LoadInt32(&failed) == 1 {
+			action = evloop.Shutdown
+		}
+		return
+	}
+	if stdlib {
+		must(evloop.Serve(events, network+"-net://"+addr))
+	} else {
+		must(evloop.Serve(events, network+"://"+addr))
+	}
+	if err := server.Dial(network, addr, "closed"); err != evloop.ErrServerClosed {
+		panic(fmt.Sprintf("expected the server closed error, got %v", err))
+	}
+}
+
+func TestRun(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testRun("tcp://:9991")
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testRun("tcp-net://:9992")
+	})
+}
+
+func testRun(addr string) {
+	var events evloop.Events
+	events.Serving = func(srv evloop.Server) (action evloop.Action) {
+		if srv.NumLoops != 3 {
+			panic("options were not applied")
+		}
+		go func() {
+			time.Sleep(time.Second / 20)
+			srv.Shutdown()
+		}()
+		return
+	}
+	must(evloop.Run(events, []string{addr}, evloop.WithNumLoops(3), evloop.WithLoadBalance(evloop.RoundRobin)))
+}
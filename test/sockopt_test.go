@@ -0,0 +1,93 @@
+// +build linux
+
+package test
+
+import (
+	"github.com/konstantin-kukharev/pureserver/evloop"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSocketOptions(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testSocketOptions("tcp://127.0.0.1:9991") })
+	t.Run("stdlib", func(t *testing.T) { testSocketOptions("tcp-net://127.0.0.1:9992") })
+}
+
+func testSocketOptions(addr string) {
+	var events evloop.Events
+	events.Serving = func(srv evloop.Server) (action evloop.Action) {
+		go func() {
+			defer srv.Shutdown()
+			conn, err := net.Dial("tcp", srv.Addresses[0].String())
+			must(err)
+			defer conn.Close()
+			conn.Write([]byte("close"))
+			// a negative linger resets the connection on close
+			_, err = io.ReadAll(conn)
+			if err == nil || !strings.Contains(err.Error(), "reset") {
+				panic("expected connection reset")
+			}
+		}()
+		return
+	}
+	events.Opened = func(c evloop.Conn) (out []byte, opts evloop.Options, action evloop.Action) {
+		opts.TCPNoDelay = true
+		opts.Linger = -1
+		opts.ReadBuffer = 1 << 16
+		opts.WriteBuffer = 1 << 16
+		opts.TCPUserTimeout = time.Second
+		opts.TCPQuickAck = true
+		opts.TCPNotSentLowat = 1 << 14
+		return
+	}
+	events.Data = func(c evloop.Conn, in []byte) (out []byte, action evloop.Action) {
+		return nil, evloop.Close
+	}
+	must(evloop.Serve(events, addr))
+}
+
+func TestListenerOptions(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testListenerOptions("tcp://127.0.0.1:9991?fastopen=16&defer_accept=5&backlog=64") })
+	t.Run("stdlib", func(t *testing.T) { testListenerOptions("tcp-net://127.0.0.1:9992?fastopen=16&defer_accept=5&backlog=64") })
+	var events evloop.Events
+	for _, addr := range []string{"tcp://:9991?backlog=x", "tcp://:9991?defer_accept=-1"} {
+		if err := evloop.Serve(events, addr); err == nil {
+			t.Fatalf("%s: expected error", addr)
+		}
+	}
+}
+
+func testListenerOptions(addr string) {
+	var opened int32
+	var events evloop.Events
+	events.Serving = func(srv evloop.Server) (action evloop.Action) {
+		go func() {
+			defer srv.Shutdown()
+			conn, err := net.Dial("tcp", srv.Addresses[0].String())
+			must(err)
+			defer conn.Close()
+			// the connection is accepted once the data arrives
+			time.Sleep(time.Millisecond * 200)
+			if atomic.LoadInt32(&opened) != 0 {
+				panic("connection accepted before data")
+			}
+			conn.Write([]byte("ping"))
+			p := make([]byte, 4)
+			_, err = io.ReadFull(conn, p)
+			must(err)
+		}()
+		return
+	}
+	events.Opened = func(c evloop.Conn) (out []byte, opts evloop.Options, action evloop.Action) {
+		atomic.AddInt32(&opened, 1)
+		return
+	}
+	events.Data = func(c evloop.Conn, in []byte) (out []byte, action evloop.Action) {
+		return in, evloop.None
+	}
+	must(evloop.Serve(events, addr))
+}
@@ -0,0 +1,65 @@
+package test
+
+import (
+	"github.com/konstantin-kukharev/pureserver/evloop"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testStats("tcp://127.0.0.1:9991", "udp://127.0.0.1:9993") })
+	t.Run("stdlib", func(t *testing.T) { testStats("tcp-net://127.0.0.1:9992", "udp-net://127.0.0.1:9993") })
+}
+
+func testStats(addr, udpAddr string) {
+	var events evloop.Events
+	events.Serving = func(srv evloop.Server) (action evloop.Action) {
+		go func() {
+			defer srv.Shutdown()
+			lnAddr := srv.Addresses[0].String()
+			a, b := limitsDial(lnAddr), limitsDial(lnAddr)
+			limitsEcho(a, "hello")
+			limitsEcho(b, "hello")
+			p := udpPeer(srv.Addresses[1].String())
+			udpExpect(p, "x")
+			p.Close()
+			st := srv.Stats()
+			if len(st.Loops) != 2 || len(st.Listeners) != 2 {
+				panic("unexpected stats size")
+			}
+			ln := st.Listeners[0]
+			if ln.Addr.String() != lnAddr || ln.Accepted != 2 || ln.Conns != 2 ||
+				ln.BytesIn != 10 || ln.BytesOut != 10 {
+				panic("unexpected listener stats")
+			}
+			if u := st.Listeners[1]; u.BytesIn != 1 || u.BytesOut != 1 || u.Accepted != 0 {
+				panic("unexpected udp listener stats")
+			}
+			var conns int
+			var bytesIn, wakeups uint64
+			for _, l := range st.Loops {
+				conns += l.Conns
+				bytesIn += l.BytesIn
+				wakeups += l.Wakeups
+				if l.Errors != (evloop.ErrorStats{}) {
+					panic("unexpected errors")
+				}
+			}
+			if conns != 2 || bytesIn != 11 || wakeups == 0 {
+				panic("unexpected loop stats")
+			}
+			a.Close()
+			time.Sleep(time.Millisecond * 100)
+			st = srv.Stats()
+			if ln := st.Listeners[0]; ln.Closed != 1 || ln.Conns != 1 {
+				panic("unexpected closed stats")
+			}
+			b.Close()
+		}()
+		return
+	}
+	events.Data = func(c evloop.Conn, in []byte) (out []byte, action evloop.Action) {
+		return in, evloop.None
+	}
+	must(evloop.Run(events, []string{addr, udpAddr}, evloop.WithNumLoops(2)))
+}
@@ -0,0 +1,92 @@
+package test
+
+import (
+	"encoding/hex"
+	"errors"
+	ps "github.com/konstantin-kukharev/pureserver"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type chanExporter chan *ps.SpanData
+
+func (ch chanExporter) ExportSpan(span *ps.SpanData) {
+	ch <- span
+}
+
+func TestHttpServerTracing(t *testing.T) {
+	spans := make(chanExporter, 8)
+	handled := make(chan ps.Span, 8)
+	mux := ps.NewMux()
+	mux.Get("/trace/:id", ps.HandlerFunc(func(w ps.ResponseWriter, r ps.HttpRequestInterface) {
+		span := ps.SpanFromContext(ps.RequestContext(r))
+		id, _ := r.GetParam("id")
+		span.SetAttribute("trace.id", id)
+		if id == "fail" {
+			span.RecordError(errors.New("failed"))
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		w.SetBody([]byte(span.SpanContext().TraceParent()))
+		handled <- span
+	}))
+	server := ps.NewHttp(mux)
+	server.SetPort(8088)
+	server.SetTracing(spans)
+	go server.Serve()
+	waitPort(8088)
+
+	next := func() *ps.SpanData {
+		select {
+		case span := <-spans:
+			return span
+		case <-time.After(time.Second):
+			panic("span not exported")
+		}
+	}
+
+	req, err := http.NewRequest("GET", "http://127.0.0.1:8088/trace/1", nil)
+	must(err)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Header.Set("tracestate", "vendor=value")
+	resp, err := http.DefaultClient.Do(req)
+	must(err)
+	resp.Body.Close()
+	span := next()
+	if hex.EncodeToString(span.Context.TraceID[:]) != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+		hex.EncodeToString(span.Parent.SpanID[:]) != "00f067aa0ba902b7" ||
+		span.Context.SpanID == span.Parent.SpanID || span.Context.TraceState != "vendor=value" {
+		t.Fatalf("unexpected span context %+v", span.Context)
+	}
+	if span.Name != "GET /trace/:id" || span.Attributes["http.status_code"] != 200 ||
+		span.Attributes["trace.id"] != "1" || span.Failed {
+		t.Fatalf("unexpected span %+v", span)
+	}
+	// the changes after the end don't reach the exported span
+	late := <-handled
+	late.SetAttribute("late", true)
+	late.RecordError(errors.New("late"))
+	if _, ok := span.Attributes["late"]; ok || span.Failed {
+		t.Fatalf("unexpected span %+v", span)
+	}
+
+	resp, err = http.Get("http://127.0.0.1:8088/trace/fail")
+	must(err)
+	resp.Body.Close()
+	span = next()
+	if span.Parent.IsValid() || !span.Context.IsValid() || !span.Failed || len(span.Errors) != 1 ||
+		span.Attributes["http.status_code"] != 500 {
+		t.Fatalf("unexpected root span %+v", span)
+	}
+
+	// invalid traceparent headers start a new trace
+	req, err = http.NewRequest("GET", "http://127.0.0.1:8088/missing", nil)
+	must(err)
+	req.Header.Set("traceparent", "00-00000000000000000000000000000000-00f067aa0ba902b7-01")
+	resp, err = http.DefaultClient.Do(req)
+	must(err)
+	resp.Body.Close()
+	if span = next(); span.Parent.IsValid() || span.Name != "GET unmatched" {
+		t.Fatalf("unexpected span %+v", span)
+	}
+}
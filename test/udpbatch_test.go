@@ -0,0 +1,52 @@
+package test
+
+import (
+	"bytes"
+	"github.com/konstantin-kukharev/pureserver/evloop"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPBatch(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testUDPBatch("udp://127.0.0.1:9991") })
+	t.Run("poll-offload", func(t *testing.T) { testUDPBatch("udp://127.0.0.1:9991?gso=1&gro=1") })
+	t.Run("stdlib", func(t *testing.T) { testUDPBatch("udp-net://127.0.0.1:9992") })
+}
+
+func testUDPBatch(addr string) {
+	const count = 64
+	var events evloop.Events
+	events.Serving = func(srv evloop.Server) (action evloop.Action) {
+		go func() {
+			defer srv.Shutdown()
+			conn, err := net.Dial("udp", srv.Addresses[0].String())
+			must(err)
+			defer conn.Close()
+			for i := 0; i < count; i++ {
+				conn.Write(bytes.Repeat([]byte{byte(i)}, 1200))
+			}
+			conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+			seen := make(map[byte]bool)
+			p := make([]byte, 0xFFFF)
+			for len(seen) < count {
+				n, err := conn.Read(p)
+				must(err)
+				// every reply is a single datagram, even when sent with GSO
+				if n != 1200 || !bytes.Equal(p[:n], bytes.Repeat(p[:1], 1200)) {
+					panic("unexpected datagram")
+				}
+				seen[p[0]] = true
+			}
+		}()
+		return
+	}
+	events.Data = func(c evloop.Conn, in []byte) (out []byte, action evloop.Action) {
+		raddr, ok := c.RemoteAddr().(*net.UDPAddr)
+		if !ok || len(raddr.IP) != net.IPv4len {
+			panic("unexpected remote address " + c.RemoteAddr().String())
+		}
+		return in, evloop.None
+	}
+	must(evloop.Run(events, []string{addr}, evloop.WithUDPBatchSize(8)))
+}
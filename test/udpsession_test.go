@@ -0,0 +1,91 @@
+package test
+
+import (
+	"github.com/konstantin-kukharev/pureserver/evloop"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUDPSessions(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testUDPSessions("udp://127.0.0.1:9991") })
+	t.Run("stdlib", func(t *testing.T) { testUDPSessions("udp-net://127.0.0.1:9992") })
+}
+
+func testUDPSessions(addr string) {
+	var opened, expired, closed int32
+	var events evloop.Events
+	events.Serving = func(srv evloop.Server) (action evloop.Action) {
+		go func() {
+			defer srv.Shutdown()
+			lnAddr := srv.Addresses[0].String()
+			a, b, c := udpPeer(lnAddr), udpPeer(lnAddr), udpPeer(lnAddr)
+			defer a.Close()
+			defer b.Close()
+			defer c.Close()
+			udpExpect(a, "1")
+			udpExpect(a, "2")
+			udpExpect(b, "1")
+			// the session limit is reached
+			udpExpect(c, "")
+			time.Sleep(time.Millisecond * 500)
+			if atomic.LoadInt32(&expired) != 2 {
+				panic("sessions not expired")
+			}
+			udpExpect(c, "1")
+			udpExpect(a, "1")
+		}()
+		return
+	}
+	events.Opened = func(c evloop.Conn) (out []byte, opts evloop.Options, action evloop.Action) {
+		atomic.AddInt32(&opened, 1)
+		c.SetContext(0)
+		return
+	}
+	events.Data = func(c evloop.Conn, in []byte) (out []byte, action evloop.Action) {
+		n := c.Context().(int) + 1
+		c.SetContext(n)
+		return []byte(strconv.Itoa(n)), evloop.None
+	}
+	events.Closed = func(c evloop.Conn, err error) (action evloop.Action) {
+		if err == evloop.ErrIdleTimeout {
+			atomic.AddInt32(&expired, 1)
+		}
+		atomic.AddInt32(&closed, 1)
+		return
+	}
+	must(evloop.Run(events, []string{addr},
+		evloop.WithNumLoops(2),
+		evloop.WithUDPSessions(time.Millisecond*200, 2),
+	))
+	if atomic.LoadInt32(&opened) != 4 || atomic.LoadInt32(&closed) != 4 {
+		panic("unexpected session events")
+	}
+}
+
+func udpPeer(addr string) net.Conn {
+	conn, err := net.Dial("udp", addr)
+	must(err)
+	return conn
+}
+
+// udpExpect sends a datagram and checks the reply, an empty reply expects
+// the datagram to be dropped.
+func udpExpect(conn net.Conn, reply string) {
+	conn.Write([]byte("x"))
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+	p := make([]byte, 16)
+	n, err := conn.Read(p)
+	if reply == "" {
+		if err == nil {
+			panic("expected dropped datagram")
+		}
+		return
+	}
+	must(err)
+	if string(p[:n]) != reply {
+		panic("unexpected reply " + string(p[:n]))
+	}
+}
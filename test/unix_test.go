@@ -0,0 +1,77 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package test
+
+import (
+	"github.com/konstantin-kukharev/pureserver/evloop"
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+func TestUnixSocketOptions(t *testing.T) {
+	for _, network := range []string{"unix", "unix-net"} {
+		socket := "socket-mode"
+		os.RemoveAll(socket)
+		var events evloop.Events
+		events.Serving = func(srv evloop.Server) (action evloop.Action) {
+			fi, err := os.Stat(socket)
+			must(err)
+			if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0600 {
+				t.Errorf("%s: unexpected socket mode %v", network, fi.Mode())
+			}
+			return evloop.Shutdown
+		}
+		owner := strconv.Itoa(os.Getuid())
+		must(evloop.Serve(events, network+"://"+socket+"?mode=0600&owner="+owner+"&group="+strconv.Itoa(os.Getgid())))
+		if _, err := os.Stat(socket); !os.IsNotExist(err) {
+			t.Fatalf("%s: socket was not removed", network)
+		}
+	}
+	var events evloop.Events
+	if err := evloop.Serve(events, "unix://socket-mode?mode=abc"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestUnixSocketNotSocket(t *testing.T) {
+	path := "socket-file"
+	must(ioutil.WriteFile(path, []byte("data"), 0644))
+	defer os.Remove(path)
+	var events evloop.Events
+	events.Serving = func(srv evloop.Server) (action evloop.Action) {
+		return evloop.Shutdown
+	}
+	if err := evloop.Serve(events, "unix://"+path); err == nil {
+		t.Fatal("expected error")
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || string(data) != "data" {
+		t.Fatal("regular file was removed")
+	}
+}
+
+func TestUnixSocketAbstract(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract sockets are only available on linux")
+	}
+	var events evloop.Events
+	events.Serving = func(srv evloop.Server) (action evloop.Action) {
+		go func() {
+			conn, err := net.Dial("unix", "@pureserver-test")
+			must(err)
+			defer conn.Close()
+			conn.Write([]byte("ping"))
+			p := make([]byte, 4)
+			_, err = conn.Read(p)
+			must(err)
+		}()
+		return
+	}
+	events.Data = func(c evloop.Conn, in []byte) (out []byte, action evloop.Action) {
+		return in, evloop.Shutdown
+	}
+	must(evloop.Serve(events, "unix://@pureserver-test"))
+}
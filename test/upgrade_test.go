@@ -0,0 +1,162 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package test
+
+import (
+	"github.com/konstantin-kukharev/pureserver/evloop"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const (
+	upgradeAddr       = "tcp://127.0.0.1:9993"
+	upgradeSignalAddr = "tcp://127.0.0.1:9994"
+)
+
+func init() {
+	// the upgraded test binary serves one connection and exits
+	addr, err := url.QueryUnescape(os.Getenv("PURESERVER_UPGRADE_FDS"))
+	if err != nil || addr == "" {
+		return
+	}
+	var events evloop.Events
+	events.Data = func(c evloop.Conn, in []byte) (out []byte, action evloop.Action) {
+		return []byte("child"), evloop.None
+	}
+	events.Closed = func(c evloop.Conn, err error) (action evloop.Action) {
+		return evloop.Shutdown
+	}
+	must(evloop.Serve(events, addr))
+	os.Exit(0)
+}
+
+func TestDrain(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testDrain("tcp://127.0.0.1:9991") })
+	t.Run("stdlib", func(t *testing.T) { testDrain("tcp-net://127.0.0.1:9992") })
+}
+
+func testDrain(addr string) {
+	var events evloop.Events
+	events.Serving = func(srv evloop.Server) (action evloop.Action) {
+		go func() {
+			conn, err := net.Dial("tcp", srv.Addresses[0].String())
+			must(err)
+			defer conn.Close()
+			expectReply(conn, "ping", "ping")
+			if srv.Draining() {
+				panic("unexpected draining")
+			}
+			srv.Drain()
+			if !srv.Draining() {
+				panic("expected draining")
+			}
+			time.Sleep(time.Millisecond * 100)
+			// open connections are still served, new ones are refused
+			expectReply(conn, "pong", "pong")
+			if c, err := net.Dial("tcp", srv.Addresses[0].String()); err == nil {
+				c.Close()
+				panic("expected refused connection")
+			}
+		}()
+		return
+	}
+	events.Data = func(c evloop.Conn, in []byte) (out []byte, action evloop.Action) {
+		return in, evloop.None
+	}
+	must(evloop.Run(events, []string{addr}, evloop.WithNumLoops(2)))
+}
+
+func TestDrainTimeout(t *testing.T) {
+	var events evloop.Events
+	events.Serving = func(srv evloop.Server) (action evloop.Action) {
+		go func() {
+			conn, err := net.Dial("tcp", srv.Addresses[0].String())
+			must(err)
+			defer conn.Close()
+			expectReply(conn, "ping", "ping")
+			srv.Drain()
+			// the server closes the connection on timeout
+			if _, err := conn.Read(make([]byte, 1)); err == nil {
+				panic("expected closed connection")
+			}
+		}()
+		return
+	}
+	events.Data = func(c evloop.Conn, in []byte) (out []byte, action evloop.Action) {
+		return in, evloop.None
+	}
+	start := time.Now()
+	must(evloop.Run(events, []string{"tcp://127.0.0.1:9991"}, evloop.WithDrainTimeout(time.Millisecond*200)))
+	if d := time.Since(start); d < time.Millisecond*200 || d > time.Second*5 {
+		panic("drain timeout exceeded")
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	var events evloop.Events
+	events.Serving = func(srv evloop.Server) (action evloop.Action) {
+		go func() {
+			conn, err := net.Dial("tcp", srv.Addresses[0].String())
+			must(err)
+			defer conn.Close()
+			expectReply(conn, "ping", "parent")
+			must(srv.Upgrade())
+			// new connections go to the upgraded process
+			c, err := net.Dial("tcp", srv.Addresses[0].String())
+			must(err)
+			expectReply(c, "ping", "child")
+			c.Close()
+			expectReply(conn, "ping", "parent")
+		}()
+		return
+	}
+	events.Data = func(c evloop.Conn, in []byte) (out []byte, action evloop.Action) {
+		return []byte("parent"), evloop.None
+	}
+	must(evloop.Serve(events, upgradeAddr))
+}
+
+func TestUpgradeSignal(t *testing.T) {
+	var events evloop.Events
+	events.Serving = func(srv evloop.Server) (action evloop.Action) {
+		go func() {
+			conn, err := net.Dial("tcp", srv.Addresses[0].String())
+			must(err)
+			defer conn.Close()
+			expectReply(conn, "ping", "parent")
+			must(syscall.Kill(os.Getpid(), syscall.SIGUSR2))
+			for start := time.Now(); !srv.Draining(); time.Sleep(time.Millisecond * 10) {
+				if time.Since(start) > time.Second*5 {
+					panic("the signal didn't upgrade the server")
+				}
+			}
+			c, err := net.Dial("tcp", srv.Addresses[0].String())
+			must(err)
+			expectReply(c, "ping", "child")
+			c.Close()
+			expectReply(conn, "ping", "parent")
+		}()
+		return
+	}
+	events.Data = func(c evloop.Conn, in []byte) (out []byte, action evloop.Action) {
+		return []byte("parent"), evloop.None
+	}
+	must(evloop.Run(events, []string{upgradeSignalAddr}, evloop.WithUpgradeSignal(syscall.SIGUSR2)))
+}
+
+// expectReply writes the message and reads the expected reply.
+func expectReply(conn net.Conn, msg, reply string) {
+	conn.Write([]byte(msg))
+	p := make([]byte, len(reply))
+	_, err := io.ReadFull(conn, p)
+	must(err)
+	if !strings.EqualFold(string(p), reply) {
+		panic("unexpected reply " + string(p))
+	}
+}
@@ -0,0 +1,402 @@
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	ps "github.com/konstantin-kukharev/pureserver"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type wsClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+	head string
+}
+
+type wsFrame struct {
+	fin, rsv1 bool
+	op        byte
+	payload   []byte
+}
+
+// wsDial sends the opening handshake and reads the response head.
+func wsDial(port int, path, head string) *wsClient {
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	must(err)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: localhost\r\n%s\r\n", path, head)
+	must(err)
+	c := &wsClient{conn: conn, r: bufio.NewReader(conn)}
+	for {
+		line, err := c.r.ReadString('\n')
+		must(err)
+		if line == "\r\n" {
+			return c
+		}
+		c.head += line
+	}
+}
+
+func wsUpgrade(port int, path, extra string) *wsClient {
+	c := wsDial(port, path, "Upgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n"+extra)
+	if !strings.HasPrefix(c.head, "HTTP/1.1 101 ") {
+		panic("unexpected handshake response: " + c.head)
+	}
+	return c
+}
+
+func (c *wsClient) write(fin, rsv1 bool, op byte, payload []byte, masked bool) {
+	b0, b1 := op, byte(0)
+	if fin {
+		b0 |= 0x80
+	}
+	if rsv1 {
+		b0 |= 0x40
+	}
+	if masked {
+		b1 = 0x80
+	}
+	b := []byte{b0}
+	switch n := len(payload); {
+	case n <= 125:
+		b = append(b, b1|byte(n))
+	case n <= 0xffff:
+		b = append(b, b1|126, byte(n>>8), byte(n))
+	default:
+		b = append(b, b1|127, 0, 0, 0, 0, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	data := append([]byte{}, payload...)
+	if masked {
+		mask := []byte{1, 2, 3, 4}
+		b = append(b, mask...)
+		for i := range data {
+			data[i] ^= mask[i&3]
+		}
+	}
+	_, err := c.conn.Write(append(b, data...))
+	must(err)
+}
+
+func (c *wsClient) read() wsFrame {
+	var h [2]byte
+	_, err := io.ReadFull(c.r, h[:])
+	must(err)
+	f := wsFrame{fin: h[0]&0x80 != 0, rsv1: h[0]&0x40 != 0, op: h[0] & 0x0f}
+	if h[1]&0x80 != 0 {
+		panic("masked server frame")
+	}
+	n := uint64(h[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		_, err = io.ReadFull(c.r, ext[:])
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		_, err = io.ReadFull(c.r, ext[:])
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	must(err)
+	f.payload = make([]byte, n)
+	_, err = io.ReadFull(c.r, f.payload)
+	must(err)
+	return f
+}
+
+// expectClose reads the close frame of the server and the end of the
+// connection.
+func (c *wsClient) expectClose(t *testing.T, code int) {
+	f := c.read()
+	if f.op != 0x8 || len(f.payload) < 2 || int(binary.BigEndian.Uint16(f.payload)) != code {
+		t.Fatalf("expected close %d, got %d %q", code, f.op, f.payload)
+	}
+	if _, err := c.r.ReadByte(); err != io.EOF {
+		t.Fatalf("expected the connection to close, got %v", err)
+	}
+	c.conn.Close()
+}
+
+func wsDeflate(data []byte) []byte {
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	fw.Write(data)
+	fw.Flush()
+	b := buf.Bytes()
+	return b[:len(b)-4]
+}
+
+func wsInflate(data []byte) []byte {
+	tail := []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+	b, err := ioutil.ReadAll(flate.NewReader(io.MultiReader(bytes.NewReader(data), bytes.NewReader(tail))))
+	must(err)
+	return b
+}
+
+func TestWebSocketEcho(t *testing.T) {
+	closed := make(chan string, 1)
+	mux := ps.NewMux()
+	mux.Get("/echo", &ps.WebSocket{
+		Message: func(c *ps.WebSocketConn, mt ps.MessageType, data []byte) {
+			if string(data) == "ping" {
+				must(c.Ping([]byte("x")))
+				return
+			}
+			must(c.WriteMessage(mt, data))
+		},
+		Pong: func(c *ps.WebSocketConn, data []byte) {
+			must(c.WriteMessage(ps.TextMessage, append([]byte("pong "), data...)))
+		},
+		Close: func(c *ps.WebSocketConn, code int, reason string) {
+			closed <- fmt.Sprintf("%d %s", code, reason)
+		},
+	})
+	server := ps.NewHttp(mux)
+	server.SetPort(8094)
+	go server.Serve()
+	waitPort(8094)
+
+	c := wsUpgrade(8094, "/echo", "")
+	if !strings.Contains(c.head, "Sec-Websocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n") {
+		t.Fatalf("unexpected handshake response %q", c.head)
+	}
+	c.write(true, false, 0x1, []byte("hello"), true)
+	if f := c.read(); !f.fin || f.op != 0x1 || string(f.payload) != "hello" {
+		t.Fatalf("unexpected echo %+v", f)
+	}
+
+	// a fragmented message with a ping between the fragments
+	c.write(false, false, 0x2, []byte("ab"), true)
+	c.write(true, false, 0x9, []byte("p"), true)
+	c.write(false, false, 0x0, []byte("cd"), true)
+	c.write(true, false, 0x0, []byte("ef"), true)
+	if f := c.read(); f.op != 0xa || string(f.payload) != "p" {
+		t.Fatalf("expected pong, got %+v", f)
+	}
+	if f := c.read(); f.op != 0x2 || string(f.payload) != "abcdef" {
+		t.Fatalf("unexpected echo %+v", f)
+	}
+
+	// a ping of the server
+	c.write(true, false, 0x1, []byte("ping"), true)
+	if f := c.read(); f.op != 0x9 || string(f.payload) != "x" {
+		t.Fatalf("expected ping, got %+v", f)
+	}
+	c.write(true, false, 0xa, []byte("x"), true)
+	if f := c.read(); string(f.payload) != "pong x" {
+		t.Fatalf("unexpected pong reply %+v", f)
+	}
+
+	c.write(true, false, 0x8, append([]byte{0x03, 0xe8}, "bye"...), true)
+	c.expectClose(t, ps.CloseNormalClosure)
+	if s := <-closed; s != "1000 bye" {
+		t.Fatalf("unexpected close %q", s)
+	}
+
+	// the connection closed without the close handshake
+	c = wsUpgrade(8094, "/echo", "")
+	c.conn.Close()
+	if s := <-closed; s != "1006 " {
+		t.Fatalf("unexpected close %q", s)
+	}
+}
+
+func TestWebSocketProtocolErrors(t *testing.T) {
+	mux := ps.NewMux()
+	mux.Get("/ws", &ps.WebSocket{
+		MaxMessageSize: 16,
+		CheckOrigin: func(origin string) bool {
+			return origin != "http://evil.example"
+		},
+	})
+	server := ps.NewHttp(mux)
+	server.SetPort(8095)
+	go server.Serve()
+	waitPort(8095)
+
+	c := wsUpgrade(8095, "/ws", "")
+	c.write(true, false, 0x1, []byte("unmasked"), false)
+	c.expectClose(t, ps.CloseProtocolError)
+
+	c = wsUpgrade(8095, "/ws", "")
+	c.write(true, false, 0x1, []byte{0xff, 0xfe}, true)
+	c.expectClose(t, ps.CloseInvalidPayload)
+
+	c = wsUpgrade(8095, "/ws", "")
+	c.write(false, false, 0x1, []byte("0123456789"), true)
+	c.write(true, false, 0x0, []byte("0123456789"), true)
+	c.expectClose(t, ps.CloseMessageTooBig)
+
+	// the 64-bit length of a continuation doesn't wrap the message size
+	for _, tc := range []struct {
+		length uint64
+		code   int
+	}{{1<<64 - 1, ps.CloseProtocolError}, {1<<63 - 1, ps.CloseMessageTooBig}} {
+		c = wsUpgrade(8095, "/ws", "")
+		c.write(false, false, 0x1, []byte("0"), true)
+		head := []byte{0x80, 0x80 | 127, 0, 0, 0, 0, 0, 0, 0, 0, 1, 2, 3, 4}
+		binary.BigEndian.PutUint64(head[2:], tc.length)
+		_, err := c.conn.Write(head)
+		must(err)
+		c.expectClose(t, tc.code)
+	}
+
+	c = wsUpgrade(8095, "/ws", "")
+	c.write(true, false, 0x0, []byte("orphan"), true)
+	c.expectClose(t, ps.CloseProtocolError)
+
+	c = wsUpgrade(8095, "/ws", "")
+	c.write(true, true, 0x1, []byte("not negotiated"), true)
+	c.expectClose(t, ps.CloseProtocolError)
+
+	c = wsUpgrade(8095, "/ws", "")
+	c.write(false, false, 0x9, []byte("fragmented ping"), true)
+	c.expectClose(t, ps.CloseProtocolError)
+
+	for _, tc := range []struct{ head, status string }{
+		{"Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 8\r\n", "426"},
+		{"Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\n", "400"},
+		{"Connection: keep-alive\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n", "400"},
+		{"Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\nOrigin: http://evil.example\r\n", "403"},
+	} {
+		c := wsDial(8095, "/ws", tc.head)
+		if !strings.HasPrefix(c.head, "HTTP/1.1 "+tc.status+" ") {
+			t.Fatalf("expected %s, got %q", tc.status, c.head)
+		}
+		if tc.status == "426" && !strings.Contains(c.head, "Sec-Websocket-Version: 13\r\n") {
+			t.Fatalf("expected the supported version, got %q", c.head)
+		}
+		c.conn.Close()
+	}
+}
+
+func TestWebSocketBroadcast(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testWebSocketBroadcast(t, 8096, "") })
+	t.Run("stdlib", func(t *testing.T) { testWebSocketBroadcast(t, 8107, "tcp-net://127.0.0.1:8107") })
+}
+
+// testWebSocketBroadcast serves the WebSocket at the port, or at the
+// listener address when it is set.
+func testWebSocketBroadcast(t *testing.T, port int, listener string) {
+	ws := &ps.WebSocket{
+		Subprotocols: []string{"chat.v2", "chat"},
+		Compression:  true,
+		FragmentSize: 10,
+		Open: func(c *ps.WebSocketConn) {
+			room, _ := c.Request().GetParam("room")
+			must(c.WriteMessage(ps.TextMessage, []byte("welcome to "+room)))
+		},
+		Message: func(c *ps.WebSocketConn, mt ps.MessageType, data []byte) {
+			if string(data) == "quit" {
+				must(c.Close(ps.CloseGoingAway, "bye"))
+				return
+			}
+			must(c.WriteMessage(mt, data))
+		},
+	}
+	mux := ps.NewMux()
+	mux.Get("/chat/:room", ws)
+	server := ps.NewHttp(mux)
+	if listener != "" {
+		server.SetListeners(listener)
+	} else {
+		server.SetPort(port)
+	}
+	go server.Serve()
+	waitPort(port)
+
+	plain := wsUpgrade(port, "/chat/lobby", "Sec-WebSocket-Protocol: chat, chat.v2\r\n")
+	if !strings.Contains(plain.head, "Sec-Websocket-Protocol: chat.v2\r\n") || strings.Contains(plain.head, "Extensions") {
+		t.Fatalf("unexpected handshake response %q", plain.head)
+	}
+	compressed := wsUpgrade(port, "/chat/lobby", "Sec-WebSocket-Extensions: permessage-deflate; server_max_window_bits=10, permessage-deflate; client_max_window_bits\r\n")
+	if !strings.Contains(compressed.head, "Sec-Websocket-Extensions: permessage-deflate; server_no_context_takeover; client_no_context_takeover\r\n") {
+		t.Fatalf("unexpected handshake response %q", compressed.head)
+	}
+
+	// readMessage joins the fragments of a message
+	readMessage := func(c *wsClient) (frames int, data []byte, deflated bool) {
+		for {
+			f := c.read()
+			if frames == 0 {
+				deflated = f.rsv1
+			}
+			frames++
+			data = append(data, f.payload...)
+			if f.fin {
+				if deflated {
+					data = wsInflate(data)
+				}
+				return
+			}
+		}
+	}
+	if n, data, _ := readMessage(plain); n != 2 || string(data) != "welcome to lobby" {
+		t.Fatalf("unexpected welcome %d %q", n, data)
+	}
+	if _, data, deflated := readMessage(compressed); !deflated || string(data) != "welcome to lobby" {
+		t.Fatalf("unexpected welcome %q", data)
+	}
+
+	for ws.Conns() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	msg := strings.Repeat("broadcast ", 3)
+	go ws.Broadcast(ps.TextMessage, []byte(msg))
+	if n, data, _ := readMessage(plain); n != 3 || string(data) != msg {
+		t.Fatalf("unexpected broadcast %d %q", n, data)
+	}
+	if _, data, deflated := readMessage(compressed); !deflated || string(data) != msg {
+		t.Fatalf("unexpected broadcast %q", data)
+	}
+
+	compressed.write(true, true, 0x2, wsDeflate([]byte("compressed")), true)
+	if _, data, deflated := readMessage(compressed); !deflated || string(data) != "compressed" {
+		t.Fatalf("unexpected echo %q", data)
+	}
+
+	// the close handshake started by the server
+	plain.write(true, false, 0x1, []byte("quit"), true)
+	if f := plain.read(); f.op != 0x8 || string(f.payload[2:]) != "bye" {
+		t.Fatalf("expected close, got %+v", f)
+	}
+	plain.write(true, false, 0x8, []byte{0x03, 0xe9}, true)
+	if _, err := plain.r.ReadByte(); err != io.EOF {
+		t.Fatalf("expected the connection to close, got %v", err)
+	}
+	// the broadcasts don't hold up the connections closing meanwhile
+	compressed.conn.Close()
+	stop := make(chan struct{})
+	broadcasting := make(chan struct{})
+	go func() {
+		defer close(broadcasting)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				ws.Broadcast(ps.TextMessage, []byte("tick"))
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		wsUpgrade(port, "/chat/lobby", "").conn.Close()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for ws.Conns() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections left open", ws.Conns())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	<-broadcasting
+}